@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== ACCESS LOG ====================
+// AccessLogConfig writes one line per request in an nginx-style Format to
+// every output. Variables are written $name or ${name}:
+//
+//	$remote_addr $remote_user $time_local $time_iso8601 $msec
+//	$request $request_method $request_uri $uri $args $server_protocol
+//	$status $body_bytes_sent $request_time $host $scheme $request_id
+//	$route $upstream_addr $http_<header> (e.g. $http_user_agent)
+//
+// Routes can turn logging off with "access_log": false. Under load, only a
+// fraction of successful requests can be logged while keeping every error.
+type AccessLogConfig struct {
+	Format  string            `json:"format,omitempty"` // default: combined plus request id and time
+	Outputs []AccessLogOutput `json:"outputs"`
+
+	SampleRate      *float64 `json:"sample_rate,omitempty"`       // share of responses below 400 logged, default 1
+	ErrorSampleRate *float64 `json:"error_sample_rate,omitempty"` // share of 4xx/5xx responses logged, default 1
+}
+
+// AccessLogOutput is stdout, stderr, a file or syslog. Files rotate when
+// they reach MaxSizeMB or every RotateEvery, keeping MaxBackups old files
+// (0 keeps all) named <path>.<timestamp>.
+type AccessLogOutput struct {
+	Type string `json:"type"` // stdout, stderr, file or syslog
+
+	Path        string   `json:"path,omitempty"`
+	MaxSizeMB   int      `json:"max_size_mb,omitempty"`
+	RotateEvery Duration `json:"rotate_every,omitempty"`
+	MaxBackups  int      `json:"max_backups,omitempty"`
+
+	// Syslog: empty Network and Address use the local syslog daemon.
+	Network string `json:"network,omitempty"` // udp, tcp or unix
+	Address string `json:"address,omitempty"`
+	Tag     string `json:"tag,omitempty"` // default "reverse-proxy"
+}
+
+const defaultAccessLogFormat = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" $request_id $request_time`
+
+// accessEntry is what a finished request looks like to the formatter.
+type accessEntry struct {
+	r        *http.Request
+	start    time.Time
+	duration time.Duration
+	status   int
+	bytes    int64
+	client   string
+	route    string
+	backend  string
+}
+
+type accessField func(b *strings.Builder, e *accessEntry)
+
+var accessVariables = map[string]accessField{
+	"remote_addr": func(b *strings.Builder, e *accessEntry) { b.WriteString(e.client) },
+	"remote_user": func(b *strings.Builder, e *accessEntry) { logValue(b, e.r.Header.Get(authUserHeader)) },
+	"time_local": func(b *strings.Builder, e *accessEntry) {
+		b.WriteString(e.start.Format("02/Jan/2006:15:04:05 -0700"))
+	},
+	"time_iso8601": func(b *strings.Builder, e *accessEntry) { b.WriteString(e.start.Format(time.RFC3339)) },
+	"msec": func(b *strings.Builder, e *accessEntry) {
+		b.WriteString(strconv.FormatFloat(float64(e.start.UnixMilli())/1000, 'f', 3, 64))
+	},
+	"request": func(b *strings.Builder, e *accessEntry) {
+		logValue(b, e.r.Method+" "+e.r.RequestURI+" "+e.r.Proto)
+	},
+	"request_method":  func(b *strings.Builder, e *accessEntry) { logValue(b, e.r.Method) },
+	"request_uri":     func(b *strings.Builder, e *accessEntry) { logValue(b, e.r.RequestURI) },
+	"uri":             func(b *strings.Builder, e *accessEntry) { logValue(b, e.r.URL.Path) },
+	"args":            func(b *strings.Builder, e *accessEntry) { logValue(b, e.r.URL.RawQuery) },
+	"server_protocol": func(b *strings.Builder, e *accessEntry) { b.WriteString(e.r.Proto) },
+	"status":          func(b *strings.Builder, e *accessEntry) { b.WriteString(strconv.Itoa(e.status)) },
+	"body_bytes_sent": func(b *strings.Builder, e *accessEntry) { b.WriteString(strconv.FormatInt(e.bytes, 10)) },
+	"request_time": func(b *strings.Builder, e *accessEntry) {
+		b.WriteString(strconv.FormatFloat(e.duration.Seconds(), 'f', 3, 64))
+	},
+	"host":          func(b *strings.Builder, e *accessEntry) { logValue(b, e.r.Host) },
+	"scheme":        func(b *strings.Builder, e *accessEntry) { b.WriteString(requestScheme(e.r)) },
+	"request_id":    func(b *strings.Builder, e *accessEntry) { logValue(b, requestID(e.r)) },
+	"route":         func(b *strings.Builder, e *accessEntry) { logValue(b, e.route) },
+	"upstream_addr": func(b *strings.Builder, e *accessEntry) { logValue(b, e.backend) },
+}
+
+// logValue writes s like nginx does: "-" when empty, and quotes, backslashes
+// and control characters as \xHH so a client can't forge log lines.
+func logValue(b *strings.Builder, s string) {
+	if s == "" {
+		b.WriteByte('-')
+		return
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c == 0x7f || c == '"' || c == '\\' {
+			fmt.Fprintf(b, `\x%02X`, c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+}
+
+// compileAccessFormat splits format into literal text and variables.
+func compileAccessFormat(format string) ([]accessField, error) {
+	var fields []accessField
+	literal := func(s string) {
+		if s != "" {
+			fields = append(fields, func(b *strings.Builder, _ *accessEntry) { b.WriteString(s) })
+		}
+	}
+	for {
+		i := strings.IndexByte(format, '$')
+		if i < 0 {
+			literal(format)
+			return fields, nil
+		}
+		literal(format[:i])
+		format = format[i+1:]
+
+		var name string
+		if strings.HasPrefix(format, "{") {
+			end := strings.IndexByte(format, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("access_log: unclosed ${ in format")
+			}
+			name, format = format[1:end], format[end+1:]
+		} else {
+			end := strings.IndexFunc(format, func(r rune) bool {
+				return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+			})
+			if end < 0 {
+				end = len(format)
+			}
+			name, format = format[:end], format[end:]
+		}
+
+		field, err := accessVariable(name)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+}
+
+func accessVariable(name string) (accessField, error) {
+	if header, ok := strings.CutPrefix(name, "http_"); ok && header != "" {
+		header = http.CanonicalHeaderKey(strings.ReplaceAll(header, "_", "-"))
+		return func(b *strings.Builder, e *accessEntry) { logValue(b, e.r.Header.Get(header)) }, nil
+	}
+	if field, ok := accessVariables[name]; ok {
+		return field, nil
+	}
+	known := make([]string, 0, len(accessVariables))
+	for k := range accessVariables {
+		known = append(known, k)
+	}
+	sort.Strings(known)
+	return nil, fmt.Errorf("access_log: unknown variable $%s (known: %s, http_<header>)", name, strings.Join(known, ", "))
+}
+
+// AccessLogger formats and writes access log lines. A nil *AccessLogger
+// logs nothing.
+type AccessLogger struct {
+	fields    []accessField
+	outputs   []io.Writer
+	sample    float64
+	errSample float64
+	logs      *LogSettings
+}
+
+func NewAccessLogger(cfg *AccessLogConfig, logs *LogSettings) (*AccessLogger, error) {
+	if cfg == nil || len(cfg.Outputs) == 0 {
+		return nil, nil
+	}
+	format := cfg.Format
+	if format == "" {
+		format = defaultAccessLogFormat
+	}
+	fields, err := compileAccessFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &AccessLogger{fields: fields, logs: logs}
+	if l.sample, err = sampleRate("sample_rate", cfg.SampleRate); err != nil {
+		return nil, err
+	}
+	if l.errSample, err = sampleRate("error_sample_rate", cfg.ErrorSampleRate); err != nil {
+		return nil, err
+	}
+
+	for _, out := range cfg.Outputs {
+		w, err := openAccessOutput(out)
+		if err != nil {
+			return nil, err
+		}
+		l.outputs = append(l.outputs, w)
+	}
+	return l, nil
+}
+
+// sampleRate validates an optional rate, which defaults to 1.
+func sampleRate(name string, v *float64) (float64, error) {
+	if v == nil {
+		return 1, nil
+	}
+	if *v < 0 || *v > 1 {
+		return 0, fmt.Errorf("access_log: %s %v must be between 0 and 1", name, *v)
+	}
+	return *v, nil
+}
+
+func openAccessOutput(out AccessLogOutput) (io.Writer, error) {
+	switch out.Type {
+	case "stdout":
+		return &lockedWriter{w: os.Stdout}, nil
+	case "stderr":
+		return &lockedWriter{w: os.Stderr}, nil
+	case "file":
+		if out.Path == "" {
+			return nil, fmt.Errorf("access_log: file output needs a path")
+		}
+		return newRotatingFile(out.Path, int64(out.MaxSizeMB)<<20, out.RotateEvery.Std(), out.MaxBackups)
+	case "syslog":
+		tag := out.Tag
+		if tag == "" {
+			tag = "reverse-proxy"
+		}
+		return openSyslog(out.Network, out.Address, tag)
+	default:
+		return nil, fmt.Errorf("access_log: unknown output type %q", out.Type)
+	}
+}
+
+func (l *AccessLogger) Log(e *accessEntry) {
+	if l == nil {
+		return
+	}
+	sample := l.sample
+	if e.status >= 400 {
+		sample = l.errSample
+	}
+	if sample < 1 && rand.Float64() >= sample {
+		return
+	}
+	var b strings.Builder
+	for _, f := range l.fields {
+		f(&b, e)
+	}
+	b.WriteByte('\n')
+	line := []byte(b.String())
+	for _, w := range l.outputs {
+		if _, err := w.Write(line); err != nil {
+			l.logs.Errorf("Access log write failed: %v", err)
+		}
+	}
+}
+
+// lockedWriter keeps concurrent lines from interleaving.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+// rotatingFile is an append-only log file that moves itself aside to
+// <path>.<timestamp> when it grows past maxSize or gets older than every.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64         // 0: no size limit
+	every      time.Duration // 0: no time-based rotation
+	maxBackups int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, every time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, every: every, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, fmt.Errorf("access_log: %w", err)
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.every > 0 && time.Since(f.opened) >= f.every)) {
+		if err := f.rotate(); err != nil {
+			log.Printf("Access log rotation failed: %v", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	backup := f.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(f.path, backup); err != nil {
+		if reopenErr := f.open(); reopenErr != nil {
+			return reopenErr
+		}
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// prune removes the oldest backups beyond maxBackups.
+func (f *rotatingFile) prune() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil || len(backups) <= f.maxBackups {
+		return
+	}
+	sort.Strings(backups) // timestamps sort chronologically
+	for _, old := range backups[:len(backups)-f.maxBackups] {
+		if err := os.Remove(old); err != nil {
+			log.Printf("Access log cleanup failed: %v", err)
+		}
+	}
+}
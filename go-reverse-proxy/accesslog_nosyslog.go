@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+func openSyslog(network, address, tag string) (io.Writer, error) {
+	return nil, fmt.Errorf("access_log: syslog is not supported on this platform")
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ==================== IP ACCESS CONTROL ====================
+// ACLConfig filters clients by address. Entries are CIDR ranges or single
+// IPs. Deny always wins; a non-empty Allow list admits only its ranges.
+type ACLConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	// Action for rejected clients: "403" (default) or "drop", which closes
+	// the connection without an answer.
+	Action string `json:"action,omitempty"`
+}
+
+const (
+	ACLActionForbid = "403"
+	ACLActionDrop   = "drop"
+)
+
+type IPACL struct {
+	mu     sync.RWMutex
+	allow  []netip.Prefix
+	deny   []netip.Prefix
+	action string
+}
+
+func NewIPACL(cfg *ACLConfig) (*IPACL, error) {
+	acl := &IPACL{action: ACLActionForbid}
+	if cfg != nil {
+		if err := acl.Update(*cfg); err != nil {
+			return nil, err
+		}
+	}
+	return acl, nil
+}
+
+// Update replaces the lists and action; on error nothing changes.
+func (a *IPACL) Update(cfg ACLConfig) error {
+	allow, err := parsePrefixes(cfg.Allow)
+	if err != nil {
+		return fmt.Errorf("allow: %w", err)
+	}
+	deny, err := parsePrefixes(cfg.Deny)
+	if err != nil {
+		return fmt.Errorf("deny: %w", err)
+	}
+	action := cfg.Action
+	switch action {
+	case "":
+		action = ACLActionForbid
+	case ACLActionForbid, ACLActionDrop:
+	default:
+		return fmt.Errorf("unknown action %q (want \"403\" or \"drop\")", cfg.Action)
+	}
+
+	a.mu.Lock()
+	a.allow, a.deny, a.action = allow, deny, action
+	a.mu.Unlock()
+	return nil
+}
+
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if !strings.Contains(e, "/") {
+			addr, err := netip.ParseAddr(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", e)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", e)
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// Check reports whether addr may pass and, if not, the configured action.
+func (a *IPACL) Check(addr netip.Addr) (bool, string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, p := range a.deny {
+		if p.Contains(addr) {
+			return false, a.action
+		}
+	}
+	if len(a.allow) == 0 {
+		return true, ""
+	}
+	for _, p := range a.allow {
+		if p.Contains(addr) {
+			return true, ""
+		}
+	}
+	return false, a.action
+}
+
+func (a *IPACL) Config() ACLConfig {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	cfg := ACLConfig{Action: a.action}
+	for _, p := range a.allow {
+		cfg.Allow = append(cfg.Allow, p.String())
+	}
+	for _, p := range a.deny {
+		cfg.Deny = append(cfg.Deny, p.String())
+	}
+	return cfg
+}
+
+// AccessLists holds the global list and one per route prefix. Every route
+// gets a list, empty unless configured, so the Admin API can fill it later.
+type AccessLists struct {
+	global *IPACL
+	routes map[string]*IPACL
+}
+
+func NewAccessLists(cfg *Config) (*AccessLists, error) {
+	global, err := NewIPACL(cfg.ACL)
+	if err != nil {
+		return nil, fmt.Errorf("acl: %w", err)
+	}
+	lists := &AccessLists{global: global, routes: make(map[string]*IPACL)}
+	for _, rc := range cfg.Routes {
+		if lists.routes[rc.Prefix], err = NewIPACL(rc.ACL); err != nil {
+			return nil, fmt.Errorf("route %s acl: %w", rc.Prefix, err)
+		}
+	}
+	return lists, nil
+}
+
+// Get returns the global list for "" and a route's list for its prefix.
+func (l *AccessLists) Get(route string) *IPACL {
+	if route == "" {
+		return l.global
+	}
+	return l.routes[route]
+}
+
+func (l *AccessLists) Snapshot() map[string]interface{} {
+	routes := make(map[string]ACLConfig, len(l.routes))
+	prefixes := make([]string, 0, len(l.routes))
+	for prefix := range l.routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		routes[prefix] = l.routes[prefix].Config()
+	}
+	return map[string]interface{}{
+		"global": l.global.Config(),
+		"routes": routes,
+	}
+}
+
+// aclMiddleware checks the global list, then the matching route's list.
+func aclMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr := h.trusted.RealIP(r)
+			if !addr.IsValid() {
+				h.httpError(w, r, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			lists := []*IPACL{h.acls.global}
+			if route := h.route(r); route != nil {
+				lists = append(lists, h.acls.Get(route.prefix))
+			}
+			for _, acl := range lists {
+				if ok, action := acl.Check(addr); !ok {
+					h.logs.Debugf(h.logs.SampleDebug(), "[%s] ACL rejected %s for %s %s", requestID(r), addr, r.Method, r.URL.Path)
+					if action == ACLActionDrop {
+						// Closes the connection (or resets the HTTP/2 stream)
+						// without writing a response
+						panic(http.ErrAbortHandler)
+					}
+					h.httpError(w, r, "Forbidden", http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+func aclConfigured(cfg *Config) bool {
+	if cfg.ACL != nil {
+		return true
+	}
+	for _, rc := range cfg.Routes {
+		if rc.ACL != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func logACLUpdate(route string, cfg ACLConfig) {
+	scope := "global"
+	if route != "" {
+		scope = "route " + route
+	}
+	log.Printf("ACL for %s updated via Admin API: allow=%v deny=%v action=%s", scope, cfg.Allow, cfg.Deny, cfg.Action)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestIPACLCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ACLConfig
+		addr string
+		want bool
+	}{
+		{"empty lists admit all", ACLConfig{}, "203.0.113.9", true},
+		{"allowed", ACLConfig{Allow: []string{"10.0.0.0/8"}}, "10.1.2.3", true},
+		{"not in allow list", ACLConfig{Allow: []string{"10.0.0.0/8"}}, "192.0.2.1", false},
+		{"deny wins over allow", ACLConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.5"}}, "10.0.0.5", false},
+		{"deny only", ACLConfig{Deny: []string{"192.0.2.0/24"}}, "192.0.2.77", false},
+		{"4-in-6 address entry", ACLConfig{Deny: []string{"::ffff:192.0.2.1"}}, "192.0.2.1", false},
+		{"4-in-6 CIDR entry", ACLConfig{Allow: []string{"::ffff:10.0.0.0/104"}}, "10.200.0.1", true},
+		{"4-in-6 CIDR entry outside", ACLConfig{Allow: []string{"::ffff:10.0.0.0/104"}}, "11.0.0.1", false},
+		{"IPv6", ACLConfig{Allow: []string{"2001:db8::/32"}}, "2001:db8:1::1", true},
+		{"IPv6 outside", ACLConfig{Allow: []string{"2001:db8::/32"}}, "2001:db9::1", false},
+	}
+	for _, tt := range tests {
+		acl, err := NewIPACL(&tt.cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ok, _ := acl.Check(netip.MustParseAddr(tt.addr)); ok != tt.want {
+			t.Errorf("%s: Check(%s) = %v, want %v", tt.name, tt.addr, ok, tt.want)
+		}
+	}
+}
+
+func TestIPACLUpdateRejectsBadConfig(t *testing.T) {
+	acl, err := NewIPACL(&ACLConfig{Allow: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []ACLConfig{
+		{Allow: []string{"10.0.0.0/33"}},
+		{Deny: []string{"not-an-ip"}},
+		{Action: "teapot"},
+	} {
+		if err := acl.Update(cfg); err == nil {
+			t.Errorf("Update(%+v) accepted", cfg)
+		}
+	}
+	if got := acl.Config(); len(got.Allow) != 1 || got.Allow[0] != "10.0.0.0/8" || got.Action != ACLActionForbid {
+		t.Errorf("failed updates changed the ACL to %+v", got)
+	}
+}
+
+func TestACLMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	// Test clients connect from 127.0.0.1
+	cfg := testConfig(backend.URL)
+	cfg.Routes = []RouteConfig{
+		{Prefix: "/internal/", Pool: "default", ACL: &ACLConfig{Allow: []string{"10.0.0.0/8"}}},
+		{Prefix: "/hidden/", Pool: "default", ACL: &ACLConfig{Deny: []string{"127.0.0.0/8"}, Action: ACLActionDrop}},
+	}
+	_, proxy := newTestProxy(t, cfg)
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/", http.StatusOK},
+		{"/internal/status", http.StatusForbidden},
+	} {
+		resp, err := http.Get(proxy.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.path, resp.StatusCode, tt.want)
+		}
+	}
+
+	// drop closes the connection without an answer
+	if resp, err := http.Get(proxy.URL + "/hidden/x"); err == nil {
+		resp.Body.Close()
+		t.Errorf("dropped client got status %d, want no response", resp.StatusCode)
+	}
+
+	// A global deny applies before any route's list
+	cfg.ACL = &ACLConfig{Deny: []string{"::ffff:127.0.0.1"}}
+	_, proxy = newTestProxy(t, cfg)
+	resp, err := http.Get(proxy.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("globally denied client got status %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+	"strings"
+	"time"
+)
+
+// ==================== ADMIN API VERSIONING & ERRORS ====================
+// The Admin API lives under /v1. The same paths without the prefix are
+// deprecated aliases kept for existing scripts; they answer the same but
+// say so in their headers.
+const adminAPIVersion = "/v1"
+
+// deprecatedAlias marks a response to an unversioned path and points to
+// its successor (RFC 8594 style headers).
+func deprecatedAlias(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", adminAPIVersion, r.URL.EscapedPath()))
+}
+
+// AdminError is the body of every failed Admin API call.
+type AdminError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"` // e.g. "not_found", from the status text
+	Message string `json:"message"`
+}
+
+// adminError replies with {"error": AdminError}; it replaces http.Error in
+// Admin API handlers.
+func adminError(w http.ResponseWriter, message string, status int) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	code := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	json.NewEncoder(w).Encode(map[string]AdminError{
+		"error": {Status: status, Code: code, Message: message},
+	})
+}
+
+// ==================== ADMIN AUTH & DEBUG ENDPOINTS ====================
+// AdminAuthConfig protects every Admin API endpoint. Either or both of
+// basic auth and API keys may be set; a request passing one is let in.
+type AdminAuthConfig struct {
+	BasicAuth *BasicAuthConfig `json:"basic_auth,omitempty"`
+	APIKey    *APIKeyConfig    `json:"api_key,omitempty"`
+}
+
+type AdminAuth struct {
+	basicAuth *BasicAuth
+	apiKey    *APIKeyAuth
+}
+
+// NewAdminAuth returns nil (no authentication) when cfg is nil.
+func NewAdminAuth(cfg *AdminAuthConfig) (*AdminAuth, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	a := &AdminAuth{}
+	var err error
+	if cfg.BasicAuth != nil {
+		if a.basicAuth, err = NewBasicAuth(cfg.BasicAuth); err != nil {
+			return nil, fmt.Errorf("admin_auth: %w", err)
+		}
+	}
+	if cfg.APIKey != nil {
+		if a.apiKey, err = NewAPIKeyAuth(cfg.APIKey); err != nil {
+			return nil, fmt.Errorf("admin_auth: %w", err)
+		}
+	}
+	if a.basicAuth == nil && a.apiKey == nil {
+		return nil, fmt.Errorf("admin_auth: configure basic_auth or api_key")
+	}
+	return a, nil
+}
+
+// Check answers 401 and returns false unless r carries valid credentials.
+// It also returns who made the request: the basic auth user, or the API
+// key's name as "api_key:<name>". A nil *AdminAuth lets everything through
+// anonymously.
+func (a *AdminAuth) Check(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if a == nil {
+		return "", true
+	}
+	if a.apiKey != nil {
+		if name := a.apiKey.Check(r); name != "" {
+			return "api_key:" + name, true
+		}
+	}
+	if a.basicAuth != nil {
+		if user := a.basicAuth.Check(r); user != "" {
+			return user, true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.basicAuth.realm))
+	}
+	log.Printf("Admin API: rejected unauthenticated %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	adminError(w, "Unauthorized", http.StatusUnauthorized)
+	return "", false
+}
+
+// redactQuery returns r's query string without the API key parameter.
+func (a *AdminAuth) redactQuery(r *http.Request) string {
+	if a == nil || a.apiKey == nil || a.apiKey.queryParam == "" {
+		return r.URL.RawQuery
+	}
+	q := r.URL.Query()
+	if !q.Has(a.apiKey.queryParam) {
+		return r.URL.RawQuery
+	}
+	q.Del(a.apiKey.queryParam)
+	return q.Encode()
+}
+
+// newDebugMux serves pprof, expvar and a plain-text goroutine dump under
+// /debug/. Profiles can run longer than the admin server's write timeout,
+// so the deadline is lifted for these requests.
+func newDebugMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		// pprof refuses profiles longer than the server's WriteTimeout,
+		// which it reads from the context
+		r = r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, &http.Server{}))
+		mux.ServeHTTP(w, r)
+	})
+}
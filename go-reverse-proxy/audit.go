@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== ADMIN AUDIT LOG ====================
+// AuditConfig sizes the record of mutating Admin API calls behind
+// GET /audit.
+type AuditConfig struct {
+	// Size is how many entries GET /audit can return (default 1000).
+	Size int `json:"size,omitempty"`
+
+	// File, when set, receives every entry as a JSON line. It is only ever
+	// appended to; the last Size entries are read back at startup.
+	File string `json:"file,omitempty"`
+}
+
+const (
+	defaultAuditSize = 1000
+	maxAuditBody     = 64 << 10 // request bodies beyond this are cut
+)
+
+// AuditEntry records one mutating Admin API call: who made it, from where,
+// what it asked for and, for endpoints with state to compare, the state
+// before and after.
+type AuditEntry struct {
+	Time    time.Time       `json:"time"`
+	User    string          `json:"user,omitempty"` // empty without admin_auth
+	IP      string          `json:"ip"`
+	Method  string          `json:"method"`
+	Path    string          `json:"path"`
+	Query   string          `json:"query,omitempty"`
+	Status  int             `json:"status"`
+	Request json.RawMessage `json:"request,omitempty"`
+	Old     interface{}     `json:"old,omitempty"`
+	New     interface{}     `json:"new,omitempty"`
+}
+
+type AuditLog struct {
+	mu      sync.Mutex
+	size    int
+	entries []AuditEntry // oldest first
+	file    *os.File     // nil unless persisted
+}
+
+func NewAuditLog(cfg AuditConfig) (*AuditLog, error) {
+	size := cfg.Size
+	if size == 0 {
+		size = defaultAuditSize
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("admin_audit: size must be positive")
+	}
+	l := &AuditLog{size: size}
+
+	if cfg.File != "" {
+		if err := l.load(cfg.File); err != nil {
+			return nil, fmt.Errorf("admin_audit: %w", err)
+		}
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("admin_audit: %w", err)
+		}
+		l.file = f
+	}
+	return l, nil
+}
+
+// load reads the entries of previous runs, keeping the newest. A missing
+// file is not an error.
+func (l *AuditLog) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 4*maxAuditBody)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("admin_audit: skipping unreadable line in %s: %v", path, err)
+			continue
+		}
+		l.add(e)
+	}
+	return scanner.Err()
+}
+
+func (l *AuditLog) add(e AuditEntry) {
+	l.entries = append(l.entries, e)
+	if len(l.entries) > l.size {
+		l.entries = l.entries[len(l.entries)-l.size:]
+	}
+}
+
+func (l *AuditLog) Record(e AuditEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.add(e)
+	if l.file == nil {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("admin_audit: %v", err)
+		return
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Printf("admin_audit: %v", err)
+	}
+}
+
+// Recent returns up to limit entries, newest first.
+func (l *AuditLog) Recent(limit int) []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := []AuditEntry{}
+	for i := len(l.entries) - 1; i >= 0 && len(recent) < limit; i-- {
+		recent = append(recent, l.entries[i])
+	}
+	return recent
+}
+
+// audited reports whether a call changes anything worth recording.
+func audited(r *http.Request) bool {
+	switch r.Method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		// Heartbeats would drown the rest; registrations are logged.
+		// Validating a config is a dry run.
+		path := strings.TrimPrefix(r.URL.Path, adminAPIVersion)
+		return !strings.HasPrefix(r.URL.Path, "/debug/") && path != "/register" && path != "/config/validate"
+	}
+	return false
+}
+
+// auditCall serves a mutating call through next and records it.
+func (a *AdminAPI) auditCall(w http.ResponseWriter, r *http.Request, user string, next http.Handler) {
+	e := AuditEntry{
+		Time:   time.Now(),
+		User:   user,
+		IP:     r.RemoteAddr,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  a.auth.redactQuery(r),
+	}
+	path := strings.TrimPrefix(r.URL.Path, adminAPIVersion)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.IP = host
+	}
+
+	// Keep a copy of the body and hand the handler the whole of it
+	if r.Body != nil {
+		body, _ := io.ReadAll(io.LimitReader(r.Body, maxAuditBody))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		e.Request = auditBody(path, body)
+	}
+
+	state := a.auditState(path)
+	if state != nil {
+		e.Old = state()
+	}
+	rec := &statusRecorder{ResponseWriter: w}
+	next.ServeHTTP(rec, r)
+	e.Status = rec.Status()
+	if state != nil {
+		e.New = state()
+	}
+	// Of the backends, keep only those that changed
+	if old, ok := e.Old.(map[string]*auditBackend); ok {
+		before, after := changedBackends(old, e.New.(map[string]*auditBackend))
+		e.Old, e.New = nil, nil
+		if len(before)+len(after) > 0 {
+			e.Old, e.New = before, after
+		}
+	}
+	a.audit.Record(e)
+}
+
+// auditBody is what an entry keeps of a request body. Configs sent to
+// /config/import are kept with their secrets redacted, and not at all when
+// they can't be read as one (or were cut at maxAuditBody).
+func auditBody(path string, body []byte) json.RawMessage {
+	if path == "/config/import" {
+		var cfg Config
+		if err := json.Unmarshal(body, &cfg); err != nil {
+			return nil
+		}
+		redacted, _ := json.Marshal(cfg.redacted())
+		return redacted
+	}
+	if json.Valid(body) {
+		return body
+	}
+	if len(body) > 0 {
+		quoted, _ := json.Marshal(string(body))
+		return quoted
+	}
+	return nil
+}
+
+// auditState returns what a call to path can change, for the old and new
+// values of its audit entry, or nil when there is nothing to compare.
+func (a *AdminAPI) auditState(path string) func() interface{} {
+	switch {
+	case path == "/acl":
+		return func() interface{} { return a.acls.Snapshot() }
+	case path == "/ratelimit":
+		return func() interface{} { return a.limits.Snapshot() }
+	case path == "/logging":
+		return func() interface{} { return a.loggingState() }
+	case path == "/health/pause" || path == "/health/resume":
+		return func() interface{} { return map[string]bool{"paused": a.checker.Paused()} }
+	case path == "/add" || path == "/remove" || path == "/backends/weight" || path == "/backends/status":
+		return func() interface{} { return a.backendStates() }
+	case path == "/sessions" || strings.HasPrefix(path, "/sessions/"):
+		if a.sessions != nil {
+			return func() interface{} { return map[string]int{"sessions": a.sessions.Count()} }
+		}
+	}
+	return nil
+}
+
+type auditBackend struct {
+	Pools  []string `json:"pools"`
+	Alive  bool     `json:"alive"`
+	Weight int      `json:"weight"`
+}
+
+// backendStates maps every backend URL to its pools, health and weight.
+func (a *AdminAPI) backendStates() map[string]*auditBackend {
+	states := make(map[string]*auditBackend)
+	for name, p := range a.pools {
+		for _, b := range p.GetBackends() {
+			url := b.URL.String()
+			s := states[url]
+			if s == nil {
+				s = &auditBackend{Alive: b.IsAlive(), Weight: b.GetWeight()}
+				states[url] = s
+			}
+			s.Pools = append(s.Pools, name)
+		}
+	}
+	for _, s := range states {
+		sort.Strings(s.Pools)
+	}
+	return states
+}
+
+// changedBackends keeps only the backends whose state differs; one that was
+// added or removed is missing from old or new.
+func changedBackends(old, new map[string]*auditBackend) (map[string]*auditBackend, map[string]*auditBackend) {
+	before, after := make(map[string]*auditBackend), make(map[string]*auditBackend)
+	for url, o := range old {
+		n := new[url]
+		if n == nil || o.Alive != n.Alive || o.Weight != n.Weight || !slices.Equal(o.Pools, n.Pools) {
+			before[url] = o
+			if n != nil {
+				after[url] = n
+			}
+		}
+	}
+	for url, n := range new {
+		if old[url] == nil {
+			after[url] = n
+		}
+	}
+	return before, after
+}
+
+// handleAudit lists recorded calls, newest first; ?limit= (default 100)
+// caps the list.
+func (a *AdminAPI) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			adminError(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": a.audit.Recent(limit),
+	})
+}
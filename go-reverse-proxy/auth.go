@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ==================== BASIC AUTH & API KEYS ====================
+// authUserHeader tells backends who authenticated at the proxy. ServeHTTP
+// drops client-sent values before the pipeline runs.
+const authUserHeader = "X-Auth-User"
+
+// setAuthUser records the authenticated user unless an earlier stage did.
+func setAuthUser(r *http.Request, user string) {
+	if r.Header.Get(authUserHeader) == "" {
+		r.Header.Set(authUserHeader, user)
+	}
+}
+
+type BasicAuthConfig struct {
+	// HtpasswdFile holds user:hash lines; bcrypt (htpasswd -B) and {SHA}
+	// hashes are supported.
+	HtpasswdFile string `json:"htpasswd_file"`
+	Realm        string `json:"realm,omitempty"`
+
+	// ForwardCredentials passes the Authorization header on to the
+	// backend; by default it is removed once checked.
+	ForwardCredentials bool `json:"forward_credentials,omitempty"`
+}
+
+type APIKeyConfig struct {
+	// Keys maps a name (forwarded as X-Auth-User) to its key.
+	Keys map[string]string `json:"keys"`
+
+	// Header carries the key (default X-API-Key); QueryParam, if set, is
+	// accepted as well.
+	Header     string `json:"header,omitempty"`
+	QueryParam string `json:"query_param,omitempty"`
+
+	// ForwardCredentials passes the key on to the backend; by default it
+	// is removed from the header and query once checked.
+	ForwardCredentials bool `json:"forward_credentials,omitempty"`
+}
+
+type BasicAuth struct {
+	realm   string
+	users   map[string]string // user -> hash
+	forward bool
+
+	// dummy is checked in place of an unknown user's hash, at the cost of
+	// the real ones, so timing doesn't tell which users exist
+	dummy string
+}
+
+func NewBasicAuth(cfg *BasicAuthConfig) (*BasicAuth, error) {
+	f, err := os.Open(cfg.HtpasswdFile)
+	if err != nil {
+		return nil, fmt.Errorf("basic_auth: %w", err)
+	}
+	defer f.Close()
+
+	a := &BasicAuth{realm: cfg.Realm, users: make(map[string]string), forward: cfg.ForwardCredentials}
+	if a.realm == "" {
+		a.realm = "Restricted"
+	}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("basic_auth: %s line %d: expected user:hash", cfg.HtpasswdFile, n)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("basic_auth: %s line %d: unsupported hash for %s (use htpasswd -B)", cfg.HtpasswdFile, n, user)
+		}
+		a.users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("basic_auth: %w", err)
+	}
+
+	a.dummy = "{SHA}"
+	cost := 0
+	for _, hash := range a.users {
+		if c, err := bcrypt.Cost([]byte(hash)); err == nil {
+			cost = max(cost, c)
+		}
+	}
+	if cost > 0 {
+		dummy, err := bcrypt.GenerateFromPassword([]byte("no such user"), cost)
+		if err != nil {
+			return nil, fmt.Errorf("basic_auth: %w", err)
+		}
+		a.dummy = string(dummy)
+	}
+	return a, nil
+}
+
+// Check returns the authenticated user, or "" if the credentials are wrong.
+func (a *BasicAuth) Check(r *http.Request) string {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+	hash, known := a.users[user]
+	if !known {
+		hash = a.dummy
+	}
+	if checkPassword(hash, pass) && known {
+		return user
+	}
+	return ""
+}
+
+// checkPassword reports whether pass matches an htpasswd hash.
+func checkPassword(hash, pass string) bool {
+	if sha, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(sha), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+// strip removes the checked credentials unless they are to be forwarded.
+func (a *BasicAuth) strip(r *http.Request) {
+	if !a.forward {
+		r.Header.Del("Authorization")
+	}
+}
+
+type APIKeyAuth struct {
+	header     string
+	queryParam string
+	keys       map[string]string
+	forward    bool
+}
+
+func NewAPIKeyAuth(cfg *APIKeyConfig) (*APIKeyAuth, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, fmt.Errorf("api_key: no keys configured")
+	}
+	a := &APIKeyAuth{header: cfg.Header, queryParam: cfg.QueryParam, keys: cfg.Keys, forward: cfg.ForwardCredentials}
+	if a.header == "" {
+		a.header = "X-API-Key"
+	}
+	return a, nil
+}
+
+// Check returns the name of the presented key, or "" if it is unknown.
+func (a *APIKeyAuth) Check(r *http.Request) string {
+	key := r.Header.Get(a.header)
+	if key == "" && a.queryParam != "" {
+		key = r.URL.Query().Get(a.queryParam)
+	}
+	if key == "" {
+		return ""
+	}
+	// Compare against every key so timing doesn't reveal which one matched
+	found := ""
+	for name, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			found = name
+		}
+	}
+	return found
+}
+
+// strip removes the checked key unless it is to be forwarded.
+func (a *APIKeyAuth) strip(r *http.Request) {
+	if a.forward {
+		return
+	}
+	r.Header.Del(a.header)
+	if a.queryParam == "" {
+		return
+	}
+	if q := r.URL.Query(); q.Has(a.queryParam) {
+		q.Del(a.queryParam)
+		r.URL.RawQuery = q.Encode()
+	}
+}
+
+func basicAuthConfigured(cfg *Config) bool {
+	for _, rc := range cfg.Routes {
+		if rc.BasicAuth != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func apiKeyConfigured(cfg *Config) bool {
+	for _, rc := range cfg.Routes {
+		if rc.APIKey != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// basicAuthMiddleware enforces basic auth on routes that configure it.
+func basicAuthMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	if !basicAuthConfigured(cfg) {
+		return nil, nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := h.route(r)
+			if route == nil || route.basicAuth == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			user := route.basicAuth.Check(r)
+			if user == "" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", route.basicAuth.realm))
+				h.httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			route.basicAuth.strip(r)
+			setAuthUser(r, user)
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// apiKeyMiddleware enforces API keys on routes that configure them.
+func apiKeyMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	if !apiKeyConfigured(cfg) {
+		return nil, nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := h.route(r)
+			if route == nil || route.apiKey == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			name := route.apiKey.Check(r)
+			if name == "" {
+				h.httpError(w, r, "Unauthorized - missing or invalid API key", http.StatusUnauthorized)
+				return
+			}
+			route.apiKey.strip(r)
+			setAuthUser(r, name)
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func shaHash(pass string) string {
+	sum := sha1.Sum([]byte(pass))
+	return "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestBasicAuth(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewBasicAuth(&BasicAuthConfig{HtpasswdFile: writeHtpasswd(t,
+		"# users",
+		"",
+		"alice:"+string(bcryptHash),
+		"bob:"+shaHash("sha-pass"),
+	)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, pass string
+		want       string
+	}{
+		{"alice", "bcrypt-pass", "alice"},
+		{"alice", "wrong", ""},
+		{"bob", "sha-pass", "bob"},
+		{"bob", "wrong", ""},
+		{"carol", "bcrypt-pass", ""}, // unknown, checked against the dummy hash
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(tt.user, tt.pass)
+		if got := auth.Check(r); got != tt.want {
+			t.Errorf("Check(%s:%s) = %q, want %q", tt.user, tt.pass, got, tt.want)
+		}
+	}
+	if got := auth.Check(httptest.NewRequest("GET", "/", nil)); got != "" {
+		t.Errorf("Check without credentials = %q, want none", got)
+	}
+	if cost, err := bcrypt.Cost([]byte(auth.dummy)); err != nil || cost != bcrypt.MinCost {
+		t.Errorf("dummy hash cost %d (%v), want the users' %d", cost, err, bcrypt.MinCost)
+	}
+}
+
+func TestBasicAuthRejectsBadHtpasswd(t *testing.T) {
+	for name, line := range map[string]string{
+		"no hash":     "alice",
+		"plain text":  "alice:secret",
+		"md5 (apr1)":  "alice:$apr1$abc$def",
+		"crypt (DES)": "alice:rl.3StKT.4T8M",
+	} {
+		if _, err := NewBasicAuth(&BasicAuthConfig{HtpasswdFile: writeHtpasswd(t, line)}); err == nil {
+			t.Errorf("%s: htpasswd line %q accepted", name, line)
+		}
+	}
+	if _, err := NewBasicAuth(&BasicAuthConfig{HtpasswdFile: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("missing htpasswd file accepted")
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	keys := map[string]string{"ci": "k-123", "billing": "k-456"}
+	tests := []struct {
+		name   string
+		cfg    APIKeyConfig
+		header string // header name: value
+		target string
+		want   string
+	}{
+		{"default header", APIKeyConfig{}, "X-API-Key: k-123", "/", "ci"},
+		{"custom header", APIKeyConfig{Header: "X-Token"}, "X-Token: k-456", "/", "billing"},
+		{"default header ignored when custom set", APIKeyConfig{Header: "X-Token"}, "X-API-Key: k-456", "/", ""},
+		{"wrong key", APIKeyConfig{}, "X-API-Key: k-999", "/", ""},
+		{"query param", APIKeyConfig{QueryParam: "api_key"}, "", "/?api_key=k-456", "billing"},
+		{"query param not configured", APIKeyConfig{}, "", "/?api_key=k-456", ""},
+		{"header wins over query", APIKeyConfig{QueryParam: "api_key"}, "X-API-Key: k-123", "/?api_key=k-456", "ci"},
+		{"none", APIKeyConfig{QueryParam: "api_key"}, "", "/", ""},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg
+		cfg.Keys = keys
+		auth, err := NewAPIKeyAuth(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if name, value, ok := strings.Cut(tt.header, ": "); ok {
+			r.Header.Set(name, value)
+		}
+		if got := auth.Check(r); got != tt.want {
+			t.Errorf("%s: Check = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if _, err := NewAPIKeyAuth(&APIKeyConfig{}); err == nil {
+		t.Error("api_key without keys accepted")
+	}
+}
+
+func TestAuthCredentialsStripped(t *testing.T) {
+	seen := make(chan *http.Request, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r
+	}))
+	defer backend.Close()
+
+	for _, forward := range []bool{false, true} {
+		cfg := testConfig(backend.URL)
+		cfg.Routes = []RouteConfig{
+			{Prefix: "/basic/", Pool: "default", BasicAuth: &BasicAuthConfig{
+				HtpasswdFile:       writeHtpasswd(t, "alice:"+shaHash("pass")),
+				ForwardCredentials: forward,
+			}},
+			{Prefix: "/key/", Pool: "default", APIKey: &APIKeyConfig{
+				Keys:               map[string]string{"ci": "k-123"},
+				QueryParam:         "api_key",
+				ForwardCredentials: forward,
+			}},
+		}
+		_, proxy := newTestProxy(t, cfg)
+
+		send := func(req *http.Request) *http.Request {
+			t.Helper()
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: status %d", req.URL.Path, resp.StatusCode)
+			}
+			return <-seen
+		}
+
+		req, _ := http.NewRequest("GET", proxy.URL+"/basic/x", nil)
+		req.SetBasicAuth("alice", "pass")
+		got := send(req)
+		if has := got.Header.Get("Authorization") != ""; has != forward {
+			t.Errorf("forward_credentials %v: backend got Authorization = %v", forward, has)
+		}
+		if user := got.Header.Get(authUserHeader); user != "alice" {
+			t.Errorf("backend got %s %q, want alice", authUserHeader, user)
+		}
+
+		req, _ = http.NewRequest("GET", proxy.URL+"/key/x", nil)
+		req.Header.Set("X-API-Key", "k-123")
+		if has := send(req).Header.Get("X-API-Key") != ""; has != forward {
+			t.Errorf("forward_credentials %v: backend got X-API-Key = %v", forward, has)
+		}
+
+		req, _ = http.NewRequest("GET", proxy.URL+"/key/x?api_key=k-123&page=2", nil)
+		got = send(req)
+		if has := got.URL.Query().Has("api_key"); has != forward {
+			t.Errorf("forward_credentials %v: backend got the api_key query param = %v", forward, has)
+		}
+		if page := got.URL.Query().Get("page"); page != "2" {
+			t.Errorf("backend got page=%q, want the other params kept", page)
+		}
+	}
+}
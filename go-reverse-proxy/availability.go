@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ==================== AVAILABILITY (SLA) ====================
+// Availability records every backend's up/down transitions, from the event
+// bus, for a week and turns them into uptime percentages. Tracking starts
+// with the process, so windows longer than the uptime only cover the part
+// that was observed (see observed_seconds).
+type Availability struct {
+	mu       sync.Mutex
+	backends map[string]*availabilityRecord
+	pools    map[string]*ServerPool
+}
+
+// availabilityWindows are the reporting windows, shortest first.
+var availabilityWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+}
+
+type availabilityRecord struct {
+	since       time.Time    // tracking start
+	initiallyUp bool         // state at since
+	changes     []transition // oldest first
+}
+
+type transition struct {
+	at time.Time
+	up bool
+}
+
+type windowUptime struct {
+	UptimePercent   float64 `json:"uptime_percent"`
+	DowntimeSeconds float64 `json:"downtime_seconds"`
+	ObservedSeconds float64 `json:"observed_seconds"`
+}
+
+type backendAvailability struct {
+	URL        string                  `json:"url"`
+	Alive      bool                    `json:"alive"`
+	Since      time.Time               `json:"tracking_since"`
+	LastChange *time.Time              `json:"last_change,omitempty"`
+	Windows    map[string]windowUptime `json:"windows"`
+}
+
+func NewAvailability(pools map[string]*ServerPool, events *EventBus) *Availability {
+	a := &Availability{backends: make(map[string]*availabilityRecord), pools: pools}
+	now := time.Now()
+	for _, p := range pools {
+		for _, b := range p.GetBackends() {
+			a.backends[b.URL.String()] = &availabilityRecord{since: now, initiallyUp: b.IsAlive()}
+		}
+	}
+	events.Subscribe(a.observe)
+	return a
+}
+
+func (a *Availability) observe(e Event) {
+	if e.Type != EventBackendUp && e.Type != EventBackendDown {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rec := a.record(e.Backend, e.Type == EventBackendDown, e.Time)
+	rec.changes = append(rec.changes, transition{at: e.Time, up: e.Type == EventBackendUp})
+	rec.prune(e.Time)
+}
+
+// record returns the backend's record, starting one for backends added
+// at runtime.
+func (a *Availability) record(url string, up bool, now time.Time) *availabilityRecord {
+	rec := a.backends[url]
+	if rec == nil {
+		rec = &availabilityRecord{since: now, initiallyUp: up}
+		a.backends[url] = rec
+	}
+	return rec
+}
+
+// prune folds transitions older than the longest window into the start
+// state.
+func (rec *availabilityRecord) prune(now time.Time) {
+	cutoff := now.Add(-availabilityWindows[len(availabilityWindows)-1].d)
+	for len(rec.changes) > 0 && rec.changes[0].at.Before(cutoff) {
+		rec.initiallyUp = rec.changes[0].up
+		rec.since = rec.changes[0].at
+		rec.changes = rec.changes[1:]
+	}
+}
+
+// uptime sums the time spent up within [now-d, now].
+func (rec *availabilityRecord) uptime(now time.Time, d time.Duration) windowUptime {
+	start := now.Add(-d)
+	if start.Before(rec.since) {
+		start = rec.since
+	}
+	observed := now.Sub(start)
+
+	var down time.Duration
+	up, from := rec.initiallyUp, rec.since
+	for _, c := range append(rec.changes, transition{at: now, up: up}) {
+		if !up {
+			if begin := maxTime(from, start); c.at.After(begin) {
+				down += c.at.Sub(begin)
+			}
+		}
+		up, from = c.up, c.at
+	}
+
+	w := windowUptime{
+		UptimePercent:   100,
+		DowntimeSeconds: down.Seconds(),
+		ObservedSeconds: observed.Seconds(),
+	}
+	if observed > 0 {
+		w.UptimePercent = math.Round(float64(observed-down)/float64(observed)*100000) / 1000
+	}
+	return w
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Report lists every backend in the pools with its uptime per window.
+func (a *Availability) Report() []backendAvailability {
+	now := time.Now()
+	seen := make(map[string]bool)
+	var report []backendAvailability
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, p := range a.pools {
+		for _, b := range p.GetBackends() {
+			url := b.URL.String()
+			if seen[url] {
+				continue
+			}
+			seen[url] = true
+
+			rec := a.record(url, b.IsAlive(), now)
+			entry := backendAvailability{
+				URL:     url,
+				Alive:   b.IsAlive(),
+				Since:   rec.since,
+				Windows: make(map[string]windowUptime, len(availabilityWindows)),
+			}
+			if n := len(rec.changes); n > 0 {
+				last := rec.changes[n-1].at
+				entry.LastChange = &last
+			}
+			for _, w := range availabilityWindows {
+				entry.Windows[w.name] = rec.uptime(now, w.d)
+			}
+			report = append(report, entry)
+		}
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].URL < report[j].URL })
+	return report
+}
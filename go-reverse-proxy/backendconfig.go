@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+)
+
+// ==================== BACKEND CONFIGURATION ====================
+// BackendConfig is one entry of a pool's backends: its URL and everything
+// that applies to that backend alone. An entry with no options can be
+// written as the bare URL string.
+type BackendConfig struct {
+	URL string `json:"url"`
+
+	// Weight is the backend's share of traffic under the weighted strategy
+	// (default 1). 0 drains it under every strategy.
+	Weight *int `json:"weight,omitempty"`
+
+	// MaxConnections caps its requests in flight, in place of
+	// bulkhead.max_in_flight; see BulkheadConfig.
+	MaxConnections int `json:"max_connections,omitempty"`
+
+	// RateLimit caps the requests sent to it. A capped backend is passed
+	// over; when all are, clients get a 503.
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+
+	HealthCheck *BackendHealthCheck `json:"health_check,omitempty"`
+
+	// Zone says where the backend runs, e.g. an availability zone. It is
+	// reported with the backend's status.
+	Zone string `json:"zone,omitempty"`
+
+	TLS *BackendTLSConfig `json:"tls,omitempty"`
+}
+
+// BackendHealthCheck changes how the health checker probes a backend.
+type BackendHealthCheck struct {
+	// Path is requested instead of the backend URL's own path.
+	Path string `json:"path,omitempty"`
+
+	// Disabled leaves the backend out of health checks; its status only
+	// changes through POST /backends/status.
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// BackendTLSConfig applies to proxied requests and health checks to an
+// https backend.
+type BackendTLSConfig struct {
+	// CAFile holds PEM certificates trusted in place of the system roots,
+	// e.g. an internal CA.
+	CAFile string `json:"ca_file,omitempty"`
+
+	// CertFile and KeyFile are presented to backends requiring client
+	// certificates.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// ServerName is verified instead of the URL's host.
+	ServerName string `json:"server_name,omitempty"`
+
+	// InsecureSkipVerify accepts any certificate; for testing only.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+}
+
+func (bc *BackendConfig) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*bc = BackendConfig{URL: url}
+		return nil
+	}
+	type plain BackendConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var p plain
+	if err := dec.Decode(&p); err != nil {
+		return err
+	}
+	if p.URL == "" {
+		return fmt.Errorf("backend needs a url")
+	}
+	*bc = BackendConfig(p)
+	return nil
+}
+
+// MarshalJSON writes a backend without options as its bare URL.
+func (bc BackendConfig) MarshalJSON() ([]byte, error) {
+	if !bc.hasOptions() {
+		return json.Marshal(bc.URL)
+	}
+	type plain BackendConfig
+	return json.Marshal(plain(bc))
+}
+
+func (bc BackendConfig) hasOptions() bool {
+	return !reflect.DeepEqual(bc, BackendConfig{URL: bc.URL})
+}
+
+// backendURLs returns the URLs of backends, in order.
+func backendURLs(backends []BackendConfig) []string {
+	urls := make([]string, len(backends))
+	for i, bc := range backends {
+		urls[i] = bc.URL
+	}
+	return urls
+}
+
+// BackendConfigs returns each backend's options by URL. A backend listed
+// in several pools may have its options in just one entry; entries that
+// both set options must agree.
+func (c *Config) BackendConfigs() (map[string]BackendConfig, error) {
+	configs := make(map[string]BackendConfig)
+	where := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(c.Pools)) {
+		for _, bc := range c.Pools[name].Backends {
+			prev, seen := configs[bc.URL]
+			switch {
+			case !seen || !prev.hasOptions():
+				configs[bc.URL] = bc
+				where[bc.URL] = name
+			case bc.hasOptions() && !reflect.DeepEqual(prev, bc):
+				return nil, fmt.Errorf("backend %s has different options in pools %s and %s", bc.URL, where[bc.URL], name)
+			}
+		}
+	}
+	return configs, nil
+}
+
+// backendOptions is what a Backend keeps of its BackendConfig.
+type backendOptions struct {
+	zone           string
+	healthPath     string
+	healthDisabled bool
+	tls            *tls.Config // nil: the shared upstream transport's
+}
+
+func newBackendOptions(bc BackendConfig) (backendOptions, error) {
+	opts := backendOptions{zone: bc.Zone}
+	if hc := bc.HealthCheck; hc != nil {
+		if hc.Path != "" && hc.Path[0] != '/' {
+			return opts, fmt.Errorf("health_check: path %q must start with /", hc.Path)
+		}
+		opts.healthPath, opts.healthDisabled = hc.Path, hc.Disabled
+	}
+	if bc.MaxConnections < 0 {
+		return opts, fmt.Errorf("max_connections must not be negative")
+	}
+	if isDNSBackend(bc.URL) && (bc.MaxConnections != 0 || bc.RateLimit != nil) {
+		return opts, fmt.Errorf("max_connections and rate_limit apply to one backend, not to a dns+ name")
+	}
+	if bc.Weight != nil && *bc.Weight < 0 {
+		return opts, fmt.Errorf("weight must not be negative")
+	}
+	if bc.TLS != nil {
+		tc, err := backendTLS(bc.TLS)
+		if err != nil {
+			return opts, fmt.Errorf("tls: %w", err)
+		}
+		opts.tls = tc
+	}
+	return opts, nil
+}
+
+func backendTLS(cfg *BackendTLSConfig) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CAFile)
+		}
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file go together")
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// configure gives b the weight and options of bc, which
+// newBackendOptions has checked.
+func (b *Backend) configure(bc BackendConfig, opts backendOptions) {
+	weight := 1
+	if bc.Weight != nil {
+		weight = *bc.Weight
+	}
+	b.SetWeight(weight)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Zone = opts.zone
+	for _, t := range b.transports {
+		t.CloseIdleConnections()
+	}
+	b.transports = nil
+	b.proxies = nil
+	b.opts = opts
+}
+
+// upstreamTransport returns the transport for requests to b through base
+// (shared or its pool's): base itself, unless b has TLS settings of its
+// own, in which case a clone of base carrying them.
+func (b *Backend) upstreamTransport(base *http.Transport) *http.Transport {
+	b.mu.RLock()
+	t, tc := b.transports[base], b.opts.tls
+	b.mu.RUnlock()
+	if tc == nil {
+		return base
+	}
+	if t != nil {
+		return t
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.transports[base] == nil {
+		t := base.Clone()
+		t.TLSClientConfig = tc.Clone()
+		if b.transports == nil {
+			b.transports = make(map[*http.Transport]*http.Transport)
+		}
+		b.transports[base] = t
+	}
+	return b.transports[base]
+}
+
+func (b *Backend) tlsConfig() *tls.Config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.opts.tls
+}
+
+// healthTarget returns where to probe b, and false if b isn't probed.
+func (b *Backend) healthTarget() (string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.opts.healthDisabled {
+		return "", false
+	}
+	target := wireURL(b.URL)
+	if b.opts.healthPath != "" {
+		u := *target
+		u.Path, u.RawPath, u.RawQuery = b.opts.healthPath, "", ""
+		target = &u
+	}
+	return target.String(), true
+}
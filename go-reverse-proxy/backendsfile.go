@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== BACKENDS FILE ====================
+// A pool with backends_file also serves the backends listed in that file,
+// one per line as a URL and an optional weight:
+//
+//	# generated by inventory-sync
+//	http://10.0.4.1:8080 3
+//	http://10.0.4.2:8080
+//
+// The file is checked every few seconds and the pool follows its changes.
+// A file that can't be read or parsed is logged and the last list kept,
+// so a generator writing it in place never empties the pool.
+
+// backendsFileInterval is how often the files are checked.
+const backendsFileInterval = 2 * time.Second
+
+// readBackendsFile parses a backends file.
+func readBackendsFile(path string) ([]BackendConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []BackendConfig
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: want a URL and an optional weight", path, n)
+		}
+		bc := BackendConfig{URL: fields[0]}
+		if len(fields) == 2 {
+			weight, err := strconv.Atoi(fields[1])
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("%s:%d: weight %q is not a non-negative number", path, n, fields[1])
+			}
+			bc.Weight = &weight
+		}
+		if isDNSBackend(bc.URL) {
+			return nil, fmt.Errorf("%s:%d: dns+ backends belong in the config file", path, n)
+		}
+		if _, err := newBackend(bc.URL); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if seen[bc.URL] {
+			return nil, fmt.Errorf("%s:%d: %s is listed twice", path, n, bc.URL)
+		}
+		seen[bc.URL] = true
+		list = append(list, bc)
+	}
+	return list, scanner.Err()
+}
+
+// checkBackendsFiles reads the backends file of every pool of cfg.
+func checkBackendsFiles(cfg *Config) error {
+	for _, name := range slices.Sorted(maps.Keys(cfg.Pools)) {
+		if path := cfg.Pools[name].BackendsFile; path != "" {
+			if _, err := readBackendsFile(path); err != nil {
+				return fmt.Errorf("pool %s: backends_file: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// backendsFile is a watched file and what it last listed.
+type backendsFile struct {
+	digest     [sha256.Size]byte // of the contents last read, valid or not
+	backends   []BackendConfig
+	unreadable bool
+}
+
+// FileProvider is the provider of the backends listed in backends files.
+type FileProvider struct {
+	updates
+
+	mu    sync.Mutex
+	pools map[string]string        // pool -> file
+	files map[string]*backendsFile // by path
+	stop  chan struct{}
+}
+
+func NewFileProvider() *FileProvider {
+	return &FileProvider{
+		updates: make(updates),
+		pools:   make(map[string]string),
+		files:   make(map[string]*backendsFile),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (p *FileProvider) Name() string { return ProviderFile }
+
+// Start checks the files every backendsFileInterval until Stop.
+func (p *FileProvider) Start() {
+	go func() {
+		ticker := time.NewTicker(backendsFileInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				p.refresh(false)
+				p.mu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *FileProvider) Stop() {
+	close(p.stop)
+}
+
+// Sync takes the backends files of cfg, reads them and returns what
+// changed in the pools. Pools that no longer name a file lose its
+// backends.
+func (p *FileProvider) Sync(cfg *Config) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pools := make(map[string]string)
+	files := make(map[string]*backendsFile)
+	for name, pc := range cfg.Pools {
+		if pc.BackendsFile == "" {
+			continue
+		}
+		pools[name] = pc.BackendsFile
+		files[pc.BackendsFile] = cmp.Or(p.files[pc.BackendsFile], &backendsFile{})
+	}
+	dropped := slices.Collect(maps.Keys(p.pools))
+	p.pools, p.files = pools, files
+	return p.refresh(true, dropped...)
+}
+
+// refresh reads the files that changed and sends their pools, or every
+// pool when all is set, plus the pools in also; p.mu must be held.
+func (p *FileProvider) refresh(all bool, also ...string) []string {
+	changed := make(map[string]bool)
+	for path, f := range p.files {
+		digest, ok := fileDigest(path)
+		if !ok {
+			if !f.unreadable {
+				log.Printf("Backends file: %s can't be read; keeping its last backends", path)
+			}
+			f.unreadable = true
+			continue
+		}
+		f.unreadable = false
+		if digest == f.digest {
+			continue
+		}
+		f.digest = digest
+		backends, err := readBackendsFile(path)
+		if err != nil {
+			log.Printf("Backends file: %v; keeping the last backends", err)
+			continue
+		}
+		f.backends = backends
+		changed[path] = true
+	}
+
+	var list []PoolUpdate
+	for _, pool := range slices.Sorted(maps.Keys(p.pools)) {
+		if path := p.pools[pool]; all || changed[path] {
+			list = append(list, PoolUpdate{Pool: pool, Backends: slices.Clone(p.files[path].backends)})
+		}
+	}
+	for _, pool := range also {
+		if _, ok := p.pools[pool]; !ok {
+			list = append(list, PoolUpdate{Pool: pool, Backends: []BackendConfig{}})
+		}
+	}
+	changes := p.send(list...)
+	for _, c := range changes {
+		log.Printf("Backends file: %s", c)
+	}
+	return changes
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+)
+
+// ==================== BACKEND STATISTICS ====================
+// BackendStats keeps a rolling window of one backend's recent traffic:
+// request and error counts plus a latency histogram per second. Latency is
+// the time until response headers arrive; errors are transport failures and
+// 5xx responses.
+type BackendStats struct {
+	mu      sync.Mutex
+	buckets [statsWindow]statsBucket
+}
+
+// statsWindow is the number of one-second buckets kept.
+const statsWindow = 60
+
+type statsBucket struct {
+	second   int64 // unix time this bucket holds, stale if outside the window
+	requests uint32
+	errors   uint32
+	latency  [len(latencyBounds) + 1]uint32 // the last slot is > the last bound
+}
+
+// latencyBounds are histogram bucket upper bounds in milliseconds, growing
+// by 20% from 1ms to about a minute, so percentiles are within 20%.
+var latencyBounds = func() [61]float64 {
+	var bounds [61]float64
+	for i := range bounds {
+		bounds[i] = math.Pow(1.2, float64(i))
+	}
+	return bounds
+}()
+
+func NewBackendStats() *BackendStats {
+	return &BackendStats{}
+}
+
+// bucket returns the bucket for now, clearing it if it held an older second.
+func (s *BackendStats) bucket(now time.Time) *statsBucket {
+	sec := now.Unix()
+	b := &s.buckets[sec%statsWindow]
+	if b.second != sec {
+		*b = statsBucket{second: sec}
+	}
+	return b
+}
+
+// ObserveResponse records a response that arrived after d.
+func (s *BackendStats) ObserveResponse(d time.Duration, status int) {
+	ms := float64(d) / float64(time.Millisecond)
+	i := len(latencyBounds)
+	for j, bound := range latencyBounds {
+		if ms <= bound {
+			i = j
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.bucket(time.Now())
+	b.requests++
+	b.latency[i]++
+	if status >= 500 {
+		b.errors++
+	}
+}
+
+// ObserveError records a request that got no response.
+func (s *BackendStats) ObserveError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.bucket(time.Now())
+	b.requests++
+	b.errors++
+}
+
+type BackendStatsSnapshot struct {
+	WindowSeconds int     `json:"window_seconds"`
+	Requests      uint64  `json:"requests"`
+	Errors        uint64  `json:"errors"`
+	ErrorRate     float64 `json:"error_rate"`
+	RPS           float64 `json:"rps"`
+	P50Ms         float64 `json:"p50_ms"`
+	P95Ms         float64 `json:"p95_ms"`
+	P99Ms         float64 `json:"p99_ms"`
+}
+
+// Snapshot sums the buckets of the last statsWindow seconds.
+func (s *BackendStats) Snapshot() BackendStatsSnapshot {
+	var latency [len(latencyBounds) + 1]uint64
+	snap := BackendStatsSnapshot{WindowSeconds: statsWindow}
+	now := time.Now().Unix()
+
+	s.mu.Lock()
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		if now-b.second >= statsWindow {
+			continue
+		}
+		snap.Requests += uint64(b.requests)
+		snap.Errors += uint64(b.errors)
+		for j, n := range b.latency {
+			latency[j] += uint64(n)
+		}
+	}
+	s.mu.Unlock()
+
+	if snap.Requests > 0 {
+		snap.ErrorRate = math.Round(float64(snap.Errors)/float64(snap.Requests)*1000) / 1000
+	}
+	snap.RPS = math.Round(float64(snap.Requests)/statsWindow*100) / 100
+	snap.P50Ms = percentile(latency[:], 0.50)
+	snap.P95Ms = percentile(latency[:], 0.95)
+	snap.P99Ms = percentile(latency[:], 0.99)
+	return snap
+}
+
+// percentile returns the upper bound of the bucket holding quantile q,
+// 0 without samples.
+func percentile(counts []uint64, q float64) float64 {
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, n := range counts {
+		seen += n
+		if seen >= rank {
+			if i == len(latencyBounds) {
+				i-- // beyond the histogram; report its top
+			}
+			return math.Round(latencyBounds[i]*100) / 100
+		}
+	}
+	return 0
+}
+
+func (s *BackendStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Snapshot())
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ==================== BODY LOGGING & REDACTION ====================
+type BodyLogConfig struct {
+	Enabled  bool `json:"enabled"`
+	MaxBytes int  `json:"max_bytes"`
+
+	// Redact applies RedactFields and RedactPatterns before a body reaches
+	// the log. SensitivePaths are redacted even when Redact is false.
+	Redact         bool     `json:"redact"`
+	RedactFields   []string `json:"redact_fields"`
+	RedactPatterns []string `json:"redact_patterns"`
+	SensitivePaths []string `json:"sensitive_paths"`
+}
+
+func defaultBodyLogConfig() BodyLogConfig {
+	return BodyLogConfig{
+		MaxBytes: 4096,
+		Redact:   true,
+		RedactFields: []string{
+			"password", "passwd", "secret", "token", "access_token", "refresh_token",
+			"api_key", "authorization", "card_number", "cvv", "ssn",
+		},
+		RedactPatterns: []string{
+			`\b(?:\d[ -]?){12,18}\d\b`,                       // card numbers
+			`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`, // email addresses
+		},
+		SensitivePaths: []string{"/login*", "/auth*", "/oauth*", "/payment*", "/checkout*", "/account*"},
+	}
+}
+
+const redacted = "[REDACTED]"
+
+// BodyLogger captures up to MaxBytes of request/response bodies while they
+// stream through and logs them redacted according to their content type.
+type BodyLogger struct {
+	maxBytes  int
+	redact    bool
+	fields    map[string]bool
+	jsonField *regexp.Regexp
+	patterns  []*regexp.Regexp
+	sensitive *PathMatcher
+}
+
+func NewBodyLogger(cfg BodyLogConfig) (*BodyLogger, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	b := &BodyLogger{
+		maxBytes:  cfg.MaxBytes,
+		redact:    cfg.Redact,
+		fields:    make(map[string]bool),
+		sensitive: NewPathMatcher(cfg.SensitivePaths),
+	}
+	if b.maxBytes <= 0 {
+		b.maxBytes = 4096
+	}
+
+	var quoted []string
+	for _, f := range cfg.RedactFields {
+		b.fields[strings.ToLower(f)] = true
+		quoted = append(quoted, regexp.QuoteMeta(f))
+	}
+	if len(quoted) > 0 {
+		// Works on truncated JSON too, where a real decode would fail
+		b.jsonField = regexp.MustCompile(`(?i)("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]+)`)
+	}
+	for _, p := range cfg.RedactPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %w", p, err)
+		}
+		b.patterns = append(b.patterns, re)
+	}
+	return b, nil
+}
+
+// Redact renders a captured body for the log. Binary content is never logged.
+func (b *BodyLogger) Redact(path, contentType string, body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !isTextual(mediaType) {
+		return fmt.Sprintf("[%d bytes of %s omitted]", len(body), orUnknown(mediaType))
+	}
+
+	text := string(body)
+	if !b.redact && !b.sensitive.Match(path) {
+		return text
+	}
+
+	switch {
+	case strings.HasSuffix(mediaType, "json"):
+		if b.jsonField != nil {
+			text = b.jsonField.ReplaceAllString(text, `${1}"`+redacted+`"`)
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(text); err == nil {
+			for key := range values {
+				if b.fields[strings.ToLower(key)] {
+					values[key] = []string{redacted}
+				}
+			}
+			text = values.Encode()
+		}
+	}
+	for _, re := range b.patterns {
+		text = re.ReplaceAllString(text, redacted)
+	}
+	return text
+}
+
+func isTextual(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml") ||
+		mediaType == "application/x-www-form-urlencoded" ||
+		mediaType == "application/javascript"
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown type"
+	}
+	return s
+}
+
+// Capture wraps body so its first maxBytes are recorded while it streams;
+// the redacted result is logged under label once the body is closed.
+func (b *BodyLogger) Capture(body io.ReadCloser, label, path, contentType string) io.ReadCloser {
+	if body == nil {
+		return body
+	}
+	return &bodyCapture{ReadCloser: body, limit: b.maxBytes, onClose: func(c *bodyCapture) {
+		if c.total == 0 {
+			return
+		}
+		suffix := ""
+		if c.total > int64(c.buf.Len()) {
+			suffix = fmt.Sprintf(" [truncated, %d bytes total]", c.total)
+		}
+		log.Printf("DEBUG %s (%s, %d bytes): %s%s", label, orUnknown(contentType), c.total,
+			b.Redact(path, contentType, c.buf.Bytes()), suffix)
+	}}
+}
+
+type bodyCapture struct {
+	io.ReadCloser
+	buf     bytes.Buffer
+	limit   int
+	total   int64
+	onClose func(*bodyCapture)
+	once    sync.Once
+}
+
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if room := c.limit - c.buf.Len(); room > 0 {
+		c.buf.Write(p[:min(n, room)])
+	}
+	c.total += int64(n)
+	return n, err
+}
+
+func (c *bodyCapture) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() { c.onClose(c) })
+	return err
+}
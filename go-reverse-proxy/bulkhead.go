@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ==================== BULKHEADS ====================
+// BulkheadConfig caps the requests in flight to each backend, so a burst
+// can't drown a single server. A full backend is passed over for the next
+// one; when all are full, requests queue for up to MaxWait and then get a
+// 503. A backend's max_connections replaces MaxInFlight for it, and works
+// without a bulkhead section.
+type BulkheadConfig struct {
+	MaxInFlight int      `json:"max_in_flight"`      // per backend; 0 = unlimited
+	MaxWait     Duration `json:"max_wait,omitempty"` // 0 fails at once when all are full
+}
+
+// Bulkheads counts in-flight requests per backend URL. A nil *Bulkheads
+// admits everything.
+type Bulkheads struct {
+	max     int
+	maxWait time.Duration
+
+	mu       sync.Mutex
+	backends map[string]int // max_connections by URL
+	inFlight map[string]int
+	freed    chan struct{} // closed and replaced whenever a slot frees up
+}
+
+// NewBulkheads returns nil when neither cfg nor any backend's
+// max_connections limits anything.
+func NewBulkheads(cfg *BulkheadConfig, backends map[string]BackendConfig) (*Bulkheads, error) {
+	limits := backendConnLimits(backends)
+	if cfg == nil && len(limits) == 0 {
+		return nil, nil
+	}
+	b := &Bulkheads{
+		backends: limits,
+		inFlight: make(map[string]int),
+		freed:    make(chan struct{}),
+	}
+	if cfg != nil {
+		if cfg.MaxInFlight < 0 {
+			return nil, fmt.Errorf("bulkhead: max_in_flight must not be negative")
+		}
+		b.max, b.maxWait = cfg.MaxInFlight, cfg.MaxWait.Std()
+	}
+	return b, nil
+}
+
+func backendConnLimits(backends map[string]BackendConfig) map[string]int {
+	limits := make(map[string]int)
+	for u, bc := range backends {
+		if bc.MaxConnections > 0 {
+			limits[u] = bc.MaxConnections
+		}
+	}
+	return limits
+}
+
+// SetBackendLimits replaces the max_connections limits, e.g. on reload.
+func (b *Bulkheads) SetBackendLimits(backends map[string]BackendConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.backends = backendConnLimits(backends)
+}
+
+// limit must be called with b.mu held.
+func (b *Bulkheads) limit(backendURL string) int {
+	if n, ok := b.backends[backendURL]; ok {
+		return n
+	}
+	return b.max
+}
+
+// tryAcquire takes a slot for backendURL if one is free.
+func (b *Bulkheads) tryAcquire(backendURL string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if limit := b.limit(backendURL); limit > 0 && b.inFlight[backendURL] >= limit {
+		return false
+	}
+	b.inFlight[backendURL]++
+	return true
+}
+
+func (b *Bulkheads) release(backendURL string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.inFlight[backendURL]--; b.inFlight[backendURL] <= 0 {
+		delete(b.inFlight, backendURL)
+	}
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// waitFreed is closed by the next release. Take it before trying to
+// acquire so a release in between isn't missed.
+func (b *Bulkheads) waitFreed() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.freed
+}
+
+// pickBackend selects a live backend of pool that is under its rate cap
+// and in-flight limit and takes a slot on it, which the caller must
+// release. It returns nil when none is available: with the time until a
+// capped backend frees up, or busy when all were at their limit. key and
+// skip are passed on to ServerPool.NextPeer.
+func (h *ProxyHandler) pickBackend(ctx context.Context, pool *ServerPool, key string, skip int) (backend *Backend, wait time.Duration, busy bool) {
+	var deadline <-chan time.Time
+	for {
+		var freed <-chan struct{}
+		if h.bulkheads != nil {
+			freed = h.bulkheads.waitFreed()
+		}
+		backend, wait, busy = h.tryBackends(pool, key, skip)
+		if backend != nil || !busy || h.bulkheads.maxWait <= 0 {
+			return backend, wait, busy
+		}
+
+		// Every backend is full: queue until a slot frees up
+		if deadline == nil {
+			t := time.NewTimer(h.bulkheads.maxWait)
+			defer t.Stop()
+			deadline = t.C
+		}
+		select {
+		case <-freed:
+		case <-deadline:
+			return nil, wait, true
+		case <-ctx.Done():
+			return nil, wait, true
+		}
+	}
+}
+
+// tryBackends makes one pass over the pool's live backends.
+func (h *ProxyHandler) tryBackends(pool *ServerPool, key string, skip int) (*Backend, time.Duration, bool) {
+	var (
+		wait time.Duration
+		busy bool
+	)
+	for i := range max(len(pool.GetBackends()), 1) {
+		b := pool.NextPeer(key, skip+i)
+		if b == nil {
+			return nil, 0, false
+		}
+		url := b.URL.String()
+		if !h.bulkheads.tryAcquire(url) {
+			busy = true
+			continue
+		}
+		ok, d := h.limits.allowBackend(url)
+		if ok {
+			return b, 0, false
+		}
+		h.bulkheads.release(url)
+		if wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return nil, wait, busy
+}
+
+// bulkheadRetryAfter is suggested to clients turned away by full backends.
+const bulkheadRetryAfter = "1"
+
+func (h *ProxyHandler) writeBackendsBusy(w http.ResponseWriter, r *http.Request, grpc bool) {
+	w.Header().Set("Retry-After", bulkheadRetryAfter)
+	if grpc {
+		writeGRPCError(w, grpcResourceExhausted, "all backends busy")
+		return
+	}
+	h.httpError(w, r, "Service Unavailable - all backends busy", http.StatusServiceUnavailable)
+}
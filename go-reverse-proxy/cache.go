@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== RESPONSE CACHE ====================
+// CacheConfig keeps GET responses in memory. Freshness comes from the
+// backend's Cache-Control (s-maxage, max-age) or Expires; responses without
+// it are only cached on routes with a cache_ttl. HEAD requests are answered
+// from cached GETs.
+type CacheConfig struct {
+	Enabled       bool `json:"enabled"`
+	MaxBytes      int  `json:"max_bytes"`       // whole cache, default 64 MiB
+	MaxEntryBytes int  `json:"max_entry_bytes"` // larger bodies pass uncached, default 1 MiB
+
+	// StaleWhileRevalidate, when set, keeps serving an expired entry for
+	// this long while one background request refreshes it. A backend's
+	// stale-while-revalidate=N directive replaces the window per response.
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate,omitempty"`
+}
+
+// revalidateTimeout bounds a background refresh, which has no client
+// waiting on it to cancel it.
+const revalidateTimeout = 30 * time.Second
+
+func defaultCacheConfig() CacheConfig {
+	return CacheConfig{MaxBytes: 64 << 20, MaxEntryBytes: 1 << 20}
+}
+
+// cacheableStatus are the codes RFC 9111 lets a cache store by default.
+var cacheableStatus = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+type cacheEntry struct {
+	key       string
+	host, uri string // for purging
+	status    int
+	header    http.Header
+	body      []byte
+	storedAt  time.Time
+	ttl       time.Duration
+	stale     time.Duration // served stale for this long after ttl
+	size      int
+}
+
+func (e *cacheEntry) age() time.Duration { return time.Since(e.storedAt) }
+func (e *cacheEntry) fresh() bool        { return e.age() < e.ttl }
+func (e *cacheEntry) usable() bool       { return e.age() < e.ttl+e.stale }
+
+// ResponseCache is an LRU of responses bounded by total body+header bytes.
+type ResponseCache struct {
+	maxBytes      int
+	maxEntryBytes int
+	staleWindow   time.Duration
+
+	mu           sync.Mutex
+	lru          *list.List               // front = most recently used
+	entries      map[string]*list.Element // full key -> element holding *cacheEntry
+	vary         map[string][]string      // primary key -> Vary header names
+	bytes        int
+	revalidating map[string]bool          // full keys with a refresh in flight
+	fetching     map[string]chan struct{} // coalesced misses, closed when fetched
+
+	hits, misses, stale, stores, evictions, purges, coalesced atomic.Int64
+}
+
+func NewResponseCache(cfg CacheConfig) *ResponseCache {
+	if !cfg.Enabled {
+		return nil
+	}
+	c := &ResponseCache{
+		maxBytes:      cfg.MaxBytes,
+		maxEntryBytes: cfg.MaxEntryBytes,
+		staleWindow:   cfg.StaleWhileRevalidate.Std(),
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+		vary:          make(map[string][]string),
+		revalidating:  make(map[string]bool),
+		fetching:      make(map[string]chan struct{}),
+	}
+	if c.maxBytes <= 0 {
+		c.maxBytes = 64 << 20
+	}
+	if c.maxEntryBytes <= 0 || c.maxEntryBytes > c.maxBytes {
+		c.maxEntryBytes = min(1<<20, c.maxBytes)
+	}
+	return c
+}
+
+func primaryKey(r *http.Request) string {
+	return "GET " + strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+// fullKey adds the request's values of the Vary headers to the primary key.
+func fullKey(primary string, names []string, r *http.Request) string {
+	if len(names) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range names {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// get returns the entry for r, fresh or still within its stale window.
+func (c *ResponseCache) get(r *http.Request) *cacheEntry {
+	primary := primaryKey(r)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[fullKey(primary, c.vary[primary], r)]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	if !entry.usable() {
+		c.removeLocked(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return entry
+}
+
+// startRevalidate claims the refresh of key; only one runs at a time.
+func (c *ResponseCache) startRevalidate(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.revalidating[key] {
+		return false
+	}
+	c.revalidating[key] = true
+	return true
+}
+
+func (c *ResponseCache) endRevalidate(key string) {
+	c.mu.Lock()
+	delete(c.revalidating, key)
+	c.mu.Unlock()
+}
+
+// joinFetch returns the key r's miss is coalesced under and the channel
+// closed once it has been fetched, which leader must then do.
+func (c *ResponseCache) joinFetch(r *http.Request) (key string, done chan struct{}, leader bool) {
+	primary := primaryKey(r)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key = fullKey(primary, c.vary[primary], r)
+	if done, ok := c.fetching[key]; ok {
+		return key, done, false
+	}
+	done = make(chan struct{})
+	c.fetching[key] = done
+	return key, done, true
+}
+
+func (c *ResponseCache) endFetch(key string, done chan struct{}) {
+	c.mu.Lock()
+	delete(c.fetching, key)
+	c.mu.Unlock()
+	close(done)
+}
+
+func (c *ResponseCache) put(r *http.Request, entry *cacheEntry) {
+	primary := primaryKey(r)
+	names := varyNames(entry.header)
+	entry.key = fullKey(primary, names, r)
+	entry.host, entry.uri = strings.ToLower(r.Host), r.URL.RequestURI()
+	entry.size = len(entry.body) + len(entry.key)
+	for k, v := range entry.header {
+		entry.size += len(k) + len(strings.Join(v, ""))
+	}
+	if entry.size > c.maxEntryBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vary[primary] = names
+	if el, ok := c.entries[entry.key]; ok {
+		c.removeLocked(el)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.size
+	c.stores.Add(1)
+	for c.bytes > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *ResponseCache) removeLocked(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+// Purge drops the entries for target, either an absolute URL or a path
+// that matches on every host; with prefix, every URL starting with target.
+// All Vary variants of a URL go together. It returns how many were removed.
+func (c *ResponseCache) Purge(target string, prefix bool) (int, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Host == "" && !strings.HasPrefix(target, "/")) {
+		return 0, fmt.Errorf("invalid URL %q: want http://host/path or /path", target)
+	}
+	host, uri := strings.ToLower(u.Host), u.RequestURI()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		entry := el.Value.(*cacheEntry)
+		matched := entry.uri == uri || prefix && strings.HasPrefix(entry.uri, uri)
+		if matched && (host == "" || entry.host == host) {
+			c.removeLocked(el)
+			delete(c.vary, "GET "+entry.host+entry.uri)
+			removed++
+		}
+		el = next
+	}
+	c.purges.Add(int64(removed))
+	return removed, nil
+}
+
+// Stats is reported under "cache" by GET /status.
+func (c *ResponseCache) Stats() map[string]interface{} {
+	c.mu.Lock()
+	entries, bytes := len(c.entries), c.bytes
+	c.mu.Unlock()
+
+	hits, misses := c.hits.Load(), c.misses.Load()
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	return map[string]interface{}{
+		"hits":      hits,
+		"misses":    misses,
+		"hit_ratio": ratio,
+		"stale":     c.stale.Load(),
+		"stores":    c.stores.Load(),
+		"evictions": c.evictions.Load(),
+		"purged":    c.purges.Load(),
+		"coalesced": c.coalesced.Load(),
+		"entries":   entries,
+		"bytes":     bytes,
+		"max_bytes": c.maxBytes,
+	}
+}
+
+// cacheControl parses a Cache-Control header into directive -> value.
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// authenticated reports whether r carries credentials or was authenticated
+// at the proxy (basic auth, API key), so its response may be the user's own.
+func authenticated(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get(authUserHeader) != ""
+}
+
+// freshness is how long resp may be served from cache; 0 means not at all.
+// routeTTL, when set, replaces the backend's lifetime but never overrides
+// no-store or private.
+func freshness(r *http.Request, status int, h http.Header, routeTTL *time.Duration) time.Duration {
+	if !slices.Contains(cacheableStatus, status) || h.Get("Set-Cookie") != "" {
+		return 0
+	}
+	cc := cacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return 0
+	}
+	if _, ok := cc["private"]; ok {
+		return 0
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if slices.Contains(varyNames(h), "*") {
+		return 0
+	}
+	_, public := cc["public"]
+	_, shared := cc["s-maxage"]
+	if authenticated(r) && !public && !shared {
+		return 0
+	}
+
+	if routeTTL != nil {
+		return *routeTTL
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs <= 0 {
+				return 0
+			}
+			return time.Duration(secs) * time.Second
+		}
+	}
+	if exp := h.Get("Expires"); exp != "" {
+		expires, err := http.ParseTime(exp)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return max(expires.Sub(date), 0)
+	}
+	return 0
+}
+
+// staleWindow is how long past its lifetime a response may be served while
+// it is refreshed: the backend's stale-while-revalidate, else def. It stays
+// 0 when the mode is off (def == 0) or the backend demands revalidation.
+func staleWindow(h http.Header, def time.Duration) time.Duration {
+	if def <= 0 {
+		return 0
+	}
+	cc := cacheControl(h)
+	for _, directive := range []string{"must-revalidate", "proxy-revalidate"} {
+		if _, ok := cc[directive]; ok {
+			return 0
+		}
+	}
+	if v, ok := cc["stale-while-revalidate"]; ok {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	return def
+}
+
+// cacheWriter passes the response through while keeping a copy of it, up
+// to maxEntryBytes, for the cache.
+type cacheWriter struct {
+	http.ResponseWriter
+	limit       int
+	status      int
+	buf         bytes.Buffer
+	overflow    bool
+	wroteHeader bool
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		cw.status = code
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.overflow {
+		if cw.buf.Len()+len(b) > cw.limit {
+			cw.overflow = true
+			cw.buf = bytes.Buffer{}
+		} else {
+			cw.buf.Write(b)
+		}
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *cacheWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// discardWriter is the client of a background refresh.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+// serveCached answers from entry; result is the X-Cache value, HIT or STALE.
+func serveCached(w http.ResponseWriter, r *http.Request, entry *cacheEntry, result string) {
+	h := w.Header()
+	for k, v := range entry.header {
+		h[k] = slices.Clone(v) // later Header().Add calls must not touch the entry
+	}
+	h.Set("Age", strconv.Itoa(int(entry.age().Seconds())))
+	h.Set("X-Cache", result)
+	w.WriteHeader(entry.status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.body)
+	}
+}
+
+// bypassCache reports requests the cache must not answer.
+func bypassCache(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return true
+	}
+	if r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+		return true
+	}
+	cc := cacheControl(r.Header)
+	_, noStore := cc["no-store"]
+	return noStore
+}
+
+// fetch runs r through next and stores the response if it is cacheable.
+func (c *ResponseCache) fetch(next http.Handler, w http.ResponseWriter, r *http.Request, routeTTL *time.Duration) {
+	cw := &cacheWriter{ResponseWriter: w, limit: c.maxEntryBytes}
+	next.ServeHTTP(cw, r)
+	if cw.overflow || !cw.wroteHeader {
+		return
+	}
+
+	header := w.Header().Clone()
+	header.Del("X-Cache")
+	header.Del(requestIDHeader)
+	for _, name := range rateLimitHeaders {
+		header.Del(name)
+	}
+	if ttl := freshness(r, cw.status, header, routeTTL); ttl > 0 {
+		c.put(r, &cacheEntry{
+			status:   cw.status,
+			header:   header,
+			body:     bytes.Clone(cw.buf.Bytes()),
+			storedAt: time.Now(),
+			ttl:      ttl,
+			stale:    staleWindow(header, c.staleWindow),
+		})
+	}
+}
+
+// revalidate refreshes a stale entry in the background. r is detached from
+// the client, who has already been answered, and reports its backend into
+// requestMetrics of its own: the client's are read as its request ends.
+func (c *ResponseCache) revalidate(next http.Handler, r *http.Request, routeTTL *time.Duration, key string) {
+	defer c.endRevalidate(key)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), revalidateTimeout)
+	defer cancel()
+	r, _ = withRequestMetrics(r.WithContext(ctx))
+	c.fetch(next, &discardWriter{header: make(http.Header)}, r, routeTTL)
+}
+
+// cacheMiddleware serves fresh entries and stores cacheable GET responses.
+func cacheMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	c := h.cache
+	if c == nil {
+		return nil, nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if bypassCache(r) || h.isGRPC(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var routeTTL *time.Duration
+			coalesce := false
+			if route := h.route(r); route != nil {
+				routeTTL, coalesce = route.cacheTTL, route.coalesce
+			}
+			if routeTTL != nil && *routeTTL <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// no-cache asks for a fresh answer, which may still be stored
+			_, revalidate := cacheControl(r.Header)["no-cache"]
+			if !revalidate {
+				if entry := c.get(r); entry != nil {
+					if entry.fresh() {
+						c.hits.Add(1)
+						serveCached(w, r, entry, "HIT")
+						return
+					}
+					c.stale.Add(1)
+					if c.startRevalidate(entry.key) {
+						req := r.Clone(r.Context())
+						req.Method, req.Body, req.ContentLength = http.MethodGet, http.NoBody, 0
+						go c.revalidate(next, req, routeTTL, entry.key)
+					}
+					serveCached(w, r, entry, "STALE")
+					return
+				}
+			}
+			c.misses.Add(1)
+			w.Header().Set("X-Cache", "MISS")
+
+			if r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if coalesce && !revalidate {
+				c.fetchCoalesced(next, w, r, routeTTL)
+				return
+			}
+			c.fetch(next, w, r, routeTTL)
+		})
+	}, nil
+}
+
+// fetchCoalesced fetches r unless the same miss is already being fetched,
+// in which case it waits for that and serves what was stored. When nothing
+// was (the response wasn't cacheable, or differs by Vary), it fetches
+// after all.
+func (c *ResponseCache) fetchCoalesced(next http.Handler, w http.ResponseWriter, r *http.Request, routeTTL *time.Duration) {
+	key, done, leader := c.joinFetch(r)
+	if leader {
+		defer c.endFetch(key, done)
+		c.fetch(next, w, r, routeTTL)
+		return
+	}
+
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		return // the client is gone
+	}
+	if entry := c.get(r); entry != nil {
+		c.coalesced.Add(1)
+		serveCached(w, r, entry, "COALESCED")
+		return
+	}
+	c.fetch(next, w, r, routeTTL)
+}
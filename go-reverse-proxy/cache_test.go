@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestCacheStaleRevalidate serves a stale entry several times in a row, so
+// a background refresh runs alongside the requests answered from cache; it
+// is meant for go test -race.
+func TestCacheStaleRevalidate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=60")
+		io.WriteString(w, "cached")
+	}))
+	defer backend.Close()
+	cfg := testConfig(backend.URL)
+	cfg.Cache.Enabled = true
+	cfg.Cache.StaleWhileRevalidate = Duration(time.Minute)
+	_, proxy := newTestProxy(t, cfg)
+
+	get := func() string {
+		resp, err := http.Get(proxy.URL + "/stale")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.Header.Get("X-Cache")
+	}
+	get() // fill the cache
+
+	stale := 0
+	for range 2 {
+		time.Sleep(1100 * time.Millisecond) // past max-age
+		for range 5 {
+			if get() == "STALE" {
+				stale++
+			}
+		}
+	}
+	if stale == 0 {
+		t.Error("no response was served stale")
+	}
+}
+
+func TestCacheKeepsAuthenticatedResponsesPrivate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := "max-age=60"
+		if r.URL.Path == "/keys/public" {
+			cc = "public, max-age=60"
+		}
+		w.Header().Set("Cache-Control", cc)
+		io.WriteString(w, r.Header.Get(authUserHeader))
+	}))
+	defer backend.Close()
+	cfg := testConfig(backend.URL)
+	cfg.Cache.Enabled = true
+	cfg.Routes = []RouteConfig{{
+		Prefix: "/keys/",
+		Pool:   "default",
+		APIKey: &APIKeyConfig{Keys: map[string]string{"alice": "alice-key", "bob": "bob-key"}},
+	}}
+	_, proxy := newTestProxy(t, cfg)
+
+	get := func(path, key string) (body, cache string) {
+		req, err := http.NewRequest("GET", proxy.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return string(data), resp.Header.Get("X-Cache")
+	}
+
+	get("/keys/mine", "alice-key")
+	if body, cache := get("/keys/mine", "bob-key"); body != "bob" || cache != "MISS" {
+		t.Errorf("bob got %q (X-Cache %s), want his own response", body, cache)
+	}
+
+	// Marked public, the response may be shared between key holders
+	get("/keys/public", "alice-key")
+	if body, cache := get("/keys/public", "bob-key"); body != "alice" || cache != "HIT" {
+		t.Errorf("public response: bob got %q (X-Cache %s), want alice's from the cache", body, cache)
+	}
+}
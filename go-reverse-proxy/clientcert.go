@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ==================== CLIENT CERTIFICATES (mTLS) ====================
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional" // verify a certificate if the client sends one
+	ClientAuthRequire  = "require"  // refuse the handshake without a valid one
+)
+
+// Headers describing the verified client certificate to backends. Incoming
+// copies are always removed so clients cannot forge them.
+var clientCertHeaders = []string{
+	"X-Client-Verify",
+	"X-Client-Cert-Subject",
+	"X-Client-Cert-Issuer",
+	"X-Client-Cert-SAN",
+	"X-Client-Cert-Fingerprint",
+}
+
+func clientAuthMode(cfg TLSConfig) string {
+	if cfg.ClientAuth == "" {
+		if cfg.ClientCAFile != "" {
+			return ClientAuthOptional
+		}
+		return ClientAuthNone
+	}
+	return cfg.ClientAuth
+}
+
+// configureClientAuth loads the client CA bundle into tc.
+func configureClientAuth(tc *tls.Config, cfg TLSConfig) error {
+	mode := clientAuthMode(cfg)
+	switch mode {
+	case ClientAuthNone:
+		return nil
+	case ClientAuthOptional:
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unknown tls.client_auth %q", mode)
+	}
+
+	if cfg.ClientCAFile == "" {
+		return fmt.Errorf("tls.client_auth %q needs tls.client_ca_file", mode)
+	}
+	pem, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	tc.ClientCAs = x509.NewCertPool()
+	if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", cfg.ClientCAFile)
+	}
+	return nil
+}
+
+func hasVerifiedClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// setClientCertHeaders replaces any client-supplied cert headers with the
+// details of the certificate verified during the handshake.
+func setClientCertHeaders(req *http.Request, state *tls.ConnectionState) {
+	for _, h := range clientCertHeaders {
+		req.Header.Del(h)
+	}
+	if state == nil || len(state.VerifiedChains) == 0 {
+		if state != nil {
+			req.Header.Set("X-Client-Verify", "NONE")
+		}
+		return
+	}
+
+	cert := state.VerifiedChains[0][0]
+	var sans []string
+	for _, n := range cert.DNSNames {
+		sans = append(sans, "DNS:"+n)
+	}
+	for _, e := range cert.EmailAddresses {
+		sans = append(sans, "email:"+e)
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, "URI:"+u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	req.Header.Set("X-Client-Verify", "SUCCESS")
+	req.Header.Set("X-Client-Cert-Subject", cert.Subject.String())
+	req.Header.Set("X-Client-Cert-Issuer", cert.Issuer.String())
+	if len(sans) > 0 {
+		req.Header.Set("X-Client-Cert-SAN", strings.Join(sans, ", "))
+	}
+	req.Header.Set("X-Client-Cert-Fingerprint", hex.EncodeToString(fingerprint[:]))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ==================== CLIENT IP ====================
+
+// extractClientIP parses the peer address of a connection. It accepts
+// "1.2.3.4:port", "[2001:db8::1]:port", "[fe80::1%eth0]:port" as well as bare
+// and bracketed addresses without a port. IPv4-mapped IPv6 addresses are
+// unmapped so "::ffff:1.2.3.4" and "1.2.3.4" compare equal.
+func extractClientIP(remoteAddr string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid client address %q", remoteAddr)
+	}
+	return addr.Unmap(), nil
+}
+
+// clientIP is the request's peer IP without port or zone, suitable as a key
+// for limits, ACLs and sessions. Unparseable addresses are returned as is.
+func clientIP(r *http.Request) string {
+	addr, err := extractClientIP(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return addr.WithZone("").String()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtractClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+		wantErr    bool
+	}{
+		{remoteAddr: "1.2.3.4:5678", want: "1.2.3.4"},
+		{remoteAddr: "1.2.3.4", want: "1.2.3.4"},
+		{remoteAddr: "[2001:db8::1]:443", want: "2001:db8::1"},
+		{remoteAddr: "2001:db8::1", want: "2001:db8::1"},
+		{remoteAddr: "[2001:db8::1]", want: "2001:db8::1"},
+		{remoteAddr: "[fe80::1%eth0]:8080", want: "fe80::1%eth0"},
+		{remoteAddr: "fe80::1%eth0", want: "fe80::1%eth0"},
+		{remoteAddr: "[fe80::1%eth0]", want: "fe80::1%eth0"},
+		{remoteAddr: "[::ffff:1.2.3.4]:80", want: "1.2.3.4"},
+		{remoteAddr: "::ffff:1.2.3.4", want: "1.2.3.4"},
+		{remoteAddr: "[::1]:9000", want: "::1"},
+		{remoteAddr: "", wantErr: true},
+		{remoteAddr: "example.com:80", wantErr: true},
+		{remoteAddr: "1.2.3.4:", want: "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			got, err := extractClientIP(tt.remoteAddr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("extractClientIP(%q) = %v, want an error", tt.remoteAddr, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractClientIP(%q): %v", tt.remoteAddr, err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("extractClientIP(%q) = %s, want %s", tt.remoteAddr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"1.2.3.4:5678", "1.2.3.4"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[fe80::1%eth0]:8080", "fe80::1"}, // zones don't split a client's keys
+		{"[::ffff:10.0.0.1]:80", "10.0.0.1"},
+		{"not an address", "not an address"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP with RemoteAddr %q = %q, want %q", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
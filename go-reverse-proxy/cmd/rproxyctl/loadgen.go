@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// loadRequest is one entry of a -mix, picked in proportion to its weight.
+type loadRequest struct {
+	method string
+	path   string
+	weight int
+}
+
+// loadResult is what loadgen reports, in both output formats.
+type loadResult struct {
+	Requests   int            `json:"requests"`
+	Errors     int            `json:"errors"` // transport failures, not HTTP statuses
+	Statuses   map[string]int `json:"statuses"`
+	DurationS  float64        `json:"duration_s"`
+	RPS        float64        `json:"rps"`
+	P50Ms      float64        `json:"p50_ms"`
+	P95Ms      float64        `json:"p95_ms"`
+	P99Ms      float64        `json:"p99_ms"`
+	MaxMs      float64        `json:"max_ms"`
+	Concurrent int            `json:"concurrency"`
+}
+
+// runLoadgen sends requests to the proxy (not the Admin API) from
+// concurrent workers and reports throughput and latency percentiles, so a
+// change's effect on performance can be measured.
+func runLoadgen(args []string, output string) {
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	concurrency := fs.Int("c", 50, "concurrent workers")
+	total := fs.Int("n", 0, "requests to send in all (0: run for -d)")
+	duration := fs.Duration("d", 10*time.Second, "how long to run when -n is 0")
+	mix := fs.String("mix", "GET /=1", `requests to send, "METHOD PATH=WEIGHT" separated by commas`)
+	bodySize := fs.Int("body", 1024, "body bytes for POST, PUT and PATCH")
+	timeout := fs.Duration("timeout", 30*time.Second, "per-request timeout")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: rproxyctl loadgen [flags] <proxy url>\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *concurrency < 1 {
+		fail("-c must be at least 1")
+	}
+	requests, err := parseMix(*mix)
+	if err != nil {
+		fail("-mix: %v", err)
+	}
+	base := strings.TrimSuffix(fs.Arg(0), "/")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *concurrency
+	client := &http.Client{Transport: transport, Timeout: *timeout}
+	body := bytes.Repeat([]byte("x"), *bodySize)
+
+	// Workers draw from a shared budget of -n requests or run until -d
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		result    = loadResult{Statuses: make(map[string]int), Concurrent: *concurrency}
+		remaining = *total
+		deadline  = time.Now().Add(*duration)
+	)
+	next := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if *total > 0 {
+			remaining--
+			return remaining >= 0
+		}
+		return time.Now().Before(deadline)
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var mine []time.Duration
+			statuses := make(map[string]int)
+			failed := 0
+			for next() {
+				d, status, err := sendOne(client, base, pick(requests), body)
+				if err != nil {
+					failed++
+					continue
+				}
+				mine = append(mine, d)
+				statuses[strconv.Itoa(status/100)+"xx"]++
+			}
+			mu.Lock()
+			latencies = append(latencies, mine...)
+			result.Errors += failed
+			for class, n := range statuses {
+				result.Statuses[class] += n
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	slices.Sort(latencies)
+	result.Requests = len(latencies) + result.Errors
+	result.DurationS = elapsed.Seconds()
+	result.RPS = float64(result.Requests) / elapsed.Seconds()
+	result.P50Ms = percentileMs(latencies, 0.50)
+	result.P95Ms = percentileMs(latencies, 0.95)
+	result.P99Ms = percentileMs(latencies, 0.99)
+	if len(latencies) > 0 {
+		result.MaxMs = msOf(latencies[len(latencies)-1])
+	}
+
+	if output == "json" {
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	printLoadResult(result)
+}
+
+// parseMix reads "GET /=8,POST /orders=2"; a missing weight counts as 1.
+func parseMix(s string) ([]loadRequest, error) {
+	var requests []loadRequest
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		spec, weight := entry, 1
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			n, err := strconv.Atoi(entry[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("weight of %q must be a positive number", entry)
+			}
+			spec, weight = entry[:i], n
+		}
+		method, path, ok := strings.Cut(strings.TrimSpace(spec), " ")
+		path = strings.TrimSpace(path)
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("%q is not \"METHOD /path\"", entry)
+		}
+		requests = append(requests, loadRequest{method: strings.ToUpper(method), path: path, weight: weight})
+	}
+	return requests, nil
+}
+
+func pick(requests []loadRequest) loadRequest {
+	total := 0
+	for _, r := range requests {
+		total += r.weight
+	}
+	n := rand.IntN(total)
+	for _, r := range requests {
+		if n -= r.weight; n < 0 {
+			return r
+		}
+	}
+	return requests[len(requests)-1]
+}
+
+// sendOne times one request until its body has been read.
+func sendOne(client *http.Client, base string, lr loadRequest, body []byte) (time.Duration, int, error) {
+	var reqBody io.Reader
+	switch lr.method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(lr.method, base+lr.path, reqBody)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	return time.Since(start), resp.StatusCode, nil
+}
+
+// percentileMs reads the p-th quantile of sorted latencies.
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	return msOf(sorted[min(max(i, 0), len(sorted)-1)])
+}
+
+func msOf(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func printLoadResult(r loadResult) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Requests\t%d in %.1fs with %d workers\n", r.Requests, r.DurationS, r.Concurrent)
+	fmt.Fprintf(tw, "Throughput\t%.1f req/s\n", r.RPS)
+	fmt.Fprintf(tw, "Latency\tp50 %.2fms  p95 %.2fms  p99 %.2fms  max %.2fms\n", r.P50Ms, r.P95Ms, r.P99Ms, r.MaxMs)
+	var classes []string
+	for _, class := range slices.Sorted(maps.Keys(r.Statuses)) {
+		classes = append(classes, fmt.Sprintf("%s %d", class, r.Statuses[class]))
+	}
+	fmt.Fprintf(tw, "Statuses\t%s\n", strings.Join(classes, "  "))
+	fmt.Fprintf(tw, "Errors\t%d\n", r.Errors)
+	tw.Flush()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMix(t *testing.T) {
+	tests := []struct {
+		mix     string
+		want    []loadRequest
+		wantErr bool
+	}{
+		{mix: "GET /", want: []loadRequest{{method: "GET", path: "/", weight: 1}}},
+		{mix: "GET /=8, post /orders=2", want: []loadRequest{
+			{method: "GET", path: "/", weight: 8},
+			{method: "POST", path: "/orders", weight: 2},
+		}},
+		{mix: "GET /search?q=a=3", want: []loadRequest{{method: "GET", path: "/search?q=a", weight: 3}}},
+		{mix: "GET /=0", wantErr: true},
+		{mix: "GET /=x", wantErr: true},
+		{mix: "GET", wantErr: true},
+		{mix: "GET orders", wantErr: true},
+		{mix: "GET /,", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMix(tt.mix)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMix(%q) error = %v, want error %v", tt.mix, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseMix(%q) = %+v, want %+v", tt.mix, got, tt.want)
+		}
+	}
+}
+
+func TestPickFollowsWeights(t *testing.T) {
+	requests := []loadRequest{{path: "/a", weight: 9}, {path: "/b", weight: 1}}
+	counts := map[string]int{}
+	for range 10000 {
+		counts[pick(requests).path]++
+	}
+	// 9000 expected; this is many standard deviations either side
+	if counts["/a"] < 8500 || counts["/a"] > 9500 {
+		t.Errorf("picked /a %d times in 10000, want about 9000", counts["/a"])
+	}
+}
+
+func TestPercentileMs(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	for _, tt := range []struct {
+		p    float64
+		want float64
+	}{{0.5, 50}, {0.95, 95}, {0.99, 99}, {1, 100}, {0, 1}} {
+		if got := percentileMs(sorted, tt.p); got != tt.want {
+			t.Errorf("percentileMs(p%v) = %v, want %v", tt.p*100, got, tt.want)
+		}
+	}
+	if got := percentileMs(nil, 0.5); got != 0 {
+		t.Errorf("percentileMs of no latencies = %v, want 0", got)
+	}
+}
+
+func TestSendOne(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	d, status, err := sendOne(srv.Client(), srv.URL, loadRequest{method: "POST", path: "/orders"}, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusCreated || d <= 0 {
+		t.Errorf("sendOne = %v, %d; want a positive duration and 201", d, status)
+	}
+}
+
+// BenchmarkSendOne measures loadgen's own cost per request, which is
+// included in every latency it reports.
+func BenchmarkSendOne(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	client := srv.Client()
+	requests := []loadRequest{{method: "GET", path: "/", weight: 8}, {method: "POST", path: "/orders", weight: 2}}
+	body := []byte(`{"id":1}`)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, _, err := sendOne(client, srv.URL, pick(requests), body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// rproxyctl drives the reverse proxy's Admin API from the command line.
+//
+//	rproxyctl [flags] status
+//	rproxyctl [flags] backend add|remove|drain|undrain <url>
+//	rproxyctl [flags] config reload
+//	rproxyctl [flags] config rollback [version]
+//	rproxyctl [flags] loadgen [loadgen flags] <proxy url>
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type client struct {
+	base      string
+	apiKey    string
+	keyHeader string
+	user      string
+	password  string
+	http      *http.Client
+}
+
+func main() {
+	c := &client{http: &http.Client{Timeout: 30 * time.Second}}
+	flag.StringVar(&c.base, "admin", envOr("RPROXY_ADMIN", "http://localhost:8082"), "Admin API address ($RPROXY_ADMIN)")
+	flag.StringVar(&c.apiKey, "api-key", os.Getenv("RPROXY_API_KEY"), "API key for admin_auth ($RPROXY_API_KEY)")
+	flag.StringVar(&c.keyHeader, "api-key-header", "X-API-Key", "header carrying the API key")
+	flag.StringVar(&c.user, "user", os.Getenv("RPROXY_USER"), "basic auth user ($RPROXY_USER)")
+	flag.StringVar(&c.password, "password", os.Getenv("RPROXY_PASSWORD"), "basic auth password ($RPROXY_PASSWORD)")
+	output := flag.String("o", "table", "output format: table or json")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *output != "table" && *output != "json" {
+		fail("unknown output format %q", *output)
+	}
+	c.base = strings.TrimSuffix(c.base, "/")
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if args[0] == "loadgen" {
+		runLoadgen(args[1:], *output)
+		return
+	}
+
+	var (
+		body  []byte
+		err   error
+		table func([]byte) error
+	)
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		body, err = c.do("GET", "/v1/dashboard/data", nil)
+		table = printStatus
+	case args[0] == "backend" && len(args) == 3:
+		url := args[2]
+		switch args[1] {
+		case "add":
+			body, err = c.do("POST", "/v1/add", map[string]string{"url": url})
+		case "remove":
+			body, err = c.do("POST", "/v1/remove", map[string]string{"url": url})
+		case "drain":
+			body, err = c.do("PATCH", "/v1/backends/weight", map[string]interface{}{"weights": map[string]int{url: 0}})
+		case "undrain":
+			body, err = c.do("PATCH", "/v1/backends/weight", map[string]interface{}{"weights": map[string]int{url: 1}})
+		default:
+			usage()
+			os.Exit(2)
+		}
+		table = printMessage
+	case args[0] == "config" && len(args) == 2 && args[1] == "reload":
+		body, err = c.do("POST", "/v1/config/reload", nil)
+		table = printReload
+	case args[0] == "config" && (len(args) == 2 || len(args) == 3) && args[1] == "rollback":
+		req := map[string]int{}
+		if len(args) == 3 {
+			version, convErr := strconv.Atoi(args[2])
+			if convErr != nil {
+				fail("version %q is not a number", args[2])
+			}
+			req["version"] = version
+		}
+		body, err = c.do("POST", "/v1/config/rollback", req)
+		table = printReload
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail("%v", err)
+	}
+
+	if *output == "json" {
+		var out bytes.Buffer
+		if json.Indent(&out, body, "", "  ") != nil {
+			out.Reset()
+			out.Write(body)
+		}
+		fmt.Println(strings.TrimSpace(out.String()))
+		return
+	}
+	if err := table(body); err != nil {
+		fail("unexpected response: %v", err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: rproxyctl [flags] <command>
+
+Commands:
+  status                       backends with health, weight and traffic
+  backend add <url>            add a backend to the default pool
+  backend remove <url>         remove a backend from every pool
+  backend drain <url>          stop sending new requests (weight 0)
+  backend undrain <url>        send requests again (weight 1)
+  config reload                re-read the proxy's config file
+  config rollback [version]    go back to the previous (or given) applied config
+  loadgen [flags] <proxy url>  send load to the proxy and report latency percentiles
+                               (rproxyctl loadgen -h for its flags)
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "rproxyctl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// do sends a request to the Admin API and returns the response body, or an
+// error carrying the server's message for non-2xx answers.
+func (c *client) do(method, path string, payload interface{}) ([]byte, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set(c.keyHeader, c.apiKey)
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var failure struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		msg := strings.TrimSpace(string(body))
+		if json.Unmarshal(body, &failure) == nil && failure.Error.Message != "" {
+			msg = failure.Error.Message
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, msg)
+	}
+	return body, nil
+}
+
+func printStatus(body []byte) error {
+	var data struct {
+		Backends []struct {
+			URL      string   `json:"url"`
+			Pools    []string `json:"pools"`
+			Alive    bool     `json:"alive"`
+			Weight   int      `json:"weight"`
+			InFlight int64    `json:"in_flight"`
+			Stats    struct {
+				RPS       float64 `json:"rps"`
+				ErrorRate float64 `json:"error_rate"`
+				P95Ms     float64 `json:"p95_ms"`
+			} `json:"stats"`
+		} `json:"backends"`
+		InFlight     int64 `json:"in_flight"`
+		ChecksPaused bool  `json:"health_checks_paused"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKEND\tPOOLS\tSTATUS\tWEIGHT\tIN FLIGHT\tRPS\tERRORS\tP95 MS")
+	for _, b := range data.Backends {
+		status := "down"
+		if b.Alive {
+			status = "up"
+			if b.Weight == 0 {
+				status = "drained"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%g\t%.1f%%\t%g\n", b.URL, strings.Join(b.Pools, ","), status,
+			b.Weight, b.InFlight, b.Stats.RPS, b.Stats.ErrorRate*100, b.Stats.P95Ms)
+	}
+	tw.Flush()
+
+	fmt.Printf("\n%d requests in flight", data.InFlight)
+	if data.ChecksPaused {
+		fmt.Print(", health checks paused")
+	}
+	fmt.Println()
+	return nil
+}
+
+func printMessage(body []byte) error {
+	var data struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return err
+	}
+	fmt.Println(data.Message)
+	return nil
+}
+
+func printReload(body []byte) error {
+	var data struct {
+		Changes       []string `json:"changes"`
+		RestartNeeded []string `json:"restart_needed"`
+		Version       int      `json:"version"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return err
+	}
+	if len(data.Changes) == 0 {
+		fmt.Println("Config applied, nothing changed")
+	} else {
+		fmt.Printf("Config version %d applied\n", data.Version)
+	}
+	for _, c := range data.Changes {
+		fmt.Println("changed: " + c)
+	}
+	for _, f := range data.RestartNeeded {
+		fmt.Println("needs restart: " + f)
+	}
+	return nil
+}
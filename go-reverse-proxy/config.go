@@ -0,0 +1,484 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ==================== CONFIGURATION ====================
+type Config struct {
+	Port      int `json:"port"`
+	AdminPort int `json:"admin_port"`
+	RateLimit int `json:"rate_limit"`
+
+	// Listeners replace Port and AdminPort when set (see ListenerConfig).
+	Listeners []ListenerConfig `json:"listeners,omitempty"`
+
+	// ConnLimit caps the client connections of the proxy listeners, in all
+	// and per peer IP (see ConnLimitConfig).
+	ConnLimit *ConnLimitConfig `json:"conn_limit,omitempty"`
+
+	// AdminAuth requires credentials on every Admin API request.
+	AdminAuth *AdminAuthConfig `json:"admin_auth,omitempty"`
+
+	// AdminAudit records every mutating Admin API call for GET /audit
+	// (see AuditConfig).
+	AdminAudit AuditConfig `json:"admin_audit"`
+
+	// AdminDebug mounts pprof, expvar and /debug/goroutines on the Admin
+	// API; it requires AdminAuth.
+	AdminDebug bool `json:"admin_debug,omitempty"`
+
+	// ClientRateLimit limits each client IP on top of the global RateLimit
+	// (see ClientRateLimitConfig).
+	ClientRateLimit *ClientRateLimitConfig `json:"client_rate_limit,omitempty"`
+
+	// Strategy applies to every pool that doesn't set its own, as do
+	// StrategyOptions.
+	Strategy        string           `json:"strategy"`
+	StrategyOptions *StrategyOptions `json:"strategy_options,omitempty"`
+
+	// Pools must include "default", which serves unrouted traffic. Files
+	// using the legacy flat schema are converted by migrateLegacyConfig.
+	Pools  map[string]PoolConfig `json:"pools"`
+	Routes []RouteConfig         `json:"routes,omitempty"`
+
+	Experiment *ExperimentConfig `json:"experiment,omitempty"`
+
+	// IdentityHeader names the header announcing the proxy to backends;
+	// set it to "" to send none. IdentityValue defaults to ProxyIdentity().
+	IdentityHeader string `json:"identity_header"`
+	IdentityValue  string `json:"identity_value,omitempty"`
+
+	// ViaPseudonym identifies this proxy in Via headers and is how forwarding
+	// loops are detected; give each proxy in a chain its own.
+	ViaPseudonym string `json:"via_pseudonym"`
+
+	// MaxForwardDepth rejects requests that already passed through this
+	// many proxies (counted from Via and X-Forwarded-For); 0 disables it.
+	MaxForwardDepth int `json:"max_forward_depth"`
+
+	// RewriteRedirects maps Location headers that point at a backend's own
+	// host back to the public host; routes may override it.
+	RewriteRedirects bool `json:"rewrite_redirects"`
+
+	// CookieRewrite maps backend Set-Cookie domains and paths to public
+	// ones; routes may replace it.
+	CookieRewrite *CookieRewriteConfig `json:"cookie_rewrite,omitempty"`
+
+	// TrustedProxies (CIDRs) may send X-Forwarded-For/-Host/-Proto and
+	// X-Real-IP; from other peers those headers are dropped. The client IP
+	// used for ACLs and X-Real-IP is taken from the chain they build.
+	// Defaults to loopback.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// Middleware orders the request pipeline, outermost first; stages left
+	// out are disabled. See middlewares for the available names.
+	Middleware []string `json:"middleware"`
+
+	// ACL allows or denies clients by IP for every request; routes may add
+	// their own lists. Both can be changed at runtime via PUT /acl.
+	ACL *ACLConfig `json:"acl,omitempty"`
+
+	// CORS answers preflights and sets CORS headers (see CORSConfig).
+	CORS *CORSConfig `json:"cors,omitempty"`
+
+	// Headers edits request and response headers for all traffic; pools and
+	// routes may add rules of their own (see HeaderRules).
+	Headers *HeaderRules `json:"headers,omitempty"`
+
+	// JWT requires a valid bearer token on every request (see JWTConfig).
+	JWT *JWTConfig `json:"jwt,omitempty"`
+
+	// ForwardAuth asks an external service to approve every request.
+	ForwardAuth *ForwardAuthConfig `json:"forward_auth,omitempty"`
+
+	// StickySessions pins each client to the backend that first served
+	// it, per pool, through a proxy_session cookie. Sessions idle for
+	// StickySessionTTL (default 30m) are forgotten. StickySessionHash,
+	// "client_ip" or "header:<name>", pins by a hash of that instead,
+	// without a cookie or a session table. StickySessionCookie sets the
+	// cookie's name and attributes, and StickySessionSecret signs it
+	// (default: a random key per start). StickySessionRebalance moves
+	// sessions off overloaded backends. StickySessionFile keeps the
+	// sessions across restarts. StickySessionMax (default 100000) caps the
+	// session table.
+	StickySessions         bool                    `json:"sticky_sessions,omitempty"`
+	StickySessionTTL       Duration                `json:"sticky_session_ttl,omitempty"`
+	StickySessionHash      string                  `json:"sticky_session_hash,omitempty"`
+	StickySessionCookie    *SessionCookieConfig    `json:"sticky_session_cookie,omitempty"`
+	StickySessionSecret    string                  `json:"sticky_session_secret,omitempty"`
+	StickySessionRebalance *SessionRebalanceConfig `json:"sticky_session_rebalance,omitempty"`
+	StickySessionFile      string                  `json:"sticky_session_file,omitempty"`
+	StickySessionMax       int                     `json:"sticky_session_max,omitempty"`
+
+	// Probes serves /healthz and /readyz on the proxy port (see
+	// ProbesConfig).
+	Probes ProbesConfig `json:"probes"`
+
+	// BypassPaths skip rate limiting, experiment bucketing and sticky
+	// sessions (see PathMatcher).
+	BypassPaths []string `json:"bypass_paths"`
+
+	// GRPC accepts h2c on the proxy port and forwards application/grpc
+	// requests over HTTP/2 with trailers and streaming intact.
+	GRPC bool `json:"grpc"`
+
+	// LogLevel is debug, info, warn or error. At debug level every request
+	// logs its forwarding and response lines, thinned by DebugSampleRate.
+	LogLevel        string  `json:"log_level"`
+	DebugSampleRate float64 `json:"debug_sample_rate"`
+
+	// LogRateLimit caps per-request warning and error lines per second
+	// (0: no cap); dropped lines are counted in the next one written.
+	LogRateLimit float64 `json:"log_rate_limit,omitempty"`
+
+	// HealthHistory keeps backend up/down transitions for
+	// GET /health/history (see HealthHistoryConfig).
+	HealthHistory HealthHistoryConfig `json:"health_history"`
+
+	// ConfigHistory keeps applied configs for POST /config/rollback (see
+	// ConfigHistoryConfig).
+	ConfigHistory ConfigHistoryConfig `json:"config_history"`
+
+	// DNSDiscovery sets how often dns+ backends are resolved (see
+	// DNSDiscoveryConfig).
+	DNSDiscovery DNSDiscoveryConfig `json:"dns_discovery"`
+
+	// Etcd, when set, serves pool backends from etcd keys (see
+	// EtcdConfig).
+	Etcd *EtcdConfig `json:"etcd,omitempty"`
+
+	// Docker, when set, adds labelled containers to pools (see
+	// DockerConfig).
+	Docker *DockerConfig `json:"docker,omitempty"`
+
+	// Registration bounds the TTLs of backends that join through
+	// POST /register (see RegistrationConfig).
+	Registration RegistrationConfig `json:"registration"`
+
+	// DumpDir receives SIGQUIT / POST /dump diagnostic files (default: temp dir).
+	DumpDir string `json:"dump_dir,omitempty"`
+
+	// KeepAlive tunes upstream connection reuse (see KeepAliveConfig).
+	KeepAlive KeepAliveConfig `json:"upstream_keepalive"`
+
+	// Transport sizes the upstream connection pools and sets dial and TLS
+	// handshake timeouts; pools may override it (see TransportConfig).
+	Transport TransportConfig `json:"upstream_transport"`
+
+	// UpstreamDNS caches what backend hostnames resolve to for upstream
+	// dials (see DNSCacheConfig).
+	UpstreamDNS *DNSCacheConfig `json:"upstream_dns_cache,omitempty"`
+
+	// UploadIdleTimeout replaces the read timeout for requests with a body:
+	// an upload may take any time as long as data keeps arriving. 0 keeps
+	// the plain server timeouts.
+	UploadIdleTimeout Duration `json:"upload_idle_timeout"`
+
+	// AccessLog writes one line per request (see AccessLogConfig).
+	AccessLog *AccessLogConfig `json:"access_log,omitempty"`
+
+	// BodyLog logs redacted request/response bodies of debug-sampled requests.
+	BodyLog BodyLogConfig `json:"body_logging"`
+
+	// Scripts are Lua hooks that can inspect and change requests and
+	// responses, run in order (see ScriptConfig).
+	Scripts []ScriptConfig `json:"scripts,omitempty"`
+
+	// SecurityHeaders adds HSTS, X-Frame-Options and similar headers to
+	// every response (see SecurityHeadersConfig).
+	SecurityHeaders *SecurityHeadersConfig `json:"security_headers,omitempty"`
+
+	// ErrorPages renders the proxy's own error responses from templates.
+	ErrorPages *ErrorPagesConfig `json:"error_pages,omitempty"`
+
+	// Bulkhead limits the requests in flight per backend (see BulkheadConfig).
+	Bulkhead *BulkheadConfig `json:"bulkhead,omitempty"`
+
+	// InFlightLimit caps the requests proxied at once over all backends
+	// (see InFlightLimitConfig).
+	InFlightLimit *InFlightLimitConfig `json:"in_flight_limit,omitempty"`
+
+	// Retry tries failed requests again on another backend (see RetryConfig).
+	Retry RetryConfig `json:"retry"`
+
+	// Cache keeps cacheable GET responses in memory (see CacheConfig).
+	Cache CacheConfig `json:"cache"`
+
+	// TLS terminates HTTPS on the proxy port.
+	TLS TLSConfig `json:"tls"`
+
+	// TLSPassthrough routes still-encrypted connections by SNI on a port of
+	// its own (see PassthroughProxy).
+	TLSPassthrough *PassthroughConfig `json:"tls_passthrough,omitempty"`
+
+	// WatchConfig reloads the config file by itself when it changes (see
+	// ConfigWatchConfig).
+	WatchConfig ConfigWatchConfig `json:"watch_config"`
+}
+
+type PoolConfig struct {
+	Strategy        string           `json:"strategy,omitempty"`
+	StrategyOptions *StrategyOptions `json:"strategy_options,omitempty"`
+	Backends        []BackendConfig  `json:"backends"`
+	Headers         *HeaderRules     `json:"headers,omitempty"`
+
+	// BackendsFile lists more backends, one URL and optional weight per
+	// line, and is followed as it changes (see FileProvider).
+	BackendsFile string `json:"backends_file,omitempty"`
+
+	// Discovery names the providers the pool takes backends from
+	// (default: all of them; see Provider).
+	Discovery []string `json:"discovery,omitempty"`
+
+	// Transport gives the pool upstream connections of its own, with the
+	// fields it sets replacing upstream_transport's.
+	Transport *TransportConfig `json:"transport,omitempty"`
+
+	// FlushInterval is how often responses are flushed to clients; -1
+	// flushes after every write (see FlushInterval). Routes may override it.
+	FlushInterval FlushInterval `json:"flush_interval,omitempty"`
+}
+
+// Duration is a time.Duration written as a string ("30s", "1m30s") in JSON.
+// Plain numbers are read as nanoseconds for compatibility.
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("duration must be a string like \"10s\": %s", data)
+		}
+		*d = Duration(n)
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// DefaultConfig mirrors the values the proxy used before it read a config file.
+func DefaultConfig() *Config {
+	return &Config{
+		Port:              8000,
+		AdminPort:         8082,
+		RateLimit:         100,
+		Strategy:          StrategyRoundRobin,
+		IdentityHeader:    "X-Proxy-Server",
+		ViaPseudonym:      defaultViaPseudonym(),
+		MaxForwardDepth:   10,
+		RewriteRedirects:  true,
+		TrustedProxies:    defaultTrustedProxies(),
+		Middleware:        defaultMiddleware(),
+		Probes:            defaultProbesConfig(),
+		BypassPaths:       []string{"/health", "/favicon.ico"},
+		LogLevel:          "info",
+		DebugSampleRate:   1,
+		UploadIdleTimeout: Duration(30 * time.Second),
+		BodyLog:           defaultBodyLogConfig(),
+		Retry:             defaultRetryConfig(),
+		Cache:             defaultCacheConfig(),
+		TLS:               TLSConfig{ReloadInterval: Duration(30 * time.Second)},
+		WatchConfig:       ConfigWatchConfig{Debounce: Duration(time.Second)},
+		KeepAlive: KeepAliveConfig{
+			TCPIdle:         Duration(30 * time.Second),
+			TCPInterval:     Duration(10 * time.Second),
+			TCPCount:        3,
+			IdleConnTimeout: Duration(90 * time.Second),
+		},
+		Transport: defaultTransportConfig(),
+		Pools: map[string]PoolConfig{
+			"default": {Backends: []BackendConfig{
+				{URL: "http://localhost:9091"},
+				{URL: "http://localhost:9092"},
+			}},
+		},
+	}
+}
+
+func defaultViaPseudonym() string {
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return "go-reverse-proxy"
+}
+
+// LoadConfig reads a JSON config file on top of the defaults, then applies
+// the environment overrides. A missing file is not an error: the proxy
+// starts with DefaultConfig.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		log.Printf("Config file %s not found, using defaults", path)
+	} else {
+		var notes []string
+		if cfg, notes, err = parseConfig(data); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if len(notes) > 0 {
+			log.Printf("Config %s uses the legacy flat schema, converted at load time (rewrite it with --migrate-config):", path)
+			for _, n := range notes {
+				log.Printf("  %s", n)
+			}
+		}
+	}
+
+	overrides, err := applyEnvOverrides(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) > 0 {
+		log.Printf("Config overridden from the environment: %s", strings.Join(overrides, ", "))
+	}
+	if err := cfg.checkRangesIn(data, overrides); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig reads a config file's contents on top of the defaults,
+// resolving ${VAR} references and converting the legacy flat schema, whose
+// conversion notes it returns. Decoding is strict (see decodeStrict).
+func parseConfig(data []byte) (*Config, []string, error) {
+	if err := checkSyntax(data); err != nil {
+		return nil, nil, err
+	}
+	data, err := interpolateEnv(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, notes, err := migrateLegacyConfig(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := DefaultConfig()
+	if err := decodeStrict(data, cfg); err != nil {
+		if len(notes) > 0 {
+			err = fmt.Errorf("%w\n(line numbers are those of the converted file; see --migrate-config)", err)
+		}
+		return nil, nil, err
+	}
+	return cfg, notes, nil
+}
+
+// MigrateConfigFile returns the file converted to the current schema.
+func MigrateConfigFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := migrateLegacyConfig(data)
+	return out, err
+}
+
+// BuildPools creates every configured pool, "default" first.
+// A URL listed in several pools maps to a single shared Backend.
+func (c *Config) BuildPools(events *EventBus, dns *DNSCache) (map[string]*ServerPool, error) {
+	if _, ok := c.Pools["default"]; !ok {
+		return nil, fmt.Errorf("pools: a \"default\" pool is required")
+	}
+	if err := validateStrategy(c.Strategy); err != nil {
+		return nil, err
+	}
+
+	shared := make(map[string]*Backend)
+	attach := func(pool *ServerPool, rawURL string) error {
+		if isDNSBackend(rawURL) {
+			// DNSDiscovery attaches what the name resolves to
+			_, err := parseDNSTarget(rawURL)
+			return err
+		}
+		if b, ok := shared[rawURL]; ok {
+			pool.AttachBackend(b)
+			return nil
+		}
+		if err := pool.AddBackend(rawURL); err != nil {
+			return err
+		}
+		backends := pool.GetBackends()
+		shared[rawURL] = backends[len(backends)-1]
+		return nil
+	}
+
+	names := []string{"default"}
+	for _, name := range slices.Sorted(maps.Keys(c.Pools)) {
+		if name != "default" {
+			names = append(names, name)
+		}
+	}
+
+	pools := make(map[string]*ServerPool, len(names))
+	for _, name := range names {
+		pc := c.Pools[name]
+		strategy := cmp.Or(pc.Strategy, c.Strategy, StrategyRoundRobin)
+		if err := validateStrategy(strategy); err != nil {
+			return nil, fmt.Errorf("pool %s: %w", name, err)
+		}
+
+		var options StrategyOptions
+		if o := cmp.Or(pc.StrategyOptions, c.StrategyOptions); o != nil {
+			options = *o
+		}
+		options, err := options.withDefaults()
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: strategy_options: %w", name, err)
+		}
+
+		pools[name] = NewServerPool(name, events)
+		pools[name].strategy = strategy
+		pools[name].options = options
+		pools[name].headers = pc.Headers
+		pools[name].flushInterval = pc.FlushInterval.Std()
+		if pc.Transport != nil {
+			pools[name].transport = newUpstreamTransport(c.KeepAlive, c.Transport.merge(*pc.Transport), dns)
+		}
+		for _, bc := range pc.Backends {
+			if err := attach(pools[name], bc.URL); err != nil {
+				return nil, fmt.Errorf("pool %s backend %q: %w", name, bc.URL, err)
+			}
+		}
+	}
+
+	configs, err := c.BackendConfigs()
+	if err != nil {
+		return nil, err
+	}
+	for rawURL, bc := range configs {
+		opts, err := newBackendOptions(bc)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", rawURL, err)
+		}
+		if b, ok := shared[rawURL]; ok {
+			b.configure(bc, opts)
+		}
+	}
+	return pools, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigErrorsNameFieldAndLine(t *testing.T) {
+	t.Setenv("RP_TEST_SECRET", "0123456789abcdef0123")
+	t.Setenv("RP_TEST_TTL", "soon")
+
+	tests := []struct {
+		name   string
+		config string
+		want   []string // each must appear in the error
+	}{
+		{"unknown field", `{
+  "port": 8080,
+  "admin_port": 8081,
+  "rate_limt": 100
+}`, []string{"line 4: rate_limt: unknown field"}},
+		{"bad duration", `{
+  "port": 8080,
+  "sticky_session_ttl": "10 minutes"
+}`, []string{"line 3: sticky_session_ttl:"}},
+		{"out of range", `{
+  "port": 8080,
+  "admin_port": 70000
+}`, []string{"line 3: admin_port: port 70000 is out of range"}},
+		{"nested out of range", `{
+  "pools": {
+    "default": {
+      "backends": ["http://10.0.0.1:80"],
+      "transport": {"max_idle_conns": -1}
+    }
+  }
+}`, []string{"line 5: pools.default.transport."}},
+		{"bad duration from ${VAR}", `{
+  "sticky_session_secret": "${RP_TEST_SECRET}",
+  "sticky_session_ttl": "${RP_TEST_TTL}"
+}`, []string{"line 3: sticky_session_ttl:", `"soon"`}},
+		{"out of range after ${VAR}", `{
+  "sticky_session_secret": "${RP_TEST_SECRET}",
+  "rate_limit": -5
+}`, []string{"line 3: rate_limit: must not be negative"}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(path)
+		if err == nil {
+			t.Errorf("%s: loaded without error", tt.name)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q doesn't contain %q", tt.name, err, want)
+			}
+		}
+	}
+}
+
+func TestLoadConfigOverrideErrorNamesVariable(t *testing.T) {
+	t.Setenv("RP_PORT", "0")
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte("{\n  \"port\": 8080\n}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "port: port 0 is out of range 1-65535 (set by RP_PORT)") {
+		t.Fatalf("error %v, want it to name RP_PORT", err)
+	}
+	if strings.Contains(err.Error(), "line 2") {
+		t.Errorf("error %q points at the file's value, not the override", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ==================== CONFIG HISTORY ====================
+// ConfigHistoryConfig sizes the list of applied configs behind
+// GET /config/history and POST /config/rollback.
+type ConfigHistoryConfig struct {
+	// Size is how many versions are kept (default 10).
+	Size int `json:"size,omitempty"`
+
+	// File, when set, keeps the versions as JSON lines so they survive
+	// restarts.
+	File string `json:"file,omitempty"`
+}
+
+const defaultConfigHistorySize = 10
+
+// ConfigVersion is a config as it was applied.
+type ConfigVersion struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"` // startup, config file, config import, ...
+
+	// RolledBackTo is the version a rollback restored.
+	RolledBackTo int `json:"rolled_back_to,omitempty"`
+
+	Config *Config `json:"config,omitempty"`
+}
+
+// ConfigHistory keeps the last applied configs, oldest first.
+type ConfigHistory struct {
+	mu       sync.Mutex
+	size     int
+	file     string
+	versions []ConfigVersion
+}
+
+func NewConfigHistory(cfg ConfigHistoryConfig) (*ConfigHistory, error) {
+	size := cfg.Size
+	if size == 0 {
+		size = defaultConfigHistorySize
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("config_history: size must be positive")
+	}
+	h := &ConfigHistory{size: size, file: cfg.File}
+	if cfg.File != "" {
+		if err := h.load(); err != nil {
+			return nil, fmt.Errorf("config_history: %w", err)
+		}
+	}
+	return h, nil
+}
+
+// load reads a previous run's versions. A missing file is not an error.
+func (h *ConfigHistory) load() error {
+	f, err := os.Open(h.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxConfigSize)
+	for scanner.Scan() {
+		var v ConfigVersion
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil || v.Config == nil {
+			log.Printf("config_history: skipping unreadable line in %s: %v", h.file, err)
+			continue
+		}
+		h.versions = append(h.versions, v)
+	}
+	h.trim()
+	return scanner.Err()
+}
+
+func (h *ConfigHistory) trim() {
+	if extra := len(h.versions) - h.size; extra > 0 {
+		h.versions = h.versions[extra:]
+	}
+}
+
+// Record adds cfg as the newest version and returns its number.
+// rolledBackTo is the version a rollback restored, or 0.
+func (h *ConfigHistory) Record(cfg *Config, source string, rolledBackTo int) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	version := 1
+	if n := len(h.versions); n > 0 {
+		version = h.versions[n-1].Version + 1
+	}
+	h.versions = append(h.versions, ConfigVersion{
+		Version:      version,
+		Time:         time.Now().UTC(),
+		Source:       source,
+		RolledBackTo: rolledBackTo,
+		Config:       cfg,
+	})
+	h.trim()
+	if h.file != "" {
+		if err := h.save(); err != nil {
+			log.Printf("config_history: %v", err)
+		}
+	}
+	return version
+}
+
+// save rewrites the file with the versions kept, replacing it in one step
+// so a crash leaves the old or the new list.
+func (h *ConfigHistory) save() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, v := range h.versions {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(h.file), ".config-history-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), h.file)
+}
+
+// List returns the versions kept, newest first, without their configs.
+func (h *ConfigHistory) List() []ConfigVersion {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]ConfigVersion, 0, len(h.versions))
+	for i := len(h.versions) - 1; i >= 0; i-- {
+		v := h.versions[i]
+		v.Config = nil
+		list = append(list, v)
+	}
+	return list
+}
+
+// Get returns one version with its config.
+func (h *ConfigHistory) Get(version int) (ConfigVersion, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, v := range h.versions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return ConfigVersion{}, false
+}
+
+// rollbackTarget returns the version to roll back to: the given one, or
+// for 0 the one before the version in effect. After a rollback that means
+// the one before the version it restored, so repeated rollbacks keep
+// going back.
+func (h *ConfigHistory) rollbackTarget(version int) (ConfigVersion, error) {
+	if version != 0 {
+		if v, ok := h.Get(version); ok {
+			return v, nil
+		}
+		return ConfigVersion{}, fmt.Errorf("version %d is not in the history", version)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.versions) == 0 {
+		return ConfigVersion{}, fmt.Errorf("no earlier version to roll back to")
+	}
+	current := h.versions[len(h.versions)-1]
+	before := current.Version
+	if current.RolledBackTo != 0 {
+		before = current.RolledBackTo
+	}
+	for i := len(h.versions) - 1; i >= 0; i-- {
+		if h.versions[i].Version < before {
+			return h.versions[i], nil
+		}
+	}
+	return ConfigVersion{}, fmt.Errorf("no version before %d is kept", before)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"log"
+	"os"
+	"time"
+)
+
+// ==================== CONFIG FILE WATCH ====================
+// ConfigWatchConfig makes the proxy reload its config file when the file
+// changes, as SIGHUP would, so pushing a new file is enough to apply it.
+type ConfigWatchConfig struct {
+	// Interval is how often the file is checked; 0 (the default) turns
+	// watching off.
+	Interval Duration `json:"interval,omitempty"`
+
+	// Debounce is how long the file must stay unchanged before it is
+	// loaded (default 1s), so an editor or deploy tool writing it in
+	// several steps triggers a single reload.
+	Debounce Duration `json:"debounce,omitempty"`
+}
+
+// Watch polls the config file's contents and reloads once a change has
+// settled. The new file is validated in full before anything is applied;
+// an invalid one is logged and the running config kept until the file
+// changes again. Files replaced through a symlink swap, as Kubernetes
+// ConfigMaps are, are picked up too.
+func (rl *Reloader) Watch(cfg ConfigWatchConfig) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	loaded, _ := fileDigest(rl.path)
+	log.Printf("Watching %s for changes every %v", rl.path, cfg.Interval.Std())
+	go func() {
+		ticker := time.NewTicker(cfg.Interval.Std())
+		defer ticker.Stop()
+		var pending [sha256.Size]byte
+		var changedAt time.Time
+		for range ticker.C {
+			digest, ok := fileDigest(rl.path)
+			switch {
+			case !ok:
+				continue // mid-replacement; look again next tick
+			case digest == loaded:
+				changedAt = time.Time{}
+				continue
+			case changedAt.IsZero() || digest != pending:
+				pending, changedAt = digest, time.Now()
+			}
+			if time.Since(changedAt) < cfg.Debounce.Std() {
+				continue
+			}
+			loaded, changedAt = digest, time.Time{}
+
+			rl.mu.Lock()
+			_, err := rl.reload("config file watch")
+			rl.mu.Unlock()
+			if err != nil {
+				log.Printf("Config watch: %s changed but can't be applied, keeping the running config: %v", rl.path, err)
+			}
+		}
+	}()
+}
+
+func fileDigest(path string) ([sha256.Size]byte, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, false
+	}
+	return sha256.Sum256(data), true
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ==================== CONNECTION LIMITS ====================
+// ConnLimitConfig protects the proxy listeners from connection exhaustion.
+// Once MaxConns client connections are open over all proxy listeners, new
+// ones wait in the kernel's accept queue until one closes, like
+// netutil.LimitListener. A peer IP already holding MaxConnsPerIP
+// connections has further ones closed as soon as they are accepted. The
+// peer is the connection's, so behind a load balancer the per-IP cap
+// counts the balancer.
+type ConnLimitConfig struct {
+	MaxConns      int `json:"max_conns,omitempty"`        // 0 = unlimited
+	MaxConnsPerIP int `json:"max_conns_per_ip,omitempty"` // 0 = unlimited
+}
+
+// ConnLimiter counts the open connections of the listeners it wraps. A nil
+// *ConnLimiter leaves listeners as they are.
+type ConnLimiter struct {
+	slots chan struct{} // nil without max_conns
+	perIP int
+
+	mu   sync.Mutex
+	byIP map[string]int
+
+	open     atomic.Int64
+	rejected atomic.Uint64 // closed for the per-IP cap
+}
+
+// NewConnLimiter returns nil when cfg limits nothing.
+func NewConnLimiter(cfg *ConnLimitConfig) (*ConnLimiter, error) {
+	if cfg == nil || (cfg.MaxConns == 0 && cfg.MaxConnsPerIP == 0) {
+		return nil, nil
+	}
+	if cfg.MaxConns < 0 || cfg.MaxConnsPerIP < 0 {
+		return nil, fmt.Errorf("conn_limit: max_conns and max_conns_per_ip must not be negative")
+	}
+	c := &ConnLimiter{perIP: cfg.MaxConnsPerIP, byIP: make(map[string]int)}
+	if cfg.MaxConns > 0 {
+		c.slots = make(chan struct{}, cfg.MaxConns)
+	}
+	return c, nil
+}
+
+// Wrap returns ln with its connections counted against c.
+func (c *ConnLimiter) Wrap(ln net.Listener) net.Listener {
+	if c == nil {
+		return ln
+	}
+	return &limitListener{Listener: ln, limiter: c, done: make(chan struct{})}
+}
+
+// Open is the number of client connections open on the wrapped listeners.
+func (c *ConnLimiter) Open() int64 {
+	return c.open.Load()
+}
+
+// Rejected counts connections closed for the per-IP cap.
+func (c *ConnLimiter) Rejected() uint64 {
+	return c.rejected.Load()
+}
+
+// Peers is the number of distinct peer IPs with a connection open.
+func (c *ConnLimiter) Peers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.byIP)
+}
+
+// admit counts a connection from ip unless ip is at its cap.
+func (c *ConnLimiter) admit(ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.perIP > 0 && c.byIP[ip] >= c.perIP {
+		return false
+	}
+	c.byIP[ip]++
+	return true
+}
+
+func (c *ConnLimiter) leave(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.byIP[ip]--; c.byIP[ip] <= 0 {
+		delete(c.byIP, ip)
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	limiter   *ConnLimiter
+	done      chan struct{} // closed by Close to stop waiting for a slot
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	c := l.limiter
+	for {
+		if c.slots != nil {
+			select {
+			case c.slots <- struct{}{}:
+			case <-l.done:
+				return nil, net.ErrClosed
+			}
+		}
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.releaseSlot()
+			return nil, err
+		}
+
+		ip := conn.RemoteAddr().String()
+		if addr, err := extractClientIP(ip); err == nil {
+			ip = addr.WithZone("").String()
+		}
+		if !c.admit(ip) {
+			conn.Close()
+			l.releaseSlot()
+			c.rejected.Add(1)
+			continue
+		}
+		c.open.Add(1)
+		return &limitConn{Conn: conn, listener: l, ip: ip}, nil
+	}
+}
+
+func (l *limitListener) releaseSlot() {
+	if l.limiter.slots != nil {
+		<-l.limiter.slots
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitConn gives its slot back when closed, once.
+type limitConn struct {
+	net.Conn
+	listener  *limitListener
+	ip        string
+	closeOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.listener.limiter.leave(c.ip)
+		c.listener.limiter.open.Add(-1)
+		c.listener.releaseSlot()
+	})
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ==================== COOKIE REWRITING ====================
+// CookieRewriteConfig fixes Set-Cookie attributes that only make sense on
+// the backend's side, like nginx's proxy_cookie_domain/proxy_cookie_path.
+type CookieRewriteConfig struct {
+	// Domains maps a backend cookie domain to the public one; an empty
+	// replacement removes the attribute, making the cookie host-only.
+	Domains map[string]string `json:"domains,omitempty"`
+
+	// Paths maps a path prefix to its replacement, longest match first.
+	Paths map[string]string `json:"paths,omitempty"`
+}
+
+type CookieRewriter struct {
+	domains map[string]string // lowercase, without leading dot
+	paths   [][2]string       // {prefix, replacement}, longest prefix first
+}
+
+func NewCookieRewriter(cfg *CookieRewriteConfig) *CookieRewriter {
+	if cfg == nil {
+		return nil
+	}
+	c := &CookieRewriter{domains: make(map[string]string)}
+	for from, to := range cfg.Domains {
+		c.domains[normalizeCookieDomain(from)] = to
+	}
+	for from, to := range cfg.Paths {
+		c.paths = append(c.paths, [2]string{from, to})
+	}
+	sort.Slice(c.paths, func(i, j int) bool {
+		return len(c.paths[i][0]) > len(c.paths[j][0])
+	})
+	return c
+}
+
+func normalizeCookieDomain(d string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "."))
+}
+
+// Rewrite edits the Domain and Path attributes of every Set-Cookie in h,
+// leaving the rest of each line as the backend wrote it.
+func (c *CookieRewriter) Rewrite(h http.Header) {
+	lines := h.Values("Set-Cookie")
+	if len(lines) == 0 {
+		return
+	}
+	rewritten := make([]string, len(lines))
+	for i, line := range lines {
+		rewritten[i] = c.rewriteLine(line)
+	}
+	h["Set-Cookie"] = rewritten
+}
+
+func (c *CookieRewriter) rewriteLine(line string) string {
+	parts := strings.Split(line, ";")
+	kept := parts[:1] // name=value
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			to, ok := c.domains[normalizeCookieDomain(value)]
+			if !ok {
+				break
+			}
+			if to == "" {
+				continue
+			}
+			part = " Domain=" + to
+		case "path":
+			for _, p := range c.paths {
+				if strings.HasPrefix(value, p[0]) {
+					part = " Path=" + p[1] + strings.TrimPrefix(value, p[0])
+					break
+				}
+			}
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ";")
+}
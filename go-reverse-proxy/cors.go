@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ==================== CORS ====================
+// CORSConfig answers preflight requests at the proxy and adds CORS headers
+// to proxied responses, replacing any the backend sent. Configured globally
+// it covers every route; a route's own block replaces it, and a route with
+// {"disabled": true} opts out.
+type CORSConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+
+	// AllowedOrigins are exact origins, "*", or wildcards such as
+	// "https://*.example.com".
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods,omitempty"` // default GET, HEAD, POST
+	AllowedHeaders   []string `json:"allowed_headers,omitempty"` // "*" echoes the request
+	ExposedHeaders   []string `json:"exposed_headers,omitempty"`
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+	MaxAge           Duration `json:"max_age,omitempty"`
+}
+
+type CORSPolicy struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	wildcards   [][2]string // "https://*.example.com" as {"https://", ".example.com"}
+	methods     string
+	headers     string
+	anyHeader   bool
+	exposed     string
+	credentials bool
+	maxAge      string
+}
+
+func NewCORSPolicy(cfg *CORSConfig) *CORSPolicy {
+	p := &CORSPolicy{
+		origins:     make(map[string]bool),
+		credentials: cfg.AllowCredentials,
+		exposed:     strings.Join(cfg.ExposedHeaders, ", "),
+	}
+	for _, o := range cfg.AllowedOrigins {
+		switch {
+		case o == "*":
+			p.anyOrigin = true
+		case strings.Contains(o, "*"):
+			scheme, suffix, _ := strings.Cut(strings.ToLower(o), "*")
+			p.wildcards = append(p.wildcards, [2]string{scheme, suffix})
+		default:
+			p.origins[strings.ToLower(o)] = true
+		}
+	}
+
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	p.methods = strings.ToUpper(strings.Join(methods, ", "))
+
+	for _, h := range cfg.AllowedHeaders {
+		if h == "*" {
+			p.anyHeader = true
+		}
+	}
+	p.headers = strings.Join(cfg.AllowedHeaders, ", ")
+
+	if secs := int(cfg.MaxAge.Std().Seconds()); secs > 0 {
+		p.maxAge = strconv.Itoa(secs)
+	}
+	return p
+}
+
+func (p *CORSPolicy) allowed(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		scheme, suffix := w[0], w[1]
+		if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, suffix) &&
+			len(origin) > len(scheme)+len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// setOrigin writes the origin-related headers shared by preflight and
+// actual responses.
+func (p *CORSPolicy) setOrigin(h http.Header, origin string) {
+	if p.anyOrigin && !p.credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// Credentials forbid "*", so the origin is echoed
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+	}
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// preflight answers an OPTIONS preflight from an allowed origin.
+func (p *CORSPolicy) preflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	origin := r.Header.Get("Origin")
+	p.setOrigin(h, origin)
+	h.Set("Access-Control-Allow-Methods", p.methods)
+	if p.anyHeader {
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			h.Set("Access-Control-Allow-Headers", requested)
+		}
+	} else if p.headers != "" {
+		h.Set("Access-Control-Allow-Headers", p.headers)
+	}
+	if p.maxAge != "" {
+		h.Set("Access-Control-Max-Age", p.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// corsWriter swaps the backend's CORS headers for the proxy's just before
+// the response header is written.
+type corsWriter struct {
+	http.ResponseWriter
+	policy      *CORSPolicy
+	origin      string
+	wroteHeader bool
+}
+
+func (cw *corsWriter) WriteHeader(code int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		h := cw.Header()
+		for key := range h {
+			if strings.HasPrefix(key, "Access-Control-") {
+				h.Del(key)
+			}
+		}
+		if cw.policy.allowed(cw.origin) {
+			cw.policy.setOrigin(h, cw.origin)
+			if cw.policy.exposed != "" {
+				h.Set("Access-Control-Expose-Headers", cw.policy.exposed)
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *corsWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *corsWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *corsWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func corsConfigured(cfg *Config) bool {
+	if cfg.CORS != nil && !cfg.CORS.Disabled {
+		return true
+	}
+	for _, rc := range cfg.Routes {
+		if rc.CORS != nil && !rc.CORS.Disabled {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware short-circuits preflights and decorates cross-origin responses.
+func corsMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	if !corsConfigured(cfg) {
+		return nil, nil
+	}
+	var global *CORSPolicy
+	if cfg.CORS != nil && !cfg.CORS.Disabled {
+		global = NewCORSPolicy(cfg.CORS)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy := global
+			if route := h.route(r); route != nil && route.corsOverride {
+				policy = route.cors
+			}
+			origin := r.Header.Get("Origin")
+			if policy == nil || origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if isPreflight(r) {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				if !policy.allowed(origin) {
+					h.httpError(w, r, "Forbidden - origin not allowed", http.StatusForbidden)
+					return
+				}
+				policy.preflight(w, r)
+				return
+			}
+			next.ServeHTTP(&corsWriter{ResponseWriter: w, policy: policy, origin: origin}, r)
+		})
+	}, nil
+}
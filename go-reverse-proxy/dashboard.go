@@ -0,0 +1,89 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== DASHBOARD ====================
+// The dashboard is a single page served by the Admin API. It polls
+// /v1/dashboard/data and drives the same endpoints as curl users do: /add,
+// /remove and /backends/weight.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+func (a *AdminAPI) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(dashboardPage)
+}
+
+type dashboardBackend struct {
+	URL      string               `json:"url"`
+	Pools    []string             `json:"pools"`
+	Alive    bool                 `json:"alive"`
+	Weight   int                  `json:"weight"`
+	InFlight int64                `json:"in_flight"`
+	Sessions int                  `json:"sessions"` // sticky sessions pinned here
+	Stats    BackendStatsSnapshot `json:"stats"`
+}
+
+// handleDashboardData gathers what the dashboard shows in one response.
+func (a *AdminAPI) handleDashboardData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var sessions map[string]int
+	if a.sessions != nil {
+		sessions = a.sessions.ByBackend()
+	}
+	byURL := make(map[string]*dashboardBackend)
+	for name, p := range a.pools {
+		for _, b := range p.GetBackends() {
+			url := b.URL.String()
+			entry := byURL[url]
+			if entry == nil {
+				entry = &dashboardBackend{
+					URL:      url,
+					Alive:    b.IsAlive(),
+					Weight:   b.GetWeight(),
+					InFlight: atomic.LoadInt64(&b.CurrentConns),
+					Sessions: sessions[url],
+					Stats:    b.Stats.Snapshot(),
+				}
+				byURL[url] = entry
+			}
+			entry.Pools = append(entry.Pools, name)
+		}
+	}
+	backends := make([]*dashboardBackend, 0, len(byURL))
+	for _, entry := range byURL {
+		sort.Strings(entry.Pools)
+		backends = append(backends, entry)
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].URL < backends[j].URL })
+
+	data := map[string]interface{}{
+		"backends":             backends,
+		"in_flight":            a.metrics.inFlight.Load(),
+		"rate_limits":          a.limits.Snapshot(),
+		"rate_limited":         a.metrics.rateLimitedCounts(),
+		"health_checks_paused": a.checker.Paused(),
+		"timestamp":            time.Now().Format(time.RFC3339),
+	}
+	if a.metrics.experiment != nil {
+		data["sessions"] = a.metrics.experiment.Assignments()
+	}
+	json.NewEncoder(w).Encode(data)
+}
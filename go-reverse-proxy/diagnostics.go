@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== DIAGNOSTIC DUMPS ====================
+
+// Diagnostics writes postmortem dumps (goroutine stacks plus a snapshot of
+// pools, limits and logging) without stopping the process. Triggered by
+// SIGQUIT or POST /dump on the admin API.
+type Diagnostics struct {
+	dir     string
+	pools   map[string]*ServerPool
+	handler *ProxyHandler
+	logs    *LogSettings
+}
+
+func NewDiagnostics(dir string, pools map[string]*ServerPool, handler *ProxyHandler, logs *LogSettings) *Diagnostics {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return &Diagnostics{dir: dir, pools: pools, handler: handler, logs: logs}
+}
+
+func (d *Diagnostics) Snapshot() map[string]interface{} {
+	pools := make(map[string][]map[string]interface{}, len(d.pools))
+	for name, p := range d.pools {
+		for _, b := range p.GetBackends() {
+			pools[name] = append(pools[name], map[string]interface{}{
+				"url":                 b.URL.String(),
+				"alive":               b.IsAlive(),
+				"current_connections": atomic.LoadInt64(&b.CurrentConns),
+				"stats":               b.Stats.Snapshot(),
+			})
+		}
+	}
+
+	limits := map[string]interface{}{"enabled": false}
+	if l := d.handler.limits.globalLimiter(); l != nil {
+		limits = map[string]interface{}{
+			"enabled": true,
+			"limit":   float64(l.Limit()),
+			"burst":   l.Burst(),
+			"tokens":  l.Tokens(),
+		}
+	}
+
+	experiment := map[string]interface{}{"enabled": false}
+	if e := d.handler.experiment; e != nil {
+		variants := make(map[string]int, len(e.variants))
+		for _, v := range e.variants {
+			variants[v.name] = v.weight
+		}
+		experiment = map[string]interface{}{
+			"enabled":  true,
+			"name":     e.name,
+			"cookie":   e.cookieName,
+			"variants": variants,
+		}
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	return map[string]interface{}{
+		"timestamp":  time.Now().Format(time.RFC3339),
+		"build":      GetBuildInfo(),
+		"goroutines": runtime.NumGoroutine(),
+		"heap_alloc": mem.HeapAlloc,
+		"pools":      pools,
+		"rate_limit": limits,
+		"experiment": experiment,
+		"logging": map[string]interface{}{
+			"level":             d.logs.Level().String(),
+			"debug_sample_rate": d.logs.DebugSampleRate(),
+		},
+	}
+}
+
+// WriteDump writes the snapshot followed by all goroutine stacks and
+// returns the file path.
+func (d *Diagnostics) WriteDump() (string, error) {
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("reverse-proxy-dump-%s-%d.txt", time.Now().Format("20060102-150405"), os.Getpid())
+	path := filepath.Join(d.dir, name)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fmt.Fprintln(f, "==================== STATE SNAPSHOT ====================")
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d.Snapshot()); err != nil {
+		return "", err
+	}
+
+	fmt.Fprintln(f, "\n==================== GOROUTINES ====================")
+	if err := pprof.Lookup("goroutine").WriteTo(f, 2); err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
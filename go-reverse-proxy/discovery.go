@@ -0,0 +1,402 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"sync"
+)
+
+// ==================== DISCOVERY ====================
+// A pool's backends come from providers: the config file, backends
+// files, dns+ names, etcd, Docker and self-registration. Each provider sends the complete
+// list it has for a pool whenever it changes, and Discovery merges the
+// lists of every provider the pool takes backends from into the pool.
+// Backends added or removed through the Admin API are left alone until a
+// provider lists or drops them.
+type PoolUpdate struct {
+	Pool     string
+	Backends []BackendConfig
+
+	applied chan []string // receives the changes made, when set
+}
+
+// Provider is a source of pool backends.
+type Provider interface {
+	// Name is how pools refer to the provider in pools.<name>.discovery.
+	Name() string
+
+	// Updates delivers the provider's backend lists; Discovery reads it
+	// from before Start.
+	Updates() <-chan PoolUpdate
+
+	Start()
+	Stop()
+}
+
+// Provider names, in the order their backends are listed in a pool.
+const (
+	ProviderConfig   = "config"
+	ProviderFile     = "file"
+	ProviderDNS      = "dns"
+	ProviderEtcd     = "etcd"
+	ProviderDocker   = "docker"
+	ProviderRegister = "register"
+)
+
+var providerNames = []string{ProviderConfig, ProviderFile, ProviderDNS, ProviderEtcd, ProviderDocker, ProviderRegister}
+
+// updates is the channel a provider sends its PoolUpdates on.
+type updates chan PoolUpdate
+
+func (u updates) Updates() <-chan PoolUpdate {
+	return u
+}
+
+// send hands each update to Discovery, waits until it is applied and
+// returns the changes made.
+func (u updates) send(list ...PoolUpdate) []string {
+	var changes []string
+	for _, update := range list {
+		update.applied = make(chan []string, 1)
+		u <- update
+		changes = append(changes, <-update.applied...)
+	}
+	return changes
+}
+
+// Discovery keeps each pool's backends the merge of its providers' lists.
+type Discovery struct {
+	providers []Provider
+	override  map[string]bool // providers whose list replaces the others'
+
+	config        *ConfigProvider
+	files         *FileProvider
+	dns           *DNSDiscovery
+	registrations *Registrations
+
+	mu      sync.Mutex
+	pools   map[string]*ServerPool
+	allowed map[string][]string                   // by pool; nil: every provider
+	listed  map[string]map[string][]BackendConfig // by pool, then provider
+	serving map[string]map[string]string          // by pool: URL -> provider
+	configs map[string]BackendConfig              // by URL, as last applied
+}
+
+// NewDiscovery sets up the providers cfg asks for; Start starts them.
+func NewDiscovery(cfg *Config, pools map[string]*ServerPool) (*Discovery, error) {
+	if err := checkProviders(cfg); err != nil {
+		return nil, err
+	}
+	if err := checkBackendsFiles(cfg); err != nil {
+		return nil, err
+	}
+	d := &Discovery{
+		override: make(map[string]bool),
+		pools:    pools,
+		listed:   make(map[string]map[string][]BackendConfig),
+		serving:  make(map[string]map[string]string),
+		configs:  make(map[string]BackendConfig),
+	}
+	d.SetAllowed(cfg)
+
+	d.config = NewConfigProvider()
+	d.add(d.config, false)
+	d.files = NewFileProvider()
+	d.add(d.files, false)
+	d.dns = NewDNSDiscovery(cfg.DNSDiscovery)
+	d.add(d.dns, false)
+	if cfg.Etcd != nil {
+		registry, err := NewEtcdRegistry(cfg.Etcd, pools)
+		if err != nil {
+			return nil, err
+		}
+		d.add(registry, true)
+	}
+	if cfg.Docker != nil {
+		docker, err := NewDockerDiscovery(cfg.Docker, pools)
+		if err != nil {
+			return nil, err
+		}
+		d.add(docker, false)
+	}
+	registrations, err := NewRegistrations(cfg.Registration, pools)
+	if err != nil {
+		return nil, err
+	}
+	d.registrations = registrations
+	d.add(registrations, false)
+	return d, nil
+}
+
+// checkProviders reports pools naming unknown providers.
+func checkProviders(cfg *Config) error {
+	for _, name := range slices.Sorted(maps.Keys(cfg.Pools)) {
+		for _, p := range cfg.Pools[name].Discovery {
+			if !slices.Contains(providerNames, p) {
+				return fmt.Errorf("pool %s: unknown discovery provider %q (want one of %v)", name, p, providerNames)
+			}
+		}
+	}
+	return nil
+}
+
+// add takes p's updates once started. A provider with override set
+// replaces the other providers' backends in a pool it lists any for.
+func (d *Discovery) add(p Provider, override bool) {
+	d.providers = append(d.providers, p)
+	d.override[p.Name()] = override
+}
+
+// SetAllowed takes the providers each pool of cfg names in its discovery
+// list. The pools are merged again at the config provider's next update.
+func (d *Discovery) SetAllowed(cfg *Config) {
+	allowed := make(map[string][]string)
+	for name, pc := range cfg.Pools {
+		if pc.Discovery != nil {
+			allowed[name] = pc.Discovery
+		}
+	}
+	d.mu.Lock()
+	d.allowed = allowed
+	d.mu.Unlock()
+}
+
+// Start applies cfg's backends, which the pools BuildPools made already
+// have, then starts the providers in order.
+func (d *Discovery) Start(cfg *Config) error {
+	for _, p := range d.providers {
+		go func() {
+			for u := range p.Updates() {
+				changes := d.apply(p.Name(), u)
+				if u.applied != nil {
+					u.applied <- changes
+				}
+			}
+		}()
+	}
+	configs, err := cfg.BackendConfigs()
+	if err != nil {
+		return err
+	}
+	d.config.Set(cfg, configs)
+	d.files.Sync(cfg)
+	if _, err := d.dns.Sync(cfg); err != nil {
+		return err
+	}
+	for _, p := range d.providers {
+		p.Start()
+	}
+	return nil
+}
+
+func (d *Discovery) Stop() {
+	for _, p := range d.providers {
+		p.Stop()
+	}
+}
+
+// Provider returns the provider serving backendURL in pool, or "" for a
+// backend added through the Admin API.
+func (d *Discovery) Provider(pool, backendURL string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.serving[pool][backendURL]
+}
+
+// Listed returns how many backends providers other than the config file
+// list for pool.
+func (d *Discovery) Listed(pool string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for provider, configs := range d.listed[pool] {
+		if provider != ProviderConfig {
+			n += len(configs)
+		}
+	}
+	return n
+}
+
+// wanted merges the lists for pool: an override provider's if it has
+// any, else every provider's in order, a URL listed twice taking the
+// first options. d.mu must be held.
+func (d *Discovery) wanted(pool string) ([]BackendConfig, map[string]string) {
+	var names []string
+	for _, p := range d.providers {
+		if allowed, ok := d.allowed[pool]; !ok || slices.Contains(allowed, p.Name()) {
+			names = append(names, p.Name())
+		}
+	}
+	for _, name := range names {
+		if d.override[name] && len(d.listed[pool][name]) > 0 {
+			names = []string{name}
+			break
+		}
+	}
+
+	var want []BackendConfig
+	from := make(map[string]string)
+	for _, name := range names {
+		for _, bc := range d.listed[pool][name] {
+			if _, dup := from[bc.URL]; !dup {
+				want = append(want, bc)
+				from[bc.URL] = name
+			}
+		}
+	}
+	return want, from
+}
+
+// apply records provider's list for a pool and brings the pool in line.
+func (d *Discovery) apply(provider string, u PoolUpdate) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pool, ok := d.pools[u.Pool]
+	if !ok {
+		log.Printf("Discovery: %s listed backends for unknown pool %s", provider, u.Pool)
+		return nil
+	}
+	if d.listed[u.Pool] == nil {
+		d.listed[u.Pool] = make(map[string][]BackendConfig)
+	}
+	d.listed[u.Pool][provider] = u.Backends
+
+	want, from := d.wanted(u.Pool)
+	old := d.serving[u.Pool]
+	current := pool.GetBackends()
+	suffix := func(url string) string {
+		if p := cmp.Or(from[url], old[url]); p != ProviderConfig {
+			return " (" + p + ")"
+		}
+		return ""
+	}
+
+	var changes []string
+	next := make([]*Backend, 0, len(current)+len(want))
+	for _, b := range current {
+		url := b.URL.String()
+		if _, served := old[url]; served && from[url] == "" {
+			changes = append(changes, fmt.Sprintf("pool %s: removed %s%s", pool.name, url, suffix(url)))
+			continue
+		}
+		next = append(next, b)
+	}
+	for _, bc := range want {
+		i := slices.IndexFunc(next, func(b *Backend) bool { return b.URL.String() == bc.URL })
+		if i < 0 {
+			b, err := d.backend(bc.URL)
+			if err != nil {
+				log.Printf("Discovery: pool %s: %s backend %q: %v", u.Pool, from[bc.URL], bc.URL, err)
+				delete(from, bc.URL)
+				continue
+			}
+			next = append(next, b)
+			i = len(next) - 1
+			changes = append(changes, fmt.Sprintf("pool %s: added %s%s", pool.name, bc.URL, suffix(bc.URL)))
+		}
+		changes = append(changes, d.configure(next[i], bc, from[bc.URL], old[bc.URL] != "")...)
+	}
+	if !slices.Equal(current, next) {
+		pool.SetBackends(next)
+	}
+	d.serving[u.Pool] = from
+
+	// Forget the options of backends no longer served anywhere
+	for url := range d.configs {
+		if !d.served(url) {
+			delete(d.configs, url)
+		}
+	}
+	return changes
+}
+
+// served reports whether a provider serves url in any pool; d.mu must
+// be held.
+func (d *Discovery) served(url string) bool {
+	for _, serving := range d.serving {
+		if _, ok := serving[url]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// backend returns the Backend for url: the one a pool already has, so
+// pools share it, or a new one. d.mu must be held.
+func (d *Discovery) backend(url string) (*Backend, error) {
+	for _, p := range d.pools {
+		for _, b := range p.GetBackends() {
+			if b.URL.String() == url {
+				return b, nil
+			}
+		}
+	}
+	return newBackend(url)
+}
+
+// configure gives b the options of bc when they differ from the last
+// applied; the config file's are always applied, so a reload resets
+// weights changed at runtime. It reports weight and option changes of
+// backends that were already served. d.mu must be held.
+func (d *Discovery) configure(b *Backend, bc BackendConfig, provider string, served bool) []string {
+	prev, known := d.configs[bc.URL]
+	if known && provider != ProviderConfig && reflect.DeepEqual(prev, bc) {
+		return nil
+	}
+	opts, err := newBackendOptions(bc)
+	if err != nil {
+		log.Printf("Discovery: backend %s: %v", bc.URL, err)
+		return nil
+	}
+	before := b.GetWeight()
+	b.configure(bc, opts)
+	d.configs[bc.URL] = bc
+	if !served {
+		return nil
+	}
+
+	var changes []string
+	if weight := b.GetWeight(); weight != before {
+		changes = append(changes, fmt.Sprintf("weight %s: %d -> %d", bc.URL, before, weight))
+	}
+	// Weights and rate limits are reported on their own
+	prev.Weight, prev.RateLimit, bc.Weight, bc.RateLimit = nil, nil, nil, nil
+	if known && !reflect.DeepEqual(prev, bc) {
+		changes = append(changes, fmt.Sprintf("backend %s: options changed", bc.URL))
+	}
+	return changes
+}
+
+// ConfigProvider lists the config file's backends, dns+ names aside.
+type ConfigProvider struct {
+	updates
+}
+
+func NewConfigProvider() *ConfigProvider {
+	return &ConfigProvider{updates: make(updates)}
+}
+
+func (p *ConfigProvider) Name() string { return ProviderConfig }
+func (p *ConfigProvider) Start()       {}
+func (p *ConfigProvider) Stop()        {}
+
+// Set lists cfg's backends, with configs from cfg.BackendConfigs whose
+// options newBackendOptions has checked, and returns what changed in the
+// pools. It can't fail, so a reload can call it once it has checked cfg.
+func (p *ConfigProvider) Set(cfg *Config, configs map[string]BackendConfig) []string {
+	var list []PoolUpdate
+	for _, name := range slices.Sorted(maps.Keys(cfg.Pools)) {
+		u := PoolUpdate{Pool: name, Backends: []BackendConfig{}}
+		for _, raw := range backendURLs(cfg.Pools[name].Backends) {
+			if !isDNSBackend(raw) {
+				u.Backends = append(u.Backends, configs[raw])
+			}
+		}
+		list = append(list, u)
+	}
+	return p.send(list...)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== DNS DISCOVERY ====================
+// A backend written as dns+http://app.internal:8080 (or dns+https://)
+// stands for every address app.internal resolves to: one backend per A or
+// AAAA record, on the given port. dns+srv+http://_app._tcp.internal looks
+// up SRV records instead and takes host and port from each. The names are
+// resolved again every dns_discovery.interval and the pools follow: new
+// addresses are added, vanished ones removed, and the ones kept keep their
+// health and stats. This is what headless Kubernetes services need.
+type DNSDiscoveryConfig struct {
+	// Interval is the time between resolutions (default 30s).
+	Interval Duration `json:"interval,omitempty"`
+
+	// Timeout caps each lookup (default 5s).
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+const dnsBackendPrefix = "dns+"
+
+func isDNSBackend(rawURL string) bool {
+	return strings.HasPrefix(rawURL, dnsBackendPrefix)
+}
+
+// dnsTarget is a parsed dns+ backend.
+type dnsTarget struct {
+	scheme string // of the backends found: http or https
+	srv    bool
+	host   string
+	port   string // "" for SRV
+	path   string
+}
+
+func parseDNSTarget(rawURL string) (*dnsTarget, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	t := &dnsTarget{host: u.Hostname(), port: u.Port(), path: u.Path}
+	switch u.Scheme {
+	case "dns+http", "dns+https":
+		t.scheme = strings.TrimPrefix(u.Scheme, dnsBackendPrefix)
+		if t.port == "" {
+			t.port = map[string]string{"http": "80", "https": "443"}[t.scheme]
+		}
+	case "dns+srv+http", "dns+srv+https":
+		t.scheme, t.srv = strings.TrimPrefix(u.Scheme, "dns+srv+"), true
+		if t.port != "" {
+			return nil, fmt.Errorf("dns+srv backend %q takes its ports from the SRV records", rawURL)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported backend scheme %q", u.Scheme)
+	}
+	if t.host == "" {
+		return nil, fmt.Errorf("backend %q has no host", rawURL)
+	}
+	return t, nil
+}
+
+// resolve returns the backend URLs the name currently stands for, sorted.
+func (t *dnsTarget) resolve(ctx context.Context, resolver *net.Resolver) ([]string, error) {
+	var hostPorts []string
+	if t.srv {
+		_, records, err := resolver.LookupSRV(ctx, "", "", t.host)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			hostPorts = append(hostPorts, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), fmt.Sprint(r.Port)))
+		}
+	} else {
+		addrs, err := resolver.LookupIPAddr(ctx, t.host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			hostPorts = append(hostPorts, net.JoinHostPort(a.IP.String(), t.port))
+		}
+	}
+	urls := make([]string, len(hostPorts))
+	for i, hp := range hostPorts {
+		urls[i] = t.scheme + "://" + hp + t.path
+	}
+	slices.Sort(urls)
+	return slices.Compact(urls), nil
+}
+
+// dnsEntry is a dns+ backend and the addresses it last resolved to.
+type dnsEntry struct {
+	raw    string
+	target *dnsTarget
+	config BackendConfig // given to each backend found, with its own URL
+	pools  []string
+	found  []string // backend URLs, sorted
+}
+
+// DNSDiscovery is the provider of the backends dns+ names resolve to.
+type DNSDiscovery struct {
+	updates
+	interval time.Duration
+	timeout  time.Duration
+	resolver *net.Resolver
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry // by raw URL
+	listed  []string             // pools sent backends, sent none once their names go
+	stop    chan struct{}
+}
+
+func NewDNSDiscovery(cfg DNSDiscoveryConfig) *DNSDiscovery {
+	d := &DNSDiscovery{
+		updates:  make(updates),
+		interval: cfg.Interval.Std(),
+		timeout:  cfg.Timeout.Std(),
+		resolver: net.DefaultResolver,
+		entries:  make(map[string]*dnsEntry),
+		stop:     make(chan struct{}),
+	}
+	if d.interval <= 0 {
+		d.interval = 30 * time.Second
+	}
+	if d.timeout <= 0 {
+		d.timeout = 5 * time.Second
+	}
+	return d
+}
+
+func (d *DNSDiscovery) Name() string { return ProviderDNS }
+
+// Start re-resolves every interval until Stop.
+func (d *DNSDiscovery) Start() {
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.mu.Lock()
+				d.refresh()
+				d.mu.Unlock()
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (d *DNSDiscovery) Stop() {
+	close(d.stop)
+}
+
+// Sync takes the dns+ backends of cfg, resolves them and returns what
+// changed in the pools. Names cfg no longer lists lose their backends.
+func (d *DNSDiscovery) Sync(cfg *Config) ([]string, error) {
+	configs, err := cfg.BackendConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries := make(map[string]*dnsEntry)
+	for _, name := range slices.Sorted(maps.Keys(cfg.Pools)) {
+		for _, raw := range backendURLs(cfg.Pools[name].Backends) {
+			if !isDNSBackend(raw) {
+				continue
+			}
+			e, ok := entries[raw]
+			if !ok {
+				if e, err = d.entry(raw, configs[raw]); err != nil {
+					return nil, fmt.Errorf("backend %s: %w", raw, err)
+				}
+				entries[raw] = e
+			}
+			e.pools = append(e.pools, name)
+		}
+	}
+	d.entries = entries
+	return d.refresh(), nil
+}
+
+// entry returns the entry for raw with bc's options, keeping the
+// addresses found for it so far.
+func (d *DNSDiscovery) entry(raw string, bc BackendConfig) (*dnsEntry, error) {
+	target, err := parseDNSTarget(raw)
+	if err != nil {
+		return nil, err
+	}
+	// https backends found by address are verified against the name
+	if target.scheme == "https" && !target.srv && (bc.TLS == nil || bc.TLS.ServerName == "") {
+		tc := BackendTLSConfig{}
+		if bc.TLS != nil {
+			tc = *bc.TLS
+		}
+		tc.ServerName = target.host
+		bc.TLS = &tc
+	}
+	if _, err := newBackendOptions(bc); err != nil {
+		return nil, err
+	}
+	e := &dnsEntry{raw: raw, target: target, config: bc}
+	if old, ok := d.entries[raw]; ok {
+		e.found = old.found
+	}
+	return e, nil
+}
+
+// refresh resolves every entry and sends each pool the backends found
+// for its names; d.mu must be held. A failed lookup keeps the addresses
+// found before, so a DNS outage doesn't empty the pools.
+func (d *DNSDiscovery) refresh() []string {
+	lists := make(map[string][]BackendConfig)
+	for _, pool := range d.listed {
+		lists[pool] = []BackendConfig{}
+	}
+	for _, raw := range slices.Sorted(maps.Keys(d.entries)) {
+		e := d.entries[raw]
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		urls, err := e.target.resolve(ctx, d.resolver)
+		cancel()
+		if err != nil {
+			log.Printf("DNS discovery: %s: %v", raw, err)
+		} else {
+			e.found = urls
+		}
+		for _, pool := range e.pools {
+			for _, u := range e.found {
+				bc := e.config
+				bc.URL = u
+				lists[pool] = append(lists[pool], bc)
+			}
+		}
+	}
+
+	var list []PoolUpdate
+	d.listed = d.listed[:0]
+	for _, pool := range slices.Sorted(maps.Keys(lists)) {
+		list = append(list, PoolUpdate{Pool: pool, Backends: lists[pool]})
+		if len(lists[pool]) > 0 {
+			d.listed = append(d.listed, pool)
+		}
+	}
+	changes := d.send(list...)
+	for _, c := range changes {
+		log.Printf("DNS discovery: %s", c)
+	}
+	return changes
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== UPSTREAM DNS CACHE ====================
+// DNSCacheConfig keeps the addresses backend hostnames resolve to for TTL,
+// so upstream dials at high request rates don't each ask the system
+// resolver. Names that don't exist are remembered for NegativeTTL; other
+// lookup failures (timeouts, unreachable servers) are never cached. IP and
+// unix socket backends are dialed as before. Dials try the addresses in
+// the order they were resolved until one connects.
+type DNSCacheConfig struct {
+	TTL         Duration `json:"ttl"`                    // 0 disables the cache
+	NegativeTTL Duration `json:"negative_ttl,omitempty"` // default 5s
+	Timeout     Duration `json:"timeout,omitempty"`      // per lookup, default 5s
+}
+
+// DNSCache resolves upstream hostnames for dials. A nil *DNSCache leaves
+// dialing to the dialer's own resolution.
+type DNSCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	timeout     time.Duration
+	resolver    *net.Resolver
+
+	mu      sync.Mutex
+	entries map[string]*dnsCacheEntry // by host
+
+	hits, misses atomic.Uint64
+}
+
+// dnsCacheEntry is one lookup; dials wanting it while it runs wait on done.
+type dnsCacheEntry struct {
+	done    chan struct{}
+	addrs   []string
+	err     error
+	expires time.Time // set when done
+}
+
+// NewDNSCache returns nil when cfg caches nothing.
+func NewDNSCache(cfg *DNSCacheConfig) *DNSCache {
+	if cfg == nil || cfg.TTL == 0 {
+		return nil
+	}
+	c := &DNSCache{
+		ttl:         cfg.TTL.Std(),
+		negativeTTL: cfg.NegativeTTL.Std(),
+		timeout:     cfg.Timeout.Std(),
+		resolver:    net.DefaultResolver,
+		entries:     make(map[string]*dnsCacheEntry),
+	}
+	if c.negativeTTL <= 0 {
+		c.negativeTTL = 5 * time.Second
+	}
+	if c.timeout <= 0 {
+		c.timeout = 5 * time.Second
+	}
+	return c
+}
+
+// dial wraps a dialer so hostnames are resolved through c.
+func (c *DNSCache) dial(dial dialFunc) dialFunc {
+	if c == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return dial(ctx, network, addr)
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, err
+	}
+}
+
+// lookup returns host's addresses, from the cache while they are fresh.
+// Concurrent misses for a host share one lookup.
+func (c *DNSCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	e := c.entries[host]
+	if e != nil && !e.expired() {
+		c.mu.Unlock()
+		c.hits.Add(1)
+		select {
+		case <-e.done:
+			return e.addrs, e.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	e = &dnsCacheEntry{done: make(chan struct{})}
+	c.entries[host] = e
+	c.mu.Unlock()
+	c.misses.Add(1)
+
+	// The lookup is shared, so one caller giving up doesn't end it
+	lookupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.timeout)
+	addrs, err := c.resolver.LookupHost(lookupCtx, host)
+	cancel()
+
+	var dnsErr *net.DNSError
+	c.mu.Lock()
+	switch {
+	case err == nil:
+		e.addrs, e.expires = addrs, time.Now().Add(c.ttl)
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		e.err, e.expires = err, time.Now().Add(c.negativeTTL)
+	default:
+		e.err = err
+		if c.entries[host] == e {
+			delete(c.entries, host)
+		}
+	}
+	close(e.done)
+	c.mu.Unlock()
+	return e.addrs, e.err
+}
+
+// expired is false while the lookup runs; c.mu must be held.
+func (e *dnsCacheEntry) expired() bool {
+	select {
+	case <-e.done:
+		return time.Now().After(e.expires)
+	default:
+		return false
+	}
+}
+
+// Flush forgets every cached name and returns how many there were.
+func (c *DNSCache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[string]*dnsCacheEntry)
+	return n
+}
+
+// Len is the number of names cached or being looked up.
+func (c *DNSCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Hits and Misses count the dials answered from the cache and the
+// lookups made.
+func (c *DNSCache) Hits() uint64   { return c.hits.Load() }
+func (c *DNSCache) Misses() uint64 { return c.misses.Load() }
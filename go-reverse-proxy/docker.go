@@ -0,0 +1,305 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== DOCKER DISCOVERY ====================
+// With a docker section, running containers labelled rproxy.enable=true
+// are added to a pool as backends, and removed when they stop, so a
+// compose stack wires itself into the proxy:
+//
+//	labels:
+//	  rproxy.enable: "true"
+//	  rproxy.port: "8080"     # default: the container's only exposed port
+//	  rproxy.pool: "api"      # default: default
+//	  rproxy.scheme: "https"  # default: http
+//	  rproxy.weight: "3"      # default: 1
+//
+// The proxy reaches a container at its address on docker.network, or on
+// its only network. The Docker Engine API is read from the socket, and
+// its event stream tells when to look again.
+type DockerConfig struct {
+	// Host is the Engine API address: unix:///path (default
+	// unix:///var/run/docker.sock) or tcp://host:port.
+	Host string `json:"host,omitempty"`
+
+	// Network picks the address of containers on several networks.
+	Network string `json:"network,omitempty"`
+}
+
+const (
+	defaultDockerHost = "unix:///var/run/docker.sock"
+
+	dockerLabelEnable = "rproxy.enable"
+	dockerLabelPort   = "rproxy.port"
+	dockerLabelPool   = "rproxy.pool"
+	dockerLabelScheme = "rproxy.scheme"
+	dockerLabelWeight = "rproxy.weight"
+)
+
+// dockerRetryDelay is the wait before reconnecting to the Engine API.
+const dockerRetryDelay = 5 * time.Second
+
+// dockerContainer is what the Engine API's container list says of one.
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []struct {
+		PrivatePort int    `json:"PrivatePort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func (c *dockerContainer) name() string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	return c.ID[:min(12, len(c.ID))]
+}
+
+// backend returns the pool and backend the container's labels ask for.
+func (c *dockerContainer) backend(network string) (string, BackendConfig, error) {
+	var bc BackendConfig
+	port := c.Labels[dockerLabelPort]
+	if port == "" {
+		var tcp []int
+		for _, p := range c.Ports {
+			if p.Type == "tcp" && !slices.Contains(tcp, p.PrivatePort) {
+				tcp = append(tcp, p.PrivatePort)
+			}
+		}
+		if len(tcp) != 1 {
+			return "", bc, fmt.Errorf("%d exposed ports; set %s", len(tcp), dockerLabelPort)
+		}
+		port = strconv.Itoa(tcp[0])
+	}
+
+	var addr string
+	if network != "" {
+		n, ok := c.NetworkSettings.Networks[network]
+		if !ok {
+			return "", bc, fmt.Errorf("not on network %s", network)
+		}
+		addr = cmp.Or(n.IPAddress, n.GlobalIPv6Address)
+	} else if len(c.NetworkSettings.Networks) == 1 {
+		for _, n := range c.NetworkSettings.Networks {
+			addr = cmp.Or(n.IPAddress, n.GlobalIPv6Address)
+		}
+	} else {
+		return "", bc, fmt.Errorf("on %d networks; set docker.network", len(c.NetworkSettings.Networks))
+	}
+	if addr == "" {
+		return "", bc, fmt.Errorf("no address")
+	}
+
+	scheme := c.Labels[dockerLabelScheme]
+	if scheme == "" {
+		scheme = "http"
+	}
+	bc.URL = scheme + "://" + net.JoinHostPort(addr, port)
+	if w := c.Labels[dockerLabelWeight]; w != "" {
+		weight, err := strconv.Atoi(w)
+		if err != nil {
+			return "", bc, fmt.Errorf("%s: %v", dockerLabelWeight, err)
+		}
+		bc.Weight = &weight
+	}
+	pool := c.Labels[dockerLabelPool]
+	if pool == "" {
+		pool = "default"
+	}
+	return pool, bc, nil
+}
+
+// DockerDiscovery is the provider of the labelled containers.
+type DockerDiscovery struct {
+	updates
+	network string
+	client  *http.Client
+	base    string // URL the API paths are appended to
+
+	ctx    context.Context // canceled by Stop
+	cancel context.CancelFunc
+
+	pools map[string]*ServerPool // the pools containers may join
+	mu    sync.Mutex             // one sync at a time
+}
+
+func NewDockerDiscovery(cfg *DockerConfig, pools map[string]*ServerPool) (*DockerDiscovery, error) {
+	host := cfg.Host
+	if host == "" {
+		host = defaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("docker: host %q: %w", host, err)
+	}
+	d := &DockerDiscovery{updates: make(updates), network: cfg.Network, pools: pools}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		d.base = "http://docker"
+		d.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}}
+	case "tcp", "http":
+		d.base = "http://" + u.Host
+		d.client = &http.Client{}
+	default:
+		return nil, fmt.Errorf("docker: host %q must be unix:// or tcp://", host)
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	return d, nil
+}
+
+// Start lists the containers once, then follows the Engine API's events
+// until Stop.
+func (d *DockerDiscovery) Start() {
+	err := d.sync()
+	if err != nil {
+		log.Printf("Docker discovery: %v", err)
+	}
+	go func() {
+		for {
+			if err == nil {
+				err = d.follow()
+			}
+			if d.ctx.Err() != nil {
+				return
+			}
+			log.Printf("Docker discovery: %v; retrying in %v", err, dockerRetryDelay)
+			select {
+			case <-time.After(dockerRetryDelay):
+			case <-d.ctx.Done():
+				return
+			}
+			err = d.sync()
+		}
+	}()
+}
+
+func (d *DockerDiscovery) Name() string { return ProviderDocker }
+
+func (d *DockerDiscovery) Stop() {
+	d.cancel()
+}
+
+func (d *DockerDiscovery) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sync lists the running labelled containers and sends each pool those
+// that join it.
+func (d *DockerDiscovery) sync() error {
+	filters, _ := json.Marshal(map[string][]string{
+		"label":  {dockerLabelEnable + "=true"},
+		"status": {"running"},
+	})
+	ctx, cancel := context.WithTimeout(d.ctx, 10*time.Second)
+	defer cancel()
+	resp, err := d.get(ctx, "/containers/json?filters="+url.QueryEscape(string(filters)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return fmt.Errorf("container list: %w", err)
+	}
+
+	lists := make(map[string][]BackendConfig)
+	for _, c := range containers {
+		pool, bc, err := c.backend(d.network)
+		if err == nil {
+			_, err = newBackendOptions(bc)
+		}
+		if err == nil && d.pools[pool] == nil {
+			err = fmt.Errorf("no pool %s in the config file", pool)
+		}
+		if err != nil {
+			log.Printf("Docker discovery: ignoring container %s: %v", c.name(), err)
+			continue
+		}
+		lists[pool] = append(lists[pool], bc)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var list []PoolUpdate
+	for _, pool := range slices.Sorted(maps.Keys(d.pools)) {
+		backends := lists[pool]
+		slices.SortFunc(backends, func(a, b BackendConfig) int { return strings.Compare(a.URL, b.URL) })
+		list = append(list, PoolUpdate{Pool: pool, Backends: backends})
+	}
+	for _, c := range d.send(list...) {
+		log.Printf("Docker discovery: %s", c)
+	}
+	return nil
+}
+
+// follow reads the container events and lists the containers again after
+// each start or stop. It returns when the stream breaks.
+func (d *DockerDiscovery) follow() error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die", "pause", "unpause"},
+		"label": {dockerLabelEnable + "=true"},
+	})
+	resp, err := d.get(d.ctx, "/events?filters="+url.QueryEscape(string(filters)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event json.RawMessage
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF {
+				err = errors.New("event stream closed")
+			}
+			return err
+		}
+		if err := d.sync(); err != nil {
+			return err
+		}
+	}
+}
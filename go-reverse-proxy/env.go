@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ==================== ENVIRONMENT ====================
+// Config files may refer to environment variables, and a few settings can
+// be set from the environment outright, so containers can configure the
+// proxy without mounting a file.
+
+// interpolateEnv replaces ${VAR} in the file's strings, keys included, with
+// the variable's value; ${VAR:-default} falls back to default when VAR is
+// unset or empty, and $${ stands for a literal ${. Referring to an unset
+// variable without a default is an error, so a missing secret doesn't
+// silently become "". Numbers and booleans can't be interpolated; use the
+// overrides below for those.
+//
+// Only the string literals change, so the document keeps its lines and
+// later errors still point at the right place in the file. data must be
+// valid JSON; see checkSyntax.
+func interpolateEnv(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte("${")) {
+		return data, nil
+	}
+	var out bytes.Buffer
+	for {
+		start := bytes.IndexByte(data, '"')
+		if start < 0 {
+			out.Write(data)
+			return out.Bytes(), nil
+		}
+		end := start + 1
+		for data[end] != '"' {
+			if data[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		end++
+		out.Write(data[:start])
+		literal := data[start:end]
+		if bytes.Contains(literal, []byte("${")) {
+			var err error
+			if literal, err = interpolateLiteral(literal); err != nil {
+				return nil, &SchemaError{Line: bytes.Count(out.Bytes(), []byte("\n")) + 1, Msg: err.Error()}
+			}
+		}
+		out.Write(literal)
+		data = data[end:]
+	}
+}
+
+// interpolateLiteral expands one JSON string literal, quotes included.
+func interpolateLiteral(literal []byte) ([]byte, error) {
+	var s string
+	if err := json.Unmarshal(literal, &s); err != nil {
+		return nil, err
+	}
+	s, err := expandEnv(s)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+func expandEnv(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s)
+		}
+		b.WriteString(s[:i])
+		ref := s[i+2 : i+end]
+		name, def, hasDefault := strings.Cut(ref, ":-")
+		if name == "" {
+			return "", fmt.Errorf("empty variable name in %q", s)
+		}
+		value, ok := os.LookupEnv(name)
+		switch {
+		case value == "" && hasDefault:
+			value = def
+		case !ok:
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(value)
+		s = s[i+end+1:]
+	}
+}
+
+// envOverrides are the settings the environment can set directly. They are
+// applied after the file, so they win over it.
+var envOverrides = []struct {
+	name  string
+	field string // the one it sets, as SchemaError names it
+	apply func(cfg *Config, value string) error
+}{
+	{"RP_PORT", "port", func(cfg *Config, v string) error { return envInt(&cfg.Port, v) }},
+	{"RP_ADMIN_PORT", "admin_port", func(cfg *Config, v string) error { return envInt(&cfg.AdminPort, v) }},
+	{"RP_RATE_LIMIT", "rate_limit", func(cfg *Config, v string) error { return envInt(&cfg.RateLimit, v) }},
+	{"RP_STRATEGY", "strategy", func(cfg *Config, v string) error {
+		cfg.Strategy = v
+		return nil
+	}},
+	{"RP_BACKENDS", "pools.default.backends", func(cfg *Config, v string) error {
+		var backends []BackendConfig
+		for _, b := range strings.Split(v, ",") {
+			if b = strings.TrimSpace(b); b != "" {
+				backends = append(backends, BackendConfig{URL: b})
+			}
+		}
+		if len(backends) == 0 {
+			return fmt.Errorf("no backends")
+		}
+		pc := cfg.Pools["default"]
+		pc.Backends = backends
+		if cfg.Pools == nil {
+			cfg.Pools = make(map[string]PoolConfig)
+		}
+		cfg.Pools["default"] = pc
+		return nil
+	}},
+	{"RP_LOG_LEVEL", "log_level", func(cfg *Config, v string) error {
+		cfg.LogLevel = v
+		return nil
+	}},
+}
+
+func envInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", v)
+	}
+	*dst = n
+	return nil
+}
+
+// applyEnvOverrides sets cfg from whichever override variables are set and
+// returns their names.
+func applyEnvOverrides(cfg *Config) ([]string, error) {
+	var applied []string
+	for _, o := range envOverrides {
+		v, ok := os.LookupEnv(o.name)
+		if !ok {
+			continue
+		}
+		if err := o.apply(cfg, v); err != nil {
+			return nil, fmt.Errorf("%s: %w", o.name, err)
+		}
+		applied = append(applied, o.name)
+	}
+	return applied, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ==================== ERROR PAGES ====================
+// ErrorPagesConfig replaces the plain-text bodies of errors the proxy
+// generates itself (rate limited, no backends, bad gateway, ...) with
+// templates. Keys are status codes ("502") or "default"; values are
+// template files. Clients asking for JSON get the json set, others html.
+type ErrorPagesConfig struct {
+	HTML map[string]string `json:"html,omitempty"`
+	JSON map[string]string `json:"json,omitempty"`
+}
+
+// errorPageData is what the templates see.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+	Path       string
+	Timestamp  string // RFC 3339, UTC
+}
+
+type errorTemplate interface {
+	Execute(w io.Writer, data any) error
+}
+
+type ErrorPages struct {
+	html map[string]errorTemplate
+	json map[string]errorTemplate
+}
+
+func NewErrorPages(cfg *ErrorPagesConfig) (*ErrorPages, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	p := &ErrorPages{
+		html: make(map[string]errorTemplate),
+		json: make(map[string]errorTemplate),
+	}
+	for key, file := range cfg.HTML {
+		if err := validErrorPageKey(key); err != nil {
+			return nil, err
+		}
+		t, err := htmltemplate.New(filepath.Base(file)).ParseFiles(file)
+		if err != nil {
+			return nil, fmt.Errorf("error_pages: %w", err)
+		}
+		p.html[key] = t
+	}
+	// JSON templates are plain text; {{json .Message}} quotes a value
+	funcs := template.FuncMap{"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	}}
+	for key, file := range cfg.JSON {
+		if err := validErrorPageKey(key); err != nil {
+			return nil, err
+		}
+		t, err := template.New(filepath.Base(file)).Funcs(funcs).ParseFiles(file)
+		if err != nil {
+			return nil, fmt.Errorf("error_pages: %w", err)
+		}
+		p.json[key] = t
+	}
+	return p, nil
+}
+
+func validErrorPageKey(key string) error {
+	if key == "default" {
+		return nil
+	}
+	if code, err := strconv.Atoi(key); err != nil || code < 400 || code > 599 {
+		return fmt.Errorf("error_pages: key %q is neither a 4xx/5xx status nor \"default\"", key)
+	}
+	return nil
+}
+
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") || strings.Contains(accept, "+json")
+}
+
+// write renders the page for code; false if none is configured or the
+// template fails, leaving w untouched.
+func (p *ErrorPages) write(w http.ResponseWriter, r *http.Request, msg string, code int) bool {
+	set, contentType := p.html, "text/html; charset=utf-8"
+	if len(p.json) > 0 && (wantsJSON(r) || len(p.html) == 0) {
+		set, contentType = p.json, "application/json"
+	}
+	t, ok := set[strconv.Itoa(code)]
+	if !ok {
+		if t, ok = set["default"]; !ok {
+			return false
+		}
+	}
+
+	var buf bytes.Buffer
+	err := t.Execute(&buf, errorPageData{
+		Status:     code,
+		StatusText: http.StatusText(code),
+		Message:    msg,
+		RequestID:  requestID(r),
+		Path:       r.URL.Path,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return false
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+	return true
+}
+
+// httpError replaces http.Error for errors the proxy generates itself.
+func (h *ProxyHandler) httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if h.errorPages == nil || !h.errorPages.write(w, r, msg, code) {
+		http.Error(w, msg, code)
+	}
+}
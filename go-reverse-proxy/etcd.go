@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== ETCD REGISTRY ====================
+// With an etcd section, pool backends are read from keys under a prefix
+// and followed with a watch, so every proxy pointed at the same cluster
+// serves the same backends. A key is <prefix><pool>/<id>; its value is a
+// backend URL or a backend object as in the config file:
+//
+//	/rproxy/backends/default/web-1  http://10.0.1.5:8080
+//	/rproxy/backends/api/api-1      {"url": "http://10.0.2.7:9000", "weight": 3}
+//
+// A pool with keys serves exactly those backends; a pool without keys, or
+// every pool while etcd can't be reached, serves its backends from the
+// other providers. etcd is spoken to through its v3 JSON gateway, so no client
+// library is needed.
+type EtcdConfig struct {
+	// Endpoints are the cluster's client URLs, tried in order.
+	Endpoints []string `json:"endpoints"`
+
+	// Prefix is where the backend keys live (default /rproxy/backends/).
+	Prefix string `json:"prefix,omitempty"`
+
+	// Username and Password, when set, authenticate to etcd.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Timeout caps each request other than the watch (default 5s).
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+const defaultEtcdPrefix = "/rproxy/backends/"
+
+// etcdRetryDelay is the wait before reconnecting after a failed read or a
+// broken watch.
+const etcdRetryDelay = 5 * time.Second
+
+// EtcdRegistry is the provider of the backends listed in etcd. Its lists
+// replace the other providers' in the pools it lists backends for.
+type EtcdRegistry struct {
+	updates
+	endpoints []string
+	prefix    string
+	username  string
+	password  string
+	timeout   time.Duration
+	client    *http.Client
+
+	ctx    context.Context // canceled by Stop
+	cancel context.CancelFunc
+
+	pools map[string]*ServerPool // the pools keys may name
+
+	mu       sync.Mutex
+	revision int64
+	token    string
+}
+
+func NewEtcdRegistry(cfg *EtcdConfig, pools map[string]*ServerPool) (*EtcdRegistry, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, fmt.Errorf("etcd: no endpoints")
+	}
+	for _, e := range cfg.Endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, fmt.Errorf("etcd: endpoint %q: %w", e, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("etcd: endpoint %q must be an http or https URL", e)
+		}
+	}
+	if (cfg.Username == "") != (cfg.Password == "") {
+		return nil, fmt.Errorf("etcd: username and password go together")
+	}
+	r := &EtcdRegistry{
+		updates:   make(updates),
+		endpoints: cfg.Endpoints,
+		prefix:    cmp.Or(cfg.Prefix, defaultEtcdPrefix),
+		username:  cfg.Username,
+		password:  cfg.Password,
+		timeout:   cfg.Timeout.Std(),
+		client:    &http.Client{},
+		pools:     pools,
+	}
+	if r.timeout <= 0 {
+		r.timeout = 5 * time.Second
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r, nil
+}
+
+// Start reads the keys once, so the proxy starts with them when etcd is
+// up, then watches them until Stop.
+func (r *EtcdRegistry) Start() {
+	err := r.sync()
+	if err != nil {
+		log.Printf("etcd: %v; serving the config file's backends", err)
+	}
+	go func() {
+		for {
+			if err == nil {
+				err = r.watch()
+			}
+			if r.ctx.Err() != nil {
+				return
+			}
+			log.Printf("etcd: %v; retrying in %v", err, etcdRetryDelay)
+			select {
+			case <-time.After(etcdRetryDelay):
+			case <-r.ctx.Done():
+				return
+			}
+			err = r.sync()
+		}
+	}()
+}
+
+func (r *EtcdRegistry) Name() string { return ProviderEtcd }
+
+func (r *EtcdRegistry) Stop() {
+	r.cancel()
+}
+
+// sync reads every key under the prefix and sends each pool the
+// backends listed for it, which may be none.
+func (r *EtcdRegistry) sync() error {
+	var resp struct {
+		Header struct {
+			Revision int64 `json:"revision,string"`
+		} `json:"header"`
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, r.timeout)
+	defer cancel()
+	err := r.call(ctx, "/v3/kv/range", map[string]any{
+		"key":       []byte(r.prefix),
+		"range_end": prefixEnd(r.prefix),
+	}, &resp)
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string][]BackendConfig)
+	for _, kv := range resp.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), r.prefix)
+		pool, _, ok := strings.Cut(key, "/")
+		if !ok || pool == "" {
+			log.Printf("etcd: ignoring key %s: want %s<pool>/<id>", kv.Key, r.prefix)
+			continue
+		}
+		if _, ok := r.pools[pool]; !ok {
+			log.Printf("etcd: ignoring key %s: no pool %s in the config file", kv.Key, pool)
+			continue
+		}
+		var bc BackendConfig
+		var err error
+		value := bytes.TrimSpace(kv.Value)
+		if len(value) > 0 && value[0] == '{' {
+			err = json.Unmarshal(value, &bc)
+		} else {
+			bc.URL = string(value)
+		}
+		if err == nil {
+			_, err = newBackendOptions(bc)
+		}
+		if err != nil {
+			log.Printf("etcd: ignoring key %s: %v", kv.Key, err)
+			continue
+		}
+		entries[pool] = append(entries[pool], bc)
+	}
+
+	r.mu.Lock()
+	r.revision = resp.Header.Revision
+	r.mu.Unlock()
+	var list []PoolUpdate
+	for _, pool := range slices.Sorted(maps.Keys(r.pools)) {
+		list = append(list, PoolUpdate{Pool: pool, Backends: entries[pool]})
+	}
+	for _, c := range r.send(list...) {
+		log.Printf("etcd: %s", c)
+	}
+	return nil
+}
+
+// watch follows the prefix from the revision last read, and reads it
+// again whenever a key changes. It returns when the watch breaks.
+func (r *EtcdRegistry) watch() error {
+	r.mu.Lock()
+	start := r.revision + 1
+	r.mu.Unlock()
+
+	body, err := r.open(r.ctx, "/v3/watch", map[string]any{
+		"create_request": map[string]any{
+			"key":            []byte(r.prefix),
+			"range_end":      prefixEnd(r.prefix),
+			"start_revision": fmt.Sprint(start),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+	for {
+		var msg struct {
+			Result struct {
+				CompactRevision int64             `json:"compact_revision,string"`
+				Canceled        bool              `json:"canceled"`
+				Events          []json.RawMessage `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				err = errors.New("watch closed")
+			}
+			return err
+		}
+		switch {
+		case msg.Error != nil:
+			return fmt.Errorf("watch: %s", msg.Error.Message)
+		case msg.Result.CompactRevision != 0:
+			return fmt.Errorf("watch: revision %d was compacted", start)
+		case msg.Result.Canceled:
+			return errors.New("watch canceled")
+		case len(msg.Result.Events) > 0:
+			if err := r.sync(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// call posts req to path and decodes the answer into resp.
+func (r *EtcdRegistry) call(ctx context.Context, path string, req, resp any) error {
+	body, err := r.open(ctx, path, req)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(resp)
+}
+
+// open posts req to path on the first endpoint that answers, logging in
+// first when credentials are set, and returns the response body.
+func (r *EtcdRegistry) open(ctx context.Context, path string, req any) (io.ReadCloser, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, endpoint := range r.endpoints {
+		body, err := r.post(ctx, endpoint, path, data)
+		if err == nil {
+			return body, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", endpoint, err))
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+func (r *EtcdRegistry) post(ctx context.Context, endpoint, path string, data []byte) (io.ReadCloser, error) {
+	for attempt := 0; ; attempt++ {
+		if r.username != "" && r.currentToken() == "" {
+			if err := r.authenticate(ctx, endpoint); err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+path, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token := r.currentToken(); token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp.Body, nil
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		// An expired token is replaced once
+		if resp.StatusCode == http.StatusUnauthorized && r.username != "" && attempt == 0 {
+			r.setToken("")
+			continue
+		}
+		return nil, fmt.Errorf("%s: %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+}
+
+func (r *EtcdRegistry) authenticate(ctx context.Context, endpoint string) error {
+	data, _ := json.Marshal(map[string]string{"name": r.username, "password": r.password})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/v3/auth/authenticate", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("authenticate: %s", resp.Status)
+	}
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return fmt.Errorf("authenticate: %w", err)
+	}
+	r.setToken(auth.Token)
+	return nil
+}
+
+func (r *EtcdRegistry) currentToken() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.token
+}
+
+func (r *EtcdRegistry) setToken(token string) {
+	r.mu.Lock()
+	r.token = token
+	r.mu.Unlock()
+}
+
+// prefixEnd returns the range end covering every key starting with
+// prefix: the prefix with its last byte incremented.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0} // every key
+}
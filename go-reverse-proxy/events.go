@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== EVENTS ====================
+const (
+	EventBackendUp    = "backend_up"    // Reason: probe, passive or manual
+	EventBackendDown  = "backend_down"  // Reason: probe, passive or manual
+	EventRateLimited  = "rate_limited"  // Detail: the limit's scope
+	EventRetry        = "retry"         // Detail: why the try failed
+	EventConfigReload = "config_reload" // Detail: what was changed
+)
+
+type Event struct {
+	Type      string    `json:"type"`
+	Pool      string    `json:"pool,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// EventBus fans proxy events out to subscribers (logger, metrics, streams).
+// A nil *EventBus is valid and drops everything.
+type EventBus struct {
+	mu          sync.RWMutex
+	nextID      int
+	subscribers map[int]func(Event)
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[int]func(Event))}
+}
+
+// Subscribe registers fn and returns a function that removes it again.
+// Subscribers are called synchronously and must not block.
+func (b *EventBus) Subscribe(fn func(Event)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.subscribers[id] = fn
+
+	return func() {
+		b.mu.Lock()
+		delete(b.subscribers, id)
+		b.mu.Unlock()
+	}
+}
+
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.subscribers {
+		fn(e)
+	}
+}
+
+func logEvent(e Event) {
+	switch e.Type {
+	case EventBackendDown:
+		reason := e.Reason
+		if e.Detail != "" {
+			reason += ": " + e.Detail
+		}
+		log.Printf("Backend %s is now DOWN (pool %s, %s)", e.Backend, e.Pool, reason)
+	case EventBackendUp:
+		log.Printf("Backend %s is now UP (pool %s, %s)", e.Backend, e.Pool, e.Reason)
+	}
+}
+
+// eventStreamBuffer is how many events a slow /events client may fall
+// behind before further events are dropped for it.
+const eventStreamBuffer = 256
+
+// serveEvents streams events to w as Server-Sent Events until the client
+// leaves or done is closed. ?type=a,b limits the stream to those types.
+func (b *EventBus) serveEvents(w http.ResponseWriter, r *http.Request, done <-chan struct{}) {
+	var types []string
+	if t := r.URL.Query().Get("type"); t != "" {
+		types = strings.Split(t, ",")
+	}
+
+	// The admin server's write timeout would cut the stream off
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		adminError(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		mu      sync.Mutex
+		dropped int
+	)
+	ch := make(chan Event, eventStreamBuffer)
+	unsubscribe := b.Subscribe(func(e Event) {
+		if types != nil && !slices.Contains(types, e.Type) {
+			return
+		}
+		select {
+		case ch <- e:
+		default:
+			mu.Lock()
+			dropped++
+			mu.Unlock()
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	rc.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e := <-ch:
+			mu.Lock()
+			if dropped > 0 {
+				fmt.Fprintf(w, ": dropped %d events\n\n", dropped)
+				dropped = 0
+			}
+			mu.Unlock()
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== A/B EXPERIMENTS ====================
+type ExperimentConfig struct {
+	Name         string          `json:"name"`
+	CookieName   string          `json:"cookie_name"`
+	Secret       string          `json:"secret"`
+	CookieMaxAge int             `json:"cookie_max_age"` // seconds
+	Variants     []VariantConfig `json:"variants"`
+}
+
+type VariantConfig struct {
+	Name   string `json:"name"`
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+type variant struct {
+	name     string
+	pool     *ServerPool
+	weight   int
+	assigned uint64 // clients newly bucketed here; atomic
+}
+
+// Experiment buckets each new client into a variant and pins it there with a
+// signed cookie, so the same client keeps hitting the same pool across sessions.
+type Experiment struct {
+	name        string
+	cookieName  string
+	cookieTTL   time.Duration
+	secret      []byte
+	variants    []variant
+	totalWeight int
+}
+
+func NewExperiment(cfg *ExperimentConfig, pools map[string]*ServerPool) (*Experiment, error) {
+	if len(cfg.Variants) == 0 {
+		return nil, fmt.Errorf("experiment %q has no variants", cfg.Name)
+	}
+
+	e := &Experiment{
+		name:       cfg.Name,
+		cookieName: cfg.CookieName,
+		cookieTTL:  time.Duration(cfg.CookieMaxAge) * time.Second,
+		secret:     []byte(cfg.Secret),
+	}
+	if e.cookieName == "" {
+		e.cookieName = "proxy_experiment"
+	}
+	if e.cookieTTL <= 0 {
+		e.cookieTTL = 30 * 24 * time.Hour
+	}
+	if len(e.secret) == 0 {
+		// Cookies signed with a random key do not survive a restart
+		e.secret = make([]byte, 32)
+		if _, err := crand.Read(e.secret); err != nil {
+			return nil, err
+		}
+		log.Printf("Experiment %s: no secret configured, using a random key", cfg.Name)
+	}
+
+	for _, v := range cfg.Variants {
+		pool, ok := pools[v.Pool]
+		if !ok {
+			return nil, fmt.Errorf("variant %q references unknown pool %q", v.Name, v.Pool)
+		}
+		if v.Weight < 0 {
+			return nil, fmt.Errorf("variant %q has negative weight", v.Name)
+		}
+		e.variants = append(e.variants, variant{name: v.Name, pool: pool, weight: v.Weight})
+		e.totalWeight += v.Weight
+	}
+	if e.totalWeight == 0 {
+		return nil, fmt.Errorf("experiment %q has no variant with a positive weight", cfg.Name)
+	}
+
+	return e, nil
+}
+
+// Assign returns the variant and pool for the request, setting the bucket
+// cookie when the client has none or presents one that fails verification.
+func (e *Experiment) Assign(w http.ResponseWriter, r *http.Request) (string, *ServerPool) {
+	if cookie, err := r.Cookie(e.cookieName); err == nil {
+		if v := e.lookup(cookie.Value); v != nil {
+			return v.name, v.pool
+		}
+	}
+
+	v := e.pick()
+	atomic.AddUint64(&v.assigned, 1)
+	http.SetCookie(w, &http.Cookie{
+		Name:     e.cookieName,
+		Value:    e.sign(v.name),
+		Path:     "/",
+		MaxAge:   int(e.cookieTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return v.name, v.pool
+}
+
+// Lookup is Assign without the side effects: clients without a valid cookie
+// go to the first variant's pool and no cookie is set.
+func (e *Experiment) Lookup(r *http.Request) (string, *ServerPool) {
+	if cookie, err := r.Cookie(e.cookieName); err == nil {
+		if v := e.lookup(cookie.Value); v != nil {
+			return v.name, v.pool
+		}
+	}
+	return "", e.variants[0].pool
+}
+
+// Assignments counts the clients bucketed into each variant since startup.
+func (e *Experiment) Assignments() map[string]uint64 {
+	counts := make(map[string]uint64, len(e.variants))
+	for i := range e.variants {
+		counts[e.variants[i].name] = atomic.LoadUint64(&e.variants[i].assigned)
+	}
+	return counts
+}
+
+func (e *Experiment) pick() *variant {
+	n := rand.IntN(e.totalWeight)
+	for i := range e.variants {
+		n -= e.variants[i].weight
+		if n < 0 {
+			return &e.variants[i]
+		}
+	}
+	return &e.variants[len(e.variants)-1]
+}
+
+func (e *Experiment) lookup(value string) *variant {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return nil
+	}
+	name := value[:i]
+	if !hmac.Equal([]byte(value), []byte(e.sign(name))) {
+		return nil
+	}
+	for j := range e.variants {
+		if e.variants[j].name == name {
+			return &e.variants[j]
+		}
+	}
+	return nil
+}
+
+func (e *Experiment) sign(name string) string {
+	mac := hmac.New(sha256.New, e.secret)
+	mac.Write([]byte(e.name + ":" + name))
+	return name + "." + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestExperiment(t *testing.T, secret string, weights ...int) *Experiment {
+	t.Helper()
+	cfg := &ExperimentConfig{Name: "checkout", Secret: secret}
+	pools := map[string]*ServerPool{}
+	for i, w := range weights {
+		name := string(rune('a' + i))
+		pools[name] = NewServerPool(name, NewEventBus())
+		cfg.Variants = append(cfg.Variants, VariantConfig{Name: name, Pool: name, Weight: w})
+	}
+	e, err := NewExperiment(cfg, pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// assign buckets a client without a cookie and returns its variant and cookie.
+func assign(t *testing.T, e *Experiment) (string, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	name, _ := e.Assign(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Assign set %d cookies, want 1", len(cookies))
+	}
+	return name, cookies[0]
+}
+
+func TestExperimentCookieRoundTrip(t *testing.T) {
+	e := newTestExperiment(t, "secret", 1, 1)
+	name, cookie := assign(t, e)
+
+	for range 10 {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		got, pool := e.Assign(w, r)
+		if got != name || pool.name != name {
+			t.Fatalf("client in %s was assigned %s (pool %s)", name, got, pool.name)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Fatal("a valid cookie was replaced")
+		}
+		if got, _ := e.Lookup(r); got != name {
+			t.Fatalf("Lookup = %q, want %s", got, name)
+		}
+	}
+}
+
+func TestExperimentRejectsTamperedCookie(t *testing.T) {
+	e := newTestExperiment(t, "secret", 1, 1)
+	name, cookie := assign(t, e)
+	other := "a"
+	if name == "a" {
+		other = "b"
+	}
+	otherKey := newTestExperiment(t, "another secret", 1, 1).sign(other)
+
+	for _, value := range []string{
+		other + cookie.Value[len(name):], // variant swapped, signature kept
+		cookie.Value[:len(cookie.Value)-1] + "0",
+		otherKey, // signed with another secret
+		other,
+		"",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: cookie.Name, Value: value})
+		if got, _ := e.Lookup(r); got != "" {
+			t.Errorf("cookie %q was trusted as variant %s", value, got)
+		}
+		w := httptest.NewRecorder()
+		e.Assign(w, r)
+		if len(w.Result().Cookies()) != 1 {
+			t.Errorf("cookie %q was not replaced", value)
+		}
+	}
+}
+
+func TestExperimentSplit(t *testing.T) {
+	e := newTestExperiment(t, "secret", 70, 20, 10, 0)
+	const clients = 20000
+	counts := map[string]int{}
+	for range clients {
+		name, _ := assign(t, e)
+		counts[name]++
+	}
+
+	for i, want := range []float64{0.7, 0.2, 0.1, 0} {
+		name := string(rune('a' + i))
+		got := float64(counts[name]) / clients
+		// Over 5 standard deviations at 20000 clients
+		if math.Abs(got-want) > 0.02 {
+			t.Errorf("variant %s got %.3f of clients, want %.2f", name, got, want)
+		}
+		if n := e.Assignments()[name]; n != uint64(counts[name]) {
+			t.Errorf("Assignments()[%s] = %d, want %d", name, n, counts[name])
+		}
+	}
+}
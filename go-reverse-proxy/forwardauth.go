@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ==================== FORWARD AUTH ====================
+// ForwardAuthConfig asks an external service (oauth2-proxy, Authelia, ...)
+// whether to let a request through. The proxy sends a GET to URL carrying
+// the client's headers plus X-Forwarded-Method/-Proto/-Host/-Uri; a 2xx
+// answer forwards the request, anything else is returned to the client
+// as-is (e.g. a redirect to the login page).
+type ForwardAuthConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+
+	URL     string   `json:"url"`
+	Timeout Duration `json:"timeout,omitempty"` // default 5s
+
+	// RequestHeaders limits the client headers sent along; empty sends all.
+	RequestHeaders []string `json:"request_headers,omitempty"`
+
+	// ResponseHeaders are copied from a 2xx answer onto the proxied
+	// request (e.g. X-Auth-Request-User); client-sent copies are removed.
+	ResponseHeaders []string `json:"response_headers,omitempty"`
+}
+
+// maxAuthBody caps how much of a denial response is relayed to the client.
+const maxAuthBody = 64 << 10
+
+type ForwardAuth struct {
+	url             string
+	client          *http.Client
+	requestHeaders  []string
+	responseHeaders []string
+}
+
+func NewForwardAuth(cfg *ForwardAuthConfig) (*ForwardAuth, error) {
+	if u, err := url.Parse(cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("forward_auth: url %q must be http(s)", cfg.URL)
+	}
+	timeout := cfg.Timeout.Std()
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &ForwardAuth{
+		url: cfg.URL,
+		client: &http.Client{
+			Timeout: timeout,
+			// Redirects are the auth service talking to the client
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		requestHeaders:  cfg.RequestHeaders,
+		responseHeaders: cfg.ResponseHeaders,
+	}, nil
+}
+
+// Check asks the auth service about r from client. It returns the answer
+// when access is denied (the caller relays it) and nil when the request may
+// proceed.
+func (f *ForwardAuth) Check(r *http.Request, client string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.requestHeaders) == 0 {
+		req.Header = r.Header.Clone()
+		removeHopByHop(req.Header)
+		req.Header.Del("Content-Length")
+	} else {
+		for _, h := range f.requestHeaders {
+			if values := r.Header.Values(h); len(values) > 0 {
+				req.Header[http.CanonicalHeaderKey(h)] = values
+			}
+		}
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", requestScheme(r))
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", client)
+	req.Header.Set(requestIDHeader, requestID(r))
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		resp.Body.Close()
+		for _, h := range f.responseHeaders {
+			r.Header.Del(h)
+			if values := resp.Header.Values(h); len(values) > 0 {
+				r.Header[http.CanonicalHeaderKey(h)] = values
+			}
+		}
+		return nil, nil
+	}
+	return resp, nil
+}
+
+func forwardAuthConfigured(cfg *Config) bool {
+	if cfg.ForwardAuth != nil && !cfg.ForwardAuth.Disabled {
+		return true
+	}
+	for _, rc := range cfg.Routes {
+		if rc.ForwardAuth != nil && !rc.ForwardAuth.Disabled {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardAuthMiddleware gates requests on the external auth service;
+// routes may bring their own forward_auth block or disable it.
+func forwardAuthMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	if !forwardAuthConfigured(cfg) {
+		return nil, nil
+	}
+
+	var global *ForwardAuth
+	if cfg.ForwardAuth != nil && !cfg.ForwardAuth.Disabled {
+		var err error
+		if global, err = NewForwardAuth(cfg.ForwardAuth); err != nil {
+			return nil, err
+		}
+	}
+
+	// Any header an auth service may set is stripped from every request
+	var trusted []string
+	for _, fa := range append([]*ForwardAuth{global}, h.router.forwardAuths()...) {
+		if fa != nil {
+			trusted = append(trusted, fa.responseHeaders...)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, header := range trusted {
+				r.Header.Del(header)
+			}
+
+			fa := global
+			if route := h.route(r); route != nil && route.forwardAuthOverride {
+				fa = route.forwardAuth
+			}
+			if fa == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			denied, err := fa.Check(r, h.trusted.RealIP(r).String())
+			if err != nil {
+				h.logs.Errorf("[%s] Forward auth for %s %s failed: %v", requestID(r), r.Method, r.URL.Path, err)
+				h.httpError(w, r, "Service Unavailable - authorization service unreachable", http.StatusServiceUnavailable)
+				return
+			}
+			if denied != nil {
+				defer denied.Body.Close()
+				h.logs.Debugf(h.logs.SampleDebug(), "[%s] Forward auth denied %s %s: %d", requestID(r), r.Method, r.URL.Path, denied.StatusCode)
+				denied.Header.Del(requestIDHeader)
+				for k, v := range denied.Header {
+					w.Header()[k] = v
+				}
+				removeHopByHop(w.Header())
+				w.Header().Del("Content-Length")
+				w.WriteHeader(denied.StatusCode)
+				io.Copy(w, io.LimitReader(denied.Body, maxAuthBody))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForwardAuth(t *testing.T) {
+	var authCalls atomic.Int32
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authCalls.Add(1)
+		switch uri := r.Header.Get("X-Forwarded-Uri"); {
+		case strings.HasPrefix(uri, "/ok"):
+			w.Header().Set("X-Auth-Request-User", "alice")
+		case strings.HasPrefix(uri, "/login"):
+			http.Redirect(w, r, "https://sso.example.com/?rd="+uri, http.StatusFound)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sso"`)
+			w.Header().Set("Connection", "X-Auth-Secret")
+			w.Header().Set("X-Auth-Secret", "for the proxy only")
+			w.Header().Set("Keep-Alive", "timeout=5")
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, strings.Repeat("x", 2*maxAuthBody))
+		}
+	}))
+	defer auth.Close()
+
+	var backendCalls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls.Add(1)
+		io.WriteString(w, r.Header.Get("X-Auth-Request-User"))
+	}))
+	defer backend.Close()
+
+	cfg := testConfig(backend.URL)
+	cfg.ForwardAuth = &ForwardAuthConfig{URL: auth.URL, ResponseHeaders: []string{"X-Auth-Request-User"}}
+	cfg.Routes = []RouteConfig{
+		{Prefix: "/public/", Pool: "default", ForwardAuth: &ForwardAuthConfig{Disabled: true}},
+		{Prefix: "/down/", Pool: "default", ForwardAuth: &ForwardAuthConfig{URL: "http://127.0.0.1:1"}},
+	}
+	_, proxy := newTestProxy(t, cfg)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	get := func(path string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", proxy.URL+path, nil)
+		req.Header.Set("X-Auth-Request-User", "mallory")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		resp, body := get("/ok")
+		if resp.StatusCode != http.StatusOK || body != "alice" {
+			t.Errorf("status %d, backend saw user %q; want 200 and alice from the auth service", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		before := backendCalls.Load()
+		resp, body := get("/secret")
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("status %d, want the auth service's 401", resp.StatusCode)
+		}
+		if len(body) != maxAuthBody {
+			t.Errorf("relayed %d body bytes, want the cap of %d", len(body), maxAuthBody)
+		}
+		if resp.Header.Get("WWW-Authenticate") == "" {
+			t.Error("WWW-Authenticate wasn't relayed")
+		}
+		for _, h := range []string{"X-Auth-Secret", "Keep-Alive"} {
+			if resp.Header.Get(h) != "" {
+				t.Errorf("hop-by-hop header %s was relayed", h)
+			}
+		}
+		if backendCalls.Load() != before {
+			t.Error("denied request reached the backend")
+		}
+	})
+
+	t.Run("redirect relayed", func(t *testing.T) {
+		resp, _ := get("/login")
+		if resp.StatusCode != http.StatusFound || !strings.HasPrefix(resp.Header.Get("Location"), "https://sso.example.com/") {
+			t.Errorf("status %d to %q, want the auth service's redirect", resp.StatusCode, resp.Header.Get("Location"))
+		}
+	})
+
+	t.Run("disabled on route", func(t *testing.T) {
+		before := authCalls.Load()
+		resp, body := get("/public/page")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, want 200", resp.StatusCode)
+		}
+		if body != "" {
+			t.Errorf("backend saw client-sent user %q", body)
+		}
+		if authCalls.Load() != before {
+			t.Error("auth service asked about a route that disables it")
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		if resp, _ := get("/down/x"); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("status %d, want 503", resp.StatusCode)
+		}
+	})
+}
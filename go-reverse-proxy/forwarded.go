@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ==================== FORWARDED HEADERS ====================
+// X-Forwarded-For/-Host/-Proto and X-Real-IP are only believed when the
+// peer is a trusted proxy (an outer load balancer, an ingress); from anyone
+// else they are dropped on arrival. The X-Forwarded-For chain that remains
+// gets the peer appended by httputil.ReverseProxy, so backends see
+// "client, proxy1, ..., peer".
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-IP"}
+
+// defaultTrustedProxies is loopback only: trusting whole private ranges
+// would let any client on them pick its own address for ACLs and rate
+// limits. A load balancer elsewhere must be listed in trusted_proxies.
+func defaultTrustedProxies() []string {
+	return []string{"127.0.0.0/8", "::1/128"}
+}
+
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+func NewTrustedProxies(entries []string) (*TrustedProxies, error) {
+	prefixes, err := parsePrefixes(entries)
+	if err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	return &TrustedProxies{prefixes: prefixes}, nil
+}
+
+func (t *TrustedProxies) Contains(addr netip.Addr) bool {
+	for _, p := range t.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sanitize removes forwarding headers the peer has no right to set.
+func (t *TrustedProxies) Sanitize(r *http.Request) {
+	if peer, err := extractClientIP(r.RemoteAddr); err == nil && t.Contains(peer) {
+		return
+	}
+	for _, h := range forwardedHeaders {
+		r.Header.Del(h)
+	}
+}
+
+// RealIP is the original client: walking X-Forwarded-For from the right,
+// the first address that isn't a trusted proxy. Call after Sanitize.
+func (t *TrustedProxies) RealIP(r *http.Request) netip.Addr {
+	peer, err := extractClientIP(r.RemoteAddr)
+	if err != nil || !t.Contains(peer) {
+		return peer
+	}
+
+	var chain []string
+	for _, line := range r.Header.Values("X-Forwarded-For") {
+		chain = append(chain, strings.Split(line, ",")...)
+	}
+	real := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(chain[i]))
+		if err != nil {
+			break
+		}
+		real = addr.Unmap()
+		if !t.Contains(real) {
+			break
+		}
+	}
+	return real
+}
+
+// hopHeaders are meaningful for a single connection only and must not be
+// relayed. httputil.ReverseProxy strips them on the main path (keeping
+// what WebSocket upgrades need); removeHopByHop covers the proxy's own
+// side requests and relayed responses.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// removeHopByHop deletes hopHeaders and any header named in Connection.
+func removeHopByHop(h http.Header) {
+	for _, line := range h.Values("Connection") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
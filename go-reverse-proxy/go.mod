@@ -3,3 +3,7 @@ module reverse-proxy
 go 1.24.0
 
 require golang.org/x/time v0.14.0
+
+require golang.org/x/crypto v0.48.0
+
+require github.com/yuin/gopher-lua v1.1.1
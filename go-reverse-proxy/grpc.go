@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== gRPC PASSTHROUGH ====================
+// gRPC status codes used for proxy-generated errors
+const (
+	grpcResourceExhausted = 8
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// frontendProtocols accepts cleartext HTTP/2 with prior knowledge (h2c)
+// next to HTTP/1.1 and HTTP/2 over TLS, which is how gRPC clients connect
+// without TLS.
+func frontendProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+// newGRPCTransport only speaks HTTP/2: h2c to http:// backends and h2 over
+// TLS to https:// ones, so trailers and bidirectional streams survive.
+func newGRPCTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = unixAwareDial((&net.Dialer{Timeout: 30 * time.Second}).DialContext)
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+	return t
+}
+
+// releaseDeadlines lifts the server read/write timeouts for this request,
+// otherwise streaming RPCs are cut off after WriteTimeout.
+func releaseDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
+
+// writeGRPCError answers with a trailers-only response so gRPC clients get
+// a real status code instead of failing to parse a plain-text HTTP error.
+func writeGRPCError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", msg)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ==================== HEADER RULES ====================
+// HeaderRules edit request headers before forwarding and response headers
+// before returning. They run after the proxy's own headers (X-Forwarded-*,
+// Via, identity), so they can also override or remove those. Global rules
+// apply first, then the pool's, then the route's.
+type HeaderRules struct {
+	Request  HeaderOps `json:"request"`
+	Response HeaderOps `json:"response"`
+}
+
+// HeaderOps are applied in the order remove, set, add. Remove entries
+// ending in "*" match a prefix, e.g. "X-Debug-*".
+type HeaderOps struct {
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+func (o *HeaderOps) Apply(h http.Header) {
+	for _, name := range o.Remove {
+		prefix, wildcard := strings.CutSuffix(name, "*")
+		if !wildcard {
+			h.Del(name)
+			continue
+		}
+		prefix = http.CanonicalHeaderKey(prefix)
+		for key := range h {
+			if strings.HasPrefix(key, prefix) {
+				delete(h, key)
+			}
+		}
+	}
+	for name, value := range o.Set {
+		h.Set(name, value)
+	}
+	for name, value := range o.Add {
+		h.Add(name, value)
+	}
+}
+
+func applyRequestRules(h http.Header, rules ...*HeaderRules) {
+	for _, r := range rules {
+		if r != nil {
+			r.Request.Apply(h)
+		}
+	}
+}
+
+func applyResponseRules(h http.Header, rules ...*HeaderRules) {
+	for _, r := range rules {
+		if r != nil {
+			r.Response.Apply(h)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ==================== HEALTH HISTORY ====================
+// Why a backend changed state, carried in Event.Reason.
+const (
+	ReasonProbe   = "probe"   // the health checker's request failed or succeeded
+	ReasonPassive = "passive" // proxied traffic to the backend failed
+	ReasonManual  = "manual"  // set through PUT /backends/status
+)
+
+// HealthHistoryConfig sizes the transition log behind GET /health/history.
+type HealthHistoryConfig struct {
+	// Size is how many transitions are kept (default 1000).
+	Size int `json:"size,omitempty"`
+
+	// File, when set, receives every transition as a JSON line; the last
+	// Size entries are read back at startup.
+	File string `json:"file,omitempty"`
+}
+
+const defaultHealthHistorySize = 1000
+
+type HealthTransition struct {
+	Time    time.Time `json:"time"`
+	Pool    string    `json:"pool"`
+	Backend string    `json:"backend"`
+	Alive   bool      `json:"alive"`
+	Reason  string    `json:"reason,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// HealthHistory is a ring buffer of backend up/down transitions, fed by
+// the event bus.
+type HealthHistory struct {
+	mu      sync.Mutex
+	entries []HealthTransition // ring, next is the oldest once full
+	next    int
+	full    bool
+
+	file    *os.File // nil unless persisted
+	written int      // lines in file, rewritten at twice the ring size
+}
+
+func NewHealthHistory(cfg HealthHistoryConfig, events *EventBus) (*HealthHistory, error) {
+	size := cfg.Size
+	if size == 0 {
+		size = defaultHealthHistorySize
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("health_history: size must be positive")
+	}
+	h := &HealthHistory{entries: make([]HealthTransition, size)}
+
+	if cfg.File != "" {
+		if err := h.load(cfg.File); err != nil {
+			return nil, fmt.Errorf("health_history: %w", err)
+		}
+		// Start the file over with what was kept, so it doesn't grow forever
+		f, err := os.Create(cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("health_history: %w", err)
+		}
+		h.file = f
+		h.rewrite()
+	}
+
+	events.Subscribe(h.observe)
+	return h, nil
+}
+
+// load reads a previous run's file, keeping the newest entries. A missing
+// file is not an error.
+func (h *HealthHistory) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var t HealthTransition
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			log.Printf("health_history: skipping unreadable line in %s: %v", path, err)
+			continue
+		}
+		h.add(t)
+	}
+	return scanner.Err()
+}
+
+func (h *HealthHistory) observe(e Event) {
+	if e.Type != EventBackendUp && e.Type != EventBackendDown {
+		return
+	}
+	t := HealthTransition{
+		Time:    e.Time,
+		Pool:    e.Pool,
+		Backend: e.Backend,
+		Alive:   e.Type == EventBackendUp,
+		Reason:  e.Reason,
+		Detail:  e.Detail,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.add(t)
+	if h.file == nil {
+		return
+	}
+	if h.written >= 2*len(h.entries) {
+		h.rewrite()
+		return
+	}
+	h.append(t)
+}
+
+func (h *HealthHistory) add(t HealthTransition) {
+	h.entries[h.next] = t
+	h.next++
+	if h.next == len(h.entries) {
+		h.next, h.full = 0, true
+	}
+}
+
+func (h *HealthHistory) append(t HealthTransition) {
+	line, _ := json.Marshal(t)
+	if _, err := h.file.Write(append(line, '\n')); err != nil {
+		log.Printf("health_history: %v", err)
+		return
+	}
+	h.written++
+}
+
+// rewrite replaces the file's contents with the ring.
+func (h *HealthHistory) rewrite() {
+	if err := h.file.Truncate(0); err != nil {
+		log.Printf("health_history: %v", err)
+		return
+	}
+	if _, err := h.file.Seek(0, 0); err != nil {
+		log.Printf("health_history: %v", err)
+		return
+	}
+	h.written = 0
+	for _, t := range h.ordered() {
+		h.append(t)
+	}
+}
+
+// ordered returns the ring oldest first.
+func (h *HealthHistory) ordered() []HealthTransition {
+	if !h.full {
+		return append([]HealthTransition(nil), h.entries[:h.next]...)
+	}
+	return append(append([]HealthTransition(nil), h.entries[h.next:]...), h.entries[:h.next]...)
+}
+
+// Recent returns up to limit transitions, newest first, optionally only
+// those of one backend.
+func (h *HealthHistory) Recent(backend string, limit int) []HealthTransition {
+	h.mu.Lock()
+	all := h.ordered()
+	h.mu.Unlock()
+
+	recent := []HealthTransition{}
+	for i := len(all) - 1; i >= 0 && len(recent) < limit; i-- {
+		if backend == "" || all[i].Backend == backend {
+			recent = append(recent, all[i])
+		}
+	}
+	return recent
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkRouterMatch finds the route for a path among many, the last of
+// which matches.
+func BenchmarkRouterMatch(b *testing.B) {
+	for _, n := range []int{1, 16, 256} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			cfg := testConfig("http://10.0.0.1:80")
+			for i := range n {
+				cfg.Routes = append(cfg.Routes, RouteConfig{Prefix: fmt.Sprintf("/api/v%d/", n-i), Pool: "default"})
+			}
+			pools, err := cfg.BuildPools(NewEventBus(), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			router, err := NewRouter(cfg, pools)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			for b.Loop() {
+				if router.Match("/api/v1/orders/42") == nil {
+					b.Fatal("no route matched")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkServeHTTPCached serves a response from the cache, which never
+// reaches the backend after the first request.
+func BenchmarkServeHTTPCached(b *testing.B) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		io.WriteString(w, "cached")
+	}))
+	defer backend.Close()
+	cfg := testConfig(backend.URL)
+	cfg.Cache.Enabled = true
+	h, _ := newTestProxy(b, cfg)
+
+	serve := func(b *testing.B) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/cached", nil))
+		if w.Code != http.StatusOK {
+			b.Errorf("status %d", w.Code)
+		}
+	}
+	serve(b) // fill the cache
+
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			serve(b)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				serve(b)
+			}
+		})
+	})
+	if n := hits.Load(); n != 1 {
+		b.Errorf("backend reached %d times, want once", n)
+	}
+}
+
+// BenchmarkClientLimiter takes a token for one of many clients, as every
+// request does with client_rate_limit set.
+func BenchmarkClientLimiter(b *testing.B) {
+	for _, clients := range []int{100, 100000} {
+		b.Run(fmt.Sprint(clients), func(b *testing.B) {
+			l, err := NewClientLimiter(&ClientRateLimitConfig{RPS: 1e9, MaxClients: 10000})
+			if err != nil {
+				b.Fatal(err)
+			}
+			addrs := make([]netip.Addr, clients)
+			for i := range addrs {
+				addrs[i] = netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+			}
+			var next atomic.Uint64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					addr := addrs[next.Add(1)%uint64(clients)]
+					l.bucket(addr, time.Now()).Allow()
+				}
+			})
+		})
+	}
+}
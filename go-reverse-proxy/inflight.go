@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== IN-FLIGHT LIMIT ====================
+// InFlightLimitConfig caps the requests being proxied at once, over all
+// pools, so a flood of slow requests can't exhaust the proxy itself.
+// Requests over the cap wait up to MaxWait for a slot, then get a 503 with
+// Retry-After. Requests answered before forwarding (cache hits, auth
+// rejections, probes) take no slot.
+type InFlightLimitConfig struct {
+	Max        int      `json:"max"`                   // 0 = unlimited
+	MaxWait    Duration `json:"max_wait,omitempty"`    // 0 rejects at once
+	RetryAfter Duration `json:"retry_after,omitempty"` // default 1s
+}
+
+// InFlightLimit hands out the slots. A nil *InFlightLimit admits
+// everything.
+type InFlightLimit struct {
+	slots      chan struct{}
+	maxWait    time.Duration
+	retryAfter time.Duration
+	queued     atomic.Int64
+}
+
+// NewInFlightLimit returns nil when cfg limits nothing.
+func NewInFlightLimit(cfg *InFlightLimitConfig) (*InFlightLimit, error) {
+	if cfg == nil || cfg.Max == 0 {
+		return nil, nil
+	}
+	if cfg.Max < 0 {
+		return nil, fmt.Errorf("in_flight_limit: max must not be negative")
+	}
+	l := &InFlightLimit{
+		slots:      make(chan struct{}, cfg.Max),
+		maxWait:    cfg.MaxWait.Std(),
+		retryAfter: cfg.RetryAfter.Std(),
+	}
+	if l.retryAfter <= 0 {
+		l.retryAfter = time.Second
+	}
+	return l, nil
+}
+
+// acquire takes a slot, queueing for up to maxWait; false if none freed up
+// in time or the client left. A taken slot must be released.
+func (l *InFlightLimit) acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.maxWait <= 0 {
+		return false
+	}
+
+	l.queued.Add(1)
+	defer l.queued.Add(-1)
+	t := time.NewTimer(l.maxWait)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *InFlightLimit) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// InFlight is the number of slots taken.
+func (l *InFlightLimit) InFlight() int {
+	return len(l.slots)
+}
+
+// Queued is the number of requests waiting for a slot.
+func (l *InFlightLimit) Queued() int64 {
+	return l.queued.Load()
+}
+
+func (h *ProxyHandler) writeInFlightLimited(w http.ResponseWriter, r *http.Request, grpc bool) {
+	w.Header().Set("Retry-After", retryAfter(h.inFlight.retryAfter))
+	if grpc {
+		writeGRPCError(w, grpcResourceExhausted, "too many requests in flight")
+		return
+	}
+	h.httpError(w, r, "Service Unavailable - too many requests in flight", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== JWT AUTHENTICATION ====================
+// JWTConfig validates "Authorization: Bearer" tokens. Set either Secret
+// (HS256) or PublicKeyFile / JWKSURL (RS256). Configured globally it covers
+// every request; a route's own block replaces it for that prefix, and a
+// route with {"disabled": true} opts out.
+type JWTConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+
+	Secret        string   `json:"secret,omitempty"`
+	PublicKeyFile string   `json:"public_key_file,omitempty"`
+	JWKSURL       string   `json:"jwks_url,omitempty"`
+	JWKSCacheTTL  Duration `json:"jwks_cache_ttl,omitempty"` // default 10m
+
+	Issuer   string   `json:"issuer,omitempty"`
+	Audience string   `json:"audience,omitempty"`
+	Leeway   Duration `json:"leeway,omitempty"` // clock skew allowed on exp/nbf
+
+	// ClaimHeaders forwards claims to backends, e.g. {"sub": "X-User-Id"}.
+	// Client-sent copies of these headers are always removed.
+	ClaimHeaders map[string]string `json:"claim_headers,omitempty"`
+}
+
+type JWTVerifier struct {
+	secret       []byte
+	publicKey    *rsa.PublicKey
+	jwks         *jwksCache
+	issuer       string
+	audience     string
+	leeway       time.Duration
+	claimHeaders map[string]string
+}
+
+func NewJWTVerifier(cfg *JWTConfig) (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		secret:       []byte(cfg.Secret),
+		issuer:       cfg.Issuer,
+		audience:     cfg.Audience,
+		leeway:       cfg.Leeway.Std(),
+		claimHeaders: cfg.ClaimHeaders,
+	}
+
+	sources := 0
+	if cfg.Secret != "" {
+		sources++
+	}
+	if cfg.PublicKeyFile != "" {
+		sources++
+		key, err := loadRSAPublicKey(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKey = key
+	}
+	if cfg.JWKSURL != "" {
+		sources++
+		ttl := cfg.JWKSCacheTTL.Std()
+		if ttl <= 0 {
+			ttl = 10 * time.Minute
+		}
+		v.jwks = &jwksCache{url: cfg.JWKSURL, ttl: ttl, client: &http.Client{Timeout: 5 * time.Second}}
+	}
+	if sources != 1 {
+		return nil, fmt.Errorf("jwt: set exactly one of secret, public_key_file or jwks_url")
+	}
+	return v, nil
+}
+
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jwt: no PEM data in %s", path)
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		block.Bytes, _ = x509.MarshalPKIXPublicKey(cert.PublicKey)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: parse %s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("jwt: %s is not an RSA key", path)
+	}
+	if err := checkRSAKey(rsaKey); err != nil {
+		return nil, fmt.Errorf("jwt: %s: %w", path, err)
+	}
+	return rsaKey, nil
+}
+
+// minRSABits is the smallest modulus a signing key may have.
+const minRSABits = 2048
+
+// checkRSAKey rejects keys too weak to trust a signature from, such as a
+// JWK with an exponent of 1, under which any "signature" verifies.
+func checkRSAKey(key *rsa.PublicKey) error {
+	if key.E < 3 {
+		return fmt.Errorf("RSA exponent %d is too small", key.E)
+	}
+	if bits := key.N.BitLen(); bits < minRSABits {
+		return fmt.Errorf("RSA key of %d bits is under %d", bits, minRSABits)
+	}
+	return nil
+}
+
+// Verify checks the token's signature and registered claims and returns its claims.
+func (v *JWTVerifier) Verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("bad header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("bad signature encoding")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	// The algorithm is fixed by how the verifier is configured, never by the token
+	switch {
+	case len(v.secret) > 0:
+		if header.Alg != "HS256" {
+			return nil, fmt.Errorf("unexpected alg %q", header.Alg)
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unexpected alg %q", header.Alg)
+		}
+		key := v.publicKey
+		if v.jwks != nil {
+			if key, err = v.jwks.key(header.Kid); err != nil {
+				return nil, err
+			}
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("invalid signature")
+		}
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("bad payload: %w", err)
+	}
+	return claims, v.checkClaims(claims)
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]any) error {
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-v.leeway)) {
+		return errors.New("token not yet valid")
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return errors.New("wrong issuer")
+	}
+	if v.audience != "" {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud == v.audience {
+				return nil
+			}
+		case []any:
+			for _, a := range aud {
+				if a == v.audience {
+					return nil
+				}
+			}
+		}
+		return errors.New("wrong audience")
+	}
+	return nil
+}
+
+func decodeSegment(seg string, into any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, into)
+}
+
+// claimValue renders a claim as a header value: strings as-is, lists
+// comma-separated, anything else as JSON.
+func claimValue(v any) string {
+	switch c := v.(type) {
+	case string:
+		return c
+	case []any:
+		items := make([]string, len(c))
+		for i, item := range c {
+			items[i] = claimValue(item)
+		}
+		return strings.Join(items, ",")
+	default:
+		data, _ := json.Marshal(c)
+		return string(data)
+	}
+}
+
+// jwksCache fetches signing keys on first use and again after ttl. An
+// unknown kid triggers an early refresh (at most once a minute) to pick up
+// rotated keys. One fetch runs at a time, outside the lock: requests whose
+// key is cached keep being served from the cache meanwhile, the others
+// wait for it. After a failed fetch none is tried for jwksRetry, so an
+// unreachable endpoint doesn't put every request behind a timeout.
+type jwksCache struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]*rsa.PublicKey
+	fetched  time.Time
+	failed   time.Time     // of the last failed fetch
+	err      error         // of the last fetch
+	fetching chan struct{} // closed when the fetch under way ends; nil without one
+}
+
+const jwksRetry = 10 * time.Second
+
+func (c *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.lookup(kid)
+	stale := time.Since(c.fetched) > c.ttl
+	due := stale || (key == nil && time.Since(c.fetched) > time.Minute)
+	if due && time.Since(c.failed) > jwksRetry {
+		done := c.fetch()
+		if key == nil {
+			c.mu.Unlock()
+			<-done
+			c.mu.Lock()
+			key = c.lookup(kid)
+		}
+	}
+
+	if key != nil {
+		return key, nil
+	}
+	if c.keys == nil && c.err != nil {
+		return nil, c.err
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// lookup returns the cached key for kid, or the only one for no kid;
+// c.mu must be held.
+func (c *jwksCache) lookup(kid string) *rsa.PublicKey {
+	if key, ok := c.keys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key
+		}
+	}
+	return nil
+}
+
+// fetch starts a refresh unless one is under way and returns the channel
+// closed when it ends; c.mu must be held.
+func (c *jwksCache) fetch() <-chan struct{} {
+	if c.fetching == nil {
+		c.fetching = make(chan struct{})
+		go c.refresh(c.fetching)
+	}
+	return c.fetching
+}
+
+func (c *jwksCache) refresh(done chan struct{}) {
+	keys, err := c.download()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	if err != nil {
+		c.failed = time.Now()
+		if c.keys != nil {
+			log.Printf("JWKS refresh from %s failed, keeping cached keys: %v", c.url, err)
+		}
+	} else {
+		c.keys, c.fetched = keys, time.Now()
+	}
+	c.fetching = nil
+	close(done)
+}
+
+func (c *jwksCache) download() (map[string]*rsa.PublicKey, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > math.MaxInt32 {
+			log.Printf("JWKS %s: ignoring key %q: RSA exponent too large", c.url, k.Kid)
+			continue
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}
+		if err := checkRSAKey(key); err != nil {
+			log.Printf("JWKS %s: ignoring key %q: %v", c.url, k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func jwtConfigured(cfg *Config) bool {
+	if cfg.JWT != nil {
+		return true
+	}
+	for _, rc := range cfg.Routes {
+		if rc.JWT != nil && !rc.JWT.Disabled {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtMiddleware rejects requests without a valid token with 401 and passes
+// the configured claims on as headers.
+func jwtMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	if !jwtConfigured(cfg) {
+		return nil, nil
+	}
+
+	var global *JWTVerifier
+	if cfg.JWT != nil && !cfg.JWT.Disabled {
+		var err error
+		if global, err = NewJWTVerifier(cfg.JWT); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every claim header any verifier sets is stripped from every request
+	var claimHeaders []string
+	for _, v := range append([]*JWTVerifier{global}, h.router.jwtVerifiers()...) {
+		if v != nil {
+			for _, header := range v.claimHeaders {
+				claimHeaders = append(claimHeaders, header)
+			}
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, header := range claimHeaders {
+				r.Header.Del(header)
+			}
+
+			verifier := global
+			if route := h.route(r); route != nil && route.jwtOverride {
+				verifier = route.jwt
+			}
+			if verifier == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || token == "" {
+				h.rejectJWT(w, r, "missing bearer token")
+				return
+			}
+			claims, err := verifier.Verify(strings.TrimSpace(token))
+			if err != nil {
+				h.rejectJWT(w, r, err.Error())
+				return
+			}
+			for claim, header := range verifier.claimHeaders {
+				if value, ok := claims[claim]; ok {
+					r.Header.Set(header, claimValue(value))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+func (h *ProxyHandler) rejectJWT(w http.ResponseWriter, r *http.Request, reason string) {
+	h.logs.Debugf(h.logs.SampleDebug(), "[%s] JWT rejected for %s %s: %s", requestID(r), r.Method, r.URL.Path, reason)
+	if h.isGRPC(r) {
+		writeGRPCError(w, grpcUnauthenticated, reason)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, reason))
+	h.httpError(w, r, "Unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testRSAKey = sync.OnceValue(func() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+})
+
+func b64(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+
+func jwtSegments(t *testing.T, header, claims map[string]any) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b64(h) + "." + b64(c)
+}
+
+func signHS256(t *testing.T, secret string, claims map[string]any) string {
+	t.Helper()
+	signed := jwtSegments(t, map[string]any{"alg": "HS256", "typ": "JWT"}, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + b64(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	header := map[string]any{"alg": "RS256", "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := jwtSegments(t, header, claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func writePublicKey(t *testing.T, key *rsa.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestVerifier(t *testing.T, cfg *JWTConfig) *JWTVerifier {
+	t.Helper()
+	v, err := NewJWTVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestJWTVerify(t *testing.T) {
+	key := testRSAKey()
+	valid := map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	expired := map[string]any{"sub": "alice", "exp": time.Now().Add(-time.Minute).Unix()}
+	hs := newTestVerifier(t, &JWTConfig{Secret: "secret"})
+	rs := newTestVerifier(t, &JWTConfig{PublicKeyFile: writePublicKey(t, &key.PublicKey)})
+	lenient := newTestVerifier(t, &JWTConfig{Secret: "secret", Leeway: Duration(5 * time.Minute)})
+
+	rsToken := signRS256(t, key, "", valid)
+	parts := strings.Split(rsToken, ".")
+	tampered := parts[0] + "." + b64([]byte(`{"sub":"mallory"}`)) + "." + parts[2]
+	none := jwtSegments(t, map[string]any{"alg": "none"}, valid) + "."
+
+	tests := []struct {
+		name     string
+		verifier *JWTVerifier
+		token    string
+		wantErr  string
+	}{
+		{"HS256", hs, signHS256(t, "secret", valid), ""},
+		{"HS256 wrong secret", hs, signHS256(t, "other", valid), "invalid signature"},
+		{"RS256", rs, rsToken, ""},
+		{"RS256 tampered", rs, tampered, "invalid signature"},
+		{"RS256 token for HS256", hs, rsToken, "unexpected alg"},
+		{"HS256 token for RS256", rs, signHS256(t, "secret", valid), "unexpected alg"},
+		{"alg none", hs, none, "unexpected alg"},
+		{"expired", hs, signHS256(t, "secret", expired), "token expired"},
+		{"expired within leeway", lenient, signHS256(t, "secret", expired), ""},
+		{"malformed", hs, "a.b", "malformed token"},
+	}
+	for _, tt := range tests {
+		claims, err := tt.verifier.Verify(tt.token)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.wantErr == "" && claims["sub"] != "alice":
+			t.Errorf("%s: sub = %v, want alice", tt.name, claims["sub"])
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// jwksServer serves the keys set by its set method and counts fetches.
+type jwksServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+
+	mu   sync.Mutex
+	keys []map[string]string
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	s := &jwksServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": s.keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) set(keys ...map[string]string) {
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+}
+
+func jwk(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func TestJWKSUnknownKidRefetches(t *testing.T) {
+	old := testRSAKey()
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := newJWKSServer(t)
+	jwks.set(jwk("old", &old.PublicKey))
+	v := newTestVerifier(t, &JWTConfig{JWKSURL: jwks.URL})
+	claims := map[string]any{"sub": "alice"}
+
+	if _, err := v.Verify(signRS256(t, old, "old", claims)); err != nil {
+		t.Fatal(err)
+	}
+	jwks.set(jwk("old", &old.PublicKey), jwk("new", &rotated.PublicKey))
+
+	// Within a minute of the last fetch an unknown kid is just rejected
+	if _, err := v.Verify(signRS256(t, rotated, "new", claims)); err == nil {
+		t.Fatal("unknown kid accepted without a refetch")
+	}
+	if n := jwks.fetches.Load(); n != 1 {
+		t.Fatalf("%d fetches, want 1", n)
+	}
+
+	v.jwks.mu.Lock()
+	v.jwks.fetched = time.Now().Add(-2 * time.Minute)
+	v.jwks.mu.Unlock()
+	if _, err := v.Verify(signRS256(t, rotated, "new", claims)); err != nil {
+		t.Fatalf("rotated key after refetch: %v", err)
+	}
+	if n := jwks.fetches.Load(); n != 2 {
+		t.Fatalf("%d fetches, want 2", n)
+	}
+}
+
+func TestJWKSRejectsWeakKeys(t *testing.T) {
+	key := testRSAKey()
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := newJWKSServer(t)
+	exponentOne := jwk("e1", &key.PublicKey)
+	exponentOne["e"] = b64([]byte{1})
+	jwks.set(jwk("good", &key.PublicKey), exponentOne, jwk("small", &small.PublicKey))
+	v := newTestVerifier(t, &JWTConfig{JWKSURL: jwks.URL})
+
+	if _, err := v.Verify(signRS256(t, key, "good", map[string]any{"sub": "alice"})); err != nil {
+		t.Fatal(err)
+	}
+	v.jwks.mu.Lock()
+	for kid := range v.jwks.keys {
+		if kid != "good" {
+			t.Errorf("weak key %q was cached", kid)
+		}
+	}
+	v.jwks.mu.Unlock()
+	if _, err := v.Verify(signRS256(t, small, "small", map[string]any{"sub": "alice"})); err == nil {
+		t.Error("token signed with a 1024-bit key accepted")
+	}
+
+	if _, err := NewJWTVerifier(&JWTConfig{PublicKeyFile: writePublicKey(t, &small.PublicKey)}); err == nil {
+		t.Error("1024-bit public_key_file accepted")
+	}
+}
+
+func TestJWTRouteOverrides(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	cfg := testConfig(backend.URL)
+	cfg.JWT = &JWTConfig{Secret: "global"}
+	cfg.Routes = []RouteConfig{
+		{Prefix: "/public/", Pool: "default", JWT: &JWTConfig{Disabled: true}},
+		{Prefix: "/partner/", Pool: "default", JWT: &JWTConfig{Secret: "partner"}},
+	}
+	_, proxy := newTestProxy(t, cfg)
+	claims := map[string]any{"sub": "alice"}
+
+	tests := []struct {
+		path, token string
+		want        int
+	}{
+		{"/api", "", http.StatusUnauthorized},
+		{"/api", signHS256(t, "global", claims), http.StatusOK},
+		{"/public/page", "", http.StatusOK},
+		{"/partner/x", signHS256(t, "global", claims), http.StatusUnauthorized},
+		{"/partner/x", signHS256(t, "partner", claims), http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", proxy.URL+tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s (token %v): status %d, want %d", tt.path, tt.token != "", resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// ==================== LISTENERS ====================
+// By default the proxy serves port and the Admin API admin_port. Listeners
+// replace both with any number of addresses, each serving the proxy or the
+// Admin API, with or without TLS; proxy listeners may each have their own
+// route table.
+const (
+	ListenerProxy = "proxy"
+	ListenerAdmin = "admin"
+)
+
+type ListenerConfig struct {
+	// Name identifies the listener in logs (default: its address).
+	Name string `json:"name,omitempty"`
+
+	// Address is host:port; ":port" listens on every interface.
+	Address string `json:"address"`
+
+	// Role is "proxy" (default) or "admin".
+	Role string `json:"role,omitempty"`
+
+	// TLS serves the listener with the certificates of the tls section,
+	// which must be enabled.
+	TLS bool `json:"tls,omitempty"`
+
+	// Routes are the prefixes of the top-level routes this listener
+	// serves; unset serves all of them, [] none.
+	Routes []string `json:"routes,omitempty"`
+
+	// Pool serves requests no route matches, in place of the default pool
+	// and the experiment.
+	Pool string `json:"pool,omitempty"`
+}
+
+// ListenerConfigs returns the listeners to serve: those configured, or
+// else port and admin_port as listeners.
+func (c *Config) ListenerConfigs() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return []ListenerConfig{
+		{Address: fmt.Sprintf(":%d", c.Port), TLS: c.TLS.Enabled},
+		{Address: fmt.Sprintf(":%d", c.AdminPort), Role: ListenerAdmin, TLS: c.TLS.Enabled && c.TLS.Admin},
+	}
+}
+
+// checkListeners reports listeners that can't be served.
+func (c *Config) checkListeners(fail func(field, format string, args ...any)) {
+	names := make(map[string]bool)
+	addresses := make(map[string]bool)
+	proxies := 0
+	for i, lc := range c.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+		switch lc.Role {
+		case "", ListenerProxy:
+			proxies++
+		case ListenerAdmin:
+			if lc.Routes != nil || lc.Pool != "" {
+				fail(field, "an admin listener has no routes or pool")
+			}
+		default:
+			fail(field+".role", "unknown role %q (want proxy or admin)", lc.Role)
+		}
+		_, port, err := net.SplitHostPort(lc.Address)
+		if err != nil {
+			fail(field+".address", "%v", err)
+		} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			fail(field+".address", "port %q is out of range 1-65535", port)
+		} else if addresses[lc.Address] {
+			fail(field+".address", "%s is used by another listener", lc.Address)
+		}
+		addresses[lc.Address] = true
+		if name := lc.name(); names[name] {
+			fail(field+".name", "another listener is named %s", name)
+		} else {
+			names[name] = true
+		}
+	}
+	if len(c.Listeners) > 0 && proxies == 0 {
+		fail("listeners", "no proxy listener")
+	}
+}
+
+func (lc ListenerConfig) name() string {
+	if lc.Name != "" {
+		return lc.Name
+	}
+	return lc.Address
+}
+
+// listenerRoutes is what a proxy listener serves in place of the
+// handler's route table and default pool.
+type listenerRoutes struct {
+	router *Router
+	pool   *ServerPool // nil: the default pool or the experiment
+}
+
+type listenerKey struct{}
+
+// ForListener returns the handler serving lc, a proxy listener.
+func (h *ProxyHandler) ForListener(lc ListenerConfig, pools map[string]*ServerPool) (http.Handler, error) {
+	if lc.Routes == nil && lc.Pool == "" {
+		return h, nil
+	}
+	lr := &listenerRoutes{router: h.router}
+	if lc.Routes != nil {
+		lr.router = &Router{}
+		for _, prefix := range lc.Routes {
+			i := slices.IndexFunc(h.router.routes, func(rt *Route) bool { return rt.prefix == prefix })
+			if i < 0 {
+				return nil, fmt.Errorf("listener %s: unknown route %s", lc.name(), prefix)
+			}
+			lr.router.routes = append(lr.router.routes, h.router.routes[i])
+		}
+		// keep the longest-prefix-first order
+		slices.SortStableFunc(lr.router.routes, func(a, b *Route) int {
+			return len(b.prefix) - len(a.prefix)
+		})
+	}
+	if lc.Pool != "" {
+		pool, ok := pools[lc.Pool]
+		if !ok {
+			return nil, fmt.Errorf("listener %s: unknown pool %q", lc.name(), lc.Pool)
+		}
+		lr.pool = pool
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerKey{}, lr)))
+	}), nil
+}
+
+// route returns the route matching r among those of r's listener.
+func (h *ProxyHandler) route(r *http.Request) *Route {
+	if lr, ok := r.Context().Value(listenerKey{}).(*listenerRoutes); ok {
+		return lr.router.Match(r.URL.Path)
+	}
+	return h.router.Match(r.URL.Path)
+}
+
+// listenerPool returns the pool r's listener sends unrouted requests to,
+// or nil for the default.
+func listenerPool(r *http.Request) *ServerPool {
+	if lr, ok := r.Context().Value(listenerKey{}).(*listenerRoutes); ok {
+		return lr.pool
+	}
+	return nil
+}
+
+// Listener is a configured address and the server behind it.
+type Listener struct {
+	config ListenerConfig
+	server *http.Server
+	conns  *ConnLimiter // nil: connections aren't limited
+}
+
+// NewListener sets up the server for lc. certs may be nil when no
+// listener uses TLS, and conns when connections aren't limited; it only
+// applies to proxy listeners.
+func NewListener(lc ListenerConfig, handler http.Handler, certs *CertStore, conns *ConnLimiter, cfg *Config) (*Listener, error) {
+	l := &Listener{config: lc, server: &http.Server{Addr: lc.Address, Handler: handler}}
+	if lc.Role == ListenerAdmin {
+		l.server.ReadTimeout, l.server.WriteTimeout = 5*time.Second, 10*time.Second
+	} else {
+		l.conns = conns
+		l.server.ReadTimeout, l.server.WriteTimeout = proxyReadTimeout, proxyWriteTimeout
+		if cfg.GRPC {
+			l.server.Protocols = frontendProtocols()
+		}
+	}
+	if !lc.TLS {
+		return l, nil
+	}
+	if certs == nil {
+		return nil, fmt.Errorf("listener %s: tls needs the tls section enabled", lc.name())
+	}
+	var err error
+	if l.server.TLSConfig, err = certs.TLSConfig(cfg.TLS); err != nil {
+		return nil, err
+	}
+	if lc.Role != ListenerAdmin {
+		if err := configureClientAuth(l.server.TLSConfig, cfg.TLS); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// ListenAndServe serves until the server is shut down.
+func (l *Listener) ListenAndServe() error {
+	what := "Reverse Proxy"
+	if l.config.Role == ListenerAdmin {
+		what = "Admin API"
+	}
+	if l.config.Name != "" {
+		what += " " + l.config.Name
+	}
+	ln, err := net.Listen("tcp", l.server.Addr)
+	if err != nil {
+		return err
+	}
+	ln = l.conns.Wrap(ln)
+	if l.server.TLSConfig != nil {
+		log.Printf("%s listening on %s (TLS)", what, l.server.Addr)
+		return l.server.ServeTLS(ln, "", "")
+	}
+	log.Printf("%s listening on %s", what, l.server.Addr)
+	return l.server.Serve(ln)
+}
+
+func (l *Listener) Shutdown(ctx context.Context) error {
+	return l.server.Shutdown(ctx)
+}
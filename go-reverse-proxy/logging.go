@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// ==================== LOG LEVELS & SAMPLING ====================
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[LogLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	return levelNames[l]
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// LogSettings holds the runtime-adjustable logging knobs. The per-request
+// "Forwarding:"/"Response from" lines are debug level and only emitted for
+// a sampled fraction of requests, so they can be switched on under load.
+// Per-request warnings and errors (proxy errors, retries, ...) share a
+// lines-per-second budget so a failing backend can't flood the log.
+type LogSettings struct {
+	level      atomic.Int32
+	sampleBits atomic.Uint64 // math.Float64bits of the debug sample rate
+	lines      *rate.Limiter // per-request warn/error lines; Inf: unlimited
+	suppressed atomic.Uint64 // lines dropped since the last one written
+}
+
+func NewLogSettings(cfg *Config) (*LogSettings, error) {
+	l := &LogSettings{lines: rate.NewLimiter(rate.Inf, 1)}
+	if err := l.SetLevel(cfg.LogLevel); err != nil {
+		return nil, err
+	}
+	if err := l.SetDebugSampleRate(cfg.DebugSampleRate); err != nil {
+		return nil, err
+	}
+	if err := l.SetRateLimit(cfg.LogRateLimit); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogSettings) Level() LogLevel {
+	return LogLevel(l.level.Load())
+}
+
+func (l *LogSettings) SetLevel(name string) error {
+	level, err := ParseLogLevel(name)
+	if err != nil {
+		return err
+	}
+	l.level.Store(int32(level))
+	return nil
+}
+
+func (l *LogSettings) DebugSampleRate() float64 {
+	return math.Float64frombits(l.sampleBits.Load())
+}
+
+func (l *LogSettings) SetDebugSampleRate(rate float64) error {
+	if rate < 0 || rate > 1 {
+		return fmt.Errorf("debug sample rate %v must be between 0 and 1", rate)
+	}
+	l.sampleBits.Store(math.Float64bits(rate))
+	return nil
+}
+
+// SampleDebug decides once per request whether its debug lines are logged.
+func (l *LogSettings) SampleDebug() bool {
+	if l.Level() > LevelDebug {
+		return false
+	}
+	rate := l.DebugSampleRate()
+	return rate >= 1 || rand.Float64() < rate
+}
+
+func (l *LogSettings) Debugf(sampled bool, format string, args ...any) {
+	if sampled {
+		log.Printf("DEBUG "+format, args...)
+	}
+}
+
+// RateLimit is the per-request warn/error lines allowed per second, 0 for
+// no limit.
+func (l *LogSettings) RateLimit() float64 {
+	if limit := l.lines.Limit(); limit != rate.Inf {
+		return float64(limit)
+	}
+	return 0
+}
+
+func (l *LogSettings) SetRateLimit(perSecond float64) error {
+	if perSecond < 0 {
+		return fmt.Errorf("log rate limit %v must not be negative", perSecond)
+	}
+	if perSecond == 0 {
+		l.lines.SetLimit(rate.Inf)
+		return nil
+	}
+	l.lines.SetLimit(rate.Limit(perSecond))
+	l.lines.SetBurst(max(int(math.Ceil(perSecond)), 1))
+	return nil
+}
+
+func (l *LogSettings) Warnf(format string, args ...any) {
+	l.printf(LevelWarn, format, args...)
+}
+
+func (l *LogSettings) Errorf(format string, args ...any) {
+	l.printf(LevelError, format, args...)
+}
+
+// printf writes a per-request line at level unless the level is filtered
+// out or the line budget is spent; a note about dropped lines comes first.
+func (l *LogSettings) printf(level LogLevel, format string, args ...any) {
+	if l.Level() > level {
+		return
+	}
+	if !l.lines.Allow() {
+		l.suppressed.Add(1)
+		return
+	}
+	if n := l.suppressed.Swap(0); n > 0 {
+		log.Printf("WARN %d log lines suppressed by log_rate_limit", n)
+	}
+	log.Printf(strings.ToUpper(level.String())+" "+format, args...)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== LOG TAIL ====================
+// LogTail keeps the most recent log lines and hands new ones to
+// GET /logs/tail streams. It sits behind the standard logger as an extra
+// writer, so every line the proxy logs passes through it.
+type LogTail struct {
+	mu      sync.Mutex
+	lines   []LogLine // ring, next is the oldest once full
+	next    int
+	full    bool
+	streams map[chan LogLine]int // lines dropped for each stream
+}
+
+type LogLine struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+const (
+	logTailSize   = 1000 // lines kept for new streams
+	logTailBuffer = 256  // lines a slow stream may fall behind
+)
+
+func NewLogTail() *LogTail {
+	return &LogTail{lines: make([]LogLine, logTailSize), streams: make(map[chan LogLine]int)}
+}
+
+// Write takes one line from the standard logger, which writes each entry
+// in a single call.
+func (t *LogTail) Write(p []byte) (int, error) {
+	line := parseLogLine(strings.TrimRight(string(p), "\n"))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines[t.next] = line
+	t.next++
+	if t.next == len(t.lines) {
+		t.next, t.full = 0, true
+	}
+	for ch := range t.streams {
+		select {
+		case ch <- line:
+		default:
+			t.streams[ch]++
+		}
+	}
+	return len(p), nil
+}
+
+// parseLogLine splits off the standard logger's timestamp and the level
+// word LogSettings puts first; lines without one are info.
+func parseLogLine(s string) LogLine {
+	line := LogLine{Time: time.Now(), Level: LevelInfo.String(), Message: s}
+	const stamp = "2006/01/02 15:04:05"
+	if len(s) > len(stamp) {
+		if ts, err := time.ParseInLocation(stamp, s[:len(stamp)], time.Local); err == nil {
+			line.Time, line.Message = ts, s[len(stamp)+1:]
+		}
+	}
+	for _, level := range []LogLevel{LevelDebug, LevelWarn, LevelError} {
+		if rest, ok := strings.CutPrefix(line.Message, strings.ToUpper(level.String())+" "); ok {
+			line.Level, line.Message = level.String(), rest
+		}
+	}
+	return line
+}
+
+// subscribe returns the kept lines, oldest first, and a channel for new
+// ones, atomically so none are missed or sent twice.
+func (t *LogTail) subscribe() ([]LogLine, chan LogLine) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	recent := append([]LogLine(nil), t.lines[:t.next]...)
+	if t.full {
+		recent = append(append([]LogLine(nil), t.lines[t.next:]...), recent...)
+	}
+	ch := make(chan LogLine, logTailBuffer)
+	t.streams[ch] = 0
+	return recent, ch
+}
+
+// dropped returns and resets how many lines ch missed.
+func (t *LogTail) dropped(ch chan LogLine) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.streams[ch]
+	t.streams[ch] = 0
+	return n
+}
+
+func (t *LogTail) unsubscribe(ch chan LogLine) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.streams, ch)
+}
+
+// serve streams lines at or above ?level= (default debug) as Server-Sent
+// Events: up to ?lines= (default 100) recent ones, then live ones until the
+// client leaves or done is closed.
+func (t *LogTail) serve(w http.ResponseWriter, r *http.Request, done <-chan struct{}) {
+	min := LevelDebug
+	if v := r.URL.Query().Get("level"); v != "" {
+		level, err := ParseLogLevel(v)
+		if err != nil {
+			adminError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		min = level
+	}
+	backlog := 100
+	if v := r.URL.Query().Get("lines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			adminError(w, "lines must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		backlog = n
+	}
+	wanted := func(l LogLine) bool {
+		level, _ := ParseLogLevel(l.Level)
+		return level >= min
+	}
+
+	// The admin server's write timeout would cut the stream off
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		adminError(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	recent, ch := t.subscribe()
+	defer t.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+
+	var matching []LogLine
+	for _, l := range recent {
+		if wanted(l) {
+			matching = append(matching, l)
+		}
+	}
+	for _, l := range matching[max(len(matching)-backlog, 0):] {
+		writeLogLine(w, l)
+	}
+	rc.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case l := <-ch:
+			if n := t.dropped(ch); n > 0 {
+				fmt.Fprintf(w, ": dropped %d lines\n\n", n)
+			}
+			if wanted(l) {
+				writeLogLine(w, l)
+			}
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeLogLine(w http.ResponseWriter, l LogLine) {
+	data, _ := json.Marshal(l)
+	fmt.Fprintf(w, "event: log\ndata: %s\n\n", data)
+}
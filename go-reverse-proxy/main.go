@@ -1,335 +1,1995 @@
-package main
-
-import (
-	"context"
-	"encoding/json"
-	
-	"log"
-	"net/http"
-	"net/http/httputil"
-	"net/url"
-	"os"
-	"os/signal"
-	"sync"
-	"sync/atomic"
-	"syscall"
-	"time"
-
-	"golang.org/x/time/rate"
-)
-
-// ==================== DATA MODELS ====================
-type Backend struct {
-	URL          *url.URL `json:"url"`
-	Alive        bool     `json:"alive"`
-	CurrentConns int64    `json:"current_connections"`
-}
-
-type ServerPool struct {
-	backends []*Backend
-	current  uint64
-	mu       sync.RWMutex
-}
-
-// ==================== LOAD BALANCER ====================
-func (s *ServerPool) GetNextValidPeer() *Backend {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	if len(s.backends) == 0 {
-		return nil
-	}
-
-	// Round-robin with health check
-	for i := 0; i < len(s.backends); i++ {
-		next := atomic.AddUint64(&s.current, 1)
-		index := int(next % uint64(len(s.backends)))
-		backend := s.backends[index]
-		
-		if backend.Alive {
-			return backend
-		}
-	}
-	return nil
-}
-
-func (s *ServerPool) AddBackend(backendURL string) error {
-	parsedURL, err := url.Parse(backendURL)
-	if err != nil {
-		return err
-	}
-
-	s.mu.Lock()
-	s.backends = append(s.backends, &Backend{
-		URL:   parsedURL,
-		Alive: true,
-	})
-	s.mu.Unlock()
-	
-	log.Printf("Added backend: %s", backendURL)
-	return nil
-}
-
-func (s *ServerPool) SetBackendStatus(backendURL string, alive bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	for _, b := range s.backends {
-		if b.URL.String() == backendURL {
-			wasAlive := b.Alive
-			b.Alive = alive
-			
-			if wasAlive && !alive {
-				log.Printf("Backend %s is now DOWN", backendURL)
-			} else if !wasAlive && alive {
-				log.Printf("Backend %s is now UP", backendURL)
-			}
-			break
-		}
-	}
-}
-
-func (s *ServerPool) GetBackends() []*Backend {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return s.backends
-}
-
-// ==================== HEALTH CHECKER ====================
-func startHealthChecker(pool *ServerPool) {
-	ticker := time.NewTicker(10 * time.Second) // Check every 10 seconds
-	
-	go func() {
-		for range ticker.C {
-			backends := pool.GetBackends()
-			for _, backend := range backends {
-				go func(b *Backend) {
-					client := &http.Client{Timeout: 5 * time.Second}
-					
-					// Try to ping the backend
-					resp, err := client.Get(b.URL.String())
-					if err != nil {
-						pool.SetBackendStatus(b.URL.String(), false)
-						return
-					}
-					defer resp.Body.Close()
-					
-					if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-						pool.SetBackendStatus(b.URL.String(), false)
-					} else {
-						pool.SetBackendStatus(b.URL.String(), true)
-					}
-				}(backend)
-			}
-		}
-	}()
-}
-
-// ==================== REVERSE PROXY HANDLER ====================
-type ProxyHandler struct {
-	pool        *ServerPool
-	rateLimiter *rate.Limiter
-}
-
-func NewProxyHandler(pool *ServerPool, rps int) *ProxyHandler {
-	var limiter *rate.Limiter
-	if rps > 0 {
-		limiter = rate.NewLimiter(rate.Limit(rps), rps*2)
-	}
-	
-	return &ProxyHandler{
-		pool:        pool,
-		rateLimiter: limiter,
-	}
-}
-
-func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Rate limiting
-	if h.rateLimiter != nil && !h.rateLimiter.Allow() {
-		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-		return
-	}
-
-	// Get backend
-	backend := h.pool.GetNextValidPeer()
-	if backend == nil {
-		http.Error(w, "Service Unavailable - No healthy backends", http.StatusServiceUnavailable)
-		return
-	}
-
-	// Increment connection count
-	atomic.AddInt64(&backend.CurrentConns, 1)
-	defer atomic.AddInt64(&backend.CurrentConns, -1)
-
-	// Create reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(backend.URL)
-	
-	// Add custom headers
-	proxy.Director = func(req *http.Request) {
-		req.URL.Scheme = backend.URL.Scheme
-		req.URL.Host = backend.URL.Host
-		req.Host = backend.URL.Host
-		
-		// Add proxy headers
-		req.Header.Set("X-Forwarded-For", r.RemoteAddr)
-		req.Header.Set("X-Forwarded-Host", r.Host)
-		req.Header.Set("X-Proxy-Server", "Go-Reverse-Proxy/1.0")
-	}
-
-	// Error handling
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("Proxy error for backend %s: %v", backend.URL, err)
-		h.pool.SetBackendStatus(backend.URL.String(), false)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-	}
-
-	// Serve the request
-	proxy.ServeHTTP(w, r)
-}
-
-// ==================== ADMIN API ====================
-type AdminAPI struct {
-	pool *ServerPool
-}
-
-func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	
-	switch r.URL.Path {
-	case "/status":
-		a.handleStatus(w, r)
-	case "/add":
-		a.handleAddBackend(w, r)
-	default:
-		http.NotFound(w, r)
-	}
-}
-
-func (a *AdminAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
-	backends := a.pool.GetBackends()
-	
-	active := 0
-	for _, b := range backends {
-		if b.Alive {
-			active++
-		}
-	}
-	
-	response := map[string]interface{}{
-		"total_backends":   len(backends),
-		"active_backends":  active,
-		"backends":         backends,
-		"timestamp":        time.Now().Format(time.RFC3339),
-	}
-	
-	json.NewEncoder(w).Encode(response)
-}
-
-func (a *AdminAPI) handleAddBackend(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	
-	var data struct {
-		URL string `json:"url"`
-	}
-	
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
-	}
-	
-	if err := a.pool.AddBackend(data.URL); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	
-	response := map[string]string{
-		"message": "Backend added successfully",
-		"url":     data.URL,
-	}
-	
-	json.NewEncoder(w).Encode(response)
-}
-
-// ==================== MAIN FUNCTION ====================
-func main() {
-	log.Println("Starting Go Reverse Proxy Server...")
-	
-	// Create server pool
-	pool := &ServerPool{}
-	
-	// Add default backends
-	pool.AddBackend("http://localhost:9091")
-	pool.AddBackend("http://localhost:9092")
-	
-	// Start health checker
-	startHealthChecker(pool)
-	
-	// Create handlers
-	proxyHandler := NewProxyHandler(pool, 100) // 100 requests per second limit
-	adminAPI := &AdminAPI{pool: pool}
-	
-	// Create servers
-	proxyServer := &http.Server{
-		Addr:         ":8000",
-		Handler:      proxyHandler,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-	}
-	
-	adminServer := &http.Server{
-		Addr:         ":8082",
-		Handler:      adminAPI,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-	}
-	
-	// Start servers in goroutines
-	go func() {
-		log.Println("Reverse Proxy listening on :8000")
-		if err := proxyServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Proxy server error: %v", err)
-		}
-	}()
-	
-	go func() {
-		log.Println("Admin API listening on :9092")
-		log.Println("  GET  /status  - Check backend status")
-		log.Println("  POST /add     - Add new backend (JSON: {\"url\": \"http://...\"})")
-		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Admin server error: %v", err)
-		}
-	}()
-	
-	// Graceful shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	
-	<-quit
-	log.Println("Shutting down servers...")
-	
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	
-	var wg sync.WaitGroup
-	wg.Add(2)
-	
-	go func() {
-		defer wg.Done()
-		if err := proxyServer.Shutdown(ctx); err != nil {
-			log.Printf("Proxy shutdown error: %v", err)
-		}
-	}()
-	
-	go func() {
-		defer wg.Done()
-		if err := adminServer.Shutdown(ctx); err != nil {
-			log.Printf("Admin shutdown error: %v", err)
-		}
-	}()
-	
-	wg.Wait()
-	log.Println("Servers stopped gracefully")
-}
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ==================== DATA MODELS ====================
+// Backend is encoded for the Admin API by MarshalJSON.
+type Backend struct {
+	URL          *url.URL
+	Alive        bool // guarded by mu, as are Score, Weight, Zone and upSince
+	CurrentConns int64
+	Score        float64
+	Weight       int
+	Zone         string
+	Stats        *BackendStats
+	mu           sync.RWMutex
+
+	opts      backendOptions  // from its BackendConfig, see configure
+	transports map[*http.Transport]*http.Transport // for opts.tls, see upstreamTransport
+	proxies    map[proxyKey]*httputil.ReverseProxy // see reverseProxy
+	upSince   time.Time       // when it last came back up, for slow start
+}
+
+// backendJSON is a Backend as the Admin API shows it.
+type backendJSON struct {
+	URL          *url.URL      `json:"url"`
+	Alive        bool          `json:"alive"`
+	CurrentConns int64         `json:"current_connections"`
+	Score        float64       `json:"score"`
+	Weight       int           `json:"weight"`
+	Zone         string        `json:"zone,omitempty"`
+	Stats        *BackendStats `json:"stats"`
+}
+
+// MarshalJSON encodes a copy of b taken under its lock, as health checks
+// and the Admin API change it while it is being served.
+func (b *Backend) MarshalJSON() ([]byte, error) {
+	b.mu.RLock()
+	v := backendJSON{URL: b.URL, Alive: b.Alive, Score: b.Score, Weight: b.Weight, Zone: b.Zone, Stats: b.Stats}
+	b.mu.RUnlock()
+	v.CurrentConns = atomic.LoadInt64(&b.CurrentConns)
+	return json.Marshal(v)
+}
+
+func (b *Backend) IsAlive() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Alive
+}
+
+// SetAlive updates the status and reports whether it actually changed, so a
+// backend shared by several pools only produces one transition.
+func (b *Backend) SetAlive(alive bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	changed := b.Alive != alive
+	b.Alive = alive
+	if changed && alive {
+		b.upSince = time.Now()
+	}
+	return changed
+}
+
+// upFor returns how long b has been up since it last recovered; a backend
+// that never went down counts as up for good.
+func (b *Backend) upFor() time.Duration {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.upSince.IsZero() {
+		return math.MaxInt64
+	}
+	return time.Since(b.upSince)
+}
+
+func (b *Backend) GetScore() float64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Score
+}
+
+func (b *Backend) SetScore(score float64) {
+	b.mu.Lock()
+	b.Score = score
+	b.mu.Unlock()
+}
+
+func (b *Backend) GetWeight() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Weight
+}
+
+// SetWeight changes the backend's share of traffic; 0 drains it, sending
+// no new requests while those in flight finish.
+func (b *Backend) SetWeight(weight int) {
+	b.mu.Lock()
+	b.Weight = weight
+	b.mu.Unlock()
+}
+
+// selectable reports whether the backend may take new requests.
+func (b *Backend) selectable() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.Alive && b.Weight > 0
+}
+
+type ServerPool struct {
+	name     string
+	strategy string
+	snapshot atomic.Pointer[poolSnapshot] // see setSnapshot
+	current  uint64
+	mu       sync.Mutex // serializes changes to the backends
+	events   *EventBus
+	headers  *HeaderRules
+
+	// transport is the pool's own, nil for the handler's shared one
+	transport     *http.Transport
+	flushInterval time.Duration
+
+	options  StrategyOptions
+
+	// smooth weighted round-robin state, see nextWeighted
+	wrrMu      sync.Mutex
+	wrrCurrent map[*Backend]int
+
+	ewmaMu sync.Mutex
+	ewma   map[*Backend]*latencyEWMA
+}
+
+// poolSnapshot is a pool's backends, and its ring for consistent-hash, as
+// of its last change. It is never modified, so picking a backend takes no
+// lock and copies nothing; changes swap in a new snapshot.
+type poolSnapshot struct {
+	backends []*Backend
+	ring     []ringNode
+}
+
+func NewServerPool(name string, events *EventBus) *ServerPool {
+	s := &ServerPool{name: name, strategy: StrategyRoundRobin, events: events}
+	s.snapshot.Store(&poolSnapshot{})
+	return s
+}
+
+// setSnapshot publishes backends, which the pool now owns; s.mu must be
+// held.
+func (s *ServerPool) setSnapshot(backends []*Backend) {
+	s.snapshot.Store(&poolSnapshot{backends: backends, ring: s.buildRing(backends)})
+}
+
+// ==================== LOAD BALANCER ====================
+func (s *ServerPool) GetNextValidPeer() *Backend {
+	return s.NextPeer("", 0)
+}
+
+// NextPeer picks a backend for a request. key and skip only matter to
+// consistent-hash (see nextHashed); without a key it balances round-robin.
+func (s *ServerPool) NextPeer(key string, skip int) *Backend {
+	snap := s.snapshot.Load()
+	if len(snap.backends) == 0 {
+		return nil
+	}
+	if s.strategy == StrategyConsistentHash && key != "" {
+		return nextHashed(snap.ring, key, skip)
+	}
+
+	// A backend in slow start turns down picks until it has warmed up
+	var warming *Backend
+	for range len(snap.backends) {
+		b := s.next(snap.backends)
+		if b == nil || s.warm(b) {
+			return b
+		}
+		warming = b
+	}
+	return warming
+}
+
+// next picks among backends, a snapshot the pool's strategy is applied to.
+func (s *ServerPool) next(backends []*Backend) *Backend {
+	switch s.strategy {
+	case StrategyScored:
+		return nextScored(backends)
+	case StrategyWeighted:
+		return s.nextWeighted(backends)
+	case StrategyEWMA:
+		return s.nextEWMA(backends)
+	case StrategyP2C:
+		return s.nextP2C(backends)
+	}
+
+	// Round-robin with health check
+	for i := 0; i < len(backends); i++ {
+		next := atomic.AddUint64(&s.current, 1)
+		index := int(next % uint64(len(backends)))
+		backend := backends[index]
+		
+		if backend.selectable() {
+			return backend
+		}
+	}
+	return nil
+}
+
+func (s *ServerPool) AddBackend(backendURL string) error {
+	b, err := newBackend(backendURL)
+	if err != nil {
+		return err
+	}
+	s.AttachBackend(b)
+	
+	log.Printf("Added backend: %s", backendURL)
+	return nil
+}
+
+// newBackend returns a live backend with default score and weight.
+func newBackend(backendURL string) (*Backend, error) {
+	parsedURL, err := url.Parse(backendURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateBackendURL(parsedURL); err != nil {
+		return nil, err
+	}
+	return &Backend{
+		URL:    parsedURL,
+		Alive:  true,
+		Score:  1,
+		Weight: 1,
+		Stats:  NewBackendStats(),
+	}, nil
+}
+
+// AttachBackend adds an existing backend, letting pools share one instance.
+func (s *ServerPool) AttachBackend(b *Backend) {
+	s.mu.Lock()
+	s.setSnapshot(append(slices.Clip(s.GetBackends()), b))
+	s.mu.Unlock()
+}
+
+// RemoveBackend drops a backend by URL and reports whether it was there.
+func (s *ServerPool) RemoveBackend(backendURL string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	backends := s.GetBackends()
+	kept := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b.URL.String() != backendURL {
+			kept = append(kept, b)
+		}
+	}
+	if len(kept) == len(backends) {
+		return false
+	}
+	s.replaceBackends(kept)
+	return true
+}
+
+// SetBackends replaces the pool's backends in one step. Requests already
+// sent to a dropped backend finish normally.
+func (s *ServerPool) SetBackends(backends []*Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaceBackends(slices.Clone(backends))
+}
+
+// replaceBackends stores backends, which the pool now owns, and forgets
+// the strategy state of those dropped; s.mu must be held.
+func (s *ServerPool) replaceBackends(backends []*Backend) {
+	s.setSnapshot(backends)
+
+	s.wrrMu.Lock()
+	for b := range s.wrrCurrent {
+		if !slices.Contains(backends, b) {
+			delete(s.wrrCurrent, b)
+		}
+	}
+	s.wrrMu.Unlock()
+
+	s.ewmaMu.Lock()
+	for b := range s.ewma {
+		if !slices.Contains(backends, b) {
+			delete(s.ewma, b)
+		}
+	}
+	s.ewmaMu.Unlock()
+}
+
+// SetBackendStatus marks a backend up or down; reason is one of the
+// Reason constants and detail says what was seen.
+func (s *ServerPool) SetBackendStatus(backendURL string, alive bool, reason, detail string) {
+	for _, b := range s.GetBackends() {
+		if b.URL.String() == backendURL {
+			if b.SetAlive(alive) {
+				eventType := EventBackendDown
+				if alive {
+					eventType = EventBackendUp
+				}
+				s.events.Publish(Event{
+					Type:    eventType,
+					Pool:    s.name,
+					Backend: backendURL,
+					Reason:  reason,
+					Detail:  detail,
+				})
+			}
+			break
+		}
+	}
+}
+
+// GetBackends returns the current backends; the slice must not be modified.
+func (s *ServerPool) GetBackends() []*Backend {
+	return s.snapshot.Load().backends
+}
+
+// Proxy listener timeouts; uploads get an idle timeout instead (see streaming.go)
+const (
+	proxyReadTimeout  = 15 * time.Second
+	proxyWriteTimeout = 15 * time.Second
+)
+
+// ==================== HEALTH CHECKER ====================
+// HealthChecker probes every backend every 10 seconds. It can be paused
+// (for planned maintenance) and asked to check everything right away.
+type HealthChecker struct {
+	pools   map[string]*ServerPool
+	metrics *Metrics
+	client  *http.Client
+	paused  atomic.Bool
+	stop    chan struct{}
+}
+
+func NewHealthChecker(pools map[string]*ServerPool, metrics *Metrics) *HealthChecker {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &HealthChecker{
+		pools:   pools,
+		metrics: metrics,
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{DialContext: unixAwareDial(dialer.DialContext)},
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+func (hc *HealthChecker) Start() {
+	ticker := time.NewTicker(10 * time.Second) // Check every 10 seconds
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !hc.paused.Load() {
+					hc.CheckNow()
+				}
+			case <-hc.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (hc *HealthChecker) Stop() {
+	close(hc.stop)
+}
+
+// Pause stops the periodic checks, leaving backend states as they are.
+func (hc *HealthChecker) Pause() {
+	hc.paused.Store(true)
+}
+
+func (hc *HealthChecker) Resume() {
+	hc.paused.Store(false)
+}
+
+func (hc *HealthChecker) Paused() bool {
+	return hc.paused.Load()
+}
+
+// CheckNow probes every backend of every pool and returns once all probes
+// are done, even while paused.
+func (hc *HealthChecker) CheckNow() {
+	var wg sync.WaitGroup
+	for _, pool := range hc.pools {
+		for _, backend := range pool.GetBackends() {
+			target, ok := backend.healthTarget()
+			if !ok {
+				continue
+			}
+			wg.Add(1)
+			go func(pool *ServerPool, b *Backend) {
+				defer wg.Done()
+				hc.probe(pool, b, target)
+			}(pool, backend)
+		}
+	}
+	wg.Wait()
+}
+
+func (hc *HealthChecker) probe(pool *ServerPool, b *Backend, target string) {
+	client := hc.client
+	if tc := b.tlsConfig(); tc != nil {
+		transport := hc.client.Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tc.Clone()
+		defer transport.CloseIdleConnections()
+		client = &http.Client{Timeout: hc.client.Timeout, Transport: transport}
+	}
+
+	// Try to ping the backend
+	resp, err := client.Get(target)
+	if err != nil {
+		hc.metrics.healthChecked(pool.name, b.URL.String(), false)
+		pool.SetBackendStatus(b.URL.String(), false, ReasonProbe, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	healthy := resp.StatusCode >= 200 && resp.StatusCode < 400
+	hc.metrics.healthChecked(pool.name, b.URL.String(), healthy)
+	pool.SetBackendStatus(b.URL.String(), healthy, ReasonProbe, fmt.Sprintf("status %d", resp.StatusCode))
+}
+
+// ==================== REVERSE PROXY HANDLER ====================
+type ProxyHandler struct {
+	pool           *ServerPool
+	router         *Router
+	experiment     *Experiment
+	identityHeader string
+	identityValue  string
+	viaPseudonym   string
+	maxDepth       int
+
+	rewriteRedirects bool
+	cookies          *CookieRewriter // nil unless cookie_rewrite is set
+	bypass           *PathMatcher
+	transport        *http.Transport
+	dns              *DNSCache       // nil unless upstream_dns_cache is set
+	grpcTransport    *http.Transport // nil unless gRPC passthrough is on
+	logs             *LogSettings
+	uploadIdle       time.Duration
+	bodyLog          *BodyLogger // nil unless body logging is enabled
+	accessLog        *AccessLogger // nil unless access_log has outputs
+	acls             *AccessLists
+	limits           *RateLimits
+	bulkheads        *Bulkheads // nil unless bulkhead is set
+	inFlight         *InFlightLimit // nil unless in_flight_limit is set
+	sessions         *SessionManager // nil unless sticky_sessions is on
+	probes           *Probes
+	errorPages       *ErrorPages // nil unless error_pages is set
+	scripts          []*Script
+	retry            *RetryPolicy
+	headers          *HeaderRules
+	trusted          *TrustedProxies
+	cache            *ResponseCache // nil unless caching is enabled
+	metrics          *Metrics
+	reports          *PathReports
+	events           *EventBus
+	pipeline         http.Handler // middleware chain ending in forward
+}
+
+func NewProxyHandler(cfg *Config, pools map[string]*ServerPool, logs *LogSettings, events *EventBus, dns *DNSCache) (*ProxyHandler, error) {
+	router, err := NewRouter(cfg, pools)
+	if err != nil {
+		return nil, err
+	}
+
+	var experiment *Experiment
+	if cfg.Experiment != nil {
+		experiment, err = NewExperiment(cfg.Experiment, pools)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Experiment %s enabled with %d variants", cfg.Experiment.Name, len(cfg.Experiment.Variants))
+	}
+
+	identity := cfg.IdentityValue
+	if identity == "" {
+		identity = ProxyIdentity()
+	}
+
+	bodyLog, err := NewBodyLogger(cfg.BodyLog)
+	if err != nil {
+		return nil, err
+	}
+
+	accessLog, err := NewAccessLogger(cfg.AccessLog, logs)
+	if err != nil {
+		return nil, err
+	}
+
+	var grpcTransport *http.Transport
+	if cfg.GRPC {
+		grpcTransport = newGRPCTransport()
+	}
+
+	acls, err := NewAccessLists(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	trusted, err := NewTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := NewRateLimits(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	backendConfigs, err := cfg.BackendConfigs()
+	if err != nil {
+		return nil, err
+	}
+	bulkheads, err := NewBulkheads(cfg.Bulkhead, backendConfigs)
+	if err != nil {
+		return nil, err
+	}
+
+	inFlight, err := NewInFlightLimit(cfg.InFlightLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	errorPages, err := NewErrorPages(cfg.ErrorPages)
+	if err != nil {
+		return nil, err
+	}
+
+	var scripts []*Script
+	for _, sc := range cfg.Scripts {
+		script, err := NewScript(sc)
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, script)
+	}
+
+	pseudonym := cfg.ViaPseudonym
+	if pseudonym == "" {
+		pseudonym = defaultViaPseudonym()
+	}
+	
+	h := &ProxyHandler{
+		pool:           pools["default"],
+		router:         router,
+		experiment:     experiment,
+		identityHeader: cfg.IdentityHeader,
+		identityValue:  identity,
+		viaPseudonym:   pseudonym,
+		maxDepth:       cfg.MaxForwardDepth,
+
+		rewriteRedirects: cfg.RewriteRedirects,
+		cookies:          NewCookieRewriter(cfg.CookieRewrite),
+		bypass:           NewPathMatcher(cfg.BypassPaths),
+		transport:        newUpstreamTransport(cfg.KeepAlive, cfg.Transport, dns),
+		dns:              dns,
+		grpcTransport:    grpcTransport,
+		logs:             logs,
+		uploadIdle:       cfg.UploadIdleTimeout.Std(),
+		bodyLog:          bodyLog,
+		accessLog:        accessLog,
+		acls:             acls,
+		limits:           limits,
+		bulkheads:        bulkheads,
+		inFlight:         inFlight,
+		errorPages:       errorPages,
+		scripts:          scripts,
+		retry:            NewRetryPolicy(cfg.Retry),
+		headers:          cfg.Headers,
+		trusted:          trusted,
+		cache:            NewResponseCache(cfg.Cache),
+		metrics:          NewMetrics(pools, experiment),
+		reports:          NewPathReports(),
+		events:           events,
+	}
+	h.metrics.inFlightLimit = inFlight
+	h.metrics.dns = dns
+	if cfg.StickySessions {
+		h.sessions, err = NewSessionManager(cfg, pools)
+		if err != nil {
+			return nil, err
+		}
+		if !h.sessions.Hashed() {
+			h.metrics.sessions = h.sessions
+		}
+	}
+	h.probes, err = NewProbes(cfg.Probes, pools)
+	if err != nil {
+		return nil, err
+	}
+	h.pipeline, err = buildPipeline(h, cfg, http.HandlerFunc(h.forward))
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.probes.Handle(w, r) {
+		return
+	}
+	start := time.Now()
+	h.metrics.inFlight.Add(1)
+	defer h.metrics.inFlight.Add(-1)
+
+	cleanRequestPath(r)
+	path := r.URL.Path
+	route, accessLog := "", h.accessLog
+	if rt := h.route(r); rt != nil {
+		route = rt.prefix
+		if rt.noAccessLog {
+			accessLog = nil
+		}
+	}
+	rec := &statusRecorder{ResponseWriter: w}
+	r, rm := withRequestMetrics(r)
+
+	assignRequestID(rec, r)
+	r.Header.Del(authUserHeader)
+	h.trusted.Sanitize(r)
+	h.pipeline.ServeHTTP(rec, r)
+
+	elapsed := time.Since(start)
+	h.metrics.observeRequest(route, rm.backend, rec.Status(), elapsed)
+	h.reports.Observe(path, rec.Status(), elapsed)
+	if accessLog != nil {
+		accessLog.Log(&accessEntry{
+			r: r, start: start, duration: elapsed, status: rec.Status(), bytes: rec.bytes,
+			client: h.trusted.RealIP(r).String(), route: route, backend: rm.backend,
+		})
+	}
+}
+
+// isGRPC reports whether r is a gRPC call handled as such (gRPC mode on).
+func (h *ProxyHandler) isGRPC(r *http.Request) bool {
+	return h.grpcTransport != nil && isGRPC(r)
+}
+
+// forward is the last pipeline stage: it picks a backend and proxies to it.
+func (h *ProxyHandler) forward(w http.ResponseWriter, r *http.Request) {
+	bypass := h.bypass.Match(r.URL.Path)
+	grpc := h.isGRPC(r)
+	if grpc {
+		releaseDeadlines(w)
+	} else {
+		streamRequestBody(w, r, h.uploadIdle, proxyWriteTimeout)
+	}
+
+	if !h.inFlight.acquire(r.Context()) {
+		h.metrics.rateLimitRejected("in_flight")
+		h.events.Publish(Event{Type: EventRateLimited, RequestID: requestID(r), Detail: "in_flight"})
+		h.writeInFlightLimited(w, r, grpc)
+		return
+	}
+	defer h.inFlight.release()
+
+	// Pick the pool: a matching route wins, otherwise the experiment
+	// variant or the default pool
+	pool, variant := h.pool, ""
+	rewriteRedirects, cookies := h.rewriteRedirects, h.cookies
+	var routeHeaders *HeaderRules
+	var routeFlush *time.Duration
+	if route := h.route(r); route != nil {
+		if route.requireClientCert && !hasVerifiedClientCert(r) {
+			h.httpError(w, r, "Forbidden - client certificate required", http.StatusForbidden)
+			return
+		}
+		pool = route.PoolFor(r.Method)
+		rewriteRedirects, cookies = route.rewriteRedirects, route.cookies
+		routeHeaders = route.headers
+		routeFlush = route.flushInterval
+	} else if lp := listenerPool(r); lp != nil {
+		pool = lp
+	} else if h.experiment != nil {
+		if bypass {
+			variant, pool = h.experiment.Lookup(r)
+		} else {
+			variant, pool = h.experiment.Assign(w, r)
+		}
+	}
+
+	debug := h.logs.SampleDebug()
+	if debug && h.bodyLog != nil && hasBody(r) {
+		r.Body = h.bodyLog.Capture(r.Body, "Request body "+r.Method+" "+r.URL.Path, r.URL.Path, r.Header.Get("Content-Type"))
+	}
+
+	// Retries resend the body from memory; gRPC streams get one try
+	attempts := h.retry.attempts
+	var body []byte
+	if grpc {
+		attempts = 1
+	} else if attempts > 1 {
+		var replayable bool
+		if body, replayable = h.retry.bufferBody(r); !replayable {
+			attempts = 1
+		}
+	}
+
+	pr := &proxyRequest{
+		h:                h,
+		r:                r,
+		pool:             pool,
+		variant:          variant,
+		realIP:           h.trusted.RealIP(r).String(),
+		debug:            debug,
+		grpc:             grpc,
+		rewriteRedirects: rewriteRedirects,
+		cookies:          cookies,
+		routeHeaders:     routeHeaders,
+		flushInterval:    pool.flushInterval,
+	}
+	if routeFlush != nil {
+		pr.flushInterval = *routeFlush
+	}
+
+	// serve proxies one try to backend through its cached proxy
+	serve := func(backend *Backend, req *http.Request, headersIn func(), final bool) error {
+		// Increment connection count; the bulkhead slot was taken by pickBackend
+		atomic.AddInt64(&backend.CurrentConns, 1)
+		defer atomic.AddInt64(&backend.CurrentConns, -1)
+		defer h.bulkheads.release(backend.URL.String())
+		noteBackend(r, backend)
+
+		t := &proxyTry{proxyRequest: pr, backend: backend, headersIn: headersIn, final: final}
+		return t.serve(w, req)
+	}
+
+	key := h.balanceKey(r, pool)
+	for try := 1; ; try++ {
+		// Get backend: the session's on the first try if it can take the
+		// request, otherwise one not at its rate cap or in-flight limit
+		var (
+			backend *Backend
+			wait    time.Duration
+			busy    bool
+		)
+		if try == 1 {
+			backend = h.stickyBackend(r, pool)
+		}
+		if backend == nil {
+			backend, wait, busy = h.pickBackend(r.Context(), pool, key, try-1)
+		}
+		if backend == nil && busy && wait == 0 {
+			h.metrics.rateLimitRejected("bulkhead")
+			h.events.Publish(Event{Type: EventRateLimited, Pool: pool.name, RequestID: requestID(r), Detail: "bulkhead"})
+			h.writeBackendsBusy(w, r, grpc)
+			return
+		}
+		if backend == nil && wait > 0 {
+			h.metrics.rateLimitRejected("backend")
+			h.events.Publish(Event{Type: EventRateLimited, Pool: pool.name, RequestID: requestID(r), Detail: "backend"})
+			w.Header().Set("Retry-After", retryAfter(wait))
+			if grpc {
+				writeGRPCError(w, grpcResourceExhausted, "backend rate limit reached")
+				return
+			}
+			h.httpError(w, r, "Service Unavailable - backend rate limit reached", http.StatusServiceUnavailable)
+			return
+		}
+		if backend == nil {
+			if grpc {
+				writeGRPCError(w, grpcUnavailable, "no healthy backends")
+				return
+			}
+			h.httpError(w, r, "Service Unavailable - No healthy backends", http.StatusServiceUnavailable)
+			return
+		}
+
+		h.pinSession(w, r, pool, backend)
+
+		req, headersIn, cancel := h.retry.tryRequest(r, body)
+		err := serve(backend, req, headersIn, try >= attempts)
+		cancel()
+		if err == nil {
+			return
+		}
+		h.logs.Warnf("[%s] Retrying %s %s (try %d of %d failed on %s)", requestID(r), r.Method, r.URL.Path, try, attempts, backend.URL)
+		h.events.Publish(Event{Type: EventRetry, Pool: pool.name, Backend: backend.URL.String(), RequestID: requestID(r), Detail: err.Error()})
+		if !h.retry.wait(r.Context(), try) {
+			return
+		}
+	}
+}
+
+// ==================== ADMIN API ====================
+type AdminAPI struct {
+	pool   *ServerPool
+	pools  map[string]*ServerPool
+	logs   *LogSettings
+	diag   *Diagnostics
+	certs  *CertStore // nil without TLS
+	acls   *AccessLists
+	limits  *RateLimits
+	cache   *ResponseCache // nil unless caching is enabled
+	metrics *Metrics
+	reports *PathReports
+	events  *EventBus
+	done    chan struct{} // closed on shutdown to end /events streams
+	auth    *AdminAuth    // nil: no authentication
+	uptime  *Availability
+	health  *HealthHistory
+	checker *HealthChecker
+	reload  *Reloader
+	sessions *SessionManager // nil unless sticky_sessions is on
+	audit    *AuditLog
+	logTail  *LogTail
+	registrations *Registrations
+	dns     *DNSCache     // nil unless upstream_dns_cache is set
+	debug   http.Handler  // nil unless admin_debug is on
+}
+
+// Handler returns the Admin API's own mux behind authentication, for the
+// admin http.Server.
+func (a *AdminAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/add", a.handleAddBackend)
+	mux.HandleFunc("/remove", a.handleRemoveBackend)
+	mux.HandleFunc("/sessions", a.handleSessions)
+	mux.HandleFunc("/sessions/", a.handleSessions)
+	mux.HandleFunc("/dashboard", a.handleDashboard)
+	mux.HandleFunc("/dashboard/data", a.handleDashboardData)
+	mux.HandleFunc("/version", a.handleVersion)
+	mux.HandleFunc("/logging", a.handleLogging)
+	mux.HandleFunc("/dump", a.handleDump)
+	mux.HandleFunc("/config/reload", a.handleConfigReload)
+	mux.HandleFunc("/config/export", a.handleConfigExport)
+	mux.HandleFunc("/config/import", a.handleConfigImport)
+	mux.HandleFunc("/config/validate", a.handleConfigValidate)
+	mux.HandleFunc("/config/history", a.handleConfigHistory)
+	mux.HandleFunc("/config/rollback", a.handleConfigRollback)
+	mux.HandleFunc("/backends/score", a.handleBackendScores)
+	mux.HandleFunc("/backends/weight", a.handleBackendWeights)
+	mux.HandleFunc("/backends/availability", a.handleAvailability)
+	mux.HandleFunc("/backends/", a.handleBackendDetail)
+	mux.HandleFunc("/backends/status", a.handleBackendStatus)
+	mux.HandleFunc("/health/history", a.handleHealthHistory)
+	mux.HandleFunc("/health/pause", a.handleHealthControl)
+	mux.HandleFunc("/health/resume", a.handleHealthControl)
+	mux.HandleFunc("/health/check", a.handleHealthControl)
+	mux.HandleFunc("/reports/slowest", a.handleReport)
+	mux.HandleFunc("/reports/errors", a.handleReport)
+	mux.HandleFunc("/tls/reload", a.handleTLSReload)
+	mux.HandleFunc("/acl", a.handleACL)
+	mux.HandleFunc("/ratelimit", a.handleRateLimit)
+	mux.HandleFunc("/cache/purge", a.handleCachePurge)
+	mux.HandleFunc("/dns/flush", a.handleDNSFlush)
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	mux.HandleFunc("/events", a.handleEvents)
+	mux.HandleFunc("/audit", a.handleAudit)
+	mux.HandleFunc("/logs/tail", a.handleLogTail)
+	mux.HandleFunc("/register", a.handleRegister)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		adminError(w, "Not found", http.StatusNotFound)
+	})
+	versioned := http.StripPrefix(adminAPIVersion, mux)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := a.auth.Check(w, r)
+		if !ok {
+			return
+		}
+		// Debug endpoints keep the paths pprof and expvar expect
+		if strings.HasPrefix(r.URL.Path, "/debug/") && a.debug != nil {
+			a.debug.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		next := versioned
+		if !strings.HasPrefix(r.URL.Path, adminAPIVersion+"/") {
+			deprecatedAlias(w, r)
+			next = mux
+		}
+		if audited(r) {
+			a.auditCall(w, r, user, next)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *AdminAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
+	backends := a.pool.GetBackends()
+	
+	active := 0
+	for _, b := range backends {
+		if b.IsAlive() {
+			active++
+		}
+	}
+	
+	response := map[string]interface{}{
+		"total_backends":   len(backends),
+		"active_backends":  active,
+		"backends":         backends,
+		"health_checks_paused": a.checker.Paused(),
+		"timestamp":        time.Now().Format(time.RFC3339),
+	}
+
+	if len(a.pools) > 1 {
+		pools := make(map[string][]*Backend, len(a.pools))
+		for name, p := range a.pools {
+			pools[name] = p.GetBackends()
+		}
+		response["pools"] = pools
+	}
+	if a.cache != nil {
+		response["cache"] = a.cache.Stats()
+	}
+	
+	json.NewEncoder(w).Encode(response)
+}
+
+func (a *AdminAPI) handleAddBackend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	
+	var data struct {
+		URL string `json:"url"`
+	}
+	
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		adminError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	
+	if err := a.pool.AddBackend(data.URL); err != nil {
+		adminError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	response := map[string]string{
+		"message": "Backend added successfully",
+		"url":     data.URL,
+	}
+	
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleRemoveBackend takes a backend out of every pool; requests already
+// sent to it finish normally.
+func (a *AdminAPI) handleRemoveBackend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		adminError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	removed := false
+	for _, p := range a.pools {
+		if p.RemoveBackend(data.URL) {
+			removed = true
+		}
+	}
+	if !removed {
+		adminError(w, fmt.Sprintf("Unknown backend %s", data.URL), http.StatusNotFound)
+		return
+	}
+	log.Printf("Removed backend: %s", data.URL)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Backend removed successfully",
+		"url":     data.URL,
+	})
+}
+
+func (a *AdminAPI) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(GetBuildInfo())
+}
+
+func (a *AdminAPI) handleLogging(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		var data struct {
+			Level           *string  `json:"level"`
+			DebugSampleRate *float64 `json:"debug_sample_rate"`
+			RateLimit       *float64 `json:"log_rate_limit"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			adminError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if data.Level != nil {
+			if err := a.logs.SetLevel(*data.Level); err != nil {
+				adminError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if data.DebugSampleRate != nil {
+			if err := a.logs.SetDebugSampleRate(*data.DebugSampleRate); err != nil {
+				adminError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if data.RateLimit != nil {
+			if err := a.logs.SetRateLimit(*data.RateLimit); err != nil {
+				adminError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		log.Printf("Logging changed: level=%s debug_sample_rate=%v log_rate_limit=%v", a.logs.Level(), a.logs.DebugSampleRate(), a.logs.RateLimit())
+		a.events.Publish(Event{Type: EventConfigReload, Detail: "logging"})
+	default:
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(a.loggingState())
+}
+
+func (a *AdminAPI) loggingState() map[string]interface{} {
+	return map[string]interface{}{
+		"level":             a.logs.Level().String(),
+		"debug_sample_rate": a.logs.DebugSampleRate(),
+		"log_rate_limit":    a.logs.RateLimit(),
+	}
+}
+
+func (a *AdminAPI) handleDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path, err := a.diag.WriteDump()
+	if err != nil {
+		adminError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Diagnostic dump written to %s", path)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Dump written",
+		"file":    path,
+	})
+}
+
+// findBackend looks a backend up by URL across all pools.
+func (a *AdminAPI) findBackend(rawURL string) *Backend {
+	for _, p := range a.pools {
+		for _, b := range p.GetBackends() {
+			if b.URL.String() == rawURL {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+// handleBackendScores lets an external controller push scores, e.g.
+// {"scores": {"http://localhost:9091": 2.5, "http://localhost:9092": 0}}.
+// Nothing is applied unless every URL is known.
+func (a *AdminAPI) handleBackendScores(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PATCH" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data struct {
+		Scores map[string]float64 `json:"scores"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		adminError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	backends := make(map[*Backend]float64, len(data.Scores))
+	for rawURL, score := range data.Scores {
+		b := a.findBackend(rawURL)
+		if b == nil {
+			adminError(w, fmt.Sprintf("Unknown backend %s", rawURL), http.StatusNotFound)
+			return
+		}
+		if math.IsNaN(score) || math.IsInf(score, 0) {
+			adminError(w, fmt.Sprintf("Invalid score for %s", rawURL), http.StatusBadRequest)
+			return
+		}
+		backends[b] = score
+	}
+	for b, score := range backends {
+		b.SetScore(score)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Scores updated",
+		"scores":  data.Scores,
+	})
+}
+
+// handleBackendWeights changes backend weights, e.g.
+// {"weights": {"http://localhost:9091": 3, "http://localhost:9092": 0}}.
+// Weight 0 drains a backend. Nothing is applied unless every entry is valid.
+func (a *AdminAPI) handleBackendWeights(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PATCH" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data struct {
+		Weights map[string]int `json:"weights"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		adminError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	backends := make(map[*Backend]int, len(data.Weights))
+	for rawURL, weight := range data.Weights {
+		b := a.findBackend(rawURL)
+		if b == nil {
+			adminError(w, fmt.Sprintf("Unknown backend %s", rawURL), http.StatusNotFound)
+			return
+		}
+		if weight < 0 {
+			adminError(w, fmt.Sprintf("Invalid weight for %s", rawURL), http.StatusBadRequest)
+			return
+		}
+		backends[b] = weight
+	}
+	for b, weight := range backends {
+		b.SetWeight(weight)
+		log.Printf("Backend weight via Admin API: %s = %d", b.URL, weight)
+	}
+	if len(backends) > 0 {
+		a.events.Publish(Event{Type: EventConfigReload, Detail: "backend weights"})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Weights updated",
+		"weights": data.Weights,
+	})
+}
+
+// handleSessions serves DELETE /sessions (all, or ?backend= for one
+// backend's clients), DELETE /sessions/{id} and GET /sessions/by-backend.
+// Clients whose session is dropped are balanced afresh on their next request.
+func (a *AdminAPI) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if a.sessions == nil {
+		adminError(w, "Sticky sessions are not enabled", http.StatusConflict)
+		return
+	}
+	if a.sessions.Hashed() {
+		adminError(w, "Sticky sessions are hashed; there are none to list or drop", http.StatusConflict)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+
+	switch {
+	case id == "by-backend" && r.Method == "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"sessions":   a.sessions.Count(),
+			"by_backend": a.sessions.ByBackend(),
+			"pools":      a.sessions.Stats(a.pools),
+		})
+	case id == "" && r.Method == "DELETE":
+		backend := r.URL.Query().Get("backend")
+		n := a.sessions.Flush(backend)
+		log.Printf("Sessions flushed via Admin API: %d removed (backend=%q)", n, backend)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Sessions flushed",
+			"removed": n,
+		})
+	case id != "" && id != "by-backend" && r.Method == "DELETE":
+		if !a.sessions.Delete(id) {
+			adminError(w, "Unknown session", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Session removed",
+			"removed": 1,
+		})
+	default:
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleConfigReload re-reads the config file, like SIGHUP, and reports
+// what changed and what needs a restart.
+func (a *AdminAPI) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := a.reload.Reload()
+	if err != nil {
+		log.Printf("Config reload via Admin API failed: %v", err)
+		adminError(w, fmt.Sprintf("Reload failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleConfigExport returns the running config, including backends,
+// weights, rate limits and logging changed at runtime.
+func (a *AdminAPI) handleConfigExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(a.reload.Export())
+}
+
+// handleConfigImport applies an exported config the way a reload applies
+// the config file: validated in full first, then the reloadable parts.
+func (a *AdminAPI) handleConfigImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigSize))
+	if err != nil {
+		adminError(w, fmt.Sprintf("Reading config: %v", err), http.StatusBadRequest)
+		return
+	}
+	result, err := a.reload.Import(data)
+	if err != nil {
+		log.Printf("Config import via Admin API failed: %v", err)
+		adminError(w, fmt.Sprintf("Import failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleConfigHistory lists the applied configs, newest first, or with
+// ?version= returns one of them in full, secrets redacted.
+func (a *AdminAPI) handleConfigHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	history := a.reload.history
+	if q := r.URL.Query().Get("version"); q != "" {
+		version, err := strconv.Atoi(q)
+		if err != nil {
+			adminError(w, "version must be a number", http.StatusBadRequest)
+			return
+		}
+		v, ok := history.Get(version)
+		if !ok {
+			adminError(w, fmt.Sprintf("Version %d is not in the history", version), http.StatusNotFound)
+			return
+		}
+		v.Config = v.Config.redacted()
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"versions": history.List()})
+}
+
+// handleConfigRollback applies an earlier config from the history, by
+// default the one before the config in effect. Like a reload, it only
+// changes the reloadable settings.
+func (a *AdminAPI) handleConfigRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		adminError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	result, err := a.reload.Rollback(req.Version)
+	if err != nil {
+		log.Printf("Config rollback via Admin API failed: %v", err)
+		adminError(w, fmt.Sprintf("Rollback failed: %v", err), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (a *AdminAPI) handleTLSReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.certs == nil {
+		adminError(w, "TLS is not enabled", http.StatusConflict)
+		return
+	}
+
+	if err := a.certs.Reload(); err != nil {
+		adminError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("TLS certificates reloaded via Admin API")
+	a.events.Publish(Event{Type: EventConfigReload, Detail: "tls certificates"})
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Certificates reloaded",
+	})
+}
+
+// handleACL shows all IP access lists (GET) or replaces one (PUT), e.g.
+// {"route": "/admin", "allow": ["10.0.0.0/8"], "deny": [], "action": "drop"};
+// an empty route means the global list. Changes last until restart.
+func (a *AdminAPI) handleACL(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var data struct {
+			Route string `json:"route"`
+			ACLConfig
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			adminError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		acl := a.acls.Get(data.Route)
+		if acl == nil {
+			adminError(w, fmt.Sprintf("Unknown route %s", data.Route), http.StatusNotFound)
+			return
+		}
+		if err := acl.Update(data.ACLConfig); err != nil {
+			adminError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logACLUpdate(data.Route, acl.Config())
+		a.events.Publish(Event{Type: EventConfigReload, Detail: strings.TrimSpace("acl " + data.Route)})
+	default:
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(a.acls.Snapshot())
+}
+
+func (a *AdminAPI) handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var data struct {
+			Scope   string `json:"scope"` // "global" or "client"
+			Route   string `json:"route"`
+			Backend string `json:"backend"`
+			RateLimitConfig
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			adminError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		given := 0
+		for _, s := range []string{data.Scope, data.Route, data.Backend} {
+			if s != "" {
+				given++
+			}
+		}
+		switch {
+		case given != 1:
+			adminError(w, "Give exactly one of scope, route or backend", http.StatusBadRequest)
+			return
+		case data.Scope == "global" || data.Scope == "client":
+			if !a.limits.hasStage(data.Scope) {
+				adminError(w, fmt.Sprintf("The %s rate limit stage is not in the middleware list", data.Scope), http.StatusConflict)
+				return
+			}
+			if data.Scope == "global" {
+				err = a.limits.SetGlobal(data.RateLimitConfig)
+			} else {
+				err = a.limits.SetClient(data.RateLimitConfig)
+			}
+			if err == nil {
+				logRateLimitUpdate(data.Scope, data.RateLimitConfig)
+				a.events.Publish(Event{Type: EventConfigReload, Detail: "rate_limit " + data.Scope})
+			}
+		case data.Scope != "":
+			adminError(w, fmt.Sprintf("Unknown scope %s, want global or client", data.Scope), http.StatusBadRequest)
+			return
+		case data.Route != "":
+			if a.acls.Get(data.Route) == nil {
+				adminError(w, fmt.Sprintf("Unknown route %s", data.Route), http.StatusNotFound)
+				return
+			}
+			err = a.limits.SetRoute(data.Route, data.RateLimitConfig)
+			if err == nil {
+				logRateLimitUpdate("route "+data.Route, data.RateLimitConfig)
+				a.events.Publish(Event{Type: EventConfigReload, Detail: "rate_limit route " + data.Route})
+			}
+		default:
+			if a.findBackend(data.Backend) == nil {
+				adminError(w, fmt.Sprintf("Unknown backend %s", data.Backend), http.StatusNotFound)
+				return
+			}
+			err = a.limits.SetBackend(data.Backend, data.RateLimitConfig)
+			if err == nil {
+				logRateLimitUpdate("backend "+data.Backend, data.RateLimitConfig)
+				a.events.Publish(Event{Type: EventConfigReload, Detail: "rate_limit backend " + data.Backend})
+			}
+		}
+		if err != nil {
+			adminError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(a.limits.Snapshot())
+}
+
+func (a *AdminAPI) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.cache == nil {
+		adminError(w, "Response cache is not enabled", http.StatusConflict)
+		return
+	}
+
+	var data struct {
+		URL    string `json:"url"`
+		Prefix string `json:"prefix"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		adminError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if (data.URL == "") == (data.Prefix == "") {
+		adminError(w, "Give exactly one of url or prefix", http.StatusBadRequest)
+		return
+	}
+
+	target, prefix := data.URL, false
+	if data.Prefix != "" {
+		target, prefix = data.Prefix, true
+	}
+	purged, err := a.cache.Purge(target, prefix)
+	if err != nil {
+		adminError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Cache purge via Admin API: %s (prefix=%v) removed %d entries", target, prefix, purged)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"purged": purged,
+	})
+}
+
+// handleDNSFlush drops every cached upstream name, e.g. after a backend
+// moved to a new address before its TTL ran out.
+func (a *AdminAPI) handleDNSFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.dns == nil {
+		adminError(w, "Upstream DNS cache is not enabled", http.StatusConflict)
+		return
+	}
+
+	flushed := a.dns.Flush()
+	log.Printf("DNS cache flush via Admin API: removed %d names", flushed)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"flushed": flushed,
+	})
+}
+
+func (a *AdminAPI) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	a.metrics.WriteTo(w)
+}
+
+// handleAvailability reports each backend's uptime over 1h, 24h and 7d.
+func (a *AdminAPI) handleAvailability(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"backends":  a.uptime.Report(),
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+// handleBackendStatus marks a backend up or down by hand, e.g.
+// {"url": "http://localhost:9091", "alive": false}. The health checker
+// still probes it and may change it back.
+func (a *AdminAPI) handleBackendStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data struct {
+		URL   string `json:"url"`
+		Alive *bool  `json:"alive"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Alive == nil {
+		adminError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if a.findBackend(data.URL) == nil {
+		adminError(w, fmt.Sprintf("Unknown backend %s", data.URL), http.StatusNotFound)
+		return
+	}
+	for _, p := range a.pools {
+		p.SetBackendStatus(data.URL, *data.Alive, ReasonManual, "")
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Backend status updated",
+		"url":     data.URL,
+		"alive":   *data.Alive,
+	})
+}
+
+// handleHealthControl pauses or resumes the health checker, or runs a
+// full check now and answers once it is done.
+func (a *AdminAPI) handleHealthControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var message string
+	switch r.URL.Path {
+	case "/health/pause":
+		a.checker.Pause()
+		message = "Health checks paused"
+	case "/health/resume":
+		a.checker.Resume()
+		message = "Health checks resumed"
+	case "/health/check":
+		a.checker.CheckNow()
+		message = "Health check completed"
+	}
+	log.Printf("%s via Admin API", message)
+
+	alive := 0
+	backends := a.pool.GetBackends()
+	for _, b := range backends {
+		if b.IsAlive() {
+			alive++
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":         message,
+		"paused":          a.checker.Paused(),
+		"total_backends":  len(backends),
+		"active_backends": alive,
+	})
+}
+
+// handleHealthHistory lists backend transitions, newest first; ?backend=
+// filters by URL and ?limit= (default 100) caps the list.
+func (a *AdminAPI) handleHealthHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			adminError(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"transitions": a.health.Recent(r.URL.Query().Get("backend"), limit),
+	})
+}
+
+// handleBackendDetail serves GET /backends/{id}/stats, where id is the
+// backend's host:port or its URL path-escaped.
+func (a *AdminAPI) handleBackendDetail(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.EscapedPath(), "/backends/"), "/stats")
+	if !ok {
+		adminError(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := url.PathUnescape(rest)
+	if err != nil {
+		adminError(w, "Invalid backend id", http.StatusBadRequest)
+		return
+	}
+
+	var backend *Backend
+	var pools []string
+	for _, name := range slices.Sorted(maps.Keys(a.pools)) {
+		for _, b := range a.pools[name].GetBackends() {
+			if b.URL.String() == id || b.URL.Host == id {
+				backend = b
+				pools = append(pools, name)
+			}
+		}
+	}
+	if backend == nil {
+		adminError(w, fmt.Sprintf("Unknown backend %s", id), http.StatusNotFound)
+		return
+	}
+	rawURL := backend.URL.String()
+
+	// There is no circuit breaker: a failed request marks the backend down
+	// until a health check passes, so its health is the breaker state
+	health := map[string]interface{}{"alive": backend.IsAlive()}
+	if last := a.health.Recent(rawURL, 1); len(last) > 0 {
+		health["last_transition"] = last[0]
+	}
+
+	response := map[string]interface{}{
+		"url":                 rawURL,
+		"pools":               pools,
+		"weight":              backend.GetWeight(),
+		"score":               backend.GetScore(),
+		"current_connections": atomic.LoadInt64(&backend.CurrentConns),
+		"requests":            a.metrics.backendRequests(rawURL),
+		"recent":              backend.Stats.Snapshot(),
+		"health":              health,
+		"rate_limit":          a.limits.backendLimit(rawURL),
+	}
+	if a.sessions != nil && !a.sessions.Hashed() {
+		response["sessions"] = a.sessions.ByBackend()[rawURL]
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleReport lists the slowest or most failing paths of the last few
+// minutes; ?by= picks the ordering, ?limit= and ?min_requests= filter.
+func (a *AdminAPI) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, minRequests, err := reportQuery(r)
+	if err != nil {
+		adminError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	var paths []PathReport
+	if r.URL.Path == "/reports/slowest" {
+		paths = a.reports.Slowest(by, limit, minRequests)
+	} else {
+		paths = a.reports.Errors(by, limit, minRequests)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window_seconds": reportWindowMinutes * 60,
+		"paths":          paths,
+	})
+}
+
+// handleEvents streams proxy events as Server-Sent Events.
+func (a *AdminAPI) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.events.serveEvents(w, r, a.done)
+}
+
+func (a *AdminAPI) handleLogTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.logTail.serve(w, r, a.done)
+}
+
+// ==================== MAIN FUNCTION ====================
+func main() {
+	configPath := flag.String("config", "config.json", "path to the JSON config file")
+	migrateConfig := flag.Bool("migrate-config", false, "print the config converted from the legacy flat schema and exit")
+	devTLS := flag.Bool("dev-tls", false, "serve HTTPS with an in-memory self-signed certificate (local testing only)")
+	flag.Parse()
+
+	if *migrateConfig {
+		out, err := MigrateConfigFile(*configPath)
+		if err != nil {
+			log.Fatalf("Config migration error: %v", err)
+		}
+		os.Stdout.Write(out)
+		return
+	}
+
+	// Keep recent log lines for GET /logs/tail
+	logTail := NewLogTail()
+	log.SetOutput(io.MultiWriter(os.Stderr, logTail))
+
+	info := GetBuildInfo()
+	log.Printf("Starting Go Reverse Proxy Server %s (commit %s)...", info.Version, info.Commit)
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	
+	// Backend transitions are published once and consumed here
+	events := NewEventBus()
+	events.Subscribe(logEvent)
+	
+	// Create server pools; their upstream dials share one DNS cache
+	dns := NewDNSCache(cfg.UpstreamDNS)
+	pools, err := cfg.BuildPools(events, dns)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	discovery, err := NewDiscovery(cfg, pools)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	if err := discovery.Start(cfg); err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	availability := NewAvailability(pools, events)
+	healthHistory, err := NewHealthHistory(cfg.HealthHistory, events)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	audit, err := NewAuditLog(cfg.AdminAudit)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	configHistory, err := NewConfigHistory(cfg.ConfigHistory)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	pool := pools["default"]
+	
+	// Create handlers
+	logs, err := NewLogSettings(cfg)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	proxyHandler, err := NewProxyHandler(cfg, pools, logs, events, dns)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	
+	// Start health checker
+	healthChecker := NewHealthChecker(pools, proxyHandler.metrics)
+	healthChecker.Start()
+	reloader := NewReloader(*configPath, cfg, pools, proxyHandler, events, configHistory, discovery)
+	reloader.Watch(cfg.WatchConfig)
+	startIdleConnProber(pools, proxyHandler.transport, cfg.KeepAlive.ProbeInterval.Std(), logs)
+	
+	var certs *CertStore
+	if *devTLS {
+		certs, err = NewDevCertStore()
+		if err != nil {
+			log.Fatalf("TLS error: %v", err)
+		}
+		cfg.TLS.Enabled = true
+		log.Printf("WARNING: --dev-tls serves a self-signed certificate (sha256 %s); never use it in production",
+			certFingerprint(certs.certs[0]))
+	} else if cfg.TLS.Enabled {
+		certs, err = NewCertStore(cfg.TLS)
+		if err != nil {
+			log.Fatalf("TLS error: %v", err)
+		}
+		certs.Watch(cfg.TLS.ReloadInterval.Std())
+	}
+
+	diag := NewDiagnostics(cfg.DumpDir, pools, proxyHandler, logs)
+	adminAuth, err := NewAdminAuth(cfg.AdminAuth)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	var debug http.Handler
+	if cfg.AdminDebug {
+		if adminAuth == nil {
+			log.Fatalf("Config error: admin_debug requires admin_auth")
+		}
+		debug = newDebugMux()
+	}
+	adminAPI := &AdminAPI{pool: pool, pools: pools, logs: logs, diag: diag, certs: certs, acls: proxyHandler.acls, limits: proxyHandler.limits, cache: proxyHandler.cache, metrics: proxyHandler.metrics, reports: proxyHandler.reports, events: events, done: make(chan struct{}), auth: adminAuth, debug: debug, uptime: availability, health: healthHistory, checker: healthChecker, reload: reloader, sessions: proxyHandler.sessions, audit: audit, logTail: logTail, registrations: discovery.registrations, dns: dns}
+	
+	connLimiter, err := NewConnLimiter(cfg.ConnLimit)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	proxyHandler.metrics.conns = connLimiter
+
+	// Create servers, one per listener
+	adminHandler := adminAPI.Handler()
+	var listeners []*Listener
+	hasAdmin := false
+	for _, lc := range cfg.ListenerConfigs() {
+		handler := adminHandler
+		if lc.Role == ListenerAdmin {
+			hasAdmin = true
+		} else if handler, err = proxyHandler.ForListener(lc, pools); err != nil {
+			log.Fatalf("Config error: %v", err)
+		}
+		l, err := NewListener(lc, handler, certs, connLimiter, cfg)
+		if err != nil {
+			log.Fatalf("TLS error: %v", err)
+		}
+		listeners = append(listeners, l)
+	}
+	
+	var passthrough *PassthroughProxy
+	if cfg.TLSPassthrough != nil {
+		passthrough, err = NewPassthroughProxy(cfg.TLSPassthrough, pools, logs)
+		if err != nil {
+			log.Fatalf("Config error: %v", err)
+		}
+	}
+	
+	// Start servers in goroutines; the first one to fail stops the rest
+	serverErr := make(chan error, len(listeners)+1)
+	for _, l := range listeners {
+		go func() {
+			if err := l.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				serverErr <- fmt.Errorf("listener %s: %w", l.config.name(), err)
+			}
+		}()
+	}
+	
+	if hasAdmin {
+		log.Printf("  Endpoints are under %s; the unprefixed paths are deprecated aliases", adminAPIVersion)
+		log.Println("  GET  /status  - Check backend status")
+		log.Println("  POST /add     - Add new backend (JSON: {\"url\": \"http://...\"})")
+		log.Println("  POST /remove  - Remove a backend from every pool (JSON: {\"url\": \"http://...\"})")
+		log.Println("  GET  /dashboard - Web dashboard")
+		log.Println("  DELETE /sessions[?backend=], /sessions/{id} - Drop sticky sessions; GET /sessions/by-backend - Count them")
+		log.Println("  GET  /version - Build version and commit")
+		log.Println("  GET|PUT /logging - Log level and debug sampling")
+		log.Println("  POST /dump    - Write goroutine stacks and state snapshot")
+		log.Println("  POST /config/reload - Reload backends, weights, rate limits and logging from the config file (or SIGHUP)")
+		log.Println("  GET  /config/export, POST /config/import - Save or restore the running config")
+		log.Println("  POST /config/validate - Check a candidate config without applying it")
+		log.Println("  GET  /config/history[?version=], POST /config/rollback - List applied configs or go back to one")
+		log.Println("  POST /tls/reload - Reload TLS certificates from disk")
+		log.Println("  GET|PUT /acl  - Show or replace IP allow/deny lists")
+		log.Println("  GET|PUT /ratelimit - Show or change global, per-client, route and backend rate limits")
+		log.Println("  POST /cache/purge - Drop cached responses by URL or prefix")
+		log.Println("  POST /dns/flush - Forget the upstream DNS cache")
+		log.Println("  GET  /metrics - Prometheus metrics")
+		log.Println("  GET  /events  - Stream proxy events (Server-Sent Events, ?type=...)")
+		log.Println("  GET  /audit   - Recent mutating Admin API calls (who, what, old/new values)")
+		log.Println("  GET  /logs/tail - Stream recent and live log lines (Server-Sent Events, ?level=error)")
+		log.Println("  POST /register, DELETE /register?url= - Backends join a pool with a TTL and renew it; GET lists them")
+		if debug != nil {
+			log.Println("  GET  /debug/pprof/, /debug/vars, /debug/goroutines - Runtime profiling and debug info")
+		}
+		log.Println("  GET  /backends/availability - Backend uptime over 1h/24h/7d")
+		log.Println("  GET  /backends/{host:port}/stats - One backend's requests, latency, health and sessions")
+		log.Println("  PUT  /backends/status - Mark a backend up or down (JSON: {\"url\": \"http://...\", \"alive\": false})")
+		log.Println("  GET  /health/history - Backend up/down transitions with reasons")
+		log.Println("  POST /health/pause, /health/resume, /health/check - Pause, resume or run health checks now")
+		log.Println("  GET  /reports/slowest, /reports/errors - Slowest and most failing paths")
+		log.Println("  PATCH /backends/score - Push backend scores (JSON: {\"scores\": {\"http://...\": 1.5}})")
+		log.Println("  PATCH /backends/weight - Change backend weights, 0 drains (JSON: {\"weights\": {\"http://...\": 3}})")
+	}
+	
+	proxyHandler.probes.SetReady(true)
+	
+	if passthrough != nil {
+		go func() {
+			ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.TLSPassthrough.Port))
+			if err != nil {
+				serverErr <- fmt.Errorf("TLS passthrough: %w", err)
+				return
+			}
+			log.Printf("TLS passthrough listening on %s", ln.Addr())
+			if err := passthrough.Serve(ln); err != nil {
+				serverErr <- fmt.Errorf("TLS passthrough: %w", err)
+			}
+		}()
+	}
+	
+	// SIGQUIT writes a diagnostic dump instead of killing the process
+	dumpSignal := make(chan os.Signal, 1)
+	signal.Notify(dumpSignal, syscall.SIGQUIT)
+	go func() {
+		for range dumpSignal {
+			if path, err := diag.WriteDump(); err != nil {
+				log.Printf("Diagnostic dump failed: %v", err)
+			} else {
+				log.Printf("Diagnostic dump written to %s", path)
+			}
+		}
+	}()
+	
+	// SIGHUP reloads backends, weights and rate limits from the config file
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := reloader.Reload(); err != nil {
+				log.Printf("Config reload failed: %v", err)
+			}
+		}
+	}()
+	
+	// Graceful shutdown
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	
+	var failed error
+	select {
+	case <-quit:
+	case failed = <-serverErr:
+		log.Printf("Server error: %v", failed)
+	}
+	log.Println("Shutting down servers...")
+	proxyHandler.probes.SetReady(false)
+	
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	
+	// Ends Admin API streams, which would otherwise hold up shutdown
+	close(adminAPI.done)
+	
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Shutdown(ctx); err != nil {
+				log.Printf("Listener %s shutdown error: %v", l.config.name(), err)
+			}
+		}()
+	}
+	
+	if passthrough != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := passthrough.Shutdown(ctx); err != nil {
+				log.Printf("TLS passthrough shutdown error: %v", err)
+			}
+		}()
+	}
+	
+	wg.Wait()
+	healthChecker.Stop()
+	discovery.Stop()
+	if proxyHandler.sessions != nil {
+		if err := proxyHandler.sessions.Save(); err != nil {
+			log.Printf("Sticky sessions: not saved: %v", err)
+		}
+	}
+	if failed != nil {
+		log.Fatalf("Servers stopped after error: %v", failed)
+	}
+	log.Println("Servers stopped gracefully")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testConfig is the default config with one pool of backends and no
+// global rate limit, so tests and benchmarks aren't throttled.
+func testConfig(backends ...string) *Config {
+	cfg := DefaultConfig()
+	cfg.RateLimit = 0
+	pc := PoolConfig{}
+	for _, u := range backends {
+		pc.Backends = append(pc.Backends, BackendConfig{URL: u})
+	}
+	cfg.Pools = map[string]PoolConfig{"default": pc}
+	return cfg
+}
+
+// newTestProxy builds the proxy for cfg and serves it; the server is
+// closed when the test ends.
+func newTestProxy(tb testing.TB, cfg *Config) (*ProxyHandler, *httptest.Server) {
+	tb.Helper()
+	events := NewEventBus()
+	pools, err := cfg.BuildPools(events, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	logs, err := NewLogSettings(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	h, err := NewProxyHandler(cfg, pools, logs, events, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	tb.Cleanup(srv.Close)
+	return h, srv
+}
+
+// TestBackendJSONWhileChanging encodes backends, as the Admin API does,
+// while their health and weight change; it is meant for go test -race.
+func TestBackendJSONWhileChanging(t *testing.T) {
+	b, err := newBackend("http://10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 1000 {
+			b.SetAlive(i%2 == 0)
+			b.SetWeight(i % 3)
+			b.SetScore(float64(i))
+		}
+	}()
+	for range 1000 {
+		data, err := json.Marshal([]*Backend{b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []map[string]any
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := got[0]["alive"]; !ok {
+			t.Fatalf("encoded backend %s has no alive field", data)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== METRICS ====================
+// Metrics collects counters for the admin API's /metrics endpoint, written
+// in the Prometheus text format. Gauges (in-flight requests per backend,
+// backend health) are read from the pools at scrape time.
+type Metrics struct {
+	mu           sync.Mutex
+	requests     map[requestKey]uint64
+	durations    map[string]*histogram // by route
+	rateLimited  map[string]uint64     // by scope
+	healthChecks map[healthKey]uint64
+
+	inFlight   atomic.Int64
+	pools      map[string]*ServerPool
+	experiment *Experiment     // nil without an experiment
+	sessions   *SessionManager // nil without stored sticky sessions
+
+	inFlightLimit *InFlightLimit // nil without in_flight_limit
+	conns         *ConnLimiter   // nil without conn_limit
+	dns           *DNSCache      // nil without upstream_dns_cache
+}
+
+type requestKey struct {
+	route, backend, class string
+}
+
+type healthKey struct {
+	pool, backend, result string
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the request duration
+// histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func NewMetrics(pools map[string]*ServerPool, experiment *Experiment) *Metrics {
+	return &Metrics{
+		requests:     make(map[requestKey]uint64),
+		durations:    make(map[string]*histogram),
+		rateLimited:  make(map[string]uint64),
+		healthChecks: make(map[healthKey]uint64),
+		pools:        pools,
+		experiment:   experiment,
+	}
+}
+
+func (m *Metrics) observeRequest(route, backend string, status int, d time.Duration) {
+	key := requestKey{route: route, backend: backend, class: strconv.Itoa(status/100) + "xx"}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[key]++
+	hist := m.durations[route]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.durations[route] = hist
+	}
+	seconds := d.Seconds()
+	if i, _ := slices.BinarySearch(latencyBuckets, seconds); i < len(latencyBuckets) {
+		hist.counts[i]++
+	}
+	hist.sum += seconds
+	hist.count++
+}
+
+func (m *Metrics) rateLimitRejected(scope string) {
+	m.mu.Lock()
+	m.rateLimited[scope]++
+	m.mu.Unlock()
+}
+
+// backendRequests sums a backend's requests by status class over all routes.
+func (m *Metrics) backendRequests(backendURL string) map[string]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]uint64)
+	for k, n := range m.requests {
+		if k.backend == backendURL {
+			counts[k.class] += n
+		}
+	}
+	return counts
+}
+
+// rateLimitedCounts returns a copy of the rejections by scope.
+func (m *Metrics) rateLimitedCounts() map[string]uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.rateLimited)
+}
+
+func (m *Metrics) healthChecked(pool, backend string, up bool) {
+	result := "down"
+	if up {
+		result = "up"
+	}
+	m.mu.Lock()
+	m.healthChecks[healthKey{pool, backend, result}]++
+	m.mu.Unlock()
+}
+
+// requestMetrics travels in the request context so forward can report which
+// backend served the request (the last one tried, with retries).
+type requestMetrics struct {
+	backend string
+}
+
+type requestMetricsKey struct{}
+
+func withRequestMetrics(r *http.Request) (*http.Request, *requestMetrics) {
+	rm := &requestMetrics{}
+	return r.WithContext(context.WithValue(r.Context(), requestMetricsKey{}, rm)), rm
+}
+
+func noteBackend(r *http.Request, backend *Backend) {
+	if rm, ok := r.Context().Value(requestMetricsKey{}).(*requestMetrics); ok {
+		rm.backend = backend.URL.String()
+	}
+}
+
+// statusRecorder remembers the status code and body size written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 && code >= 200 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	http.NewResponseController(sr.ResponseWriter).Flush()
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Status is the code sent, 200 if the handler wrote nothing.
+func (sr *statusRecorder) Status() int {
+	if sr.status == 0 {
+		return http.StatusOK
+	}
+	return sr.status
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	m.mu.Lock()
+	metricHeader(&b, "rproxy_requests_total", "counter", "Requests handled, by route, backend and status class.")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b requestKey) int {
+		return strings.Compare(a.route+"\x00"+a.backend+"\x00"+a.class, b.route+"\x00"+b.backend+"\x00"+b.class)
+	})
+	for _, k := range keys {
+		metricSample(&b, "rproxy_requests_total", m.requests[k], "route", k.route, "backend", k.backend, "class", k.class)
+	}
+
+	metricHeader(&b, "rproxy_request_duration_seconds", "histogram", "Time to handle a request, by route.")
+	for _, route := range sortedKeys(m.durations) {
+		hist := m.durations[route]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += hist.counts[i]
+			metricSample(&b, "rproxy_request_duration_seconds_bucket", cumulative, "route", route, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		metricSample(&b, "rproxy_request_duration_seconds_bucket", hist.count, "route", route, "le", "+Inf")
+		metricSample(&b, "rproxy_request_duration_seconds_sum", hist.sum, "route", route)
+		metricSample(&b, "rproxy_request_duration_seconds_count", hist.count, "route", route)
+	}
+
+	metricHeader(&b, "rproxy_rate_limited_total", "counter", "Requests rejected by a rate limit, by scope.")
+	for _, scope := range sortedKeys(m.rateLimited) {
+		metricSample(&b, "rproxy_rate_limited_total", m.rateLimited[scope], "scope", scope)
+	}
+
+	metricHeader(&b, "rproxy_health_checks_total", "counter", "Health check results, by pool and backend.")
+	checks := make([]healthKey, 0, len(m.healthChecks))
+	for k := range m.healthChecks {
+		checks = append(checks, k)
+	}
+	slices.SortFunc(checks, func(a, b healthKey) int {
+		return strings.Compare(a.pool+"\x00"+a.backend+"\x00"+a.result, b.pool+"\x00"+b.backend+"\x00"+b.result)
+	})
+	for _, k := range checks {
+		metricSample(&b, "rproxy_health_checks_total", m.healthChecks[k], "pool", k.pool, "backend", k.backend, "result", k.result)
+	}
+	m.mu.Unlock()
+
+	metricHeader(&b, "rproxy_requests_in_flight", "gauge", "Requests currently being handled.")
+	metricSample(&b, "rproxy_requests_in_flight", m.inFlight.Load())
+
+	if l := m.inFlightLimit; l != nil {
+		metricHeader(&b, "rproxy_in_flight_limit_requests", "gauge", "Requests holding an in_flight_limit slot.")
+		metricSample(&b, "rproxy_in_flight_limit_requests", l.InFlight())
+		metricHeader(&b, "rproxy_in_flight_limit_capacity", "gauge", "Slots of the in_flight_limit.")
+		metricSample(&b, "rproxy_in_flight_limit_capacity", cap(l.slots))
+		metricHeader(&b, "rproxy_in_flight_limit_queued", "gauge", "Requests waiting for an in_flight_limit slot.")
+		metricSample(&b, "rproxy_in_flight_limit_queued", l.Queued())
+	}
+
+	if c := m.conns; c != nil {
+		metricHeader(&b, "rproxy_connections_open", "gauge", "Client connections open on the proxy listeners.")
+		metricSample(&b, "rproxy_connections_open", c.Open())
+		metricHeader(&b, "rproxy_connection_peers", "gauge", "Distinct peer IPs with a connection open.")
+		metricSample(&b, "rproxy_connection_peers", c.Peers())
+		metricHeader(&b, "rproxy_connections_rejected_total", "counter", "Connections closed because their peer IP was at max_conns_per_ip.")
+		metricSample(&b, "rproxy_connections_rejected_total", c.Rejected())
+	}
+
+	if c := m.dns; c != nil {
+		metricHeader(&b, "rproxy_upstream_dns_cache_names", "gauge", "Backend hostnames in the upstream DNS cache.")
+		metricSample(&b, "rproxy_upstream_dns_cache_names", c.Len())
+		metricHeader(&b, "rproxy_upstream_dns_cache_hits_total", "counter", "Upstream dials resolved from the DNS cache.")
+		metricSample(&b, "rproxy_upstream_dns_cache_hits_total", c.Hits())
+		metricHeader(&b, "rproxy_upstream_dns_cache_misses_total", "counter", "Lookups the upstream DNS cache made.")
+		metricSample(&b, "rproxy_upstream_dns_cache_misses_total", c.Misses())
+	}
+
+	metricHeader(&b, "rproxy_backend_in_flight", "gauge", "Requests currently proxied to each backend.")
+	for _, name := range sortedKeys(m.pools) {
+		for _, be := range m.pools[name].GetBackends() {
+			metricSample(&b, "rproxy_backend_in_flight", atomic.LoadInt64(&be.CurrentConns), "pool", name, "backend", be.URL.String())
+		}
+	}
+
+	metricHeader(&b, "rproxy_backend_up", "gauge", "Whether each backend is considered healthy.")
+	for _, name := range sortedKeys(m.pools) {
+		for _, be := range m.pools[name].GetBackends() {
+			up := 0
+			if be.IsAlive() {
+				up = 1
+			}
+			metricSample(&b, "rproxy_backend_up", up, "pool", name, "backend", be.URL.String())
+		}
+	}
+
+	if m.sessions != nil {
+		stats := m.sessions.Stats(m.pools)
+		metricHeader(&b, "rproxy_sticky_sessions", "gauge", "Live sticky sessions pinned to each backend.")
+		for _, name := range sortedKeys(stats) {
+			for _, url := range sortedKeys(stats[name].ByBackend) {
+				metricSample(&b, "rproxy_sticky_sessions", stats[name].ByBackend[url], "pool", name, "backend", url)
+			}
+		}
+		metricHeader(&b, "rproxy_sticky_session_skew", "gauge", "Largest ratio of a backend's sticky sessions to its fair share by weight; 1 is even.")
+		for _, name := range sortedKeys(stats) {
+			metricSample(&b, "rproxy_sticky_session_skew", stats[name].Skew, "pool", name)
+		}
+	}
+
+	if m.experiment != nil {
+		metricHeader(&b, "rproxy_experiment_sessions_total", "counter", "Clients newly assigned to each experiment variant.")
+		for variant, n := range m.experiment.Assignments() {
+			metricSample(&b, "rproxy_experiment_sessions_total", n, "experiment", m.experiment.name, "variant", variant)
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func metricHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// metricSample writes one line; labels are name/value pairs.
+func metricSample(b *strings.Builder, name string, value any, labels ...string) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(b, " %v\n", value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
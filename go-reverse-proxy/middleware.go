@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ==================== MIDDLEWARE ====================
+// Middleware wraps the proxy's forwarding step. The pipeline is built from
+// Config.Middleware, outermost first, so stages can be reordered or left out
+// without touching ServeHTTP.
+type Middleware func(http.Handler) http.Handler
+
+// middlewareFactory builds a stage for the handler. Returning nil skips the
+// stage, e.g. the cache without a cache config.
+type middlewareFactory func(h *ProxyHandler, cfg *Config) (Middleware, error)
+
+var middlewares = map[string]middlewareFactory{
+	"ip_acl":            aclMiddleware,
+	"loop_detection":    loopDetectionMiddleware,
+	"rate_limit":        rateLimitMiddleware,
+	"client_rate_limit": clientRateLimitMiddleware,
+	"route_rate_limit":  routeRateLimitMiddleware,
+	"jwt":               jwtMiddleware,
+	"basic_auth":        basicAuthMiddleware,
+	"api_key":           apiKeyMiddleware,
+	"forward_auth":      forwardAuthMiddleware,
+	"cors":              corsMiddleware,
+	"cache":             cacheMiddleware,
+	"security_headers":  securityHeadersMiddleware,
+	"scripts":           scriptsMiddleware,
+}
+
+// Security stages must not be silently dropped from a custom pipeline
+// while their config is present.
+var middlewareConfigured = map[string]func(*Config) bool{
+	"ip_acl":            aclConfigured,
+	"client_rate_limit": clientRateLimitConfigured,
+	"route_rate_limit":  routeRateLimitConfigured,
+	"scripts":           scriptsConfigured,
+	"jwt":               jwtConfigured,
+	"basic_auth":        basicAuthConfigured,
+	"api_key":           apiKeyConfigured,
+	"forward_auth":      forwardAuthConfigured,
+}
+
+func defaultMiddleware() []string {
+	return []string{"security_headers", "ip_acl", "loop_detection", "client_rate_limit", "route_rate_limit", "rate_limit", "cors", "forward_auth", "jwt", "basic_auth", "api_key", "scripts", "cache"}
+}
+
+// Chain wraps h so that mws[0] sees the request first.
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+func buildPipeline(h *ProxyHandler, cfg *Config, final http.Handler) (http.Handler, error) {
+	var (
+		stages []Middleware
+		active []string
+		seen   = make(map[string]bool)
+	)
+	for _, name := range cfg.Middleware {
+		factory, ok := middlewares[name]
+		if !ok {
+			return nil, fmt.Errorf("middleware: unknown stage %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("middleware: stage %q listed twice", name)
+		}
+		seen[name] = true
+
+		mw, err := factory(h, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", name, err)
+		}
+		if mw != nil {
+			stages = append(stages, mw)
+			active = append(active, name)
+		}
+	}
+	for name, configured := range middlewareConfigured {
+		if configured(cfg) && !seen[name] {
+			return nil, fmt.Errorf("middleware: %s is configured but missing from the middleware list", name)
+		}
+	}
+	if len(active) > 0 {
+		log.Printf("Middleware: %s", strings.Join(active, " -> "))
+	}
+	return Chain(final, stages...), nil
+}
+
+// loopDetectionMiddleware rejects requests that already passed through this
+// proxy (our pseudonym in Via) or through too many proxies.
+func loopDetectionMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if viaContains(r.Header, h.viaPseudonym) {
+				h.logs.Warnf("[%s] Forwarding loop detected for %s %s (Via: %s)", requestID(r), r.Method, r.URL.Path, r.Header.Get("Via"))
+				h.httpError(w, r, "Loop Detected", http.StatusLoopDetected)
+				return
+			}
+			if h.maxDepth > 0 {
+				if depth := forwardDepth(r.Header); depth >= h.maxDepth {
+					h.logs.Warnf("[%s] Rejecting %s %s: forwarded %d times (max %d)", requestID(r), r.Method, r.URL.Path, depth, h.maxDepth)
+					h.httpError(w, r, "Loop Detected - too many forwarding hops", http.StatusLoopDetected)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// rateLimitMiddleware applies the global limiter; bypass paths are exempt.
+// It stays in the pipeline with rate_limit 0, so a limit set via
+// PUT /ratelimit takes effect.
+func rateLimitMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	h.limits.globalStage = true
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lim := h.limits.globalLimiter()
+			if lim == nil || h.bypass.Match(r.URL.Path) || h.applyRateLimit(w, r, lim, "global", "") {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// ==================== CONFIG MIGRATION ====================
+// Configs written before pools became objects use a flat schema:
+//
+//	{"port": 8000, "strategy": "round-robin",
+//	 "backends": ["http://localhost:9091"],
+//	 "pools": {"canary": ["http://localhost:9093"]}}
+//
+// migrateLegacyConfig rewrites such a file into the pool schema:
+//
+//	{"port": 8000, "strategy": "round-robin",
+//	 "pools": {"default": {"backends": ["http://localhost:9091"]},
+//	           "canary":  {"backends": ["http://localhost:9093"]}}}
+//
+// Per-backend settings later moved from top-level maps keyed by URL into
+// the backend entries (see BackendConfig): backend_weights becomes each
+// entry's weight, backend_rate_limits its rate_limit and bulkhead.backends
+// its max_connections.
+//
+// Only the legacy keys are touched; everything else is passed through as is.
+// It returns the (possibly unchanged) document and a note per conversion.
+func migrateLegacyConfig(data []byte) ([]byte, []string, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	pools := make(map[string]json.RawMessage)
+	if raw, ok := doc["pools"]; ok {
+		if err := json.Unmarshal(raw, &pools); err != nil {
+			return nil, nil, fmt.Errorf("pools: %w", err)
+		}
+	}
+
+	var notes []string
+	for name, raw := range pools {
+		if isJSONArray(raw) {
+			pools[name] = wrapBackends(raw)
+			notes = append(notes, fmt.Sprintf("pools.%s: URL list -> {\"backends\": [...]}", name))
+		}
+	}
+
+	if raw, ok := doc["backends"]; ok {
+		if _, exists := pools["default"]; exists {
+			return nil, nil, fmt.Errorf("both legacy \"backends\" and pools.default are set")
+		}
+		pools["default"] = wrapBackends(raw)
+		delete(doc, "backends")
+		notes = append(notes, "backends -> pools.default.backends")
+	}
+
+	folds := []struct{ key, option string }{
+		{"backend_weights", "weight"},
+		{"backend_rate_limits", "rate_limit"},
+	}
+	for _, f := range folds {
+		raw, ok := doc[f.key]
+		if !ok {
+			continue
+		}
+		if err := foldBackendOption(pools, f.key, f.option, raw); err != nil {
+			return nil, nil, err
+		}
+		delete(doc, f.key)
+		notes = append(notes, fmt.Sprintf("%s -> pools.*.backends[].%s", f.key, f.option))
+	}
+	if raw, ok := doc["bulkhead"]; ok && string(raw) != "null" {
+		var bulkhead map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &bulkhead); err != nil {
+			return nil, nil, fmt.Errorf("bulkhead: %w", err)
+		}
+		if limits, ok := bulkhead["backends"]; ok {
+			if err := foldBackendOption(pools, "bulkhead.backends", "max_connections", limits); err != nil {
+				return nil, nil, err
+			}
+			delete(bulkhead, "backends")
+			encoded, err := json.Marshal(bulkhead)
+			if err != nil {
+				return nil, nil, err
+			}
+			doc["bulkhead"] = encoded
+			notes = append(notes, "bulkhead.backends -> pools.*.backends[].max_connections")
+		}
+	}
+
+	if len(notes) == 0 {
+		return data, nil, nil
+	}
+
+	encoded, err := json.Marshal(pools)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc["pools"] = encoded
+
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(out, '\n'), notes, nil
+}
+
+// foldBackendOption sets option on every backend entry whose URL is a key
+// of the legacy map raw (from key), turning bare URLs into objects.
+func foldBackendOption(pools map[string]json.RawMessage, key, option string, raw json.RawMessage) error {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	found := make(map[string]bool)
+	for name, poolRaw := range pools {
+		var pool map[string]json.RawMessage
+		if err := json.Unmarshal(poolRaw, &pool); err != nil {
+			return fmt.Errorf("pools.%s: %w", name, err)
+		}
+		if pool["backends"] == nil {
+			continue
+		}
+		var backends []json.RawMessage
+		if err := json.Unmarshal(pool["backends"], &backends); err != nil {
+			return fmt.Errorf("pools.%s.backends: %w", name, err)
+		}
+		changed := false
+		for i, entry := range backends {
+			obj := map[string]json.RawMessage{"url": entry}
+			if !bytes.HasPrefix(bytes.TrimSpace(entry), []byte(`"`)) {
+				if err := json.Unmarshal(entry, &obj); err != nil {
+					return fmt.Errorf("pools.%s.backends[%d]: %w", name, i, err)
+				}
+			}
+			var url string
+			json.Unmarshal(obj["url"], &url)
+			value, ok := values[url]
+			if !ok {
+				continue
+			}
+			found[url], changed = true, true
+			obj[option] = value
+			var err error
+			if backends[i], err = json.Marshal(obj); err != nil {
+				return err
+			}
+		}
+		if !changed {
+			continue
+		}
+		encoded, err := json.Marshal(backends)
+		if err != nil {
+			return err
+		}
+		pool["backends"] = encoded
+		if pools[name], err = json.Marshal(pool); err != nil {
+			return err
+		}
+	}
+	for url := range values {
+		if !found[url] {
+			return fmt.Errorf("%s: %q is not a backend of any pool", key, url)
+		}
+	}
+	return nil
+}
+
+func isJSONArray(raw json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(raw)
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+func wrapBackends(urls json.RawMessage) json.RawMessage {
+	return json.RawMessage(`{"backends":` + string(urls) + `}`)
+}
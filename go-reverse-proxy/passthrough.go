@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== TLS PASSTHROUGH ====================
+// PassthroughConfig runs a second listener that never terminates TLS: it
+// reads the SNI hostname from the ClientHello, picks a backend from the
+// pool routed to that name and splices the encrypted stream through, so
+// backends keep doing their own TLS termination.
+type PassthroughConfig struct {
+	Port int `json:"port"`
+
+	// Routes maps SNI hostnames to pools; "*.example.com" matches one label.
+	Routes map[string]string `json:"routes"`
+
+	// DefaultPool takes connections with no or an unknown SNI name;
+	// empty closes them.
+	DefaultPool string `json:"default_pool,omitempty"`
+}
+
+// helloTimeout bounds how long a client may take to send its ClientHello.
+const helloTimeout = 10 * time.Second
+
+var errHelloRead = errors.New("client hello read")
+
+type PassthroughProxy struct {
+	routes   map[string]*ServerPool
+	fallback *ServerPool
+	logs     *LogSettings
+
+	ln     net.Listener
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func NewPassthroughProxy(cfg *PassthroughConfig, pools map[string]*ServerPool, logs *LogSettings) (*PassthroughProxy, error) {
+	if cfg.Port == 0 {
+		return nil, fmt.Errorf("tls_passthrough: port is required")
+	}
+
+	p := &PassthroughProxy{
+		routes: make(map[string]*ServerPool),
+		logs:   logs,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	for name, poolName := range cfg.Routes {
+		pool, ok := pools[poolName]
+		if !ok {
+			return nil, fmt.Errorf("tls_passthrough: route %s references unknown pool %q", name, poolName)
+		}
+		p.routes[strings.ToLower(strings.TrimSuffix(name, "."))] = pool
+	}
+	if cfg.DefaultPool != "" {
+		pool, ok := pools[cfg.DefaultPool]
+		if !ok {
+			return nil, fmt.Errorf("tls_passthrough: unknown default_pool %q", cfg.DefaultPool)
+		}
+		p.fallback = pool
+	}
+	return p, nil
+}
+
+// Serve accepts connections until Shutdown closes the listener.
+func (p *PassthroughProxy) Serve(ln net.Listener) error {
+	p.mu.Lock()
+	p.ln = ln
+	p.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !p.track(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer p.untrack(conn)
+			p.handle(conn)
+		}()
+	}
+}
+
+func (p *PassthroughProxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	p.wg.Add(1)
+	return true
+}
+
+func (p *PassthroughProxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	delete(p.conns, conn)
+	p.mu.Unlock()
+	conn.Close()
+	p.wg.Done()
+}
+
+// Shutdown stops accepting and waits for spliced connections to finish;
+// whatever is still open when ctx expires is closed.
+func (p *PassthroughProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	if p.ln != nil {
+		p.ln.Close()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (p *PassthroughProxy) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	sni, hello, err := readClientHello(conn)
+	if err != nil {
+		log.Printf("TLS passthrough: %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	pool := p.poolFor(sni)
+	if pool == nil {
+		log.Printf("TLS passthrough: no route for SNI %q from %s", sni, conn.RemoteAddr())
+		return
+	}
+	// consistent-hash has only the client's address to go on here
+	client, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	backend := pool.NextPeer(client, 0)
+	if backend == nil {
+		log.Printf("TLS passthrough: no healthy backend in pool %s for %q", pool.name, sni)
+		return
+	}
+
+	upstream, err := dialPassthrough(backend)
+	if err != nil {
+		log.Printf("TLS passthrough: dial %s: %v", backend.URL, err)
+		pool.SetBackendStatus(backend.URL.String(), false, ReasonPassive, err.Error())
+		return
+	}
+	defer upstream.Close()
+
+	atomic.AddInt64(&backend.CurrentConns, 1)
+	defer atomic.AddInt64(&backend.CurrentConns, -1)
+	p.logs.Debugf(p.logs.SampleDebug(), "TLS passthrough: %s (SNI %q) -> %s", conn.RemoteAddr(), sni, backend.URL)
+
+	if _, err := upstream.Write(hello); err != nil {
+		return
+	}
+	splice(conn, upstream)
+}
+
+func (p *PassthroughProxy) poolFor(sni string) *ServerPool {
+	name := strings.ToLower(strings.TrimSuffix(sni, "."))
+	if pool, ok := p.routes[name]; ok {
+		return pool
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if pool, ok := p.routes["*"+name[i:]]; ok {
+			return pool
+		}
+	}
+	return p.fallback
+}
+
+// dialPassthrough connects to the backend's host, defaulting to port 443.
+func dialPassthrough(b *Backend) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	if isUnixURL(b.URL) {
+		return d.Dial("unix", b.URL.Path)
+	}
+	addr := b.URL.Host
+	if b.URL.Port() == "" {
+		addr = net.JoinHostPort(b.URL.Hostname(), "443")
+	}
+	return d.Dial("tcp", addr)
+}
+
+// readClientHello parses the ClientHello without answering it and returns
+// the SNI name along with the raw bytes read, to be replayed upstream.
+func readClientHello(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var sni string
+	parsed := false
+
+	err := tls.Server(helloConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni, parsed = hello.ServerName, true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !parsed {
+		return "", nil, fmt.Errorf("reading client hello: %w", err)
+	}
+	return sni, buf.Bytes(), nil
+}
+
+// helloConn feeds the TLS stack the client's bytes and discards its replies.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                       { return nil }
+func (c helloConn) LocalAddr() net.Addr                { return nil }
+func (c helloConn) RemoteAddr() net.Addr               { return nil }
+func (c helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// splice copies both directions, half-closing each side as the other
+// finishes so TLS close_notify and pipelined data are not cut short.
+func splice(client, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(upstream, client)
+	go copyHalf(client, upstream)
+	wg.Wait()
+}
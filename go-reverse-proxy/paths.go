@@ -0,0 +1,40 @@
+package main
+
+import "strings"
+
+// ==================== PATH LISTS ====================
+
+// PathMatcher matches request paths against a configured list. An entry
+// ending in "*" matches as a prefix, anything else must match exactly.
+//
+// Used for bypass_paths: monitoring and probe paths (/health, /favicon.ico,
+// ...) that skip rate limiting and never create experiment cookies, so probe
+// traffic doesn't pollute client buckets or statistics.
+type PathMatcher struct {
+	exact    map[string]bool
+	prefixes []string
+}
+
+func NewPathMatcher(paths []string) *PathMatcher {
+	m := &PathMatcher{exact: make(map[string]bool)}
+	for _, p := range paths {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			m.prefixes = append(m.prefixes, prefix)
+		} else {
+			m.exact[p] = true
+		}
+	}
+	return m
+}
+
+func (m *PathMatcher) Match(path string) bool {
+	if m.exact[path] {
+		return true
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// ==================== LIVENESS AND READINESS ====================
+// ProbesConfig names the paths on the proxy port that answer liveness and
+// readiness checks, e.g. from Kubernetes or a load balancer. They are
+// served ahead of routing and the middleware pipeline, so a route, ACL or
+// auth stage can't get in the way. An empty path turns that probe off.
+type ProbesConfig struct {
+	Liveness  string `json:"liveness"`  // default /healthz
+	Readiness string `json:"readiness"` // default /readyz
+}
+
+func defaultProbesConfig() ProbesConfig {
+	return ProbesConfig{Liveness: "/healthz", Readiness: "/readyz"}
+}
+
+// Probes answers the probe paths. The proxy is live while it serves
+// requests at all, and ready from the end of startup until shutdown begins
+// as long as some backend can take traffic.
+type Probes struct {
+	cfg   ProbesConfig
+	pools map[string]*ServerPool
+	ready atomic.Bool
+}
+
+func NewProbes(cfg ProbesConfig, pools map[string]*ServerPool) (*Probes, error) {
+	for _, path := range []string{cfg.Liveness, cfg.Readiness} {
+		if path != "" && path[0] != '/' {
+			return nil, fmt.Errorf("probes: path %q must start with /", path)
+		}
+	}
+	if cfg.Liveness != "" && cfg.Liveness == cfg.Readiness {
+		return nil, fmt.Errorf("probes: liveness and readiness need different paths")
+	}
+	return &Probes{cfg: cfg, pools: pools}, nil
+}
+
+// SetReady is called once the proxy is listening, and with false when it
+// starts shutting down so load balancers stop sending new traffic.
+func (p *Probes) SetReady(ready bool) {
+	p.ready.Store(ready)
+}
+
+// aliveBackends counts the distinct backends that can take requests.
+func (p *Probes) aliveBackends() int {
+	seen := make(map[*Backend]bool)
+	for _, pool := range p.pools {
+		for _, b := range pool.GetBackends() {
+			if b.selectable() {
+				seen[b] = true
+			}
+		}
+	}
+	return len(seen)
+}
+
+// Handle answers r if it is for a probe path and reports whether it did.
+func (p *Probes) Handle(w http.ResponseWriter, r *http.Request) bool {
+	path := r.URL.Path
+	if path == "" || (path != p.cfg.Liveness && path != p.cfg.Readiness) {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	if path == p.cfg.Liveness {
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok"})
+		return true
+	}
+
+	alive := p.aliveBackends()
+	reason := ""
+	switch {
+	case !p.ready.Load():
+		reason = "not serving (starting or shutting down)"
+	case alive == 0:
+		reason = "no alive backends"
+	}
+	if reason != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "not ready", "reason": reason, "alive_backends": alive})
+		return true
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ready", "alive_backends": alive})
+	return true
+}
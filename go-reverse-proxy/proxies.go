@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// ==================== PER-BACKEND PROXIES ====================
+// Each backend keeps one httputil.ReverseProxy per transport it is reached
+// through (its pools' and, with gRPC on, the gRPC one) and flush interval,
+// built on first use and dropped when its options change. Everything that differs per request
+// travels in a proxyTry in the request context, so serving a request
+// allocates no proxy and no closures.
+
+// proxyRequest is what forward works out once per client request.
+type proxyRequest struct {
+	h                *ProxyHandler
+	r                *http.Request // the client's request
+	pool             *ServerPool
+	variant          string
+	realIP           string
+	debug            bool
+	grpc             bool
+	rewriteRedirects bool
+	cookies          *CookieRewriter
+	routeHeaders     *HeaderRules
+	flushInterval    time.Duration // the route's or the pool's
+}
+
+// proxyTry is one try of a proxyRequest at one backend.
+type proxyTry struct {
+	*proxyRequest
+	backend   *Backend
+	headersIn func()
+	final     bool
+	sent      time.Time
+	failure   error // retryable failure left for forward, see handleError
+}
+
+type proxyTryKey struct{}
+
+func tryOf(req *http.Request) *proxyTry {
+	return req.Context().Value(proxyTryKey{}).(*proxyTry)
+}
+
+// proxyKey tells a backend's cached proxies apart: the transport requests
+// go through (the gRPC one or their pool's) and how often they flush.
+type proxyKey struct {
+	base          *http.Transport
+	flushInterval time.Duration
+}
+
+// reverseProxy returns b's cached proxy for key.
+func (b *Backend) reverseProxy(key proxyKey, grpc bool) *httputil.ReverseProxy {
+	b.mu.RLock()
+	p := b.proxies[key]
+	b.mu.RUnlock()
+	if p != nil {
+		return p
+	}
+
+	// upstreamTransport takes b.mu itself
+	transport := key.base
+	if !grpc {
+		transport = b.upstreamTransport(key.base)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.proxies[key] == nil {
+		if b.proxies == nil {
+			b.proxies = make(map[proxyKey]*httputil.ReverseProxy)
+		}
+		b.proxies[key] = &httputil.ReverseProxy{
+			Director:       directTry,
+			Transport:      transport,
+			FlushInterval:  key.flushInterval,
+			ModifyResponse: modifyTryResponse,
+			ErrorHandler:   handleTryError,
+		}
+	}
+	return b.proxies[key]
+}
+
+func directTry(req *http.Request) {
+	tryOf(req).direct(req)
+}
+
+func modifyTryResponse(resp *http.Response) error {
+	return tryOf(resp.Request).modifyResponse(resp)
+}
+
+func handleTryError(w http.ResponseWriter, req *http.Request, err error) {
+	tryOf(req).handleError(w, req, err)
+}
+
+// serve proxies the try. Unless final, a retryable failure is returned
+// without writing anything to the client.
+func (t *proxyTry) serve(w http.ResponseWriter, req *http.Request) error {
+	t.sent = time.Now()
+	req = req.WithContext(context.WithValue(req.Context(), proxyTryKey{}, t))
+	key := proxyKey{t.pool.upstreamTransport(t.h.transport), t.flushInterval}
+	if t.grpc {
+		key = proxyKey{t.h.grpcTransport, -1}
+	}
+	t.backend.reverseProxy(key, t.grpc).ServeHTTP(w, req)
+	return t.failure
+}
+
+func (t *proxyTry) direct(req *http.Request) {
+	h, r, backend := t.h, t.r, t.backend
+	target := wireURL(backend.URL)
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.Host = wireHost(backend.URL)
+
+	// Add proxy headers; ReverseProxy appends the peer to X-Forwarded-For
+	req.Header.Set("X-Real-IP", t.realIP)
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", requestScheme(r))
+	}
+	if h.identityHeader != "" {
+		req.Header.Set(h.identityHeader, h.identityValue)
+	}
+	if t.variant != "" {
+		req.Header.Set("X-Experiment-Variant", t.variant)
+	}
+	addVia(req.Header, r.ProtoMajor, r.ProtoMinor, h.viaPseudonym)
+	setClientCertHeaders(req, r.TLS)
+	applyRequestRules(req.Header, h.headers, t.pool.headers, t.routeHeaders)
+	h.logs.Debugf(t.debug, "[%s] Forwarding: %s %s -> %s", requestID(r), req.Method, req.URL.Path, backend.URL)
+}
+
+func (t *proxyTry) modifyResponse(resp *http.Response) error {
+	h, r, backend := t.h, t.r, t.backend
+	t.headersIn()
+	backend.Stats.ObserveResponse(time.Since(t.sent), resp.StatusCode)
+	t.pool.observeLatency(backend, time.Since(t.sent))
+	h.logs.Debugf(t.debug, "[%s] Response from %s: %d for %s %s", requestID(r), backend.URL, resp.StatusCode, r.Method, r.URL.Path)
+	if !t.final && h.retry.retryStatus(r, resp.StatusCode) {
+		return fmt.Errorf("%w %d", errRetryStatus, resp.StatusCode)
+	}
+	if t.debug && h.bodyLog != nil {
+		label := fmt.Sprintf("Response body %d for %s %s", resp.StatusCode, r.Method, r.URL.Path)
+		resp.Body = h.bodyLog.Capture(resp.Body, label, r.URL.Path, resp.Header.Get("Content-Type"))
+	}
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, h.viaPseudonym)
+	resp.Header.Del(requestIDHeader) // ours is already set; don't duplicate a backend echo
+	if t.rewriteRedirects {
+		rewriteLocation(resp, backend.URL, r)
+	}
+	if t.cookies != nil {
+		t.cookies.Rewrite(resp.Header)
+	}
+	applyResponseRules(resp.Header, h.headers, t.pool.headers, t.routeHeaders)
+	h.applyResponseScripts(resp, r)
+	return nil
+}
+
+func (t *proxyTry) handleError(w http.ResponseWriter, req *http.Request, err error) {
+	h, r, backend := t.h, t.r, t.backend
+	if context.Cause(req.Context()) == errPerTryTimeout {
+		err = errPerTryTimeout
+	}
+	h.logs.Errorf("[%s] Proxy error for backend %s: %v", requestID(r), backend.URL, err)
+	if !errors.Is(err, errRetryStatus) {
+		backend.Stats.ObserveError() // a retried status was counted as a response
+		if err != errPerTryTimeout {
+			t.pool.SetBackendStatus(backend.URL.String(), false, ReasonPassive, err.Error())
+		}
+	}
+	if !t.final && h.retry.retryable(r, err) {
+		t.failure = err
+		return
+	}
+	if t.grpc {
+		writeGRPCError(w, grpcUnavailable, "bad gateway")
+		return
+	}
+	if err == errPerTryTimeout {
+		h.httpError(w, r, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	}
+	h.httpError(w, r, "Bad Gateway", http.StatusBadGateway)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// BenchmarkServeHTTP measures a request through the whole handler to a
+// local backend. Each backend's ReverseProxy is built once, so the
+// allocations reported are those of the request itself; "uncached" drops
+// the proxy before every request to show what building one costs.
+func BenchmarkServeHTTP(b *testing.B) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	h, _ := newTestProxy(b, testConfig(backend.URL))
+
+	serve := func(b *testing.B) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/bench", nil))
+		if w.Code != http.StatusOK {
+			b.Errorf("status %d", w.Code)
+		}
+	}
+	serve(b) // build the proxy outside the timing
+
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			serve(b)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		target := h.pool.GetBackends()[0]
+		b.ReportAllocs()
+		for b.Loop() {
+			target.mu.Lock()
+			clear(target.proxies)
+			target.mu.Unlock()
+			serve(b)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				serve(b)
+			}
+		})
+	})
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ==================== PER-CLIENT RATE LIMITING ====================
+// ClientRateLimitConfig gives every client IP its own token bucket, so one
+// noisy client is turned away without using up rate_limit for everyone
+// else. Buckets are kept for the most recently seen clients only.
+type ClientRateLimitConfig struct {
+	RPS         float64  `json:"rps"`
+	Burst       int      `json:"burst,omitempty"`        // default 2*rps, at least 1
+	MaxClients  int      `json:"max_clients,omitempty"`  // default 10000
+	IdleTimeout Duration `json:"idle_timeout,omitempty"` // forget quiet clients, default 10m
+
+	// IPv6Prefix is how many leading bits of an IPv6 address make one
+	// client, default 64. A host usually gets a whole /64 and can pick a
+	// fresh address in it for every request; 128 limits each address.
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+}
+
+const defaultIPv6Prefix = 64
+
+type clientBucket struct {
+	addr     netip.Addr
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// ClientLimiter is an LRU of per-IP limiters; idle entries expire lazily.
+type ClientLimiter struct {
+	limit      rate.Limit
+	burst      int
+	maxClients int
+	idle       time.Duration
+	ipv6Prefix int
+
+	mu      sync.Mutex
+	lru     *list.List // front = most recently seen
+	clients map[netip.Addr]*list.Element
+}
+
+func NewClientLimiter(cfg *ClientRateLimitConfig) (*ClientLimiter, error) {
+	if cfg.RPS <= 0 {
+		return nil, fmt.Errorf("client_rate_limit: rps must be positive")
+	}
+	if cfg.Burst < 0 {
+		return nil, fmt.Errorf("client_rate_limit: burst must not be negative")
+	}
+	if cfg.IPv6Prefix < 0 || cfg.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("client_rate_limit: ipv6_prefix must be between 0 and 128")
+	}
+	l := &ClientLimiter{
+		limit:      rate.Limit(cfg.RPS),
+		burst:      cfg.Burst,
+		maxClients: cfg.MaxClients,
+		idle:       cfg.IdleTimeout.Std(),
+		ipv6Prefix: cfg.IPv6Prefix,
+		lru:        list.New(),
+		clients:    make(map[netip.Addr]*list.Element),
+	}
+	if l.burst <= 0 {
+		l.burst = max(int(math.Ceil(cfg.RPS*2)), 1)
+	}
+	if l.maxClients <= 0 {
+		l.maxClients = 10000
+	}
+	if l.idle <= 0 {
+		l.idle = 10 * time.Minute
+	}
+	if l.ipv6Prefix == 0 {
+		l.ipv6Prefix = defaultIPv6Prefix
+	}
+	return l, nil
+}
+
+// client is the key addr is limited under: IPv4 addresses as they are,
+// IPv6 ones by their ipv6Prefix network.
+func (l *ClientLimiter) client(addr netip.Addr) netip.Addr {
+	addr = addr.Unmap()
+	if !addr.Is6() {
+		return addr
+	}
+	return netip.PrefixFrom(addr.WithZone(""), l.ipv6Prefix).Masked().Addr()
+}
+
+func (l *ClientLimiter) bucket(addr netip.Addr, now time.Time) *rate.Limiter {
+	addr = l.client(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Expire from the cold end; everything behind an active entry is newer
+	for el := l.lru.Back(); el != nil; el = l.lru.Back() {
+		b := el.Value.(*clientBucket)
+		if now.Sub(b.lastSeen) < l.idle {
+			break
+		}
+		l.lru.Remove(el)
+		delete(l.clients, b.addr)
+	}
+
+	if el, ok := l.clients[addr]; ok {
+		b := el.Value.(*clientBucket)
+		b.lastSeen = now
+		l.lru.MoveToFront(el)
+		return b.limiter
+	}
+	b := &clientBucket{addr: addr, limiter: rate.NewLimiter(l.limit, l.burst), lastSeen: now}
+	l.clients[addr] = l.lru.PushFront(b)
+	if l.lru.Len() > l.maxClients {
+		oldest := l.lru.Remove(l.lru.Back()).(*clientBucket)
+		delete(l.clients, oldest.addr)
+	}
+	return b.limiter
+}
+
+// setLimit changes the rate for all clients, including those already
+// being tracked.
+func (l *ClientLimiter) setLimit(limit rate.Limit, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit, l.burst = limit, burst
+	for el := l.lru.Front(); el != nil; el = el.Next() {
+		b := el.Value.(*clientBucket)
+		b.limiter.SetLimit(limit)
+		b.limiter.SetBurst(burst)
+	}
+}
+
+func (l *ClientLimiter) config() RateLimitConfig {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return RateLimitConfig{RPS: float64(l.limit), Burst: l.burst}
+}
+
+// retryAfter renders a delay as whole seconds, rounded up.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(max(int(math.Ceil(d.Seconds())), 1))
+}
+
+// applyRateLimit takes a token from lim for r and reports the bucket in
+// the X-RateLimit-* headers. When lim is empty it answers 429 with
+// Retry-After and returns false.
+func (h *ProxyHandler) applyRateLimit(w http.ResponseWriter, r *http.Request, lim *rate.Limiter, scope, key string) bool {
+	ok, wait := reserve(lim)
+	setRateLimitHeaders(w.Header(), lim)
+	if ok {
+		return true
+	}
+	h.metrics.rateLimitRejected(scope)
+	h.events.Publish(Event{Type: EventRateLimited, RequestID: requestID(r), Detail: strings.TrimSpace(scope + " " + key)})
+	h.logs.Debugf(h.logs.SampleDebug(), "[%s] Rate limit (%s) exceeded for %s %s", requestID(r), strings.TrimSpace(scope+" "+key), r.Method, r.URL.Path)
+	w.Header().Set("Retry-After", retryAfter(wait))
+	if h.isGRPC(r) {
+		writeGRPCError(w, grpcResourceExhausted, "rate limit exceeded")
+		return false
+	}
+	h.httpError(w, r, "Too Many Requests", http.StatusTooManyRequests)
+	return false
+}
+
+// rateLimitHeaders are per request and must not be cached with a response.
+var rateLimitHeaders = []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"}
+
+// setRateLimitHeaders describes a token bucket to the client: Limit is the
+// burst, Remaining the whole tokens left and Reset the seconds until the
+// bucket is full again. With several limits in play, the one with the
+// fewest remaining requests is reported.
+func setRateLimitHeaders(h http.Header, lim *rate.Limiter) {
+	tokens := lim.Tokens()
+	remaining := max(int(math.Floor(tokens)), 0)
+	if prev, err := strconv.Atoi(h.Get("X-RateLimit-Remaining")); err == nil && prev <= remaining {
+		return
+	}
+	reset := 0
+	if missing := float64(lim.Burst()) - tokens; missing > 0 && lim.Limit() > 0 {
+		reset = int(math.Ceil(missing / float64(lim.Limit())))
+	}
+	h.Set("X-RateLimit-Limit", strconv.Itoa(lim.Burst()))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(reset))
+}
+
+func clientRateLimitConfigured(cfg *Config) bool {
+	return cfg.ClientRateLimit != nil
+}
+
+// clientRateLimitMiddleware limits each client IP; bypass paths are exempt.
+// It stays in the pipeline without client_rate_limit, so a limit set via
+// PUT /ratelimit takes effect.
+func clientRateLimitMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	h.limits.clientStage = true
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limiter := h.limits.clientLimiter()
+			if limiter == nil || h.bypass.Match(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			addr := h.trusted.RealIP(r)
+			if h.applyRateLimit(w, r, limiter.bucket(addr, time.Now()), "client", addr.String()) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}, nil
+}
+
+// ==================== ROUTE AND BACKEND RATE LIMITS ====================
+// RateLimitConfig is a token bucket shared by all clients: per route, e.g.
+// to slow down /login, or per backend, as a hard cap protecting a fragile
+// server. An RPS of 0 means unlimited.
+type RateLimitConfig struct {
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst,omitempty"` // default 2*rps, at least 1
+}
+
+func newRateLimiter(cfg RateLimitConfig) (*rate.Limiter, error) {
+	if cfg.RPS < 0 || cfg.Burst < 0 {
+		return nil, fmt.Errorf("rps and burst must not be negative")
+	}
+	if cfg.RPS == 0 {
+		return nil, nil
+	}
+	burst := cfg.Burst
+	if burst == 0 {
+		burst = max(int(math.Ceil(cfg.RPS*2)), 1)
+	}
+	return rate.NewLimiter(rate.Limit(cfg.RPS), burst), nil
+}
+
+func limiterConfig(lim *rate.Limiter) RateLimitConfig {
+	return RateLimitConfig{RPS: float64(lim.Limit()), Burst: lim.Burst()}
+}
+
+// reserve takes a token if one is available now; otherwise it reports how
+// long until one is.
+func reserve(lim *rate.Limiter) (bool, time.Duration) {
+	now := time.Now()
+	res := lim.ReserveN(now, 1)
+	if !res.OK() {
+		return false, time.Second
+	}
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// RateLimits holds the global limiter, the per-client limiter and the
+// per-route (by prefix) and per-backend (by URL) limiters. All of them can
+// be changed at runtime via PUT /ratelimit.
+type RateLimits struct {
+	mu       sync.RWMutex
+	global   *rate.Limiter
+	client   *ClientLimiter
+	routes   map[string]*rate.Limiter
+	backends map[string]*rate.Limiter
+
+	// Whether the rate_limit and client_rate_limit stages are in the
+	// pipeline; without them a global or client limit would do nothing.
+	globalStage, clientStage bool
+}
+
+func NewRateLimits(cfg *Config) (*RateLimits, error) {
+	l := &RateLimits{
+		routes:   make(map[string]*rate.Limiter),
+		backends: make(map[string]*rate.Limiter),
+	}
+	if rps := cfg.RateLimit; rps > 0 {
+		l.global = rate.NewLimiter(rate.Limit(rps), rps*2)
+	}
+	if cfg.ClientRateLimit != nil {
+		client, err := NewClientLimiter(cfg.ClientRateLimit)
+		if err != nil {
+			return nil, err
+		}
+		l.client = client
+	}
+	for _, rc := range cfg.Routes {
+		if rc.RateLimit == nil {
+			continue
+		}
+		if err := l.SetRoute(rc.Prefix, *rc.RateLimit); err != nil {
+			return nil, fmt.Errorf("route %s rate_limit: %w", rc.Prefix, err)
+		}
+	}
+	backends, err := cfg.BackendConfigs()
+	if err != nil {
+		return nil, err
+	}
+	for backend, bc := range backends {
+		if bc.RateLimit == nil {
+			continue
+		}
+		if err := l.SetBackend(backend, *bc.RateLimit); err != nil {
+			return nil, fmt.Errorf("backend %s rate_limit: %w", backend, err)
+		}
+	}
+	return l, nil
+}
+
+// SetGlobal replaces the limit shared by all requests; an RPS of 0 turns
+// it off.
+func (l *RateLimits) SetGlobal(cfg RateLimitConfig) error {
+	lim, err := newRateLimiter(cfg)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global = lim
+	return nil
+}
+
+// SetClient changes the limit each client IP gets; an RPS of 0 turns it
+// off. Clients already being tracked keep their buckets at the new rate.
+func (l *RateLimits) SetClient(cfg RateLimitConfig) error {
+	if cfg.RPS < 0 || cfg.Burst < 0 {
+		return fmt.Errorf("rps and burst must not be negative")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case cfg.RPS == 0:
+		l.client = nil
+	case l.client == nil:
+		client, err := NewClientLimiter(&ClientRateLimitConfig{RPS: cfg.RPS, Burst: cfg.Burst})
+		if err != nil {
+			return err
+		}
+		l.client = client
+	default:
+		burst := cfg.Burst
+		if burst == 0 {
+			burst = max(int(math.Ceil(cfg.RPS*2)), 1)
+		}
+		l.client.setLimit(rate.Limit(cfg.RPS), burst)
+	}
+	return nil
+}
+
+// hasStage reports whether the pipeline applies the "global" or "client"
+// limit.
+func (l *RateLimits) hasStage(scope string) bool {
+	if scope == "client" {
+		return l.clientStage
+	}
+	return l.globalStage
+}
+
+func (l *RateLimits) globalLimiter() *rate.Limiter {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.global
+}
+
+func (l *RateLimits) clientLimiter() *ClientLimiter {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.client
+}
+
+func (l *RateLimits) SetRoute(prefix string, cfg RateLimitConfig) error {
+	return l.set(l.routes, prefix, cfg)
+}
+
+func (l *RateLimits) SetBackend(backendURL string, cfg RateLimitConfig) error {
+	return l.set(l.backends, backendURL, cfg)
+}
+
+func (l *RateLimits) set(m map[string]*rate.Limiter, key string, cfg RateLimitConfig) error {
+	lim, err := newRateLimiter(cfg)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lim == nil {
+		delete(m, key)
+	} else {
+		m[key] = lim
+	}
+	return nil
+}
+
+// replace takes over next's limiters, as on a config reload.
+func (l *RateLimits) replace(next *RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.routes, l.backends = next.routes, next.backends
+}
+
+// backendLimit returns the backend's rate cap, nil without one.
+func (l *RateLimits) backendLimit(backendURL string) *RateLimitConfig {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if lim := l.backends[backendURL]; lim != nil {
+		cfg := limiterConfig(lim)
+		return &cfg
+	}
+	return nil
+}
+
+func (l *RateLimits) route(prefix string) *rate.Limiter {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.routes[prefix]
+}
+
+func (l *RateLimits) allowBackend(backendURL string) (bool, time.Duration) {
+	l.mu.RLock()
+	lim := l.backends[backendURL]
+	l.mu.RUnlock()
+	if lim == nil {
+		return true, 0
+	}
+	return reserve(lim)
+}
+
+func (l *RateLimits) Snapshot() map[string]interface{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	routes := make(map[string]RateLimitConfig, len(l.routes))
+	for prefix, lim := range l.routes {
+		routes[prefix] = limiterConfig(lim)
+	}
+	backends := make(map[string]RateLimitConfig, len(l.backends))
+	for backend, lim := range l.backends {
+		backends[backend] = limiterConfig(lim)
+	}
+	var global, client *RateLimitConfig
+	if l.global != nil {
+		cfg := limiterConfig(l.global)
+		global = &cfg
+	}
+	if l.client != nil {
+		cfg := l.client.config()
+		client = &cfg
+	}
+	return map[string]interface{}{
+		"global":   global,
+		"client":   client,
+		"routes":   routes,
+		"backends": backends,
+	}
+}
+
+// routeRateLimitMiddleware applies the matching route's limit. It is active
+// whenever routes exist, so limits added at runtime take effect.
+func routeRateLimitMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	if len(cfg.Routes) == 0 {
+		return nil, nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := h.route(r)
+			if route == nil || h.bypass.Match(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			lim := h.limits.route(route.prefix)
+			if lim == nil || h.applyRateLimit(w, r, lim, "route", route.prefix) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}, nil
+}
+
+func routeRateLimitConfigured(cfg *Config) bool {
+	for _, rc := range cfg.Routes {
+		if rc.RateLimit != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func logRateLimitUpdate(scope string, cfg RateLimitConfig) {
+	if cfg.RPS == 0 {
+		log.Printf("Rate limit for %s removed via Admin API", scope)
+		return
+	}
+	log.Printf("Rate limit for %s set via Admin API: rps=%v burst=%d", scope, cfg.RPS, cfg.Burst)
+}
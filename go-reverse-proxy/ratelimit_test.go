@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientLimiterKeysIPv6ByPrefix(t *testing.T) {
+	tests := []struct {
+		prefix int
+		a, b   string
+		shared bool
+	}{
+		{0, "2001:db8:1:2::1", "2001:db8:1:2:ffff::9", true},
+		{0, "2001:db8:1:2::1", "2001:db8:1:3::1", false},
+		{48, "2001:db8:1:2::1", "2001:db8:1:3::1", true},
+		{128, "2001:db8:1:2::1", "2001:db8:1:2::2", false},
+		{0, "192.0.2.1", "192.0.2.2", false},
+		{0, "::ffff:192.0.2.1", "192.0.2.1", true},
+		{0, "fe80::1%eth0", "fe80::2%eth1", true},
+	}
+	for _, tt := range tests {
+		l, err := NewClientLimiter(&ClientRateLimitConfig{RPS: 1, Burst: 1, IPv6Prefix: tt.prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		l.bucket(netip.MustParseAddr(tt.a), now).AllowN(now, 1)
+		// With burst 1 the second client only finds the bucket empty when
+		// it is the first one's
+		shared := !l.bucket(netip.MustParseAddr(tt.b), now).AllowN(now, 1)
+		if shared != tt.shared {
+			t.Errorf("ipv6_prefix %d: %s and %s share a bucket = %v, want %v", tt.prefix, tt.a, tt.b, shared, tt.shared)
+		}
+	}
+}
+
+func TestClientLimiterRejectsBadIPv6Prefix(t *testing.T) {
+	for _, prefix := range []int{-1, 129} {
+		if _, err := NewClientLimiter(&ClientRateLimitConfig{RPS: 1, IPv6Prefix: prefix}); err == nil {
+			t.Errorf("ipv6_prefix %d accepted", prefix)
+		}
+	}
+}
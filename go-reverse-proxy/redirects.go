@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ==================== REDIRECT REWRITING ====================
+
+// publicOrigin is the scheme and host the client used to reach the proxy,
+// preferring what an outer load balancer reported in X-Forwarded-*.
+func publicOrigin(r *http.Request) (scheme, host string) {
+	scheme = "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+
+	host = r.Host
+	if fwdHost := r.Header.Get("X-Forwarded-Host"); fwdHost != "" {
+		host = strings.TrimSpace(strings.Split(fwdHost, ",")[0])
+	}
+	return scheme, host
+}
+
+// rewriteLocation points an absolute Location that names the backend itself
+// back at the public origin. Relative and third-party locations are kept.
+func rewriteLocation(resp *http.Response, backend *url.URL, r *http.Request) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return
+	}
+
+	u, err := url.Parse(location)
+	if err != nil || !u.IsAbs() || !strings.EqualFold(u.Host, wireHost(backend)) {
+		return
+	}
+
+	u.Scheme, u.Host = publicOrigin(r)
+	resp.Header.Set("Location", u.String())
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ==================== SELF-REGISTRATION ====================
+// Backends can join a pool themselves with POST /register, giving their
+// URL and a TTL, and stay in it for as long as they post again before the
+// TTL runs out; DELETE /register takes one out at once. Autoscaling
+// groups join the proxy this way without anything else being told.
+type RegistrationConfig struct {
+	// DefaultTTL is used when a registration gives none (default 30s).
+	DefaultTTL Duration `json:"default_ttl,omitempty"`
+
+	// MaxTTL is the longest TTL accepted (default 10m).
+	MaxTTL Duration `json:"max_ttl,omitempty"`
+}
+
+// Registration is a backend that registered itself.
+type Registration struct {
+	URL        string    `json:"url"`
+	Pool       string    `json:"pool"`
+	Weight     int       `json:"weight"`
+	TTL        Duration  `json:"ttl"`
+	Registered time.Time `json:"registered"`
+	Expires    time.Time `json:"expires"`
+}
+
+// Registrations is the provider of the registered backends, each until
+// its TTL lapses.
+type Registrations struct {
+	updates
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+
+	mu      sync.Mutex
+	pools   map[string]*ServerPool
+	entries map[string]*Registration // by URL
+	stop    chan struct{}
+}
+
+func NewRegistrations(cfg RegistrationConfig, pools map[string]*ServerPool) (*Registrations, error) {
+	r := &Registrations{
+		updates:    make(updates),
+		defaultTTL: cfg.DefaultTTL.Std(),
+		maxTTL:     cfg.MaxTTL.Std(),
+		pools:      pools,
+		entries:    make(map[string]*Registration),
+		stop:       make(chan struct{}),
+	}
+	if r.defaultTTL == 0 {
+		r.defaultTTL = 30 * time.Second
+	}
+	if r.maxTTL == 0 {
+		r.maxTTL = 10 * time.Minute
+	}
+	if r.defaultTTL > r.maxTTL {
+		return nil, fmt.Errorf("registration: default_ttl %v is above max_ttl %v", r.defaultTTL, r.maxTTL)
+	}
+	return r, nil
+}
+
+// Start removes lapsed registrations every second until Stop.
+func (r *Registrations) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				r.expire(now)
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (r *Registrations) Name() string { return ProviderRegister }
+
+func (r *Registrations) Stop() {
+	close(r.stop)
+}
+
+func (r *Registrations) expire(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var lapsed []string
+	for u, reg := range r.entries {
+		if now.After(reg.Expires) {
+			delete(r.entries, u)
+			lapsed = append(lapsed, reg.Pool)
+			log.Printf("Registration: pool %s: removed %s (no heartbeat for %v)", reg.Pool, u, reg.TTL.Std())
+		}
+	}
+	r.publish(lapsed...)
+}
+
+// publish sends the registered backends of each pool; r.mu must be held.
+func (r *Registrations) publish(pools ...string) {
+	slices.Sort(pools)
+	for _, pool := range slices.Compact(pools) {
+		u := PoolUpdate{Pool: pool, Backends: []BackendConfig{}}
+		for _, url := range slices.Sorted(maps.Keys(r.entries)) {
+			if reg := r.entries[url]; reg.Pool == pool {
+				weight := reg.Weight
+				u.Backends = append(u.Backends, BackendConfig{URL: url, Weight: &weight})
+			}
+		}
+		r.send(u)
+	}
+}
+
+// Register adds a backend or renews its registration, and reports
+// whether it is new. A backend already in the pool by other means can't
+// register.
+func (r *Registrations) Register(backendURL, pool string, ttl time.Duration, weight *int) (Registration, bool, error) {
+	p, ok := r.pools[pool]
+	if !ok {
+		return Registration{}, false, fmt.Errorf("unknown pool %q", pool)
+	}
+	if ttl == 0 {
+		ttl = r.defaultTTL
+	}
+	if ttl < 0 || ttl > r.maxTTL {
+		return Registration{}, false, fmt.Errorf("ttl must be between 0 and %v", r.maxTTL)
+	}
+	if _, err := newBackend(backendURL); err != nil {
+		return Registration{}, false, err
+	}
+	if weight == nil {
+		one := 1
+		weight = &one
+	}
+	if *weight < 0 {
+		return Registration{}, false, fmt.Errorf("weight must not be negative")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	reg, renewed := r.entries[backendURL]
+	moved := ""
+	if renewed && reg.Pool != pool {
+		moved, renewed = reg.Pool, false
+	}
+	if !renewed {
+		for _, b := range p.GetBackends() {
+			if b.URL.String() == backendURL {
+				return Registration{}, false, fmt.Errorf("%s is already a backend of pool %s", backendURL, pool)
+			}
+		}
+		reg = &Registration{URL: backendURL, Pool: pool, Registered: now}
+		r.entries[backendURL] = reg
+		log.Printf("Registration: pool %s: added %s", pool, backendURL)
+	}
+	changed := !renewed || reg.Weight != *weight
+	reg.Weight = *weight
+	reg.TTL = Duration(ttl)
+	reg.Expires = now.Add(ttl)
+	if changed {
+		r.publish(pool)
+		if moved != "" {
+			r.publish(moved)
+		}
+	}
+	return *reg, !renewed, nil
+}
+
+// Deregister removes a registered backend and reports whether there was
+// one.
+func (r *Registrations) Deregister(backendURL string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.entries[backendURL]
+	if !ok {
+		return false
+	}
+	delete(r.entries, backendURL)
+	r.publish(reg.Pool)
+	log.Printf("Registration: pool %s: removed %s (deregistered)", reg.Pool, backendURL)
+	return true
+}
+
+// List returns the registrations by URL.
+func (r *Registrations) List() []Registration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]Registration, 0, len(r.entries))
+	for _, u := range slices.Sorted(maps.Keys(r.entries)) {
+		list = append(list, *r.entries[u])
+	}
+	return list
+}
+
+// handleRegister lists registrations (GET), registers or renews one
+// (POST {"url", "pool", "ttl", "weight"}) or removes one (DELETE ?url=).
+func (a *AdminAPI) handleRegister(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{"registrations": a.registrations.List()})
+
+	case "POST":
+		var data struct {
+			URL    string   `json:"url"`
+			Pool   string   `json:"pool"`
+			TTL    Duration `json:"ttl"`
+			Weight *int     `json:"weight"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			adminError(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if data.URL == "" {
+			adminError(w, "url is required", http.StatusBadRequest)
+			return
+		}
+		if data.Pool == "" {
+			data.Pool = "default"
+		}
+		reg, created, err := a.registrations.Register(data.URL, data.Pool, data.TTL.Std(), data.Weight)
+		if err != nil {
+			adminError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(reg)
+
+	case "DELETE":
+		backendURL := r.URL.Query().Get("url")
+		if !a.registrations.Deregister(backendURL) {
+			adminError(w, fmt.Sprintf("No registration for %s", backendURL), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Backend deregistered",
+			"url":     backendURL,
+		})
+
+	default:
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"sync"
+)
+
+// ==================== CONFIG RELOAD ====================
+// Reloader re-reads the config file on SIGHUP or POST /config/reload, or
+// takes a config from POST /config/import, and applies what can change
+// without restarting the listeners: pool backends, backend weights, rate
+// limits and logging. Everything is validated before anything is applied;
+// other changed settings are reported as needing a restart and left alone.
+// Every config applied is kept in the history, which POST /config/rollback
+// goes back through.
+type Reloader struct {
+	path      string
+	pools     map[string]*ServerPool
+	handler   *ProxyHandler
+	events    *EventBus
+	history   *ConfigHistory
+	discovery *Discovery
+
+	mu      sync.Mutex // one reload at a time
+	current *Config    // the configuration in effect
+}
+
+// maxConfigSize caps a config sent to POST /config/import.
+const maxConfigSize = 10 << 20
+
+type ReloadResult struct {
+	Changes       []string `json:"changes"`
+	RestartNeeded []string `json:"restart_needed"`
+
+	// Version is the config's number in the history; 0 when nothing
+	// changed.
+	Version int `json:"version,omitempty"`
+}
+
+// NewReloader records cfg, the config the proxy started with, as the
+// first version of history.
+func NewReloader(path string, cfg *Config, pools map[string]*ServerPool, handler *ProxyHandler, events *EventBus, history *ConfigHistory, discovery *Discovery) *Reloader {
+	history.Record(cfg, "startup", 0)
+	return &Reloader{path: path, current: cfg, pools: pools, handler: handler, events: events, history: history, discovery: discovery}
+}
+
+func (rl *Reloader) Reload() (*ReloadResult, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.reload("config file")
+}
+
+// reload re-reads the file; rl.mu must be held.
+func (rl *Reloader) reload(source string) (*ReloadResult, error) {
+	// LoadConfig falls back to defaults without a file; a reload must not
+	if _, err := os.Stat(rl.path); err != nil {
+		return nil, err
+	}
+	next, err := LoadConfig(rl.path)
+	if err != nil {
+		return nil, err
+	}
+	return rl.applyVersion(next, source, 0)
+}
+
+// Import applies a config such as one from Export, as a reload would.
+func (rl *Reloader) Import(data []byte) (*ReloadResult, error) {
+	next := DefaultConfig()
+	if err := decodeStrict(data, next); err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+	if err := next.checkRangesIn(data, nil); err != nil {
+		return nil, err
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if err := next.keepSecrets(rl.current); err != nil {
+		return nil, err
+	}
+	return rl.applyVersion(next, "config import", 0)
+}
+
+// Rollback applies an earlier config from the history: version, or the
+// one before the config in effect for 0.
+func (rl *Reloader) Rollback(version int) (*ReloadResult, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	target, err := rl.history.rollbackTarget(version)
+	if err != nil {
+		return nil, err
+	}
+	return rl.applyVersion(target.Config, fmt.Sprintf("rollback to version %d", target.Version), target.Version)
+}
+
+// applyVersion applies next and, if that changed anything, records the
+// result in the history; rl.mu must be held.
+func (rl *Reloader) applyVersion(next *Config, source string, rolledBackTo int) (*ReloadResult, error) {
+	result, err := rl.apply(next, source)
+	if err == nil && len(result.Changes) > 0 {
+		result.Version = rl.history.Record(rl.current, source, rolledBackTo)
+	}
+	return result, err
+}
+
+// apply validates next and switches to its reloadable parts. source names
+// it in logs and events; rl.mu must be held.
+func (rl *Reloader) apply(next *Config, source string) (*ReloadResult, error) {
+	result := &ReloadResult{Changes: []string{}, RestartNeeded: restartNeeded(rl.current, next)}
+
+	// The running config with next's reloadable parts
+	applied := *rl.current
+	applied.Pools = maps.Clone(rl.current.Pools)
+	for name, pc := range applied.Pools {
+		if npc, ok := next.Pools[name]; ok {
+			pc.Backends = npc.Backends
+			pc.Discovery = npc.Discovery
+			pc.BackendsFile = npc.BackendsFile
+			applied.Pools[name] = pc
+		}
+	}
+	applied.Routes = slices.Clone(rl.current.Routes)
+	for i, rc := range applied.Routes {
+		applied.Routes[i].RateLimit = nil
+		for _, nrc := range next.Routes {
+			if nrc.Prefix == rc.Prefix {
+				applied.Routes[i].RateLimit = nrc.RateLimit
+			}
+		}
+	}
+	applied.RateLimit = next.RateLimit
+	applied.ClientRateLimit = next.ClientRateLimit
+	applied.LogLevel = next.LogLevel
+	applied.DebugSampleRate = next.DebugSampleRate
+	applied.LogRateLimit = next.LogRateLimit
+
+	// Validate
+	for name, pc := range applied.Pools {
+		for _, u := range backendURLs(pc.Backends) {
+			var err error
+			if isDNSBackend(u) {
+				_, err = parseDNSTarget(u)
+			} else {
+				_, err = newBackend(u)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("pool %s backend %q: %w", name, u, err)
+			}
+		}
+		if len(pc.Backends) == 0 && name == "default" && rl.discovery.Listed(name) == 0 {
+			return nil, fmt.Errorf("pool default: no backends")
+		}
+	}
+	if err := checkProviders(&applied); err != nil {
+		return nil, err
+	}
+	if err := checkBackendsFiles(&applied); err != nil {
+		return nil, err
+	}
+	configs, err := applied.BackendConfigs()
+	if err != nil {
+		return nil, err
+	}
+	options := make(map[string]backendOptions, len(configs))
+	for u, bc := range configs {
+		if options[u], err = newBackendOptions(bc); err != nil {
+			return nil, fmt.Errorf("backend %s: %w", u, err)
+		}
+	}
+	limits, err := NewRateLimits(&applied)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := NewLogSettings(&applied); err != nil {
+		return nil, err
+	}
+
+	// Apply
+	for _, name := range slices.Sorted(maps.Keys(applied.Pools)) {
+		if was, now := rl.current.Pools[name].Discovery, applied.Pools[name].Discovery; !slices.Equal(was, now) {
+			result.Changes = append(result.Changes, fmt.Sprintf("pool %s: discovery %v -> %v", name, was, now))
+		}
+	}
+	rl.discovery.SetAllowed(&applied)
+	result.Changes = append(result.Changes, rl.discovery.config.Set(&applied, configs)...)
+	result.Changes = append(result.Changes, rl.discovery.files.Sync(&applied)...)
+	if rl.handler.bulkheads != nil {
+		rl.handler.bulkheads.SetBackendLimits(configs)
+	} else if len(backendConnLimits(configs)) > 0 {
+		result.RestartNeeded = append(result.RestartNeeded, "max_connections")
+	}
+	cur, fresh := rl.handler.limits.Snapshot(), limits.Snapshot()
+	if !sameJSON(cur["routes"], fresh["routes"]) || !sameJSON(cur["backends"], fresh["backends"]) {
+		result.Changes = append(result.Changes, "route and backend rate limits")
+	}
+	rl.handler.limits.replace(limits)
+	if applied.RateLimit != rl.current.RateLimit {
+		result.Changes = append(result.Changes, fmt.Sprintf("rate_limit: %d -> %d", rl.current.RateLimit, applied.RateLimit))
+		rl.handler.limits.SetGlobal(RateLimitConfig{RPS: float64(applied.RateLimit), Burst: applied.RateLimit * 2})
+	}
+	if !sameJSON(applied.ClientRateLimit, rl.current.ClientRateLimit) {
+		result.Changes = append(result.Changes, "client_rate_limit")
+		client := RateLimitConfig{}
+		if c := applied.ClientRateLimit; c != nil {
+			client = RateLimitConfig{RPS: c.RPS, Burst: c.Burst}
+		}
+		rl.handler.limits.SetClient(client)
+	}
+	rl.applyLogging(&applied, result)
+	rl.current = &applied
+	if changes, err := rl.discovery.dns.Sync(&applied); err != nil {
+		log.Printf("Config reload: DNS discovery: %v", err)
+	} else {
+		result.Changes = append(result.Changes, changes...)
+	}
+
+	for _, c := range result.Changes {
+		log.Printf("Config reload: %s", c)
+	}
+	for _, field := range result.RestartNeeded {
+		log.Printf("Config reload: %s changed but needs a restart", field)
+	}
+	rl.events.Publish(Event{Type: EventConfigReload, Detail: source})
+	return result, nil
+}
+
+// applyLogging changes the log settings that differ from the running
+// config's; ones changed only via PUT /logging are left alone. The values
+// were validated by NewLogSettings.
+func (rl *Reloader) applyLogging(next *Config, result *ReloadResult) {
+	logs := rl.handler.logs
+	if next.LogLevel != rl.current.LogLevel {
+		result.Changes = append(result.Changes, fmt.Sprintf("log_level: %s -> %s", rl.current.LogLevel, next.LogLevel))
+		logs.SetLevel(next.LogLevel)
+	}
+	if next.DebugSampleRate != rl.current.DebugSampleRate {
+		result.Changes = append(result.Changes, fmt.Sprintf("debug_sample_rate: %v -> %v", rl.current.DebugSampleRate, next.DebugSampleRate))
+		logs.SetDebugSampleRate(next.DebugSampleRate)
+	}
+	if next.LogRateLimit != rl.current.LogRateLimit {
+		result.Changes = append(result.Changes, fmt.Sprintf("log_rate_limit: %v -> %v", rl.current.LogRateLimit, next.LogRateLimit))
+		logs.SetRateLimit(next.LogRateLimit)
+	}
+}
+
+// Export returns the running config with what was changed at runtime:
+// pool backends, weights, rate limits and logging. Importing it restores
+// that state. Secrets are redacted; an import keeps the running ones.
+func (rl *Reloader) Export() *Config {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	// Backends keep their configured options, with the live weight and
+	// rate limit
+	limits := rl.handler.limits
+	backendLimits := limits.Snapshot()["backends"].(map[string]RateLimitConfig)
+	configs, _ := rl.current.BackendConfigs()
+	cfg := *rl.current
+	cfg.Pools = make(map[string]PoolConfig, len(rl.current.Pools))
+	for name, pc := range rl.current.Pools {
+		configured := pc.Backends
+		pc.Backends = []BackendConfig{}
+		// The config file's backends and those added through the Admin
+		// API; other providers' backends aren't the config's
+		for _, b := range rl.pools[name].GetBackends() {
+			u := b.URL.String()
+			if p := rl.discovery.Provider(name, u); p != "" && p != ProviderConfig {
+				continue
+			}
+			bc := configs[u]
+			bc.URL, bc.Weight, bc.RateLimit = u, nil, nil
+			if w := b.GetWeight(); w != 1 {
+				bc.Weight = &w
+			}
+			if c, ok := backendLimits[u]; ok {
+				bc.RateLimit = &c
+			}
+			pc.Backends = append(pc.Backends, bc)
+		}
+		// Those an overriding provider such as etcd keeps out of the pool
+		for _, bc := range configured {
+			exported := slices.ContainsFunc(pc.Backends, func(e BackendConfig) bool { return e.URL == bc.URL })
+			if !exported && !isDNSBackend(bc.URL) {
+				pc.Backends = append(pc.Backends, configs[bc.URL])
+			}
+		}
+		// Discovered backends are exported as the name they came from
+		for _, bc := range configured {
+			if isDNSBackend(bc.URL) {
+				pc.Backends = append(pc.Backends, bc)
+			}
+		}
+		cfg.Pools[name] = pc
+	}
+
+	cfg.RateLimit = 0
+	if lim := limits.globalLimiter(); lim != nil {
+		cfg.RateLimit = max(int(math.Round(float64(lim.Limit()))), 1)
+	}
+	cfg.ClientRateLimit = nil
+	if client := limits.clientLimiter(); client != nil {
+		c := ClientRateLimitConfig{}
+		if rl.current.ClientRateLimit != nil {
+			c = *rl.current.ClientRateLimit
+		}
+		live := client.config()
+		c.RPS, c.Burst = live.RPS, live.Burst
+		cfg.ClientRateLimit = &c
+	}
+	cfg.Routes = slices.Clone(rl.current.Routes)
+	for i, rc := range cfg.Routes {
+		cfg.Routes[i].RateLimit = nil
+		if lim := limits.route(rc.Prefix); lim != nil {
+			c := limiterConfig(lim)
+			cfg.Routes[i].RateLimit = &c
+		}
+	}
+
+	logs := rl.handler.logs
+	cfg.LogLevel = logs.Level().String()
+	cfg.DebugSampleRate = logs.DebugSampleRate()
+	cfg.LogRateLimit = logs.RateLimit()
+	return cfg.redacted()
+}
+
+// restartNeeded lists the top-level settings that differ between the two
+// configs in ways a reload doesn't apply.
+func restartNeeded(cur, next *Config) []string {
+	a, b := fixedSettings(cur), fixedSettings(next)
+	fields := []string{}
+	for _, key := range slices.Sorted(maps.Keys(b)) {
+		if !bytes.Equal(a[key], b[key]) {
+			fields = append(fields, key)
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(a)) {
+		if _, ok := b[key]; !ok {
+			fields = append(fields, key)
+		}
+	}
+	return fields
+}
+
+// fixedSettings is cfg as JSON by top-level key, minus the reloadable parts.
+func fixedSettings(cfg *Config) map[string]json.RawMessage {
+	c := *cfg
+	c.RateLimit = 0
+	c.ClientRateLimit = nil
+	c.LogLevel, c.DebugSampleRate, c.LogRateLimit = "", 0, 0
+	c.Pools = make(map[string]PoolConfig, len(cfg.Pools))
+	for name, pc := range cfg.Pools {
+		pc.Backends, pc.Discovery, pc.BackendsFile = nil, nil, ""
+		c.Pools[name] = pc
+	}
+	c.Routes = slices.Clone(cfg.Routes)
+	for i := range c.Routes {
+		c.Routes[i].RateLimit = nil
+	}
+
+	var fields map[string]json.RawMessage
+	data, _ := json.Marshal(c)
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+func sameJSON(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
+
+// RestartNeeded lists the settings of next that differ from the running
+// config in ways a reload wouldn't apply.
+func (rl *Reloader) RestartNeeded(next *Config) []string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return restartNeeded(rl.current, next)
+}
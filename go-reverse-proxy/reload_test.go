@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// newTestReloader starts the proxy from cfg, written to a file a reload
+// reads again, as main does.
+func newTestReloader(t *testing.T, cfg *Config) (*Reloader, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, path, cfg)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := NewEventBus()
+	pools, err := cfg.BuildPools(events, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discovery, err := NewDiscovery(cfg, pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := discovery.Start(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(discovery.Stop)
+	history, err := NewConfigHistory(cfg.ConfigHistory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err := NewLogSettings(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewProxyHandler(cfg, pools, logs, events, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewReloader(path, cfg, pools, h, events, history, discovery), path
+}
+
+func writeTestConfig(t *testing.T, path string, cfg *Config) {
+	t.Helper()
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reloadState is what a reload may change, as seen from outside.
+func reloadState(rl *Reloader) string {
+	state := map[string]any{
+		"config":   rl.current,
+		"backends": backendURLsOf(rl.pools["default"]),
+		"limits":   rl.handler.limits.Snapshot(),
+		"log":      rl.handler.logs.Level().String(),
+		"versions": len(rl.history.List()),
+	}
+	rl.discovery.mu.Lock()
+	state["allowed"] = rl.discovery.allowed
+	rl.discovery.mu.Unlock()
+	data, _ := json.Marshal(state)
+	return string(data)
+}
+
+func backendURLsOf(pool *ServerPool) []string {
+	var urls []string
+	for _, b := range pool.GetBackends() {
+		urls = append(urls, b.URL.String())
+	}
+	return urls
+}
+
+func TestFailedReloadChangesNothing(t *testing.T) {
+	cfg := testConfig("http://10.0.0.1:80")
+	rl, path := newTestReloader(t, cfg)
+	before := reloadState(rl)
+
+	// Everything reloadable changes, but the client rate limit is invalid
+	next := testConfig("http://10.0.0.1:80", "http://10.0.0.2:80")
+	pc := next.Pools["default"]
+	pc.Discovery = []string{ProviderConfig, ProviderFile}
+	next.Pools["default"] = pc
+	next.RateLimit = 50
+	next.LogLevel = "debug"
+	next.ClientRateLimit = &ClientRateLimitConfig{RPS: 10, IPv6Prefix: 200}
+	writeTestConfig(t, path, next)
+
+	if _, err := rl.Reload(); err == nil {
+		t.Fatal("reload of an invalid config succeeded")
+	}
+	if after := reloadState(rl); after != before {
+		t.Errorf("failed reload changed the running state\nbefore: %s\nafter:  %s", before, after)
+	}
+
+	// Fixed, the same config applies
+	next.ClientRateLimit.IPv6Prefix = 0
+	writeTestConfig(t, path, next)
+	result, err := rl.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := backendURLsOf(rl.pools["default"]); !slices.Equal(got, []string{"http://10.0.0.1:80", "http://10.0.0.2:80"}) {
+		t.Errorf("backends after reload = %v", got)
+	}
+	if len(result.Changes) == 0 || result.Version == 0 {
+		t.Errorf("reload result %+v, want changes recorded as a version", result)
+	}
+}
+
+func TestRestartNeededRemovedSettingsSorted(t *testing.T) {
+	cur := testConfig("http://10.0.0.1:80")
+	cur.Experiment = &ExperimentConfig{Name: "x"}
+	cur.TLSPassthrough = &PassthroughConfig{}
+	cur.Etcd = &EtcdConfig{}
+	next := testConfig("http://10.0.0.1:80")
+
+	want := []string{"etcd", "experiment", "tls_passthrough"}
+	for range 20 {
+		if got := restartNeeded(cur, next); !slices.Equal(got, want) {
+			t.Fatalf("restartNeeded = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== SLOW ROUTE & ERROR REPORTS ====================
+// PathReports aggregates timing and status per path over the last few
+// minutes for the /reports/slowest and /reports/errors endpoints. Path
+// segments that look like IDs are folded into {id}, and at most
+// maxReportPaths paths are tracked per minute; the rest count as (other).
+type PathReports struct {
+	mu      sync.Mutex
+	buckets [reportWindowMinutes]reportBucket
+}
+
+const (
+	reportWindowMinutes = 5
+	maxReportPaths      = 1000
+)
+
+type reportBucket struct {
+	minute int64
+	paths  map[string]*pathStats
+}
+
+type pathStats struct {
+	requests     uint64
+	clientErrors uint64 // 4xx
+	errors       uint64 // 5xx
+	total        time.Duration
+	max          time.Duration
+	latency      [len(latencyBounds) + 1]uint64
+}
+
+func NewPathReports() *PathReports {
+	return &PathReports{}
+}
+
+// reportPath folds ID-like segments (numbers, UUIDs, long hex strings) so
+// /users/42 and /users/43 are reported together.
+func reportPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if isIDSegment(s) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isIDSegment(s string) bool {
+	if s == "" {
+		return false
+	}
+	if _, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return true
+	}
+	if len(s) < 16 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *PathReports) Observe(path string, status int, d time.Duration) {
+	path = reportPath(path)
+	ms := float64(d) / float64(time.Millisecond)
+	slot := len(latencyBounds)
+	for i, bound := range latencyBounds {
+		if ms <= bound {
+			slot = i
+			break
+		}
+	}
+
+	minute := time.Now().Unix() / 60
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := &p.buckets[minute%reportWindowMinutes]
+	if b.minute != minute || b.paths == nil {
+		*b = reportBucket{minute: minute, paths: make(map[string]*pathStats)}
+	}
+	st := b.paths[path]
+	if st == nil {
+		if len(b.paths) >= maxReportPaths {
+			path = "(other)"
+			st = b.paths[path]
+		}
+		if st == nil {
+			st = &pathStats{}
+			b.paths[path] = st
+		}
+	}
+	st.requests++
+	st.total += d
+	st.max = max(st.max, d)
+	st.latency[slot]++
+	switch {
+	case status >= 500:
+		st.errors++
+	case status >= 400:
+		st.clientErrors++
+	}
+}
+
+type PathReport struct {
+	Path         string  `json:"path"`
+	Requests     uint64  `json:"requests"`
+	Errors       uint64  `json:"errors"`
+	ClientErrors uint64  `json:"client_errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	AvgMs        float64 `json:"avg_ms"`
+	P95Ms        float64 `json:"p95_ms"`
+	MaxMs        float64 `json:"max_ms"`
+}
+
+// collect merges the buckets still inside the window.
+func (p *PathReports) collect() []PathReport {
+	minute := time.Now().Unix() / 60
+	merged := make(map[string]*pathStats)
+
+	p.mu.Lock()
+	for i := range p.buckets {
+		b := &p.buckets[i]
+		if minute-b.minute >= reportWindowMinutes {
+			continue
+		}
+		for path, st := range b.paths {
+			m := merged[path]
+			if m == nil {
+				m = &pathStats{}
+				merged[path] = m
+			}
+			m.requests += st.requests
+			m.errors += st.errors
+			m.clientErrors += st.clientErrors
+			m.total += st.total
+			m.max = max(m.max, st.max)
+			for j, n := range st.latency {
+				m.latency[j] += n
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	reports := make([]PathReport, 0, len(merged))
+	for path, st := range merged {
+		reports = append(reports, PathReport{
+			Path:         path,
+			Requests:     st.requests,
+			Errors:       st.errors,
+			ClientErrors: st.clientErrors,
+			ErrorRate:    roundTo(float64(st.errors)/float64(st.requests), 3),
+			AvgMs:        roundTo(float64(st.total)/float64(st.requests)/float64(time.Millisecond), 2),
+			P95Ms:        percentile(st.latency[:], 0.95),
+			MaxMs:        roundTo(float64(st.max)/float64(time.Millisecond), 2),
+		})
+	}
+	return reports
+}
+
+func roundTo(v float64, digits int) float64 {
+	scale := math.Pow10(digits)
+	return math.Round(v*scale) / scale
+}
+
+var errBadReportQuery = errors.New("limit must be a positive integer and min_requests a non-negative one")
+
+// reportQuery reads ?limit= (default 10) and ?min_requests= (default 1).
+func reportQuery(r *http.Request) (limit int, minRequests uint64, err error) {
+	limit, minRequests = 10, 1
+	q := r.URL.Query()
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return 0, 0, errBadReportQuery
+		}
+	}
+	if v := q.Get("min_requests"); v != "" {
+		if minRequests, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return 0, 0, errBadReportQuery
+		}
+	}
+	return limit, minRequests, nil
+}
+
+// Slowest returns the paths with the highest p95 latency (or average with
+// by "avg", maximum with "max").
+func (p *PathReports) Slowest(by string, limit int, minRequests uint64) []PathReport {
+	key := func(r PathReport) float64 { return r.P95Ms }
+	switch by {
+	case "avg":
+		key = func(r PathReport) float64 { return r.AvgMs }
+	case "max":
+		key = func(r PathReport) float64 { return r.MaxMs }
+	}
+	return topReports(p.collect(), limit, minRequests, key)
+}
+
+// Errors returns the paths with the most 5xx responses (or the highest
+// error rate with by "rate").
+func (p *PathReports) Errors(by string, limit int, minRequests uint64) []PathReport {
+	key := func(r PathReport) float64 { return float64(r.Errors) }
+	if by == "rate" {
+		key = func(r PathReport) float64 { return r.ErrorRate }
+	}
+	failing := []PathReport{}
+	for _, r := range p.collect() {
+		if r.Errors > 0 {
+			failing = append(failing, r)
+		}
+	}
+	return topReports(failing, limit, minRequests, key)
+}
+
+func topReports(reports []PathReport, limit int, minRequests uint64, key func(PathReport) float64) []PathReport {
+	kept := reports[:0]
+	for _, r := range reports {
+		if r.Requests >= minRequests {
+			kept = append(kept, r)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if ki, kj := key(kept[i]), key(kept[j]); ki != kj {
+			return ki > kj
+		}
+		return kept[i].Path < kept[j].Path
+	})
+	if len(kept) > limit {
+		kept = kept[:limit]
+	}
+	return kept
+}
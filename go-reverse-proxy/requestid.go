@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// ==================== REQUEST ID ====================
+// Every request carries an X-Request-ID: the client's own if it sent a
+// sensible one, otherwise a fresh UUID. It is forwarded to the backend,
+// returned to the client and printed in the proxy's request logs, so one
+// request can be followed through both.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen keeps client-supplied IDs from bloating logs.
+const maxRequestIDLen = 128
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// validRequestID accepts IDs that are safe to echo into headers and logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// assignRequestID settles the request's ID and sets it on the response.
+func assignRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	r.Header.Set(requestIDHeader, id)
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+func requestID(r *http.Request) string {
+	return r.Header.Get(requestIDHeader)
+}
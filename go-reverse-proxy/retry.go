@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// ==================== RETRIES ====================
+// RetryConfig lets a failed request be tried again on the pool's next
+// backend. Failures before anything reached a backend (connection refused)
+// are retried for every method; other errors, per-try timeouts and the
+// RetryOn statuses only for idempotent ones, since the backend may already
+// have acted on the request. A request body is replayed from memory, so
+// requests with larger bodies get a single try.
+type RetryConfig struct {
+	Attempts      int      `json:"attempts"`        // tries per request, including the first; 1 disables retries
+	Backoff       Duration `json:"backoff"`         // wait before the first retry, doubled after each
+	MaxBackoff    Duration `json:"max_backoff"`     // cap on the wait
+	PerTryTimeout Duration `json:"per_try_timeout"` // time allowed until response headers per try; 0 = none
+	RetryOn       []int    `json:"retry_on"`        // backend statuses treated as failures
+	MaxBodyBytes  int      `json:"max_body_bytes"`  // largest request body buffered for replay
+}
+
+func defaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		Attempts:     1,
+		Backoff:      Duration(50 * time.Millisecond),
+		MaxBackoff:   Duration(time.Second),
+		RetryOn:      []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		MaxBodyBytes: 64 << 10,
+	}
+}
+
+var (
+	errRetryStatus    = errors.New("retryable status from backend")
+	errPerTryTimeout  = errors.New("per-try timeout waiting for backend response")
+	idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+)
+
+type RetryPolicy struct {
+	attempts      int
+	backoff       time.Duration
+	maxBackoff    time.Duration
+	perTryTimeout time.Duration
+	retryOn       []int
+	maxBody       int
+}
+
+func NewRetryPolicy(cfg RetryConfig) *RetryPolicy {
+	return &RetryPolicy{
+		attempts:      max(cfg.Attempts, 1),
+		backoff:       cfg.Backoff.Std(),
+		maxBackoff:    cfg.MaxBackoff.Std(),
+		perTryTimeout: cfg.PerTryTimeout.Std(),
+		retryOn:       cfg.RetryOn,
+		maxBody:       cfg.MaxBodyBytes,
+	}
+}
+
+// idempotent reports whether repeating r is harmless. Clients can vouch for
+// other methods with an Idempotency-Key.
+func idempotent(r *http.Request) bool {
+	return slices.Contains(idempotentMethods, r.Method) || r.Header.Get("Idempotency-Key") != ""
+}
+
+// retryStatus reports whether a response with status should be retried.
+func (p *RetryPolicy) retryStatus(r *http.Request, status int) bool {
+	return slices.Contains(p.retryOn, status) && idempotent(r)
+}
+
+// retryable reports whether err leaves r safe to try again.
+func (p *RetryPolicy) retryable(r *http.Request, err error) bool {
+	if r.Context().Err() != nil {
+		return false // the client is gone
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return idempotent(r)
+}
+
+// wait sleeps before retry number n (1-based); false if the client left.
+func (p *RetryPolicy) wait(ctx context.Context, n int) bool {
+	d := p.backoff << (n - 1)
+	if p.maxBackoff > 0 && (d > p.maxBackoff || d <= 0) {
+		d = p.maxBackoff
+	}
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// bufferBody reads r's body into memory so every try can send it.
+func (p *RetryPolicy) bufferBody(r *http.Request) ([]byte, bool) {
+	if !hasBody(r) {
+		return nil, true
+	}
+	return bufferRequestBody(r, p.maxBody)
+}
+
+// tryRequest prepares r for one try: a fresh copy of the buffered body and,
+// with a per-try timeout, a context that is cancelled unless response
+// headers arrive in time. stop must be called once headers are in.
+func (p *RetryPolicy) tryRequest(r *http.Request, body []byte) (req *http.Request, stop func(), cancel func()) {
+	ctx, cancelCause := context.WithCancelCause(r.Context())
+	stop = func() {}
+	if p.perTryTimeout > 0 {
+		t := time.AfterFunc(p.perTryTimeout, func() { cancelCause(errPerTryTimeout) })
+		stop = func() { t.Stop() }
+	}
+	req = r.WithContext(ctx)
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return req, stop, func() { cancelCause(nil) }
+}
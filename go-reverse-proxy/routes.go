@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ==================== ROUTING ====================
+type RouteConfig struct {
+	Prefix    string `json:"prefix"`
+	Pool      string `json:"pool"`
+	ReadPool  string `json:"read_pool,omitempty"`
+	WritePool string `json:"write_pool,omitempty"`
+
+	// RewriteRedirects overrides Config.RewriteRedirects for this route.
+	RewriteRedirects *bool `json:"rewrite_redirects,omitempty"`
+
+	// CookieRewrite replaces Config.CookieRewrite for this route.
+	CookieRewrite *CookieRewriteConfig `json:"cookie_rewrite,omitempty"`
+
+	// AccessLog false keeps this route's requests out of the access log,
+	// e.g. for health checks.
+	AccessLog *bool `json:"access_log,omitempty"`
+
+	// RequireClientCert rejects requests without a verified client
+	// certificate (needs tls.client_auth "optional" or "require").
+	RequireClientCert bool `json:"require_client_cert,omitempty"`
+
+	// RateLimit applies to all requests on this route, on top of the
+	// global and per-client limits.
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+
+	// ACL applies after the global ACL for requests on this route.
+	ACL *ACLConfig `json:"acl,omitempty"`
+
+	// JWT replaces the global jwt settings for this route.
+	JWT *JWTConfig `json:"jwt,omitempty"`
+
+	// CacheTTL caches this route's GET responses for the given time,
+	// whatever the backend says (except no-store/private); "0s" disables
+	// caching for the route.
+	CacheTTL *Duration `json:"cache_ttl,omitempty"`
+
+	// Coalesce sends concurrent cache misses for the same GET to the
+	// backend once; the others wait and are answered from the cache if the
+	// response could be stored. It needs the cache enabled.
+	Coalesce bool `json:"coalesce,omitempty"`
+
+	// Headers rules run after the global and pool rules.
+	Headers *HeaderRules `json:"headers,omitempty"`
+
+	// FlushInterval replaces the pool's flush_interval for this route.
+	FlushInterval *FlushInterval `json:"flush_interval,omitempty"`
+
+	// CORS replaces the global cors settings for this route.
+	CORS *CORSConfig `json:"cors,omitempty"`
+
+	// ForwardAuth replaces the global forward_auth settings for this route.
+	ForwardAuth *ForwardAuthConfig `json:"forward_auth,omitempty"`
+
+	BasicAuth *BasicAuthConfig `json:"basic_auth,omitempty"`
+	APIKey    *APIKeyConfig    `json:"api_key,omitempty"`
+}
+
+// Route sends a path prefix to a pool. With a read/write split, GET and HEAD
+// go to readPool and POST, PUT, PATCH and DELETE go to writePool; any other
+// method uses pool.
+type Route struct {
+	prefix    string
+	pool      *ServerPool
+	readPool  *ServerPool
+	writePool *ServerPool
+
+	rewriteRedirects  bool
+	requireClientCert bool
+	noAccessLog       bool
+	cookies           *CookieRewriter
+
+	jwtOverride bool
+	jwt         *JWTVerifier // nil with jwtOverride: authentication disabled
+
+	headers       *HeaderRules
+	cacheTTL      *time.Duration
+	coalesce      bool
+	flushInterval *time.Duration
+
+	corsOverride bool
+	cors         *CORSPolicy // nil with corsOverride: CORS disabled
+
+	forwardAuthOverride bool
+	forwardAuth         *ForwardAuth // nil with forwardAuthOverride: disabled
+
+	basicAuth *BasicAuth
+	apiKey    *APIKeyAuth
+}
+
+func (rt *Route) PoolFor(method string) *ServerPool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return rt.readPool
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return rt.writePool
+	default:
+		return rt.pool
+	}
+}
+
+func (rt *Route) matches(path string) bool {
+	if rt.prefix == "/" || path == rt.prefix {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(rt.prefix, "/")+"/")
+}
+
+// cleanRequestPath resolves dot segments and repeated slashes in r's path
+// before anything looks at it, so //admin or /x/../admin can't slip past
+// the /admin route's auth and still reach the backend as /admin. The
+// cleaned path is the one forwarded; its escaped form is cleaned too and
+// kept while it still decodes to the path, so /a//b%2Fc goes on as
+// /a/b%2Fc rather than /a/b/c.
+func cleanRequestPath(r *http.Request) {
+	p := r.URL.Path
+	if !strings.HasPrefix(p, "/") {
+		return // "*" of OPTIONS *
+	}
+	cleaned := cleanPath(p)
+	if cleaned == p {
+		return
+	}
+	raw := ""
+	if r.URL.RawPath != "" {
+		raw = cleanPath(r.URL.RawPath)
+	}
+	r.URL.Path, r.URL.RawPath = cleaned, raw
+	if r.URL.EscapedPath() != raw {
+		r.URL.RawPath = "" // e.g. %2E%2E, which the escaped form doesn't resolve
+	}
+}
+
+// cleanPath is path.Clean keeping a trailing slash.
+func cleanPath(p string) string {
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+type Router struct {
+	routes []*Route // longest prefix first
+}
+
+func NewRouter(cfg *Config, pools map[string]*ServerPool) (*Router, error) {
+	lookup := func(name, fallback string) (*ServerPool, error) {
+		if name == "" {
+			name = fallback
+		}
+		pool, ok := pools[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown pool %q", name)
+		}
+		return pool, nil
+	}
+
+	router := &Router{}
+	for _, c := range cfg.Routes {
+		if !strings.HasPrefix(c.Prefix, "/") {
+			return nil, fmt.Errorf("route prefix %q must start with /", c.Prefix)
+		}
+
+		poolName := c.Pool
+		if poolName == "" {
+			poolName = "default"
+		}
+
+		if c.RequireClientCert && (!cfg.TLS.Enabled || clientAuthMode(cfg.TLS) == ClientAuthNone) {
+			return nil, fmt.Errorf("route %s requires client certificates but mutual TLS is not enabled", c.Prefix)
+		}
+
+		rt := &Route{
+			prefix:            c.Prefix,
+			rewriteRedirects:  cfg.RewriteRedirects,
+			requireClientCert: c.RequireClientCert,
+			noAccessLog:       c.AccessLog != nil && !*c.AccessLog,
+			cookies:           NewCookieRewriter(cfg.CookieRewrite),
+			headers:           c.Headers,
+		}
+		if c.RewriteRedirects != nil {
+			rt.rewriteRedirects = *c.RewriteRedirects
+		}
+		if c.CookieRewrite != nil {
+			rt.cookies = NewCookieRewriter(c.CookieRewrite)
+		}
+		if c.CacheTTL != nil {
+			ttl := c.CacheTTL.Std()
+			rt.cacheTTL = &ttl
+		}
+		if c.Coalesce && !cfg.Cache.Enabled {
+			return nil, fmt.Errorf("route %s: coalesce needs the cache enabled", c.Prefix)
+		}
+		rt.coalesce = c.Coalesce
+		if c.FlushInterval != nil {
+			flush := c.FlushInterval.Std()
+			rt.flushInterval = &flush
+		}
+		var err error
+		if c.CORS != nil {
+			rt.corsOverride = true
+			if !c.CORS.Disabled {
+				rt.cors = NewCORSPolicy(c.CORS)
+			}
+		}
+		if c.ForwardAuth != nil {
+			rt.forwardAuthOverride = true
+			if !c.ForwardAuth.Disabled {
+				if rt.forwardAuth, err = NewForwardAuth(c.ForwardAuth); err != nil {
+					return nil, fmt.Errorf("route %s: %w", c.Prefix, err)
+				}
+			}
+		}
+		if c.BasicAuth != nil {
+			if rt.basicAuth, err = NewBasicAuth(c.BasicAuth); err != nil {
+				return nil, fmt.Errorf("route %s: %w", c.Prefix, err)
+			}
+		}
+		if c.APIKey != nil {
+			if rt.apiKey, err = NewAPIKeyAuth(c.APIKey); err != nil {
+				return nil, fmt.Errorf("route %s: %w", c.Prefix, err)
+			}
+		}
+		if c.JWT != nil {
+			rt.jwtOverride = true
+			if !c.JWT.Disabled {
+				if rt.jwt, err = NewJWTVerifier(c.JWT); err != nil {
+					return nil, fmt.Errorf("route %s: %w", c.Prefix, err)
+				}
+			}
+		}
+		if rt.pool, err = lookup(poolName, ""); err != nil {
+			return nil, fmt.Errorf("route %s: %w", c.Prefix, err)
+		}
+		if rt.readPool, err = lookup(c.ReadPool, poolName); err != nil {
+			return nil, fmt.Errorf("route %s: %w", c.Prefix, err)
+		}
+		if rt.writePool, err = lookup(c.WritePool, poolName); err != nil {
+			return nil, fmt.Errorf("route %s: %w", c.Prefix, err)
+		}
+		router.routes = append(router.routes, rt)
+	}
+
+	sort.SliceStable(router.routes, func(i, j int) bool {
+		return len(router.routes[i].prefix) > len(router.routes[j].prefix)
+	})
+	return router, nil
+}
+
+func (r *Router) jwtVerifiers() []*JWTVerifier {
+	var verifiers []*JWTVerifier
+	for _, rt := range r.routes {
+		if rt.jwt != nil {
+			verifiers = append(verifiers, rt.jwt)
+		}
+	}
+	return verifiers
+}
+
+func (r *Router) forwardAuths() []*ForwardAuth {
+	var auths []*ForwardAuth
+	for _, rt := range r.routes {
+		if rt.forwardAuth != nil {
+			auths = append(auths, rt.forwardAuth)
+		}
+	}
+	return auths
+}
+
+// Match returns the most specific route for path, or nil.
+func (r *Router) Match(path string) *Route {
+	for _, rt := range r.routes {
+		if rt.matches(path) {
+			return rt
+		}
+	}
+	return nil
+}
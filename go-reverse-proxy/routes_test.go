@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCleanRequestPath(t *testing.T) {
+	tests := []struct {
+		target      string
+		path, upath string // the path routed on and the one forwarded
+	}{
+		{"/a/b", "/a/b", "/a/b"},
+		{"//admin", "/admin", "/admin"},
+		{"/x/../admin/", "/admin/", "/admin/"},
+		{"/a/./b/", "/a/b/", "/a/b/"},
+		{"/a//b%2Fc", "/a/b/c", "/a/b%2Fc"},
+		{"/a/b%2Fc", "/a/b/c", "/a/b%2Fc"},
+		{"/x/%2E%2E/admin", "/admin", "/admin"},
+		{"/a//b%20c", "/a/b c", "/a/b%20c"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		cleanRequestPath(r)
+		if r.URL.Path != tt.path || r.URL.EscapedPath() != tt.upath {
+			t.Errorf("%s: path %q, forwarded as %q; want %q, %q", tt.target, r.URL.Path, r.URL.EscapedPath(), tt.path, tt.upath)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// ==================== CONFIG SCHEMA CHECKS ====================
+// decodeStrict reads a config document into cfg, rejecting what plain
+// json.Unmarshal would let through: unknown fields (a misspelt setting is
+// otherwise silently ignored) and values of the wrong type or format.
+// Every problem found is reported, each naming the field and its line.
+
+// SchemaError locates one problem in a config document. Line is 0 when
+// the problem isn't tied to a place in the file, e.g. a value set by an
+// environment override.
+type SchemaError struct {
+	Line  int
+	Field string // dotted path, e.g. pools.default.backends[1]
+	Msg   string
+}
+
+func (e *SchemaError) Error() string {
+	msg := e.Msg
+	if e.Field != "" {
+		msg = e.Field + ": " + msg
+	}
+	if e.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", e.Line, msg)
+	}
+	return msg
+}
+
+func decodeStrict(data []byte, cfg *Config) error {
+	s := &schemaChecker{data: data}
+	var raw json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&raw); err != nil {
+		return s.syntaxError(err)
+	}
+	s.check(reflect.TypeOf(cfg).Elem(), raw, dec.InputOffset()-int64(len(raw)), "", 0)
+	if len(s.errs) > 0 {
+		return errors.Join(s.errs...)
+	}
+
+	// The document fits; decoding still catches what the walk doesn't,
+	// such as a number too large for its field
+	if err := json.Unmarshal(data, cfg); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return &SchemaError{
+				Line:  s.line(typeErr.Offset),
+				Field: typeErr.Field,
+				Msg:   fmt.Sprintf("expected %s, got %s", describeType(typeErr.Type), typeErr.Value),
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// schemaChecker walks the document alongside the Go type it decodes into,
+// collecting what doesn't fit.
+type schemaChecker struct {
+	data []byte
+	errs []error
+}
+
+func (s *schemaChecker) line(offset int64) int {
+	return bytes.Count(s.data[:min(int(offset), len(s.data))], []byte("\n")) + 1
+}
+
+// checkSyntax reports where data stops being valid JSON, if it does.
+func checkSyntax(data []byte) error {
+	s := &schemaChecker{data: data}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return s.syntaxError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return &SchemaError{Line: s.line(dec.InputOffset()), Msg: "unexpected content after the config object"}
+	}
+	return nil
+}
+
+func (s *schemaChecker) syntaxError(err error) error {
+	var syntax *json.SyntaxError
+	switch {
+	case errors.As(err, &syntax):
+		return &SchemaError{Line: s.line(syntax.Offset), Msg: syntax.Error()}
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return &SchemaError{Line: s.line(int64(len(s.data))), Msg: "unexpected end of file"}
+	}
+	return err
+}
+
+func (s *schemaChecker) fail(line int, field, format string, args ...any) {
+	s.errs = append(s.errs, &SchemaError{Line: line, Field: field, Msg: fmt.Sprintf(format, args...)})
+}
+
+var unmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+
+// check checks raw, found at offset in the document, against t. line is
+// where its key is, for errors about the value as a whole.
+func (s *schemaChecker) check(t reflect.Type, raw json.RawMessage, offset int64, path string, line int) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if line == 0 {
+		line = s.line(offset)
+	}
+	if string(raw) == "null" {
+		return
+	}
+
+	// Types with their own format, such as Duration, are checked by
+	// decoding the value alone
+	if reflect.PointerTo(t).Implements(unmarshalerType) {
+		if err := reflect.New(t).Interface().(json.Unmarshaler).UnmarshalJSON(raw); err != nil {
+			s.fail(line, path, "%v", err)
+		}
+		return
+	}
+	if want, got := describeType(t), describeValue(raw, t); want != got && t.Kind() != reflect.Interface {
+		s.fail(line, path, "expected %s, got %s", want, got)
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		s.members(raw, offset, func(key string, value json.RawMessage, at int64, keyLine int) {
+			f, ok := structField(t, key)
+			if !ok {
+				s.fail(keyLine, joinPath(path, key), "unknown field")
+				return
+			}
+			s.check(f.Type, value, at, joinPath(path, key), keyLine)
+		})
+	case reflect.Map:
+		s.members(raw, offset, func(key string, value json.RawMessage, at int64, keyLine int) {
+			s.check(t.Elem(), value, at, joinPath(path, key), keyLine)
+		})
+	case reflect.Slice, reflect.Array:
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.Token()
+		for i := 0; dec.More(); i++ {
+			var elem json.RawMessage
+			if dec.Decode(&elem) != nil {
+				return
+			}
+			s.check(t.Elem(), elem, offset+dec.InputOffset()-int64(len(elem)), fmt.Sprintf("%s[%d]", path, i), 0)
+		}
+	}
+}
+
+// members calls member for each key of the object raw with
+// the key's value, the value's offset and the key's line.
+func (s *schemaChecker) members(raw json.RawMessage, offset int64, member func(key string, value json.RawMessage, at int64, line int)) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.Token()
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return
+		}
+		line := s.line(offset + dec.InputOffset())
+		var value json.RawMessage
+		if dec.Decode(&value) != nil {
+			return
+		}
+		member(tok.(string), value, offset+dec.InputOffset()-int64(len(value)), line)
+	}
+}
+
+// structField finds the field encoding/json would decode key into,
+// matching names without regard to case as it does.
+func structField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// joinPath appends key to path, quoting keys that aren't plain names, such
+// as backend URLs.
+func joinPath(path, key string) string {
+	plain := key != "" && strings.IndexFunc(key, func(r rune) bool {
+		return !(r == '_' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) < 0
+	switch {
+	case !plain:
+		return fmt.Sprintf("%s[%q]", path, key)
+	case path == "":
+		return key
+	}
+	return path + "." + key
+}
+
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64, reflect.Int32, reflect.Uint, reflect.Uint64, reflect.Uint32:
+		return "an integer"
+	case reflect.Float64, reflect.Float32:
+		return "a number"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return t.String()
+}
+
+// describeValue names the kind of raw in describeType's terms; t tells
+// whether a number counts as an integer.
+func describeValue(raw json.RawMessage, t reflect.Type) string {
+	switch raw[0] {
+	case '{':
+		return "an object"
+	case '[':
+		return "a list"
+	case '"':
+		return "a string"
+	case 't', 'f':
+		return "true or false"
+	}
+	if describeType(t) == "an integer" && !bytes.ContainsAny(raw, ".eE") {
+		return "an integer"
+	}
+	return "a number"
+}
+
+// checkRangesIn is checkRanges with each error given the line of its field
+// in data, the document c was read from. Fields that overrides (names of
+// the envOverrides applied) set keep no line and name the variable.
+func (c *Config) checkRangesIn(data []byte, overrides []string) error {
+	err := c.checkRanges()
+	if err == nil {
+		return nil
+	}
+	setBy := make(map[string]string)
+	for _, o := range envOverrides {
+		if slices.Contains(overrides, o.name) {
+			setBy[o.field] = o.name
+		}
+	}
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, e := range errs {
+		se, ok := e.(*SchemaError)
+		if !ok || se.Line > 0 || se.Field == "" {
+			continue
+		}
+		if name, ok := setBy[se.Field]; ok {
+			se.Msg += " (set by " + name + ")"
+			continue
+		}
+		se.Line = fieldLine(data, se.Field)
+	}
+	return err
+}
+
+// fieldLine returns the line of field's key in the document data, or 0
+// when data doesn't set it.
+func fieldLine(data []byte, field string) int {
+	s := &schemaChecker{data: data}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var raw json.RawMessage
+	if dec.Decode(&raw) != nil {
+		return 0
+	}
+	line := 0
+	var walk func(raw json.RawMessage, offset int64, path string)
+	walk = func(raw json.RawMessage, offset int64, path string) {
+		switch raw[0] {
+		case '{':
+			s.members(raw, offset, func(key string, value json.RawMessage, at int64, keyLine int) {
+				switch p := joinPath(path, key); {
+				case p == field:
+					line = keyLine
+				case line == 0 && strings.HasPrefix(field, p):
+					walk(value, at, p)
+				}
+			})
+		case '[':
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.Token()
+			for i := 0; dec.More() && line == 0; i++ {
+				var elem json.RawMessage
+				if dec.Decode(&elem) != nil {
+					return
+				}
+				at := offset + dec.InputOffset() - int64(len(elem))
+				if p := fmt.Sprintf("%s[%d]", path, i); p == field {
+					line = s.line(at)
+				} else if strings.HasPrefix(field, p) {
+					walk(elem, at, p)
+				}
+			}
+		}
+	}
+	walk(raw, dec.InputOffset()-int64(len(raw)), "")
+	return line
+}
+
+// checkRanges reports settings whose values can't work, after environment
+// overrides. Checks that need more context are left to the constructors.
+func (c *Config) checkRanges() error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, &SchemaError{Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	used := make(map[int]string)
+	port := func(field string, n int) {
+		if n < 1 || n > 65535 {
+			fail(field, "port %d is out of range 1-65535", n)
+		} else if other, taken := used[n]; taken {
+			fail(field, "port %d is also used by %s", n, other)
+		}
+		used[n] = field
+	}
+	if len(c.Listeners) == 0 {
+		port("port", c.Port)
+		port("admin_port", c.AdminPort)
+	}
+	c.checkListeners(fail)
+	if c.TLSPassthrough != nil {
+		port("tls_passthrough.port", c.TLSPassthrough.Port)
+	}
+
+	if c.RateLimit < 0 {
+		fail("rate_limit", "must not be negative")
+	}
+	c.Transport.check("upstream_transport", fail)
+	for _, name := range slices.Sorted(maps.Keys(c.Pools)) {
+		if t := c.Pools[name].Transport; t != nil {
+			t.check("pools."+name+".transport", fail)
+		}
+	}
+	negativeDurations(reflect.ValueOf(c).Elem(), "", fail)
+	return errors.Join(errs...)
+}
+
+var durationType = reflect.TypeFor[Duration]()
+
+// negativeDurations reports every Duration under v that is below zero.
+func negativeDurations(v reflect.Value, path string, fail func(field, format string, args ...any)) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			negativeDurations(v.Elem(), path, fail)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := range t.NumField() {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				name = f.Name
+			}
+			negativeDurations(v.Field(i), joinPath(path, name), fail)
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			negativeDurations(v.Index(i), fmt.Sprintf("%s[%d]", path, i), fail)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if iter.Key().Kind() == reflect.String {
+				negativeDurations(iter.Value(), joinPath(path, iter.Key().String()), fail)
+			}
+		}
+	case reflect.Int64:
+		if v.Type() == durationType && v.Int() < 0 {
+			fail(path, "duration %v must not be negative", v.Interface().(Duration).Std())
+		}
+	}
+}
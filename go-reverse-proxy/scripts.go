@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ==================== SCRIPT HOOKS ====================
+// ScriptConfig loads a Lua file that may define
+//
+//	on_request(req)        -- before forwarding; may return a response table
+//	on_response(resp, req) -- before the response goes back to the client
+//
+// req has method, path, query, host, client_ip, request_id, headers and
+// body; resp has status, headers and body. Changes to path, query, headers,
+// status and body are applied. on_request returning {status=..., body=...,
+// headers={...}} answers the client directly. Headers are keyed by
+// canonical name ("Content-Type") and hold a string, or a list for repeated
+// headers. Bodies are only present up to MaxBodyBytes (Content-Length
+// known for responses); otherwise body is nil and changes to it are ignored.
+// Scripts get the base, table, string and math libraries, nothing that
+// touches files or the OS.
+type ScriptConfig struct {
+	File         string   `json:"file"`
+	Timeout      Duration `json:"timeout,omitempty"`        // per hook call, default 100ms
+	MaxBodyBytes int      `json:"max_body_bytes,omitempty"` // default 64 KiB; -1 never exposes bodies
+}
+
+// Script runs one file's hooks. Lua states are not safe for concurrent
+// use, so each call borrows one from a pool; globals a script sets are
+// per state and must not be relied upon across requests.
+type Script struct {
+	name       string
+	proto      *lua.FunctionProto
+	timeout    time.Duration
+	maxBody    int
+	onRequest  bool
+	onResponse bool
+	states     chan *lua.LState
+}
+
+func NewScript(cfg ScriptConfig) (*Script, error) {
+	proto, err := compileLua(cfg.File)
+	if err != nil {
+		return nil, fmt.Errorf("script %s: %w", cfg.File, err)
+	}
+	s := &Script{
+		name:    cfg.File,
+		proto:   proto,
+		timeout: cfg.Timeout.Std(),
+		maxBody: cfg.MaxBodyBytes,
+		states:  make(chan *lua.LState, runtime.GOMAXPROCS(0)),
+	}
+	if s.timeout <= 0 {
+		s.timeout = 100 * time.Millisecond
+	}
+	if s.maxBody == 0 {
+		s.maxBody = 64 << 10
+	}
+
+	L, err := s.newState()
+	if err != nil {
+		return nil, fmt.Errorf("script %s: %w", cfg.File, err)
+	}
+	s.onRequest = L.GetGlobal("on_request").Type() == lua.LTFunction
+	s.onResponse = L.GetGlobal("on_response").Type() == lua.LTFunction
+	if !s.onRequest && !s.onResponse {
+		L.Close()
+		return nil, fmt.Errorf("script %s defines neither on_request nor on_response", cfg.File)
+	}
+	s.put(L)
+	return s, nil
+}
+
+func compileLua(file string) (*lua.FunctionProto, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	fn, err := L.LoadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return fn.Proto, nil
+}
+
+// newState opens the safe libraries and runs the script's top level.
+func (s *Script) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		if err := L.CallByParam(lua.P{Fn: L.NewFunction(lib.open), Protect: true}, lua.LString(lib.name)); err != nil {
+			L.Close()
+			return nil, err
+		}
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+func (s *Script) get() (*lua.LState, error) {
+	select {
+	case L := <-s.states:
+		return L, nil
+	default:
+		return s.newState()
+	}
+}
+
+func (s *Script) put(L *lua.LState) {
+	select {
+	case s.states <- L:
+	default:
+		L.Close()
+	}
+}
+
+// call runs hook on a pooled state with the arguments args builds there,
+// under a deadline. A state that failed is discarded rather than returned
+// to the pool.
+func (s *Script) call(ctx context.Context, hook string, args func(L *lua.LState) []lua.LValue) (lua.LValue, error) {
+	L, err := s.get()
+	if err != nil {
+		return lua.LNil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	err = L.CallByParam(lua.P{Fn: L.GetGlobal(hook), NRet: 1, Protect: true}, args(L)...)
+	if err != nil {
+		L.Close()
+		return lua.LNil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	L.RemoveContext()
+	s.put(L)
+	return ret, nil
+}
+
+func headerTable(L *lua.LState, h http.Header) *lua.LTable {
+	t := L.NewTable()
+	for name, values := range h {
+		if len(values) == 1 {
+			t.RawSetString(name, lua.LString(values[0]))
+			continue
+		}
+		list := L.NewTable()
+		for _, v := range values {
+			list.Append(lua.LString(v))
+		}
+		t.RawSetString(name, list)
+	}
+	return t
+}
+
+// tableHeader reads a headers table back; anything but strings and lists
+// of strings is ignored.
+func tableHeader(v lua.LValue) http.Header {
+	h := make(http.Header)
+	t, ok := v.(*lua.LTable)
+	if !ok {
+		return h
+	}
+	t.ForEach(func(k, v lua.LValue) {
+		name := http.CanonicalHeaderKey(k.String())
+		switch v := v.(type) {
+		case lua.LString:
+			h.Add(name, string(v))
+		case *lua.LTable:
+			v.ForEach(func(_, item lua.LValue) {
+				if s, ok := item.(lua.LString); ok {
+					h.Add(name, string(s))
+				}
+			})
+		}
+	})
+	return h
+}
+
+func luaString(t *lua.LTable, key string) (string, bool) {
+	s, ok := t.RawGetString(key).(lua.LString)
+	return string(s), ok
+}
+
+func (h *ProxyHandler) requestTable(L *lua.LState, r *http.Request, body []byte, hasBody bool) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("method", lua.LString(r.Method))
+	t.RawSetString("path", lua.LString(r.URL.Path))
+	t.RawSetString("query", lua.LString(r.URL.RawQuery))
+	t.RawSetString("host", lua.LString(r.Host))
+	t.RawSetString("client_ip", lua.LString(h.trusted.RealIP(r).String()))
+	t.RawSetString("request_id", lua.LString(requestID(r)))
+	t.RawSetString("headers", headerTable(L, r.Header))
+	if hasBody {
+		t.RawSetString("body", lua.LString(body))
+	}
+	return t
+}
+
+// runRequest calls on_request. It returns true when the script answered
+// the client itself.
+func (s *Script) runRequest(h *ProxyHandler, w http.ResponseWriter, r *http.Request) (bool, error) {
+	var body []byte
+	buffered := s.maxBody > 0
+	if hasBody(r) && buffered {
+		body, buffered = bufferRequestBody(r, s.maxBody)
+	}
+
+	var req *lua.LTable
+	ret, err := s.call(r.Context(), "on_request", func(L *lua.LState) []lua.LValue {
+		req = h.requestTable(L, r, body, buffered)
+		return []lua.LValue{req}
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// Apply what the script changed
+	if path, ok := luaString(req, "path"); ok && path != r.URL.Path {
+		r.URL.Path, r.URL.RawPath = path, ""
+	}
+	if query, ok := luaString(req, "query"); ok {
+		r.URL.RawQuery = query
+	}
+	r.Header = tableHeader(req.RawGetString("headers"))
+	if buffered {
+		if b, ok := luaString(req, "body"); ok {
+			body = []byte(b)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		if len(body) == 0 {
+			r.Body = http.NoBody
+		}
+	}
+
+	resp, ok := ret.(*lua.LTable)
+	if !ok {
+		return false, nil
+	}
+	status := http.StatusOK
+	if n, ok := resp.RawGetString("status").(lua.LNumber); ok {
+		status = int(n)
+	}
+	for name, values := range tableHeader(resp.RawGetString("headers")) {
+		w.Header()[name] = values
+	}
+	b, _ := luaString(resp, "body")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(status)
+	io.WriteString(w, b)
+	return true, nil
+}
+
+// runResponse calls on_response and applies its changes to resp.
+func (s *Script) runResponse(h *ProxyHandler, resp *http.Response, r *http.Request) error {
+	var body []byte
+	buffered := s.maxBody > 0 && resp.ContentLength >= 0 && resp.ContentLength <= int64(s.maxBody)
+	if buffered {
+		var err error
+		if body, err = io.ReadAll(resp.Body); err != nil {
+			return err
+		}
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	var t *lua.LTable
+	_, err := s.call(r.Context(), "on_response", func(L *lua.LState) []lua.LValue {
+		t = L.NewTable()
+		t.RawSetString("status", lua.LNumber(resp.StatusCode))
+		t.RawSetString("headers", headerTable(L, resp.Header))
+		if buffered {
+			t.RawSetString("body", lua.LString(body))
+		}
+		return []lua.LValue{t, h.requestTable(L, r, nil, false)}
+	})
+	if err != nil {
+		return err
+	}
+
+	if n, ok := t.RawGetString("status").(lua.LNumber); ok && int(n) != resp.StatusCode {
+		resp.StatusCode = int(n)
+		resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	resp.Header = tableHeader(t.RawGetString("headers"))
+	if b, ok := luaString(t, "body"); ok && buffered && b != string(body) {
+		resp.Body = io.NopCloser(bytes.NewReader([]byte(b)))
+		resp.ContentLength = int64(len(b))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	}
+	return nil
+}
+
+// scriptsMiddleware runs every script's on_request, in config order.
+func scriptsMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	var scripts []*Script
+	for _, s := range h.scripts {
+		if s.onRequest {
+			scripts = append(scripts, s)
+		}
+	}
+	if len(scripts) == 0 {
+		return nil, nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, s := range scripts {
+				answered, err := s.runRequest(h, w, r)
+				if err != nil {
+					h.logs.Errorf("[%s] Script %s on_request failed: %v", requestID(r), s.name, err)
+					h.httpError(w, r, "Internal Server Error - request script failed", http.StatusInternalServerError)
+					return
+				}
+				if answered {
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+func scriptsConfigured(cfg *Config) bool {
+	return len(cfg.Scripts) > 0
+}
+
+// applyResponseScripts runs every script's on_response. A failing script
+// is logged and leaves the response as it was.
+func (h *ProxyHandler) applyResponseScripts(resp *http.Response, r *http.Request) {
+	for _, s := range h.scripts {
+		if !s.onResponse {
+			continue
+		}
+		if err := s.runResponse(h, resp, r); err != nil {
+			h.logs.Errorf("[%s] Script %s on_response failed: %v", requestID(r), s.name, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ==================== CONFIG SECRETS ====================
+// Configs leaving through the Admin API (GET /config/export and
+// /config/history?version=) have their secrets replaced by
+// redactedSecret. A config coming back through POST /config/import may
+// keep the placeholder wherever the running config has a secret, which is
+// then kept; only a new value changes it.
+
+const redactedSecret = "[REDACTED]"
+
+// eachSecret calls fn with every secret set in c, by its path in the
+// config. fn may change the value; map entries are only written back when
+// it does, so reading the running config doesn't write to it.
+func (c *Config) eachSecret(fn func(path string, value *string)) {
+	str := func(path string, p *string) {
+		if *p != "" {
+			fn(path, p)
+		}
+	}
+	keys := func(path string, m map[string]string) {
+		for _, name := range slices.Sorted(maps.Keys(m)) {
+			v := m[name]
+			fn(path+"."+name, &v)
+			if v != m[name] {
+				m[name] = v
+			}
+		}
+	}
+
+	str("sticky_session_secret", &c.StickySessionSecret)
+	if a := c.AdminAuth; a != nil && a.APIKey != nil {
+		keys("admin_auth.api_key.keys", a.APIKey.Keys)
+	}
+	if c.JWT != nil {
+		str("jwt.secret", &c.JWT.Secret)
+	}
+	if c.Experiment != nil {
+		str("experiment.secret", &c.Experiment.Secret)
+	}
+	if c.Etcd != nil {
+		str("etcd.password", &c.Etcd.Password)
+	}
+	for i := range c.Routes {
+		rc := &c.Routes[i]
+		path := fmt.Sprintf("routes[%s]", rc.Prefix)
+		if rc.JWT != nil {
+			str(path+".jwt.secret", &rc.JWT.Secret)
+		}
+		if rc.APIKey != nil {
+			keys(path+".api_key.keys", rc.APIKey.Keys)
+		}
+	}
+}
+
+// redacted returns a copy of c with its secrets replaced by
+// redactedSecret; c itself is left alone.
+func (c *Config) redacted() *Config {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil
+	}
+	out := &Config{}
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil
+	}
+	out.eachSecret(func(_ string, value *string) { *value = redactedSecret })
+	return out
+}
+
+// keepSecrets puts the secrets of current back where c has the
+// placeholder. A placeholder where current has no secret is an error.
+func (c *Config) keepSecrets(current *Config) error {
+	running := make(map[string]string)
+	current.eachSecret(func(path string, value *string) { running[path] = *value })
+
+	var missing []string
+	c.eachSecret(func(path string, value *string) {
+		if *value != redactedSecret {
+			return
+		}
+		if v, ok := running[path]; ok {
+			*value = v
+		} else {
+			missing = append(missing, path)
+		}
+	})
+	if len(missing) > 0 {
+		return fmt.Errorf("%s: %s stands for a secret the running config doesn't have", strings.Join(missing, ", "), redactedSecret)
+	}
+	return nil
+}
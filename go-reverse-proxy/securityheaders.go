@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ==================== SECURITY HEADERS ====================
+// SecurityHeadersConfig adds the usual browser security headers to every
+// response, including the proxy's own errors. A header the backend already
+// set is left alone.
+type SecurityHeadersConfig struct {
+	// HSTSMaxAge enables Strict-Transport-Security on HTTPS requests
+	// (directly or via a trusted proxy's X-Forwarded-Proto); 0 sends none.
+	HSTSMaxAge            Duration `json:"hsts_max_age,omitempty"`
+	HSTSIncludeSubdomains bool     `json:"hsts_include_subdomains,omitempty"`
+	HSTSPreload           bool     `json:"hsts_preload,omitempty"`
+
+	FrameOptions          string `json:"frame_options,omitempty"`   // default DENY
+	ReferrerPolicy        string `json:"referrer_policy,omitempty"` // default strict-origin-when-cross-origin
+	ContentSecurityPolicy string `json:"content_security_policy,omitempty"`
+}
+
+// securityHeaders renders the config once; hsts is kept apart because it
+// depends on the request.
+func securityHeaders(cfg *SecurityHeadersConfig) (headers [][2]string, hsts string) {
+	frame := cfg.FrameOptions
+	if frame == "" {
+		frame = "DENY"
+	}
+	referrer := cfg.ReferrerPolicy
+	if referrer == "" {
+		referrer = "strict-origin-when-cross-origin"
+	}
+	headers = [][2]string{
+		{"X-Content-Type-Options", "nosniff"},
+		{"X-Frame-Options", frame},
+		{"Referrer-Policy", referrer},
+	}
+	if cfg.ContentSecurityPolicy != "" {
+		headers = append(headers, [2]string{"Content-Security-Policy", cfg.ContentSecurityPolicy})
+	}
+
+	if secs := int(cfg.HSTSMaxAge.Std().Seconds()); secs > 0 {
+		hsts = "max-age=" + strconv.Itoa(secs)
+		if cfg.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if cfg.HSTSPreload {
+			hsts += "; preload"
+		}
+	}
+	return headers, hsts
+}
+
+// securityWriter fills in missing security headers just before the
+// response header is written.
+type securityWriter struct {
+	http.ResponseWriter
+	headers     [][2]string
+	wroteHeader bool
+}
+
+func (sw *securityWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		h := sw.Header()
+		for _, kv := range sw.headers {
+			if h.Get(kv[0]) == "" {
+				h.Set(kv[0], kv[1])
+			}
+		}
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *securityWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *securityWriter) Flush() {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+func (sw *securityWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// securityHeadersMiddleware is opt-in via the security_headers block.
+func securityHeadersMiddleware(h *ProxyHandler, cfg *Config) (Middleware, error) {
+	if cfg.SecurityHeaders == nil {
+		return nil, nil
+	}
+	headers, hsts := securityHeaders(cfg.SecurityHeaders)
+	withHSTS := append(headers[:len(headers):len(headers)], [2]string{"Strict-Transport-Security", hsts})
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			set := headers
+			if hsts != "" && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https") {
+				set = withHSTS
+			}
+			next.ServeHTTP(&securityWriter{ResponseWriter: w, headers: set}, r)
+		})
+	}, nil
+}
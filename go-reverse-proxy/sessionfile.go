@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ==================== SESSION SNAPSHOT ====================
+// With sticky_session_file set, the session table is written to the file
+// on shutdown and read back at startup, so a restart during a deploy
+// keeps users on their backends. Sessions that went idle for longer than
+// the TTL meanwhile are dropped on load.
+
+// sessionSnapshot is the file's content.
+type sessionSnapshot struct {
+	Saved time.Time `json:"saved"`
+
+	// Key is the generated signing key, saved when no sticky_session_secret
+	// is set so the clients' cookies stay valid; the file is private to
+	// the proxy's user.
+	Key []byte `json:"key,omitempty"`
+
+	Sessions       map[string]sessionRecord `json:"sessions"`
+	Flushed        time.Time                `json:"flushed"`
+	FlushedBackend map[string]time.Time     `json:"flushed_backend,omitempty"`
+	Deleted        map[string]time.Time     `json:"deleted,omitempty"`
+}
+
+type sessionRecord struct {
+	Backends  map[string]string `json:"backends"`
+	Restored  map[string]string `json:"restored,omitempty"`
+	LastUsed  time.Time         `json:"last_used"`
+	CookieSet time.Time         `json:"cookie_set"`
+}
+
+// load reads the snapshot in file, if there is one. generated tells
+// whether m's key was generated, and may be replaced by the saved one.
+func (m *SessionManager) load(file string, generated bool) error {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap sessionSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if generated && len(snap.Key) > 0 {
+		m.secret = snap.Key
+	}
+	for id, rec := range snap.Sessions {
+		if time.Since(rec.LastUsed) > m.ttl {
+			continue
+		}
+		m.sessions[id] = &stickySession{
+			backends:  orEmpty(rec.Backends),
+			restored:  orEmpty(rec.Restored),
+			lastUsed:  rec.LastUsed,
+			cookieSet: rec.CookieSet,
+		}
+	}
+	m.flushed = snap.Flushed
+	maps.Copy(m.flushedBackend, snap.FlushedBackend)
+	maps.Copy(m.deleted, snap.Deleted)
+	log.Printf("Sticky sessions: restored %d of %d from %s (saved %s)",
+		len(m.sessions), len(snap.Sessions), file, snap.Saved.Format(time.RFC3339))
+	return nil
+}
+
+// orEmpty returns m, or an empty map for nil.
+func orEmpty(m map[string]string) map[string]string {
+	if m == nil {
+		return make(map[string]string)
+	}
+	return m
+}
+
+// Save writes the live sessions to the sticky_session_file, replacing it
+// in one step so a crash leaves the old or the new snapshot. It does
+// nothing without one.
+func (m *SessionManager) Save() error {
+	if m.file == "" {
+		return nil
+	}
+	m.mu.Lock()
+	snap := sessionSnapshot{
+		Saved:          time.Now().UTC(),
+		Sessions:       make(map[string]sessionRecord, len(m.sessions)),
+		Flushed:        m.flushed,
+		FlushedBackend: m.flushedBackend,
+		Deleted:        m.deleted,
+	}
+	if m.generatedKey {
+		snap.Key = m.secret
+	}
+	for id, s := range m.sessions {
+		if time.Since(s.lastUsed) > m.ttl {
+			continue
+		}
+		snap.Sessions[id] = sessionRecord{Backends: s.backends, Restored: s.restored, LastUsed: s.lastUsed, CookieSet: s.cookieSet}
+	}
+	data, err := json.Marshal(snap)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// CreateTemp makes the file readable by its owner only
+	tmp, err := os.CreateTemp(filepath.Dir(m.file), ".sticky-sessions-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), m.file); err != nil {
+		return err
+	}
+	log.Printf("Sticky sessions: saved %d to %s", len(snap.Sessions), m.file)
+	return nil
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"cmp"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== STICKY SESSIONS ====================
+// SessionManager pins clients to the backend that served them, per pool.
+// Clients carry an opaque session ID in a cookie (proxy_session unless
+// sticky_session_cookie names another); the server-side table maps it to
+// backends and forgets sessions idle for longer than the TTL. A pinned
+// backend that is down, drained or full is replaced by a fresh pick.
+//
+// The cookie is signed and names the session's backends, so a session
+// the table doesn't have (after a restart, on another proxy sharing
+// sticky_session_secret, or once forgotten) is restored from it. That is
+// also how sessions get into the table: a new session only hands out its
+// cookie, and is stored when the client sends the cookie back, so clients
+// that never do (scanners, curl) cost nothing. The table holds at most
+// sticky_session_max sessions; past that, sessions live in their cookies
+// alone until it has room again.
+//
+// With a hash key instead, the backend is derived from a hash of the
+// client's IP or a request header: no cookie is set and nothing is
+// stored, which suits API clients that drop cookies.
+type SessionManager struct {
+	cookie  http.Cookie // without a value; see sessionCookie
+	secure  *bool       // nil: Secure when the request came over HTTPS
+	secret  []byte      // signs the cookies
+	ttl     time.Duration
+	max     int    // sessions the table holds
+	hashKey string // "client_ip" or "header:<name>"; "" for cookies
+	file    string // sticky_session_file; see Save
+
+	generatedKey bool // secret is random, not sticky_session_secret
+
+	mu       sync.Mutex
+	sessions map[string]*stickySession
+
+	// Cookies issued before these may not restore their sessions
+	flushed        time.Time
+	flushedBackend map[string]time.Time // by backendID
+	deleted        map[string]time.Time // by session ID
+}
+
+type stickySession struct {
+	backends  map[string]string // pool name -> backend URL
+	lastUsed  time.Time
+	cookieSet time.Time         // the cookie's Max-Age runs from here
+	restored  map[string]string // pool name -> backendID, from the cookie until seen in the pool
+}
+
+// SessionCookieConfig sets the attributes of the session cookie.
+type SessionCookieConfig struct {
+	// Name defaults to proxy_session.
+	Name string `json:"name,omitempty"`
+
+	// Secure defaults to whether the request came over HTTPS.
+	Secure *bool `json:"secure,omitempty"`
+
+	// SameSite is "lax" (default), "strict" or "none"; none implies
+	// Secure.
+	SameSite string `json:"same_site,omitempty"`
+
+	Domain string `json:"domain,omitempty"`
+
+	// Path defaults to /.
+	Path string `json:"path,omitempty"`
+}
+
+const (
+	sessionCookieName = "proxy_session"
+	defaultSessionTTL = 30 * time.Minute
+	defaultSessionMax = 100000
+)
+
+func NewSessionManager(cfg *Config, pools map[string]*ServerPool) (*SessionManager, error) {
+	if err := checkSessionHashKey(cfg.StickySessionHash); err != nil {
+		return nil, err
+	}
+	rebalance, err := cfg.StickySessionRebalance.withDefaults(cfg.StickySessionHash != "")
+	if err != nil {
+		return nil, err
+	}
+	cookie, secure, err := sessionCookie(cfg.StickySessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	ttl := cfg.StickySessionTTL.Std()
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	cookie.MaxAge = int(ttl.Seconds())
+	maxSessions := cfg.StickySessionMax
+	if maxSessions == 0 {
+		maxSessions = defaultSessionMax
+	}
+	if maxSessions < 0 {
+		return nil, fmt.Errorf("sticky_session_max must not be negative")
+	}
+	secret, err := sessionSecret(cfg.StickySessionSecret)
+	if err != nil {
+		return nil, err
+	}
+	m := &SessionManager{
+		cookie:         cookie,
+		secure:         secure,
+		secret:         secret,
+		ttl:            ttl,
+		max:            maxSessions,
+		hashKey:        cfg.StickySessionHash,
+		generatedKey:   cfg.StickySessionSecret == "",
+		sessions:       make(map[string]*stickySession),
+		flushedBackend: make(map[string]time.Time),
+		deleted:        make(map[string]time.Time),
+	}
+	if m.hashKey == "" && cfg.StickySessionFile != "" {
+		m.file = cfg.StickySessionFile
+		if err := m.load(m.file, m.generatedKey); err != nil {
+			log.Printf("Sticky sessions: not restored: %v", err)
+		}
+	}
+	if m.hashKey == "" {
+		go m.expireLoop()
+	}
+	if rebalance != nil {
+		go m.rebalanceLoop(*rebalance, pools)
+	}
+	return m, nil
+}
+
+// SessionRebalanceConfig moves sessions off a backend that is over a
+// threshold, a fraction at a time, so stickiness doesn't ride one hot
+// backend into the ground.
+type SessionRebalanceConfig struct {
+	// MaxConnections is the requests in flight above which a backend
+	// sheds sessions; 0 disables the check.
+	MaxConnections int64 `json:"max_connections,omitempty"`
+
+	// MaxLatency is the p95 latency over the last minute above which a
+	// backend sheds sessions; 0 disables the check.
+	MaxLatency Duration `json:"max_latency,omitempty"`
+
+	// Fraction is the share of a hot backend's sessions moved each
+	// interval (default 0.1), at least one.
+	Fraction float64 `json:"fraction,omitempty"`
+
+	// Interval is how often backends are checked (default 10s).
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// withDefaults checks c and fills in what it leaves out; nil stays nil.
+func (c *SessionRebalanceConfig) withDefaults(hashed bool) (*SessionRebalanceConfig, error) {
+	if c == nil {
+		return nil, nil
+	}
+	o := *c
+	switch {
+	case hashed:
+		return nil, fmt.Errorf("sticky_session_rebalance: hashed sessions can't be moved")
+	case o.MaxConnections < 0 || o.MaxLatency < 0 || o.Interval < 0:
+		return nil, fmt.Errorf("sticky_session_rebalance: thresholds and interval must not be negative")
+	case o.MaxConnections == 0 && o.MaxLatency == 0:
+		return nil, fmt.Errorf("sticky_session_rebalance: set max_connections or max_latency")
+	case o.Fraction < 0 || o.Fraction > 1:
+		return nil, fmt.Errorf("sticky_session_rebalance: fraction must be between 0 and 1")
+	}
+	if o.Fraction == 0 {
+		o.Fraction = 0.1
+	}
+	if o.Interval == 0 {
+		o.Interval = Duration(10 * time.Second)
+	}
+	return &o, nil
+}
+
+// rebalanceLoop checks the backends of pools every interval and moves a
+// fraction of the sessions of those over a threshold.
+func (m *SessionManager) rebalanceLoop(cfg SessionRebalanceConfig, pools map[string]*ServerPool) {
+	ticker := time.NewTicker(cfg.Interval.Std())
+	defer ticker.Stop()
+	for range ticker.C {
+		seen := make(map[*Backend]bool)
+		for _, pool := range pools {
+			for _, b := range pool.GetBackends() {
+				if seen[b] {
+					continue
+				}
+				seen[b] = true
+				if why := overloaded(b, cfg); why != "" {
+					if moved, of := m.shed(b.URL.String(), cfg.Fraction); moved > 0 {
+						log.Printf("Sessions: moving %d of %d off %s (%s)", moved, of, b.URL, why)
+					}
+				}
+			}
+		}
+	}
+}
+
+// overloaded says why b is over a threshold of cfg, or "" if it isn't.
+func overloaded(b *Backend, cfg SessionRebalanceConfig) string {
+	if conns := atomic.LoadInt64(&b.CurrentConns); cfg.MaxConnections > 0 && conns > cfg.MaxConnections {
+		return fmt.Sprintf("%d connections > %d", conns, cfg.MaxConnections)
+	}
+	if cfg.MaxLatency > 0 {
+		limit := float64(cfg.MaxLatency.Std()) / float64(time.Millisecond)
+		if p95 := b.Stats.Snapshot().P95Ms; p95 > limit {
+			return fmt.Sprintf("p95 %vms > %v", p95, cfg.MaxLatency.Std())
+		}
+	}
+	return ""
+}
+
+// shed unpins a random fraction, at least one, of the sessions pinned to
+// backendURL, which are then balanced afresh, and returns how many it
+// moved of how many.
+func (m *SessionManager) shed(backendURL string, fraction float64) (int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var pinned []*stickySession
+	for _, s := range m.sessions {
+		if time.Since(s.lastUsed) <= m.ttl && s.pinnedTo(backendURL) {
+			pinned = append(pinned, s)
+		}
+	}
+	n := min(len(pinned), int(math.Ceil(fraction*float64(len(pinned)))))
+	for _, i := range rand.Perm(len(pinned))[:n] {
+		s := pinned[i]
+		maps.DeleteFunc(s.backends, func(_, url string) bool { return url == backendURL })
+		maps.DeleteFunc(s.restored, func(_, id string) bool { return id == backendID(backendURL) })
+	}
+	return n, len(pinned)
+}
+
+// sessionSecret returns the key the cookies are signed with: secret, or
+// a random one when it is empty, which restarts forget.
+func sessionSecret(secret string) ([]byte, error) {
+	if secret != "" {
+		if len(secret) < 16 {
+			return nil, fmt.Errorf("sticky_session_secret must be at least 16 characters")
+		}
+		return []byte(secret), nil
+	}
+	key := make([]byte, 32)
+	if _, err := crand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// sessionCookie returns the cookie cfg describes, without a value, and
+// its Secure setting when cfg gives one.
+func sessionCookie(cfg *SessionCookieConfig) (http.Cookie, *bool, error) {
+	if cfg == nil {
+		cfg = &SessionCookieConfig{}
+	}
+	cookie := http.Cookie{
+		Name:     cmp.Or(cfg.Name, sessionCookieName),
+		Path:     cmp.Or(cfg.Path, "/"),
+		Domain:   cfg.Domain,
+		HttpOnly: true,
+	}
+	if !isCookieName(cookie.Name) {
+		return cookie, nil, fmt.Errorf("sticky_session_cookie: %q is not a valid cookie name", cookie.Name)
+	}
+	secure := cfg.Secure
+	switch strings.ToLower(cfg.SameSite) {
+	case "", "lax":
+		cookie.SameSite = http.SameSiteLaxMode
+	case "strict":
+		cookie.SameSite = http.SameSiteStrictMode
+	case "none":
+		if secure != nil && !*secure {
+			return cookie, nil, fmt.Errorf("sticky_session_cookie: same_site none needs secure")
+		}
+		cookie.SameSite = http.SameSiteNoneMode
+		always := true
+		secure = &always
+	default:
+		return cookie, nil, fmt.Errorf("sticky_session_cookie: same_site %q must be lax, strict or none", cfg.SameSite)
+	}
+	return cookie, secure, nil
+}
+
+// isCookieName reports whether name is an RFC 6265 token.
+func isCookieName(name string) bool {
+	return name != "" && !strings.ContainsFunc(name, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r)
+	})
+}
+
+func checkSessionHashKey(key string) error {
+	if name, ok := strings.CutPrefix(key, "header:"); (ok && name != "") || key == "" || key == "client_ip" {
+		return nil
+	}
+	return fmt.Errorf("sticky_session_hash %q must be client_ip or header:<name>", key)
+}
+
+// Hashed reports whether sessions are hashed rather than stored.
+func (m *SessionManager) Hashed() bool {
+	return m.hashKey != ""
+}
+
+func (m *SessionManager) expireLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		m.mu.Lock()
+		for id, s := range m.sessions {
+			if now.Sub(s.lastUsed) > m.ttl {
+				delete(m.sessions, id)
+			}
+		}
+		// Cookies older than the TTL are refused anyway
+		maps.DeleteFunc(m.flushedBackend, func(_ string, t time.Time) bool { return now.Sub(t) > m.ttl })
+		maps.DeleteFunc(m.deleted, func(_ string, t time.Time) bool { return now.Sub(t) > m.ttl })
+		m.mu.Unlock()
+	}
+}
+
+// session returns the live session named by r's cookie, restoring it
+// from the cookie if need be, or nil. It must be called with m.mu held,
+// which every access to a session's fields is made under.
+func (m *SessionManager) session(r *http.Request) (string, *stickySession) {
+	cookie, err := r.Cookie(m.cookie.Name)
+	if err != nil {
+		return "", nil
+	}
+	id, token, ok := m.parseCookie(cookie.Value)
+	if !ok {
+		return "", nil
+	}
+	if s := m.sessions[id]; s != nil {
+		if time.Since(s.lastUsed) <= m.ttl {
+			return id, s
+		}
+		delete(m.sessions, id) // expired; don't wait for expireLoop
+	}
+	if s := m.restore(id, token); s != nil {
+		return id, s
+	}
+	return "", nil
+}
+
+// sessionToken is what a session cookie carries besides the session ID.
+type sessionToken struct {
+	Issued   int64             `json:"t"` // Unix seconds
+	Backends map[string]string `json:"b"` // pool name -> backendID
+}
+
+// backendID names a backend in cookies without giving its address away.
+func backendID(url string) string {
+	return strconv.FormatUint(hashKey(url), 36)
+}
+
+// cookieValue returns the signed cookie value for session id:
+// <id>.<token>.<signature>, each part URL-safe.
+func (m *SessionManager) cookieValue(id string, s *stickySession, now time.Time) string {
+	token := sessionToken{Issued: now.Unix(), Backends: maps.Clone(s.restored)}
+	if token.Backends == nil {
+		token.Backends = make(map[string]string)
+	}
+	for pool, url := range s.backends {
+		token.Backends[pool] = backendID(url)
+	}
+	data, _ := json.Marshal(token)
+	payload := id + "." + base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + m.sign(payload)
+}
+
+func (m *SessionManager) sign(payload string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseCookie checks a cookie value's signature and returns its session
+// ID and token.
+func (m *SessionManager) parseCookie(value string) (string, sessionToken, bool) {
+	var token sessionToken
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 || !hmac.Equal([]byte(value[i+1:]), []byte(m.sign(value[:i]))) {
+		return "", token, false
+	}
+	id, data, _ := strings.Cut(value[:i], ".")
+	raw, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil || json.Unmarshal(raw, &token) != nil {
+		return "", token, false
+	}
+	return id, token, true
+}
+
+// restore rebuilds a session from its cookie's token, unless the cookie
+// is older than the TTL or the Admin API dropped the session since it
+// was issued; backends flushed since are left out. The session is stored
+// while the table has room. m.mu must be held.
+func (m *SessionManager) restore(id string, token sessionToken) *stickySession {
+	issued := time.Unix(token.Issued, 0)
+	if time.Since(issued) > m.ttl || token.Issued <= m.flushed.Unix() {
+		return nil
+	}
+	if t, ok := m.deleted[id]; ok && token.Issued <= t.Unix() {
+		return nil
+	}
+	s := &stickySession{
+		backends:  make(map[string]string),
+		restored:  make(map[string]string),
+		lastUsed:  time.Now(),
+		cookieSet: issued,
+	}
+	for pool, b := range token.Backends {
+		if t, ok := m.flushedBackend[b]; !ok || token.Issued > t.Unix() {
+			s.restored[pool] = b
+		}
+	}
+	if len(m.sessions) < m.max {
+		m.sessions[id] = s
+	}
+	return s
+}
+
+// Lookup returns the backend r's session is pinned to in pool, if it can
+// still take requests.
+func (m *SessionManager) Lookup(r *http.Request, pool *ServerPool) *Backend {
+	m.mu.Lock()
+	var url, restored string
+	if _, s := m.session(r); s != nil {
+		url, restored = s.backends[pool.name], s.restored[pool.name]
+		s.lastUsed = time.Now()
+	}
+	m.mu.Unlock()
+	if url == "" && restored == "" {
+		return nil
+	}
+
+	for _, b := range pool.GetBackends() {
+		u := b.URL.String()
+		if (u == url || url == "" && backendID(u) == restored) && b.selectable() {
+			return b
+		}
+	}
+	return nil
+}
+
+// LookupHashed returns the backend key maps to in pool, if one can take
+// requests: the highest scoring for key of those that can, scores scaled
+// by weight (rendezvous hashing). A backend joining or leaving only moves
+// the keys it wins or loses.
+func (m *SessionManager) LookupHashed(key string, pool *ServerPool) *Backend {
+	if key == "" {
+		return nil
+	}
+	var best *Backend
+	bestScore := 0.0
+	for _, b := range pool.GetBackends() {
+		weight := b.GetWeight()
+		if weight <= 0 || !b.selectable() {
+			continue
+		}
+		u := (float64(hashKey(key+"|"+b.URL.String())>>11) + 0.5) / (1 << 53)
+		if score := float64(weight) / -math.Log(u); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// Pin records backend for r's session in pool, starting a session and
+// setting its cookie if the client has none; a new session is only stored
+// once its cookie comes back (see restore). The cookie is sent again when
+// the backends change and once half its Max-Age has passed, so it outlives
+// an active session.
+func (m *SessionManager) Pin(w http.ResponseWriter, r *http.Request, pool *ServerPool, backend *Backend) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	id, s := m.session(r)
+	if s == nil {
+		var err error
+		if id, err = newSessionID(); err != nil {
+			return
+		}
+		s = &stickySession{backends: make(map[string]string)}
+	}
+	url := backend.URL.String()
+	changed := s.backends[pool.name] != url && s.restored[pool.name] != backendID(url)
+	s.backends[pool.name] = url
+	delete(s.restored, pool.name)
+	s.lastUsed = now
+	if changed || now.Sub(s.cookieSet) > m.ttl/2 {
+		cookie := m.cookie
+		cookie.Value = m.cookieValue(id, s, now)
+		cookie.Secure = r.TLS != nil
+		if m.secure != nil {
+			cookie.Secure = *m.secure
+		}
+		http.SetCookie(w, &cookie)
+		s.cookieSet = now
+	}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Flush drops all sessions, or with backendURL only those pinned to it,
+// and returns how many were removed. Their clients are balanced afresh,
+// and their cookies no longer restore them.
+func (m *SessionManager) Flush(backendURL string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if backendURL == "" {
+		m.flushed = time.Now()
+	} else {
+		m.flushedBackend[backendID(backendURL)] = time.Now()
+	}
+	n := 0
+	for id, s := range m.sessions {
+		if backendURL == "" || s.pinnedTo(backendURL) {
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *stickySession) pinnedTo(backendURL string) bool {
+	for _, url := range s.backends {
+		if url == backendURL {
+			return true
+		}
+	}
+	for _, id := range s.restored {
+		if id == backendID(backendURL) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete drops one session, by ID or cookie value, and reports whether it
+// existed.
+func (m *SessionManager) Delete(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, _, _ = strings.Cut(id, ".")
+	m.deleted[id] = time.Now()
+	_, ok := m.sessions[id]
+	delete(m.sessions, id)
+	return ok
+}
+
+// ByBackend counts the live sessions pinned to each backend.
+func (m *SessionManager) ByBackend() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]int)
+	for _, s := range m.sessions {
+		if time.Since(s.lastUsed) > m.ttl {
+			continue
+		}
+		for _, url := range s.backends {
+			counts[url]++
+		}
+	}
+	return counts
+}
+
+// PoolSessionStats is how a pool's sessions spread over its backends.
+type PoolSessionStats struct {
+	Sessions  int            `json:"sessions"`
+	ByBackend map[string]int `json:"by_backend"` // every backend, idle ones at 0
+
+	// MaxShare is the busiest backend's share of the sessions, 0 to 1.
+	MaxShare float64 `json:"max_share"`
+
+	// Skew is the largest ratio of a backend's sessions to its fair
+	// share by weight: 1 is an even spread, 2 a backend with twice its
+	// share.
+	Skew float64 `json:"skew"`
+}
+
+// Stats breaks the live sessions of each of pools down by backend.
+func (m *SessionManager) Stats(pools map[string]*ServerPool) map[string]PoolSessionStats {
+	m.mu.Lock()
+	counts := make(map[string]map[string]int) // pool -> URL -> sessions
+	for _, s := range m.sessions {
+		if time.Since(s.lastUsed) > m.ttl {
+			continue
+		}
+		for pool, url := range s.backends {
+			if counts[pool] == nil {
+				counts[pool] = make(map[string]int)
+			}
+			counts[pool][url]++
+		}
+	}
+	m.mu.Unlock()
+
+	stats := make(map[string]PoolSessionStats, len(pools))
+	for name, pool := range pools {
+		ps := PoolSessionStats{ByBackend: make(map[string]int)}
+		weights := 0
+		for _, b := range pool.GetBackends() {
+			n := counts[name][b.URL.String()]
+			ps.ByBackend[b.URL.String()] = n
+			ps.Sessions += n
+			weights += max(b.GetWeight(), 0)
+		}
+		if ps.Sessions > 0 && weights > 0 {
+			for _, b := range pool.GetBackends() {
+				n := ps.ByBackend[b.URL.String()]
+				ps.MaxShare = max(ps.MaxShare, float64(n)/float64(ps.Sessions))
+				if w := b.GetWeight(); w > 0 {
+					fair := float64(ps.Sessions) * float64(w) / float64(weights)
+					ps.Skew = max(ps.Skew, float64(n)/fair)
+				}
+			}
+			ps.MaxShare = math.Round(ps.MaxShare*1000) / 1000
+			ps.Skew = math.Round(ps.Skew*100) / 100
+		}
+		stats[name] = ps
+	}
+	return stats
+}
+
+func (m *SessionManager) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// stickyBackend returns the request's pinned backend in pool, with a
+// bulkhead slot taken as pickBackend would, or nil to pick normally.
+func (h *ProxyHandler) stickyBackend(r *http.Request, pool *ServerPool) *Backend {
+	if h.sessions == nil || h.bypass.Match(r.URL.Path) {
+		return nil
+	}
+	var b *Backend
+	if h.sessions.Hashed() {
+		b = h.sessions.LookupHashed(h.affinityKey(r), pool)
+	} else {
+		b = h.sessions.Lookup(r, pool)
+	}
+	if b == nil {
+		return nil
+	}
+	url := b.URL.String()
+	if !h.bulkheads.tryAcquire(url) {
+		return nil
+	}
+	if ok, _ := h.limits.allowBackend(url); !ok {
+		h.bulkheads.release(url)
+		return nil
+	}
+	return b
+}
+
+// affinityKey returns what hashed sessions hash for r, or "" when the
+// header is missing.
+func (h *ProxyHandler) affinityKey(r *http.Request) string {
+	if name, ok := strings.CutPrefix(h.sessions.hashKey, "header:"); ok {
+		return r.Header.Get(name)
+	}
+	return h.trusted.RealIP(r).String()
+}
+
+func (h *ProxyHandler) pinSession(w http.ResponseWriter, r *http.Request, pool *ServerPool, backend *Backend) {
+	if h.sessions == nil || h.sessions.Hashed() || h.bypass.Match(r.URL.Path) {
+		return
+	}
+	h.sessions.Pin(w, r, pool, backend)
+}
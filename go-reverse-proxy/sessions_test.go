@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var sessionBackends = []string{"http://10.0.0.1:80", "http://10.0.0.2:80", "http://10.0.0.3:80"}
+
+func newTestSessions(t *testing.T, ttl time.Duration) (*SessionManager, *ServerPool) {
+	t.Helper()
+	pool := NewServerPool("default", NewEventBus())
+	for _, u := range sessionBackends {
+		b, err := newBackend(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.AttachBackend(b)
+	}
+	cfg := testConfig(sessionBackends...)
+	cfg.StickySessions = true
+	cfg.StickySessionSecret = "0123456789abcdef0123"
+	cfg.StickySessionTTL = Duration(ttl)
+	m, err := NewSessionManager(cfg, map[string]*ServerPool{"default": pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, pool
+}
+
+// pin pins r to b and returns r carrying the cookie Pin set, if any.
+func pin(m *SessionManager, r *http.Request, pool *ServerPool, b *Backend) *http.Request {
+	w := httptest.NewRecorder()
+	m.Pin(w, r, pool, b)
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		return r
+	}
+	next := httptest.NewRequest("GET", "/", nil)
+	next.AddCookie(cookies[0])
+	return next
+}
+
+func TestSessionStoredOnceCookieReturns(t *testing.T) {
+	m, pool := newTestSessions(t, time.Minute)
+	b := pool.GetBackends()[1]
+
+	r := pin(m, httptest.NewRequest("GET", "/", nil), pool, b)
+	if n := m.Count(); n != 0 {
+		t.Fatalf("%d sessions stored before the cookie came back, want 0", n)
+	}
+	if got := m.Lookup(r, pool); got != b {
+		t.Fatalf("Lookup = %v, want %s", got, b.URL)
+	}
+	if n := m.Count(); n != 1 {
+		t.Fatalf("%d sessions stored after the cookie came back, want 1", n)
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	m, pool := newTestSessions(t, time.Second)
+	b := pool.GetBackends()[0]
+	r := pin(m, httptest.NewRequest("GET", "/", nil), pool, b)
+	if got := m.Lookup(r, pool); got != b {
+		t.Fatalf("Lookup = %v, want %s", got, b.URL)
+	}
+
+	// Cookies carry whole seconds, so wait for them to be past the TTL
+	time.Sleep(2100 * time.Millisecond)
+	if got := m.Lookup(r, pool); got != nil {
+		t.Fatalf("Lookup after the TTL = %s, want none", got.URL)
+	}
+}
+
+func TestSessionFlushedIsNotRestored(t *testing.T) {
+	m, pool := newTestSessions(t, time.Minute)
+	b := pool.GetBackends()[2]
+	r := pin(m, httptest.NewRequest("GET", "/", nil), pool, b)
+	m.Lookup(r, pool)
+
+	if n := m.Flush(b.URL.String()); n != 1 {
+		t.Fatalf("Flush removed %d sessions, want 1", n)
+	}
+	if got := m.Lookup(r, pool); got != nil {
+		t.Fatalf("Lookup after Flush = %s, want none", got.URL)
+	}
+}
+
+func TestSessionTableCapped(t *testing.T) {
+	m, pool := newTestSessions(t, time.Minute)
+	m.max = 2
+	b := pool.GetBackends()[0]
+	var requests []*http.Request
+	for range 4 {
+		r := pin(m, httptest.NewRequest("GET", "/", nil), pool, b)
+		requests = append(requests, r)
+	}
+	for i, r := range requests {
+		// Sessions past the cap still stick, from their cookies
+		if got := m.Lookup(r, pool); got != b {
+			t.Fatalf("client %d: Lookup = %v, want %s", i, got, b.URL)
+		}
+	}
+	if n := m.Count(); n != 2 {
+		t.Fatalf("%d sessions stored, want the cap of 2", n)
+	}
+}
+
+// TestSessionsConcurrent runs every session operation at once; it is
+// meant for go test -race.
+func TestSessionsConcurrent(t *testing.T) {
+	m, pool := newTestSessions(t, time.Minute)
+	backends := pool.GetBackends()
+	const clients, rounds = 16, 200
+
+	var wg sync.WaitGroup
+	for c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			for i := range rounds {
+				b := m.Lookup(r, pool)
+				if b == nil {
+					b = backends[(c+i)%len(backends)]
+				}
+				r = pin(m, r, pool, b)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range rounds {
+			switch i % 5 {
+			case 0:
+				m.Flush(backends[i%len(backends)].URL.String())
+			case 1:
+				m.shed(backends[i%len(backends)].URL.String(), 0.5)
+			case 2:
+				m.Delete(fmt.Sprintf("%032x", i))
+			case 3:
+				m.ByBackend()
+				m.Stats(map[string]*ServerPool{"default": pool})
+			case 4:
+				m.Count()
+			}
+		}
+		m.Flush("")
+	}()
+	wg.Wait()
+}
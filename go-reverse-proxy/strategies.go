@@ -0,0 +1,328 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== BALANCING STRATEGIES ====================
+const (
+	StrategyRoundRobin = "round-robin"
+	// StrategyScored picks backends with a probability proportional to the
+	// score pushed by an external controller (PATCH /backends/score).
+	StrategyScored = "scored"
+	// StrategyWeighted spreads requests in proportion to backend weights
+	// (weight, PATCH /backends/weight) in a smooth round-robin.
+	StrategyWeighted = "weighted"
+	// StrategyConsistentHash sends requests with the same key (see
+	// StrategyOptions.HashKey) to the same backend; a backend joining or
+	// leaving only moves the keys next to it on the ring.
+	StrategyConsistentHash = "consistent-hash"
+	// StrategyEWMA picks the backend with the lowest recent latency times
+	// its requests in flight.
+	StrategyEWMA = "ewma"
+	// StrategyP2C compares a few random backends and picks the one with
+	// the fewest requests in flight.
+	StrategyP2C = "p2c"
+)
+
+func validateStrategy(name string) error {
+	switch name {
+	case "", StrategyRoundRobin, StrategyScored, StrategyWeighted, StrategyConsistentHash, StrategyEWMA, StrategyP2C:
+		return nil
+	}
+	return fmt.Errorf("unknown load balancing strategy %q", name)
+}
+
+// StrategyOptions tunes the strategies; each reads only its own options.
+type StrategyOptions struct {
+	// HashKey is what consistent-hash hashes: "client_ip" (default),
+	// "path", "header:<name>" or "cookie:<name>". Requests without the
+	// header or cookie are balanced round-robin.
+	HashKey string `json:"hash_key,omitempty"`
+
+	// VirtualNodes is the number of ring points per backend (default 100);
+	// more spread keys more evenly.
+	VirtualNodes int `json:"virtual_nodes,omitempty"`
+
+	// EWMADecay is how fast ewma forgets: a latency sample this old
+	// counts for about a third of a fresh one (default 10s).
+	EWMADecay Duration `json:"ewma_decay,omitempty"`
+
+	// P2CSampleSize is how many backends p2c compares (default 2).
+	P2CSampleSize int `json:"p2c_sample_size,omitempty"`
+
+	// SlowStart ramps a backend that comes back up from no traffic to its
+	// full share over this time, so cold caches and connection pools
+	// aren't flooded. It applies to every strategy but consistent-hash.
+	SlowStart Duration `json:"slow_start,omitempty"`
+}
+
+// withDefaults checks o and fills in what it leaves out.
+func (o StrategyOptions) withDefaults() (StrategyOptions, error) {
+	kind, name, _ := strings.Cut(o.HashKey, ":")
+	switch {
+	case o.HashKey == "":
+		o.HashKey = "client_ip"
+	case o.HashKey == "client_ip", o.HashKey == "path":
+	case (kind == "header" || kind == "cookie") && name != "":
+	default:
+		return o, fmt.Errorf("hash_key %q must be client_ip, path, header:<name> or cookie:<name>", o.HashKey)
+	}
+	if o.VirtualNodes < 0 || o.P2CSampleSize < 0 {
+		return o, fmt.Errorf("virtual_nodes and p2c_sample_size must not be negative")
+	}
+	if o.VirtualNodes == 0 {
+		o.VirtualNodes = 100
+	}
+	if o.EWMADecay == 0 {
+		o.EWMADecay = Duration(10 * time.Second)
+	}
+	if o.P2CSampleSize == 0 {
+		o.P2CSampleSize = 2
+	}
+	return o, nil
+}
+
+// nextScored picks with a chance proportional to score. Backends with a
+// score of zero or less receive no traffic, as do drained ones.
+func nextScored(backends []*Backend) *Backend {
+	total := 0.0
+	for _, b := range backends {
+		if b.selectable() {
+			total += max(b.GetScore(), 0)
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.Float64() * total
+	var last *Backend
+	for _, b := range backends {
+		score := b.GetScore()
+		if !b.selectable() || score <= 0 {
+			continue
+		}
+		last = b
+		if n -= score; n < 0 {
+			return b
+		}
+	}
+	return last
+}
+
+// nextWeighted is nginx's
+// smooth weighted round-robin: every pick adds each backend's weight to its
+// running total and takes the highest, which then gives up the sum of all
+// weights. Weight changes take effect on the next pick.
+func (s *ServerPool) nextWeighted(backends []*Backend) *Backend {
+	s.wrrMu.Lock()
+	defer s.wrrMu.Unlock()
+	if s.wrrCurrent == nil {
+		s.wrrCurrent = make(map[*Backend]int)
+	}
+
+	total := 0
+	var best *Backend
+	for _, b := range backends {
+		if !b.selectable() {
+			delete(s.wrrCurrent, b)
+			continue
+		}
+		weight := b.GetWeight()
+		s.wrrCurrent[b] += weight
+		total += weight
+		if best == nil || s.wrrCurrent[b] > s.wrrCurrent[best] {
+			best = b
+		}
+	}
+	if best != nil {
+		s.wrrCurrent[best] -= total
+	}
+	return best
+}
+
+// warm reports whether b, if still in slow start, takes this pick: the
+// chance grows from 0 to 1 over the slow start.
+func (s *ServerPool) warm(b *Backend) bool {
+	slowStart := s.options.SlowStart.Std()
+	if slowStart <= 0 {
+		return true
+	}
+	up := b.upFor()
+	return up >= slowStart || rand.Float64()*float64(slowStart) < float64(up)
+}
+
+// ringNode is one of a backend's points on the consistent-hash ring.
+type ringNode struct {
+	hash    uint64
+	backend *Backend
+}
+
+// buildRing returns the consistent-hash ring of backends, nil for other
+// strategies.
+func (s *ServerPool) buildRing(backends []*Backend) []ringNode {
+	if s.strategy != StrategyConsistentHash {
+		return nil
+	}
+	ring := make([]ringNode, 0, len(backends)*s.options.VirtualNodes)
+	for _, b := range backends {
+		for i := range s.options.VirtualNodes {
+			ring = append(ring, ringNode{hashKey(fmt.Sprintf("%s#%d", b.URL, i)), b})
+		}
+	}
+	slices.SortFunc(ring, func(a, b ringNode) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	return ring
+}
+
+// hashKey is FNV-1a with a final mix, which spreads the similar strings
+// ring points are made of. It must stay stable so proxies agree on
+// where keys go.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// nextHashed walks ring from key's point and returns the skip-th live
+// backend after it, so a retry moves on to the next one.
+func nextHashed(ring []ringNode, key string, skip int) *Backend {
+	if len(ring) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	start, _ := slices.BinarySearchFunc(ring, h, func(n ringNode, h uint64) int {
+		return cmp.Compare(n.hash, h)
+	})
+	var buf [8]*Backend // enough for the first tries without allocating
+	live := buf[:0]
+	for i := range ring {
+		b := ring[(start+i)%len(ring)].backend
+		if slices.Contains(live, b) || !b.selectable() {
+			continue
+		}
+		if live = append(live, b); len(live) > skip {
+			return b
+		}
+	}
+	if len(live) == 0 {
+		return nil
+	}
+	return live[skip%len(live)]
+}
+
+// balanceKey returns what consistent-hash hashes for r, or "" when pool
+// doesn't hash.
+func (h *ProxyHandler) balanceKey(r *http.Request, pool *ServerPool) string {
+	if pool.strategy != StrategyConsistentHash {
+		return ""
+	}
+	kind, name, _ := strings.Cut(pool.options.HashKey, ":")
+	switch kind {
+	case "path":
+		return r.URL.Path
+	case "header":
+		return r.Header.Get(name)
+	case "cookie":
+		if c, err := r.Cookie(name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	return h.trusted.RealIP(r).String()
+}
+
+// latencyEWMA is an exponentially weighted moving average of a backend's
+// time to response headers.
+type latencyEWMA struct {
+	value float64 // nanoseconds
+	at    time.Time
+}
+
+// observeLatency feeds a response time into the ewma strategy.
+func (s *ServerPool) observeLatency(b *Backend, d time.Duration) {
+	if s.strategy != StrategyEWMA {
+		return
+	}
+	now := time.Now()
+	s.ewmaMu.Lock()
+	defer s.ewmaMu.Unlock()
+	if s.ewma == nil {
+		s.ewma = make(map[*Backend]*latencyEWMA)
+	}
+	e, ok := s.ewma[b]
+	if !ok {
+		s.ewma[b] = &latencyEWMA{value: float64(d), at: now}
+		return
+	}
+	w := math.Exp(-float64(now.Sub(e.at)) / float64(s.options.EWMADecay))
+	e.value = e.value*w + float64(d)*(1-w)
+	e.at = now
+}
+
+// nextEWMA picks the cheapest backend. Backends without a sample yet cost
+// nothing, so they are tried first.
+func (s *ServerPool) nextEWMA(backends []*Backend) *Backend {
+	s.ewmaMu.Lock()
+	defer s.ewmaMu.Unlock()
+	var best *Backend
+	bestCost := 0.0
+	for _, b := range backends {
+		if !b.selectable() {
+			continue
+		}
+		cost := 0.0
+		if e, ok := s.ewma[b]; ok {
+			cost = e.value * float64(atomic.LoadInt64(&b.CurrentConns)+1)
+		}
+		if best == nil || cost < bestCost {
+			best, bestCost = b, cost
+		}
+	}
+	return best
+}
+
+// nextP2C compares a random sample of the live backends, drawn in one pass
+// by reservoir sampling so nothing is copied.
+func (s *ServerPool) nextP2C(backends []*Backend) *Backend {
+	var buf [4]*Backend
+	sample := buf[:0]
+	if n := s.options.P2CSampleSize; n > len(buf) {
+		sample = make([]*Backend, 0, n)
+	}
+	seen := 0
+	for _, b := range backends {
+		if !b.selectable() {
+			continue
+		}
+		seen++
+		if len(sample) < s.options.P2CSampleSize {
+			sample = append(sample, b)
+		} else if i := rand.IntN(seen); i < len(sample) {
+			sample[i] = b
+		}
+	}
+	var best *Backend
+	for _, b := range sample {
+		if best == nil || atomic.LoadInt64(&b.CurrentConns) < atomic.LoadInt64(&best.CurrentConns) {
+			best = b
+		}
+	}
+	return best
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// benchConcurrency is how many goroutines pick backends at once.
+const benchConcurrency = 10000
+
+func newBenchPool(b *testing.B, strategy string, backends int) *ServerPool {
+	b.Helper()
+	pool := NewServerPool("bench", NewEventBus())
+	pool.strategy = strategy
+	options, err := StrategyOptions{}.withDefaults()
+	if err != nil {
+		b.Fatal(err)
+	}
+	pool.options = options
+	for i := range backends {
+		backend, err := newBackend(fmt.Sprintf("http://10.0.%d.%d:8080", i/250, i%250+1))
+		if err != nil {
+			b.Fatal(err)
+		}
+		pool.AttachBackend(backend)
+	}
+	return pool
+}
+
+// BenchmarkNextPeer picks backends with every strategy from
+// benchConcurrency goroutines at once, each holding its pick as in flight
+// while it is "served", as the proxy does.
+func BenchmarkNextPeer(b *testing.B) {
+	strategies := []string{StrategyRoundRobin, StrategyWeighted, StrategyScored, StrategyEWMA, StrategyP2C, StrategyConsistentHash}
+	for _, strategy := range strategies {
+		for _, backends := range []int{4, 64} {
+			b.Run(fmt.Sprintf("%s/%d", strategy, backends), func(b *testing.B) {
+				pool := newBenchPool(b, strategy, backends)
+				var keys atomic.Uint64
+				b.SetParallelism(max(benchConcurrency/runtime.GOMAXPROCS(0), 1))
+				b.ReportAllocs()
+				b.RunParallel(func(pb *testing.PB) {
+					key := strconv.FormatUint(keys.Add(1), 10)
+					for pb.Next() {
+						peer := pool.NextPeer(key, 0)
+						if peer == nil {
+							b.Error("no backend picked")
+							return
+						}
+						atomic.AddInt64(&peer.CurrentConns, 1)
+						atomic.AddInt64(&peer.CurrentConns, -1)
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkNextPeerWhileChanging picks backends while the pool's backends
+// keep being replaced, which readers must not wait for.
+func BenchmarkNextPeerWhileChanging(b *testing.B) {
+	pool := newBenchPool(b, StrategyRoundRobin, 16)
+	backends := pool.GetBackends()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			pool.SetBackends(backends[:len(backends)-i%2])
+		}
+	}()
+
+	b.SetParallelism(max(benchConcurrency/runtime.GOMAXPROCS(0), 1))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if pool.NextPeer("", 0) == nil {
+				b.Error("no backend picked")
+				return
+			}
+		}
+	})
+	close(stop)
+	<-done
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ==================== STREAMING UPLOADS ====================
+// Request bodies are streamed to the backend as they arrive; only small
+// ones that retries or scripts need are buffered (bufferRequestBody). The server's fixed ReadTimeout/WriteTimeout would
+// still kill a multi-GB upload, so requests with a body trade them for an
+// idle timeout that is pushed forward on every read, and the write deadline
+// only starts once the body has been consumed.
+//
+// Expect: 100-continue is relayed end to end: the upstream transport waits
+// for the backend's 100 before sending the body, and only then does the
+// proxy read from the client, which is what triggers our own 100 Continue.
+// A backend that rejects the request early never causes the body to be sent.
+
+type progressBody struct {
+	io.ReadCloser
+	rc           *http.ResponseController
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+	done         bool
+}
+
+func (b *progressBody) Read(p []byte) (int, error) {
+	b.rc.SetReadDeadline(time.Now().Add(b.idleTimeout))
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		b.rc.SetWriteDeadline(time.Now().Add(b.writeTimeout))
+	}
+	return n, err
+}
+
+func hasBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0
+}
+
+// bufferRequestBody reads r's body into memory if it is at most limit
+// bytes. A larger body is stitched back together and reported as not
+// buffered.
+func bufferRequestBody(r *http.Request, limit int) ([]byte, bool) {
+	if limit <= 0 || r.ContentLength > int64(limit) {
+		return nil, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	if err != nil || len(buf) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false
+	}
+	return buf, true
+}
+
+// streamRequestBody applies the upload deadlines described above.
+func streamRequestBody(w http.ResponseWriter, r *http.Request, idleTimeout, writeTimeout time.Duration) {
+	if idleTimeout <= 0 || !hasBody(r) {
+		return
+	}
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	r.Body = &progressBody{
+		ReadCloser:   r.Body,
+		rc:           rc,
+		idleTimeout:  idleTimeout,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// ==================== STREAMING RESPONSES ====================
+// Responses are copied to the client through a buffer that is flushed every
+// FlushInterval; 0 (the default) flushes only when the buffer fills or the
+// response ends, except for event streams and bodies of unknown length,
+// which net/http always flushes at once. gRPC always flushes at once.
+
+// FlushInterval is a Duration that may be negative (-1), which flushes
+// after every write; long-poll and streaming routes want that, while bulk
+// downloads are better off buffered.
+type FlushInterval Duration
+
+func (f FlushInterval) Std() time.Duration {
+	return time.Duration(f)
+}
+
+func (f FlushInterval) MarshalJSON() ([]byte, error) {
+	return Duration(f).MarshalJSON()
+}
+
+func (f *FlushInterval) UnmarshalJSON(data []byte) error {
+	return (*Duration)(f).UnmarshalJSON(data)
+}
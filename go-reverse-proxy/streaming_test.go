@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// patternBody produces n bytes without holding them, and counts what was
+// read from it.
+type patternBody struct {
+	n, read int64
+	reads   atomic.Int64 // calls to Read
+}
+
+func (b *patternBody) Read(p []byte) (int, error) {
+	b.reads.Add(1)
+	if b.read >= b.n {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), b.n-b.read)]
+	for i := range p {
+		p[i] = byte(b.read + int64(i))
+	}
+	b.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestLargeUploadStreamsInConstantMemory(t *testing.T) {
+	size := int64(2 << 30)
+	if testing.Short() {
+		size = 256 << 20
+	}
+
+	var received atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		received.Store(n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer backend.Close()
+	_, proxy := newTestProxy(t, testConfig(backend.URL))
+
+	// Sample the heap while the upload runs
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var peak atomic.Uint64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var m runtime.MemStats
+		for {
+			runtime.ReadMemStats(&m)
+			if m.HeapInuse > peak.Load() {
+				peak.Store(m.HeapInuse)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	body := &patternBody{n: size}
+	req, err := http.NewRequest(http.MethodPut, proxy.URL+"/upload", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = size
+	resp, err := http.DefaultClient.Do(req)
+	close(stop)
+	<-sampled
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	if got := received.Load(); got != size {
+		t.Fatalf("backend received %d bytes, want %d", got, size)
+	}
+	// The body is far larger than this; buffering any real share of it
+	// would show
+	const slack = 64 << 20
+	if grown := int64(peak.Load()) - int64(before.HeapInuse); grown > slack {
+		t.Errorf("heap grew by %d MiB during a %d MiB upload", grown>>20, size>>20)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	const size = 1 << 20 // above the retry buffer, so the proxy streams it
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") != "100-continue" {
+			t.Errorf("backend got Expect %q, want 100-continue", r.Header.Get("Expect"))
+		}
+		if strings.HasPrefix(r.URL.Path, "/reject") {
+			http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		n, _ := io.Copy(io.Discard, r.Body)
+		if n != size {
+			t.Errorf("backend received %d bytes, want %d", n, size)
+		}
+	}))
+	defer backend.Close()
+	_, proxy := newTestProxy(t, testConfig(backend.URL))
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	send := func(path string) (*http.Response, *patternBody) {
+		body := &patternBody{n: size}
+		req, err := http.NewRequest(http.MethodPost, proxy.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = size
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp, body
+	}
+
+	t.Run("rejected early", func(t *testing.T) {
+		resp, body := send("/reject")
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("status %d, want 413", resp.StatusCode)
+		}
+		if body.read != 0 {
+			t.Errorf("client sent %d body bytes to a backend that refused them", body.read)
+		}
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		resp, body := send("/upload")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, want 200", resp.StatusCode)
+		}
+		if body.read != size {
+			t.Errorf("client sent %d body bytes, want %d", body.read, size)
+		}
+	})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== TLS ====================
+type TLSConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// A single pair, as in earlier configs...
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// ...and/or one pair per domain, picked per connection by SNI
+	Certificates []CertConfig `json:"certificates,omitempty"`
+
+	// ReloadInterval is how often cert/key files are checked for changes;
+	// changed files are reloaded without dropping connections. 0 disables
+	// the watcher (POST /tls/reload still works).
+	ReloadInterval Duration `json:"reload_interval"`
+
+	// Mutual TLS: client_auth is "none", "optional" or "require" and
+	// defaults to "optional" when client_ca_file is set. Routes can demand
+	// a certificate with require_client_cert.
+	ClientAuth   string `json:"client_auth,omitempty"`
+	ClientCAFile string `json:"client_ca_file,omitempty"`
+
+	// Protocol policy for every TLS listener: versions are "1.0" to "1.3"
+	// (default minimum 1.2), cipher suites use Go/IANA names such as
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 and apply up to TLS 1.2 only.
+	MinVersion   string   `json:"min_version,omitempty"`
+	MaxVersion   string   `json:"max_version,omitempty"`
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+
+	// Admin serves the Admin API over TLS too, with the same certificates.
+	Admin bool `json:"admin,omitempty"`
+}
+
+type CertConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+func (c TLSConfig) pairs() []CertConfig {
+	pairs := c.Certificates
+	if c.CertFile != "" || c.KeyFile != "" {
+		pairs = append([]CertConfig{{CertFile: c.CertFile, KeyFile: c.KeyFile}}, pairs...)
+	}
+	return pairs
+}
+
+// CertStore serves the certificate matching the client's SNI hostname.
+// Exact names win over wildcards; unknown or missing SNI gets the first pair.
+// Because certificates are looked up per handshake, Reload takes effect for
+// new connections immediately while existing ones carry on.
+type CertStore struct {
+	pairs []CertConfig
+
+	mu      sync.RWMutex
+	certs   []*tls.Certificate
+	byName  map[string]*tls.Certificate
+	modTime map[string]time.Time
+}
+
+func NewCertStore(cfg TLSConfig) (*CertStore, error) {
+	pairs := cfg.pairs()
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("tls enabled but no certificates configured")
+	}
+
+	s := &CertStore{pairs: pairs}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads every pair and swaps them in together. On any error the
+// certificates in use are kept.
+func (s *CertStore) Reload() error {
+	if len(s.pairs) == 0 {
+		return fmt.Errorf("certificates were generated in memory (--dev-tls), nothing to reload")
+	}
+	var certs []*tls.Certificate
+	byName := make(map[string]*tls.Certificate)
+	for _, p := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load %s: %w", p.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("parse %s: %w", p.CertFile, err)
+			}
+		}
+
+		certs = append(certs, &cert)
+		for _, name := range certNames(cert.Leaf) {
+			if _, taken := byName[name]; !taken {
+				byName[name] = &cert
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.certs, s.byName, s.modTime = certs, byName, s.fileTimes()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *CertStore) fileTimes() map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, p := range s.pairs {
+		for _, f := range []string{p.CertFile, p.KeyFile} {
+			if info, err := os.Stat(f); err == nil {
+				times[f] = info.ModTime()
+			}
+		}
+	}
+	return times
+}
+
+func (s *CertStore) changed() bool {
+	current := s.fileTimes()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for f, t := range current {
+		if !t.Equal(s.modTime[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch polls the cert/key files and reloads when any of them changes.
+// A half-written pair simply fails to load and is retried next tick.
+func (s *CertStore) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !s.changed() {
+				continue
+			}
+			if err := s.Reload(); err != nil {
+				log.Printf("TLS certificate reload failed, keeping current certificates: %v", err)
+				continue
+			}
+			log.Printf("TLS certificates reloaded")
+		}
+	}()
+}
+
+func certNames(leaf *x509.Certificate) []string {
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	lower := make([]string, len(names))
+	for i, n := range names {
+		lower[i] = strings.ToLower(n)
+	}
+	return lower
+}
+
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.certs[0], nil
+}
+
+// TLSConfig returns a server config using the store's certificates and the
+// configured version and cipher policy. Client auth is left to the caller.
+func (s *CertStore) TLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.GetCertificate,
+	}
+
+	var err error
+	if cfg.MinVersion != "" {
+		if tc.MinVersion, err = parseTLSVersion(cfg.MinVersion); err != nil {
+			return nil, fmt.Errorf("tls.min_version: %w", err)
+		}
+	}
+	if cfg.MaxVersion != "" {
+		if tc.MaxVersion, err = parseTLSVersion(cfg.MaxVersion); err != nil {
+			return nil, fmt.Errorf("tls.max_version: %w", err)
+		}
+		if tc.MaxVersion < tc.MinVersion {
+			return nil, fmt.Errorf("tls.max_version %s is below min_version", cfg.MaxVersion)
+		}
+	}
+	if len(cfg.CipherSuites) > 0 {
+		if tc.CipherSuites, err = parseCipherSuites(cfg.CipherSuites); err != nil {
+			return nil, fmt.Errorf("tls.cipher_suites: %w", err)
+		}
+	}
+	return tc, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	key := strings.TrimPrefix(strings.ToUpper(strings.ReplaceAll(v, " ", "")), "TLS")
+	if version, ok := tlsVersions[strings.TrimPrefix(key, "V")]; ok {
+		return version, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", v)
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]*tls.CipherSuite)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs
+	}
+
+	var ids []uint16
+	for _, name := range names {
+		cs, ok := known[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13 {
+			// Go always enables every TLS 1.3 suite
+			return nil, fmt.Errorf("%s is a TLS 1.3 suite and cannot be configured", cs.Name)
+		}
+		if cs.Insecure {
+			log.Printf("WARNING: insecure cipher suite %s enabled", cs.Name)
+		}
+		ids = append(ids, cs.ID)
+	}
+	return ids, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ==================== UNIX SOCKET BACKENDS ====================
+// Backends may be co-located services reached over a unix domain socket,
+// written as unix:///var/run/app.sock. On the wire such a backend gets a
+// synthetic host ("unix-" + hex socket path) that unixAwareDial maps back to
+// the socket, so the regular transports and connection pools just work.
+const unixHostPrefix = "unix-"
+
+func isUnixURL(u *url.URL) bool {
+	return u.Scheme == "unix"
+}
+
+func validateBackendURL(u *url.URL) error {
+	if isUnixURL(u) {
+		if u.Path == "" {
+			return fmt.Errorf("unix backend %q has no socket path", u)
+		}
+		return nil
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported backend scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("backend %q has no host", u)
+	}
+	return nil
+}
+
+// wireURL is the URL requests to the backend are actually sent to.
+func wireURL(u *url.URL) *url.URL {
+	if !isUnixURL(u) {
+		return u
+	}
+	return &url.URL{Scheme: "http", Host: unixHostPrefix + hex.EncodeToString([]byte(u.Path))}
+}
+
+// wireHost is the Host header sent to the backend.
+func wireHost(u *url.URL) string {
+	if isUnixURL(u) {
+		return "localhost"
+	}
+	return u.Host
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// unixAwareDial wraps a TCP dialer so synthetic unix hosts dial the socket.
+func unixAwareDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil && strings.HasPrefix(host, unixHostPrefix) {
+			path, err := hex.DecodeString(strings.TrimPrefix(host, unixHostPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid unix socket host %q", host)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", string(path))
+		}
+		return dial(ctx, network, addr)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ==================== UPSTREAM CONNECTIONS ====================
+type KeepAliveConfig struct {
+	// TCP keepalive on upstream sockets lets the kernel notice dead peers
+	TCPIdle     Duration `json:"tcp_idle"`
+	TCPInterval Duration `json:"tcp_interval"`
+	TCPCount    int      `json:"tcp_count"`
+
+	// IdleConnTimeout closes pooled connections unused for this long
+	IdleConnTimeout Duration `json:"idle_conn_timeout"`
+
+	// ProbeInterval sends "OPTIONS *" to every backend through the shared
+	// transport, so broken idle connections are found and dropped by the
+	// probe instead of by the first real request after a quiet period.
+	// 0 disables probing.
+	ProbeInterval Duration `json:"probe_interval"`
+}
+
+// TransportConfig sizes the upstream connection pools. Zero fields keep
+// net/http's behaviour (MaxConnsPerHost 0: no limit); idle connections
+// expire after upstream_keepalive's idle_conn_timeout.
+type TransportConfig struct {
+	MaxIdleConns        int      `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int      `json:"max_conns_per_host"`
+	DialTimeout         Duration `json:"dial_timeout"`
+	TLSHandshakeTimeout Duration `json:"tls_handshake_timeout"`
+	DisableCompression  bool     `json:"disable_compression,omitempty"`
+}
+
+func defaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		DialTimeout:         Duration(30 * time.Second),
+		TLSHandshakeTimeout: Duration(10 * time.Second),
+	}
+}
+
+// merge returns c with the fields pool sets taken from pool.
+func (c TransportConfig) merge(pool TransportConfig) TransportConfig {
+	c.MaxIdleConns = cmp.Or(pool.MaxIdleConns, c.MaxIdleConns)
+	c.MaxIdleConnsPerHost = cmp.Or(pool.MaxIdleConnsPerHost, c.MaxIdleConnsPerHost)
+	c.MaxConnsPerHost = cmp.Or(pool.MaxConnsPerHost, c.MaxConnsPerHost)
+	c.DialTimeout = cmp.Or(pool.DialTimeout, c.DialTimeout)
+	c.TLSHandshakeTimeout = cmp.Or(pool.TLSHandshakeTimeout, c.TLSHandshakeTimeout)
+	c.DisableCompression = c.DisableCompression || pool.DisableCompression
+	return c
+}
+
+func (c TransportConfig) check(field string, fail func(field, format string, args ...any)) {
+	counts := []struct {
+		name string
+		n    int
+	}{
+		{"max_idle_conns", c.MaxIdleConns},
+		{"max_idle_conns_per_host", c.MaxIdleConnsPerHost},
+		{"max_conns_per_host", c.MaxConnsPerHost},
+	}
+	for _, count := range counts {
+		if count.n < 0 {
+			fail(field+"."+count.name, "must not be negative")
+		}
+	}
+}
+
+// newUpstreamTransport builds a transport shared by all requests it serves
+// (every pool without a transport of its own, or one pool), so pooled
+// connections are actually reused across requests. Hostnames are resolved
+// through dns when it is set.
+func newUpstreamTransport(keepAlive KeepAliveConfig, cfg TransportConfig, dns *DNSCache) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: cfg.DialTimeout.Std(),
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     keepAlive.TCPIdle.Std(),
+			Interval: keepAlive.TCPInterval.Std(),
+			Count:    keepAlive.TCPCount,
+		},
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = unixAwareDial(dns.dial(dialer.DialContext))
+	if keepAlive.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = keepAlive.IdleConnTimeout.Std()
+	}
+	t.MaxIdleConns = cfg.MaxIdleConns
+	t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = cfg.MaxConnsPerHost
+	t.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout.Std()
+	t.DisableCompression = cfg.DisableCompression
+	return t
+}
+
+// startIdleConnProber keeps pooled upstream connections validated. A probe
+// that fails on a stale connection makes the transport discard it; the
+// result itself is ignored because backend health is the health checker's job.
+// Each backend is probed through the transport of every pool it is in.
+func startIdleConnProber(pools map[string]*ServerPool, shared *http.Transport, interval time.Duration, logs *LogSettings) {
+	if interval <= 0 {
+		return
+	}
+	clients := make(map[*http.Transport]*http.Client)
+	clientFor := func(t *http.Transport) *http.Client {
+		if clients[t] == nil {
+			clients[t] = &http.Client{Transport: t, Timeout: 5 * time.Second}
+		}
+		return clients[t]
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		type probed struct {
+			transport *http.Transport
+			host      string
+		}
+		for range ticker.C {
+			seen := make(map[probed]bool)
+			for _, pool := range pools {
+				transport := pool.upstreamTransport(shared)
+				for _, b := range pool.GetBackends() {
+					target := wireURL(b.URL)
+					key := probed{transport, target.Host}
+					if seen[key] || !b.IsAlive() {
+						continue
+					}
+					seen[key] = true
+					probeIdleConn(clientFor(b.upstreamTransport(transport)), target, logs)
+				}
+			}
+		}
+	}()
+}
+
+// upstreamTransport returns the pool's own transport, or shared if it has
+// none.
+func (s *ServerPool) upstreamTransport(shared *http.Transport) *http.Transport {
+	if s.transport != nil {
+		return s.transport
+	}
+	return shared
+}
+
+func probeIdleConn(client *http.Client, backend *url.URL, logs *LogSettings) {
+	target := &url.URL{Scheme: backend.Scheme, Host: backend.Host, Opaque: "*"}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodOptions, target.String(), nil)
+	if err != nil {
+		return
+	}
+	req.URL = target
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if logs.Level() <= LevelDebug {
+			log.Printf("DEBUG Idle connection probe to %s failed: %v", backend.Host, err)
+		}
+		return
+	}
+	resp.Body.Close()
+}
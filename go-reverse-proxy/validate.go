@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ==================== CONFIG VALIDATION ====================
+// ValidateConfig checks a candidate config the way startup would, without
+// listening, opening log files or changing anything, and collects every
+// problem it finds rather than stopping at the first.
+
+type ConfigProblem struct {
+	Field   string `json:"field"` // top-level setting, e.g. "pools" or "tls"
+	Message string `json:"message"`
+}
+
+type ValidationReport struct {
+	Valid    bool            `json:"valid"`
+	Errors   []ConfigProblem `json:"errors"`
+	Warnings []ConfigProblem `json:"warnings"`
+
+	// RestartNeeded lists settings that differ from the running config in
+	// ways a reload or import wouldn't apply.
+	RestartNeeded []string `json:"restart_needed,omitempty"`
+}
+
+// errorf and warnf drop the "field: " prefix constructor errors carry, as
+// Field already says it.
+func (v *ValidationReport) errorf(field, format string, args ...any) {
+	v.Errors = append(v.Errors, newProblem(field, format, args))
+}
+
+func (v *ValidationReport) warnf(field, format string, args ...any) {
+	v.Warnings = append(v.Warnings, newProblem(field, format, args))
+}
+
+// addErrors adds each of the joined errors in err; schema errors name
+// their own field.
+func (v *ValidationReport) addErrors(field string, err error) {
+	if err == nil {
+		return
+	}
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, e := range errs {
+		if se, ok := e.(*SchemaError); ok {
+			msg := se.Msg
+			if se.Line > 0 {
+				msg = fmt.Sprintf("line %d: %s", se.Line, msg)
+			}
+			v.Errors = append(v.Errors, ConfigProblem{Field: se.Field, Message: msg})
+			continue
+		}
+		v.errorf(field, "%v", e)
+	}
+}
+
+func newProblem(field, format string, args []any) ConfigProblem {
+	msg := fmt.Sprintf(format, args...)
+	if field != "" {
+		msg = strings.TrimPrefix(msg, field+": ")
+	}
+	return ConfigProblem{Field: field, Message: msg}
+}
+
+// ParseCandidateConfig reads data as LoadConfig reads the file, resolving
+// ${VAR} references and applying the environment overrides of this process.
+func ParseCandidateConfig(data []byte, report *ValidationReport) *Config {
+	cfg, notes, err := parseConfig(data)
+	if err != nil {
+		report.addErrors("", err)
+		return nil
+	}
+	if len(notes) > 0 {
+		report.warnf("", "uses the legacy flat schema (rewrite it with --migrate-config): %s", strings.Join(notes, "; "))
+	}
+	overrides, err := applyEnvOverrides(cfg)
+	if err != nil {
+		report.errorf("", "%v", err)
+		return nil
+	}
+	if len(overrides) > 0 {
+		report.warnf("", "overridden from the environment: %s", strings.Join(overrides, ", "))
+	}
+	report.addErrors("", cfg.checkRangesIn(data, overrides))
+	return cfg
+}
+
+func ValidateConfig(cfg *Config, report *ValidationReport) {
+
+	pools, err := cfg.BuildPools(NewEventBus(), nil)
+	if err != nil {
+		report.errorf("pools", "%v", err)
+		return // everything below refers to pools
+	}
+	for name, p := range pools {
+		drained := true
+		for _, b := range p.GetBackends() {
+			drained = drained && b.GetWeight() == 0
+		}
+		if drained {
+			report.warnf("pools", "pool %s has no backend with a weight above 0", name)
+		}
+	}
+
+	logs, err := NewLogSettings(cfg)
+	if err != nil {
+		report.errorf("log_level", "%v", err)
+		logs, _ = NewLogSettings(DefaultConfig())
+	}
+	if logs.Level() == LevelDebug && logs.DebugSampleRate() >= 1 {
+		report.warnf("log_level", "debug level with debug_sample_rate 1 logs every request")
+	}
+
+	// Build the handler with the parts that open files or connections
+	// checked separately
+	handlerCfg := *cfg
+	if cfg.AccessLog != nil {
+		validateAccessLog(cfg.AccessLog, logs, report)
+		handlerCfg.AccessLog = nil
+	}
+	if cfg.StickySessions {
+		if cfg.StickySessionTTL < 0 {
+			report.errorf("sticky_session_ttl", "must not be negative")
+		}
+		if err := checkSessionHashKey(cfg.StickySessionHash); err != nil {
+			report.errorf("sticky_session_hash", "%v", err)
+		}
+		if _, _, err := sessionCookie(cfg.StickySessionCookie); err != nil {
+			report.errorf("sticky_session_cookie", "%v", err)
+		}
+		if _, err := sessionSecret(cfg.StickySessionSecret); err != nil {
+			report.errorf("sticky_session_secret", "%v", err)
+		}
+		if _, err := cfg.StickySessionRebalance.withDefaults(cfg.StickySessionHash != ""); err != nil {
+			report.errorf("sticky_session_rebalance", "%v", err)
+		}
+		if cfg.StickySessionMax < 0 {
+			report.errorf("sticky_session_max", "must not be negative")
+		}
+		checkParentDir("sticky_session_file", cfg.StickySessionFile, report)
+		handlerCfg.StickySessions = false
+	}
+	if h, err := NewProxyHandler(&handlerCfg, pools, logs, NewEventBus(), nil); err != nil {
+		report.errorf("proxy", "%v", err)
+	} else {
+		for _, lc := range cfg.ListenerConfigs() {
+			if lc.Role != ListenerAdmin {
+				if _, err := h.ForListener(lc, pools); err != nil {
+					report.errorf("listeners", "%v", err)
+				}
+			}
+			if lc.TLS && !cfg.TLS.Enabled {
+				report.errorf("listeners", "listener %s: tls needs the tls section enabled", lc.name())
+			}
+		}
+	}
+
+	auth, err := NewAdminAuth(cfg.AdminAuth)
+	if err != nil {
+		report.errorf("admin_auth", "%v", err)
+	} else if auth == nil {
+		report.warnf("admin_auth", "the Admin API accepts requests without credentials")
+	}
+	if cfg.AdminDebug && cfg.AdminAuth == nil {
+		report.errorf("admin_debug", "admin_debug requires admin_auth")
+	}
+
+	if cfg.TLS.Enabled {
+		if certs, err := NewCertStore(cfg.TLS); err != nil {
+			report.errorf("tls", "%v", err)
+		} else if tc, err := certs.TLSConfig(cfg.TLS); err != nil {
+			report.errorf("tls", "%v", err)
+		} else if err := configureClientAuth(tc, cfg.TLS); err != nil {
+			report.errorf("tls", "%v", err)
+		}
+	}
+	if err := checkProviders(cfg); err != nil {
+		report.errorf("pools", "%v", err)
+	}
+	if err := checkBackendsFiles(cfg); err != nil {
+		report.errorf("pools", "%v", err)
+	}
+	if cfg.Etcd != nil {
+		if _, err := NewEtcdRegistry(cfg.Etcd, pools); err != nil {
+			report.errorf("etcd", "%v", err)
+		}
+	}
+	if cfg.Docker != nil {
+		if _, err := NewDockerDiscovery(cfg.Docker, pools); err != nil {
+			report.errorf("docker", "%v", err)
+		}
+	}
+	if _, err := NewRegistrations(cfg.Registration, pools); err != nil {
+		report.errorf("registration", "%v", err)
+	}
+	if cfg.TLSPassthrough != nil {
+		if _, err := NewPassthroughProxy(cfg.TLSPassthrough, pools, logs); err != nil {
+			report.errorf("tls_passthrough", "%v", err)
+		}
+	}
+
+	if cfg.HealthHistory.Size < 0 {
+		report.errorf("health_history", "size must be positive")
+	}
+	checkParentDir("health_history", cfg.HealthHistory.File, report)
+	if cfg.AdminAudit.Size < 0 {
+		report.errorf("admin_audit", "size must be positive")
+	}
+	checkParentDir("admin_audit", cfg.AdminAudit.File, report)
+	if cfg.ConfigHistory.Size < 0 {
+		report.errorf("config_history", "size must be positive")
+	}
+	checkParentDir("config_history", cfg.ConfigHistory.File, report)
+}
+
+// validateAccessLog checks access_log without opening its outputs; file
+// outputs only need an existing directory.
+func validateAccessLog(cfg *AccessLogConfig, logs *LogSettings, report *ValidationReport) {
+	check := *cfg
+	check.Outputs = nil
+	for _, out := range cfg.Outputs {
+		switch out.Type {
+		case "file":
+			if out.Path == "" {
+				report.errorf("access_log", "file output needs a path")
+				continue
+			}
+			checkParentDir("access_log", out.Path, report)
+		case "stdout", "stderr", "syslog":
+		default:
+			report.errorf("access_log", "unknown output type %q", out.Type)
+			continue
+		}
+		check.Outputs = append(check.Outputs, AccessLogOutput{Type: "stdout"})
+	}
+	if len(check.Outputs) > 0 {
+		if _, err := NewAccessLogger(&check, logs); err != nil {
+			report.errorf("access_log", "%v", err)
+		}
+	}
+}
+
+// checkParentDir reports an error unless the directory path would be
+// created in exists. An empty path is not checked.
+func checkParentDir(field, path string, report *ValidationReport) {
+	if path == "" {
+		return
+	}
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		report.errorf(field, "%v", err)
+		return
+	}
+	if !info.IsDir() {
+		report.errorf(field, "%s is not a directory", dir)
+	}
+}
+
+// handleConfigValidate checks the config in the request body and reports
+// every error and warning; nothing is applied.
+func (a *AdminAPI) handleConfigValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigSize))
+	if err != nil {
+		adminError(w, fmt.Sprintf("Reading config: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	report := &ValidationReport{Errors: []ConfigProblem{}, Warnings: []ConfigProblem{}}
+	if cfg := ParseCandidateConfig(data, report); cfg != nil {
+		ValidateConfig(cfg, report)
+		report.RestartNeeded = a.reload.RestartNeeded(cfg)
+	}
+	report.Valid = len(report.Errors) == 0
+	json.NewEncoder(w).Encode(report)
+}
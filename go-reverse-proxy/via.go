@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ==================== VIA HEADER (RFC 9110 §7.6.3) ====================
+
+// viaProtocol formats the received-protocol part of a Via entry. The
+// protocol name is omitted for HTTP, so HTTP/1.1 becomes "1.1" and HTTP/2 "2".
+func viaProtocol(major, minor int) string {
+	if major >= 2 && minor == 0 {
+		return fmt.Sprint(major)
+	}
+	return fmt.Sprintf("%d.%d", major, minor)
+}
+
+// viaEntries splits every Via field line into its comma separated members.
+func viaEntries(h http.Header) []string {
+	var entries []string
+	for _, line := range h.Values("Via") {
+		for _, entry := range strings.Split(line, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+// viaContains reports whether a Via entry was received by pseudonym,
+// which means the request already passed through this proxy.
+func viaContains(h http.Header, pseudonym string) bool {
+	for _, entry := range viaEntries(h) {
+		fields := strings.Fields(entry)
+		if len(fields) >= 2 && strings.EqualFold(fields[1], pseudonym) {
+			return true
+		}
+	}
+	return false
+}
+
+func addVia(h http.Header, major, minor int, pseudonym string) {
+	h.Add("Via", viaProtocol(major, minor)+" "+pseudonym)
+}
+
+// forwardDepth counts the hops a request has already taken, using whichever
+// of Via or X-Forwarded-For records more of them.
+func forwardDepth(h http.Header) int {
+	xff := 0
+	for _, line := range h.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(line, ",") {
+			if strings.TrimSpace(addr) != "" {
+				xff++
+			}
+		}
+	}
+	return max(len(viaEntries(h)), xff)
+}